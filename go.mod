@@ -4,11 +4,17 @@ go 1.13
 
 require (
 	github.com/pion/ice/v2 v2.1.12 // indirect
+	github.com/pion/interceptor v0.0.15
+	github.com/pion/logging v0.2.2
 	github.com/pion/rtcp v1.2.6
 	github.com/pion/rtp v1.7.1
+	github.com/pion/sdp/v3 v3.0.4
+	github.com/pion/transport v0.12.3
+	github.com/pion/turn/v2 v2.0.5
 	github.com/pion/webrtc/v3 v3.1.0-beta.3
 	go.uber.org/zap v1.24.0
 	golang.org/x/crypto v0.0.0-20210812204632-0ba0e8f03122 // indirect
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/net v0.0.0-20210805182204-aaa1db679c0d
 	golang.org/x/sys v0.0.0-20210809222454-d867a43fc93e // indirect
 )
@@ -0,0 +1,174 @@
+// Package bwe estimates the bandwidth available to a sender from the RTCP
+// feedback of the remote peer, so that the encoder bitrate can follow it.
+//
+// The estimate combines the two signals the receiver sends in this version of
+// pion (GCC over transport-wide congestion control is not available yet):
+//   - REMB (receiver estimated maximum bitrate) caps the target bitrate
+//   - the fraction lost of the receiver reports lowers the target bitrate on
+//     heavy loss and raises it while there is almost no loss, like the
+//     loss-based controller of GCC (draft-ietf-rmcat-gcc-02 section 6)
+package bwe
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	// lossHigh is the fraction lost above which the target bitrate is lowered
+	lossHigh = 0.1
+	// lossLow is the fraction lost below which the target bitrate is raised
+	lossLow = 0.02
+	// increaseRate is the ratio the target bitrate is raised by per receiver report
+	increaseRate = 1.05
+	// notifyThreshold is the relative change of the target bitrate which is notified
+	notifyThreshold = 0.05
+)
+
+// Config is the configuration of the Estimator
+type Config struct {
+	// MinBitrate and MaxBitrate bound the target bitrate in bits per second
+	MinBitrate int
+	MaxBitrate int
+	// StartBitrate is the target bitrate before any feedback is received
+	StartBitrate int
+}
+
+// Flags registers the bandwidth estimation flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.IntVar(&c.MinBitrate, "bwe-min-bitrate", 100000, "minimum target bitrate of the encoder in bits per second")
+	flag.IntVar(&c.MaxBitrate, "bwe-max-bitrate", 2500000, "maximum target bitrate of the encoder in bits per second")
+	flag.IntVar(&c.StartBitrate, "bwe-start-bitrate", 1000000, "target bitrate of the encoder before any feedback is received in bits per second")
+	return c
+}
+
+// Estimator estimates the target bitrate of a sent stream
+type Estimator struct {
+	config Config
+	ssrc   uint32
+
+	mu sync.Mutex
+	// lossBitrate is the bitrate estimated from the packet loss
+	lossBitrate float64
+	// remb is the latest REMB, 0 until one is received
+	remb     float64
+	target   int
+	notified int
+	onChange func(bitrate int)
+}
+
+// NewEstimator creates an Estimator of the stream sent with ssrc
+func NewEstimator(config Config, ssrc uint32) *Estimator {
+	e := &Estimator{
+		config:      config,
+		ssrc:        ssrc,
+		lossBitrate: float64(config.StartBitrate),
+	}
+	e.target = e.clamp(e.lossBitrate)
+	e.notified = e.target
+	return e
+}
+
+// OnTargetBitrate sets a handler which is called when the target bitrate
+// has changed by more than 5% since it was last called
+func (e *Estimator) OnTargetBitrate(f func(bitrate int)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onChange = f
+}
+
+// TargetBitrate returns the current target bitrate in bits per second
+func (e *Estimator) TargetBitrate() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.target
+}
+
+// HandleRTCP updates the estimate from the RTCP packets received for the stream,
+// e.g. the packets returned by RTPSender.ReadRTCP
+func (e *Estimator) HandleRTCP(packets []rtcp.Packet) {
+	e.mu.Lock()
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			if e.hasSSRC(p.SSRCs) {
+				e.remb = float64(p.Bitrate)
+			}
+		case *rtcp.ReceiverReport:
+			e.receptionReports(p.Reports)
+		case *rtcp.SenderReport:
+			e.receptionReports(p.Reports)
+		}
+	}
+
+	// REMBを上限とし、REMBが増えた時はパケットロスに応じて徐々に増やす
+	if e.remb > 0 && e.remb < e.lossBitrate {
+		e.lossBitrate = e.remb
+	}
+	e.target = e.clamp(e.lossBitrate)
+
+	// 小さな変化ではエンコーダーを設定し直さない
+	var onChange func(int)
+	if e.onChange != nil && abs(e.target-e.notified) > int(float64(e.notified)*notifyThreshold) {
+		e.notified = e.target
+		onChange = e.onChange
+	}
+	bitrate := e.target
+	e.mu.Unlock()
+
+	if onChange != nil {
+		onChange(bitrate)
+	}
+}
+
+func (e *Estimator) receptionReports(reports []rtcp.ReceptionReport) {
+	for _, report := range reports {
+		if report.SSRC != e.ssrc {
+			continue
+		}
+		loss := float64(report.FractionLost) / 256
+		switch {
+		case loss > lossHigh:
+			e.lossBitrate *= 1 - 0.5*loss
+		case loss < lossLow:
+			e.lossBitrate *= increaseRate
+		}
+		// 上限・下限を超えて増減し続けないようにする
+		e.lossBitrate = float64(e.clamp(e.lossBitrate))
+	}
+}
+
+// hasSSRC reports whether a REMB applies to the stream.
+// A REMB without SSRCs applies to every stream.
+func (e *Estimator) hasSSRC(ssrcs []uint32) bool {
+	if len(ssrcs) == 0 {
+		return true
+	}
+	for _, ssrc := range ssrcs {
+		if ssrc == e.ssrc {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Estimator) clamp(bitrate float64) int {
+	if bitrate < float64(e.config.MinBitrate) {
+		return e.config.MinBitrate
+	}
+	if e.config.MaxBitrate > 0 && bitrate > float64(e.config.MaxBitrate) {
+		return e.config.MaxBitrate
+	}
+	return int(bitrate)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
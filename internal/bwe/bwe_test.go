@@ -0,0 +1,105 @@
+package bwe
+
+import (
+	"testing"
+
+	"github.com/pion/rtcp"
+)
+
+const ssrc = 1234
+
+func remb(bitrate uint64, ssrcs ...uint32) rtcp.Packet {
+	return &rtcp.ReceiverEstimatedMaximumBitrate{Bitrate: bitrate, SSRCs: ssrcs}
+}
+
+// receiverReportは、fractionLost/256のパケットロスを伝えるレシーバーレポートです
+func receiverReport(ssrc uint32, fractionLost uint8) rtcp.Packet {
+	return &rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{SSRC: ssrc, FractionLost: fractionLost}}}
+}
+
+func TestEstimator(t *testing.T) {
+	config := Config{MinBitrate: 100000, MaxBitrate: 2500000, StartBitrate: 1000000}
+	for _, c := range []struct {
+		name   string
+		config Config
+		// feedbacksは、HandleRTCPに順に渡すRTCPパケットです
+		feedbacks [][]rtcp.Packet
+		want      int
+		// wantNotifiedは、OnTargetBitrateに通知されるビットレートです
+		wantNotified []int
+	}{
+		{name: "start", config: config, want: 1000000},
+		{name: "start below the minimum", config: Config{MinBitrate: 100000, MaxBitrate: 2500000, StartBitrate: 50000}, want: 100000},
+		{name: "start above the maximum", config: Config{MinBitrate: 100000, MaxBitrate: 2500000, StartBitrate: 5000000}, want: 2500000},
+		{name: "no maximum", config: Config{MinBitrate: 100000, StartBitrate: 5000000}, want: 5000000},
+
+		{name: "REMB caps", config: config, feedbacks: [][]rtcp.Packet{{remb(600000, ssrc)}}, want: 600000, wantNotified: []int{600000}},
+		{name: "REMB without SSRCs", config: config, feedbacks: [][]rtcp.Packet{{remb(600000)}}, want: 600000, wantNotified: []int{600000}},
+		{name: "REMB of another stream", config: config, feedbacks: [][]rtcp.Packet{{remb(600000, 1)}}, want: 1000000},
+		{name: "REMB below the minimum", config: config, feedbacks: [][]rtcp.Packet{{remb(10000, ssrc)}}, want: 100000, wantNotified: []int{100000}},
+		{name: "REMB above the start", config: config, feedbacks: [][]rtcp.Packet{{remb(5000000, ssrc)}}, want: 1000000},
+		{
+			// REMBが増えても一度に上げず、パケットロスがない間に徐々に上げる
+			name: "REMB increased", config: config,
+			feedbacks:    [][]rtcp.Packet{{remb(600000, ssrc)}, {remb(2000000, ssrc), receiverReport(ssrc, 0)}},
+			want:         630000,
+			wantNotified: []int{600000},
+		},
+
+		{name: "heavy loss", config: config, feedbacks: [][]rtcp.Packet{{receiverReport(ssrc, 128)}}, want: 750000, wantNotified: []int{750000}},
+		{name: "moderate loss", config: config, feedbacks: [][]rtcp.Packet{{receiverReport(ssrc, 10)}}, want: 1000000},
+		{name: "no loss", config: config, feedbacks: [][]rtcp.Packet{{receiverReport(ssrc, 0)}}, want: 1050000},
+		{name: "loss of another stream", config: config, feedbacks: [][]rtcp.Packet{{receiverReport(1, 255)}}, want: 1000000},
+		{
+			name: "sender report", config: config,
+			feedbacks:    [][]rtcp.Packet{{&rtcp.SenderReport{Reports: []rtcp.ReceptionReport{{SSRC: ssrc, FractionLost: 128}}}}},
+			want:         750000,
+			wantNotified: []int{750000},
+		},
+		{
+			name: "no loss up to the maximum", config: Config{MinBitrate: 100000, MaxBitrate: 2500000, StartBitrate: 2450000},
+			feedbacks: [][]rtcp.Packet{{receiverReport(ssrc, 0)}, {receiverReport(ssrc, 0)}},
+			want:      2500000,
+		},
+		{
+			name: "heavy loss down to the minimum", config: Config{MinBitrate: 100000, MaxBitrate: 2500000, StartBitrate: 120000},
+			feedbacks:    [][]rtcp.Packet{{receiverReport(ssrc, 255)}, {receiverReport(ssrc, 255)}},
+			want:         100000,
+			wantNotified: []int{100000},
+		},
+		{
+			// 上限で止まった後は、パケットロスですぐに下がる
+			name: "heavy loss after the maximum", config: Config{MinBitrate: 100000, MaxBitrate: 2500000, StartBitrate: 2500000},
+			feedbacks:    [][]rtcp.Packet{{receiverReport(ssrc, 0)}, {receiverReport(ssrc, 0)}, {receiverReport(ssrc, 128)}},
+			want:         1875000,
+			wantNotified: []int{1875000},
+		},
+		{
+			// 5%を超えて変化した時だけ通知する
+			name: "small changes", config: config,
+			feedbacks:    [][]rtcp.Packet{{receiverReport(ssrc, 0)}, {receiverReport(ssrc, 0)}, {receiverReport(ssrc, 0)}},
+			want:         1157625,
+			wantNotified: []int{1102500},
+		},
+	} {
+		e := NewEstimator(c.config, ssrc)
+		var notified []int
+		e.OnTargetBitrate(func(bitrate int) { notified = append(notified, bitrate) })
+		for _, packets := range c.feedbacks {
+			e.HandleRTCP(packets)
+		}
+		if got := e.TargetBitrate(); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+		if len(notified) != len(c.wantNotified) {
+			t.Errorf("%s: got notified %v, want %v", c.name, notified, c.wantNotified)
+			continue
+		}
+		for i := range notified {
+			if notified[i] != c.wantNotified[i] {
+				t.Errorf("%s: got notified %v, want %v", c.name, notified, c.wantNotified)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Package capture writes the received RTP and RTCP packets with their arrival
+// times to a file in the rtpdump format, and reads such files back so that a
+// session can be replayed offline.
+//
+// rtpdump does not describe the streams, so the codec of every SSRC is written
+// to a JSON file next to the capture (<file>.json).
+package capture
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3/pkg/media/rtpdump"
+)
+
+// Config is the configuration of the capture
+type Config struct {
+	// File is the rtpdump file the packets are written to. Nothing is captured when empty.
+	File string
+}
+
+// Flags registers the capture flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.File, "dump", "", "write the received RTP and RTCP packets to this rtpdump file, e.g. ./out/capture.rtpdump (disabled when empty)")
+	return c
+}
+
+// Stream describes an RTP stream of a capture
+type Stream struct {
+	SSRC        uint32 `json:"ssrc"`
+	MimeType    string `json:"mimeType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    uint16 `json:"channels,omitempty"`
+	SDPFmtpLine string `json:"sdpFmtpLine,omitempty"`
+}
+
+// Manifest is the content of the JSON file written next to a capture
+type Manifest struct {
+	Start   time.Time `json:"start"`
+	Streams []Stream  `json:"streams"`
+}
+
+// ManifestName returns the name of the JSON file describing the capture name
+func ManifestName(name string) string {
+	return name + ".json"
+}
+
+// Interceptor writes the RTP packets of the remote streams and the received
+// RTCP packets to a capture file with the time they arrived. Register it to the
+// interceptor.Registry before any other interceptor so that the packets are
+// written before they are processed.
+// An Interceptor must not be shared between PeerConnections.
+type Interceptor struct {
+	interceptor.NoOp
+
+	name   string
+	file   *os.File
+	writer *rtpdump.Writer
+
+	// done is closed by Close to stop reading ahead
+	done chan struct{}
+
+	mu       sync.Mutex
+	manifest Manifest
+	closed   bool
+}
+
+// readFunc is the signature of RTPReader.Read and RTCPReader.Read
+type readFunc = func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error)
+
+const (
+	// bufferSize is large enough for a packet received on the network
+	bufferSize = 1500
+	// readAheadPackets is the number of packets buffered for each stream
+	readAheadPackets = 1000
+)
+
+// NewInterceptor creates the capture file name and an Interceptor writing to it
+func NewInterceptor(name string) (*Interceptor, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	writer, err := rtpdump.NewWriter(file, rtpdump.Header{Start: start, Source: net.IPv4zero})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	i := &Interceptor{
+		name:     name,
+		file:     file,
+		writer:   writer,
+		done:     make(chan struct{}),
+		manifest: Manifest{Start: start, Streams: []Stream{}},
+	}
+	if err := i.writeManifest(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return i, nil
+}
+
+// BindRemoteStream writes the received RTP packets
+func (i *Interceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	i.addStream(info)
+	return interceptor.RTPReaderFunc(i.readAhead(reader.Read, false))
+}
+
+// BindRTCPReader writes the received RTCP packets
+func (i *Interceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(i.readAhead(reader.Read, true))
+}
+
+type readResult struct {
+	data []byte
+	attr interceptor.Attributes
+	err  error
+}
+
+// readAhead reads the packets in a goroutine and writes them as soon as they
+// arrive, instead of when the application reads them. Up to readAheadPackets
+// packets are buffered until the application reads them.
+func (i *Interceptor) readAhead(read readFunc, isRTCP bool) readFunc {
+	results := make(chan readResult, readAheadPackets)
+	go func() {
+		defer close(results)
+		for {
+			buf := make([]byte, bufferSize)
+			n, attr, err := read(buf, nil)
+			if err == nil {
+				i.write(buf[:n], isRTCP)
+			}
+			select {
+			case results <- readResult{data: buf[:n], attr: attr, err: err}:
+			case <-i.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func(b []byte, _ interceptor.Attributes) (int, interceptor.Attributes, error) {
+		result, ok := <-results
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		if result.err != nil {
+			return 0, nil, result.err
+		}
+		if len(b) < len(result.data) {
+			return 0, nil, io.ErrShortBuffer
+		}
+		return copy(b, result.data), result.attr, nil
+	}
+}
+
+// Close closes the capture file
+func (i *Interceptor) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+	close(i.done)
+	return i.file.Close()
+}
+
+func (i *Interceptor) addStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.manifest.Streams = append(i.manifest.Streams, Stream{
+		SSRC:        info.SSRC,
+		MimeType:    info.MimeType,
+		ClockRate:   info.ClockRate,
+		Channels:    info.Channels,
+		SDPFmtpLine: info.SDPFmtpLine,
+	})
+	// ストリームが追加されるたびに書き直す
+	_ = i.writeManifest()
+}
+
+func (i *Interceptor) writeManifest() error {
+	data, err := json.MarshalIndent(i.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ManifestName(i.name), data, 0644)
+}
+
+func (i *Interceptor) write(b []byte, isRTCP bool) {
+	// 受信した時刻を記録し、バッファは呼び出し元で再利用されるのでコピーする
+	packet := rtpdump.Packet{
+		Offset:  time.Since(i.manifest.Start),
+		IsRTCP:  isRTCP,
+		Payload: append([]byte{}, b...),
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return
+	}
+	// キャプチャの失敗でセッションを止めない
+	_ = i.writer.WritePacket(packet)
+}
+
+// Reader reads the packets of a capture file
+type Reader struct {
+	file   *os.File
+	reader *rtpdump.Reader
+	// Manifest describes the streams of the capture
+	Manifest Manifest
+}
+
+// Open opens the capture file name and its manifest
+func Open(name string) (*Reader, error) {
+	data, err := ioutil.ReadFile(ManifestName(name))
+	if err != nil {
+		return nil, err
+	}
+	manifest := Manifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := rtpdump.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Reader{file: file, reader: reader, Manifest: manifest}, nil
+}
+
+// Next returns the next packet of the capture. io.EOF is returned at the end of the file.
+func (r *Reader) Next() (rtpdump.Packet, error) {
+	return r.reader.Next()
+}
+
+// NextRTP returns the next RTP packet of the capture, skipping RTCP packets
+// and packets which cannot be parsed. io.EOF is returned at the end of the file.
+func (r *Reader) NextRTP() (*rtp.Packet, time.Duration, error) {
+	for {
+		packet, err := r.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		if packet.IsRTCP {
+			continue
+		}
+		rtpPacket := &rtp.Packet{}
+		if err := rtpPacket.Unmarshal(packet.Payload); err != nil {
+			continue
+		}
+		return rtpPacket, packet.Offset, nil
+	}
+}
+
+// Close closes the capture file
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
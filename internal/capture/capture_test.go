@@ -0,0 +1,149 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/rtpdump"
+)
+
+// packetReaderは、packetsを間隔を空けて返し、最後にio.EOFを返すRTP/RTCPの読み込みです
+func packetReader(packets [][]byte, interval time.Duration) readFunc {
+	return func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		if len(packets) == 0 {
+			return 0, nil, io.EOF
+		}
+		time.Sleep(interval)
+		n := copy(b, packets[0])
+		packets = packets[1:]
+		return n, a, nil
+	}
+}
+
+// readAllは、アプリケーションとしてパケットをio.EOFまで読み込みます
+func readAll(t *testing.T, read readFunc) int {
+	t.Helper()
+	buf := make([]byte, bufferSize)
+	for n := 0; ; n++ {
+		if _, _, err := read(buf, nil); err == io.EOF {
+			return n
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestRoundTripは、受信したRTP・RTCPパケットをrtpdumpに書き込み、ヘッダー・到着時刻・ペイロードを読み戻せることを確認します
+func TestRoundTrip(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "capture.rtpdump")
+	i, err := NewInterceptor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []*rtp.Packet
+	var raw [][]byte
+	for seq := uint16(1); seq <= 3; seq++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 111, SequenceNumber: seq, Timestamp: uint32(seq) * 960, SSRC: 1234, Marker: seq == 3},
+			Payload: bytes.Repeat([]byte{byte(seq)}, int(seq)*10),
+		}
+		b, err := packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+		raw = append(raw, b)
+	}
+	// 解析できないパケットもそのまま書き込む
+	raw = append(raw, []byte{0x80})
+	const interval = 20 * time.Millisecond
+	info := &interceptor.StreamInfo{SSRC: 1234, MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	reader := i.BindRemoteStream(info, interceptor.RTPReaderFunc(packetReader(raw, interval)))
+	if n := readAll(t, reader.Read); n != len(raw) {
+		t.Fatalf("read %d RTP packets, want %d", n, len(raw))
+	}
+	rtcpPacket, err := (&rtcp.PictureLossIndication{SenderSSRC: 1, MediaSSRC: 1234}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtcpReader := i.BindRTCPReader(interceptor.RTCPReaderFunc(packetReader([][]byte{rtcpPacket}, interval)))
+	if n := readAll(t, rtcpReader.Read); n != 1 {
+		t.Fatalf("read %d RTCP packets, want 1", n)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if streams := r.Manifest.Streams; len(streams) != 1 || streams[0] != (Stream{SSRC: 1234, MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: info.SDPFmtpLine}) {
+		t.Errorf("got streams %+v", streams)
+	}
+
+	// RTPパケットはヘッダーとペイロードを保ち、間隔を空けて受信した時刻が記録される
+	var last time.Duration
+	for n, want := range packets {
+		packet, offset, err := r.NextRTP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.SequenceNumber != want.SequenceNumber || packet.Timestamp != want.Timestamp || packet.SSRC != want.SSRC ||
+			packet.PayloadType != want.PayloadType || packet.Marker != want.Marker || !bytes.Equal(packet.Payload, want.Payload) {
+			t.Errorf("packet %d: got %+v, want %+v", n, packet, want)
+		}
+		if offset < last+interval/2 {
+			t.Errorf("packet %d: got offset %s after %s", n, offset, last)
+		}
+		last = offset
+	}
+	// 解析できないパケットとRTCPパケットは読み飛ばす
+	if packet, _, err := r.NextRTP(); err != io.EOF {
+		t.Errorf("got %+v (%v), want io.EOF", packet, err)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	dump, header, err := rtpdump.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rtpdumpのヘッダーの開始時刻はマイクロ秒単位
+	if !header.Start.Equal(r.Manifest.Start.Truncate(time.Microsecond)) || !header.Source.Equal(net.IPv4zero) {
+		t.Errorf("got header %+v, want the start %s", header, r.Manifest.Start)
+	}
+	var rtcpPackets int
+	for {
+		packet, err := dump.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.IsRTCP {
+			rtcpPackets++
+			if !bytes.Equal(packet.Payload, rtcpPacket) || packet.Offset < last {
+				t.Errorf("got RTCP packet %x at %s", packet.Payload, packet.Offset)
+			}
+		}
+	}
+	if rtcpPackets != 1 {
+		t.Errorf("got %d RTCP packets, want 1", rtcpPackets)
+	}
+}
@@ -0,0 +1,254 @@
+// Package control exchanges control commands, chat messages and telemetry
+// with the remote peer over an RTCDataChannel.
+//
+// The remote peer opens a data channel labeled "control" and sends JSON
+// messages (see Message). Commands are answered with a "result" message
+// carrying the same ID, and a "telemetry" message is pushed every second.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// Label is the label of the data channel used for control messages
+const Label = "control"
+
+// TelemetryInterval is the interval telemetry messages are pushed at
+const TelemetryInterval = time.Second
+
+// Message types
+const (
+	// TypeCommand is sent by the remote peer to run a command
+	TypeCommand = "command"
+	// TypeResult answers a command. Error is empty when the command succeeded.
+	TypeResult = "result"
+	// TypeTelemetry carries the statistics of the session
+	TypeTelemetry = "telemetry"
+	// TypeChat carries a free text message
+	TypeChat = "chat"
+)
+
+// Commands
+const (
+	// CommandStartRecording starts writing the received media to files
+	CommandStartRecording = "start-recording"
+	// CommandStopRecording stops writing the received media to files
+	CommandStopRecording = "stop-recording"
+	// CommandPause pauses sending media
+	CommandPause = "pause"
+	// CommandResume resumes sending media
+	CommandResume = "resume"
+	// CommandRequestKeyFrame requests a key frame from the media source
+	CommandRequestKeyFrame = "request-keyframe"
+	// CommandSwitchFile switches the file being sent to Message.File
+	CommandSwitchFile = "switch-file"
+	// CommandAddTone adds a sine tone audio track, which starts a renegotiation
+	CommandAddTone = "add-tone"
+	// CommandRemoveTone removes the track added by CommandAddTone, which starts a renegotiation
+	CommandRemoveTone = "remove-tone"
+	// CommandSelectLayer switches the simulcast layer sent back to Message.Layer,
+	// or to the automatic selection when Message.Layer is empty
+	CommandSelectLayer = "select-layer"
+)
+
+// Message is the JSON message exchanged on the control data channel
+type Message struct {
+	Type string `json:"type"`
+	// ID correlates a command with its result
+	ID int `json:"id,omitempty"`
+	// Command is the name of the command (command, result)
+	Command string `json:"command,omitempty"`
+	// File is the argument of CommandSwitchFile
+	File string `json:"file,omitempty"`
+	// Layer is the RID of the simulcast layer, the argument of CommandSelectLayer
+	Layer string `json:"layer,omitempty"`
+	// Error is the reason a command failed (result)
+	Error string `json:"error,omitempty"`
+	// Text is the body of a chat message
+	Text string `json:"text,omitempty"`
+	// Telemetry is the body of a telemetry message
+	Telemetry *Telemetry `json:"telemetry,omitempty"`
+}
+
+// Telemetry is the statistics of the session pushed every TelemetryInterval
+type Telemetry struct {
+	Timestamp           time.Time `json:"timestamp"`
+	PeerConnectionState string    `json:"peerConnectionState"`
+	ICEConnectionState  string    `json:"iceConnectionState"`
+	// BytesSent and BytesReceived are counted on the ICE transport
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	// RoundTripTime is the latest RTT of the nominated candidate pair in seconds
+	RoundTripTime float64 `json:"roundTripTime"`
+	// Status is the command specific state, e.g. whether recording is running
+	Status map[string]interface{} `json:"status,omitempty"`
+}
+
+// Handler runs a command. The returned error is sent back to the remote peer.
+type Handler func(msg Message) error
+
+// Controller accepts the control data channel of a PeerConnection
+// and dispatches the received commands to the registered handlers
+type Controller struct {
+	peerConnection *webrtc.PeerConnection
+	logger         *zap.Logger
+
+	mu          sync.Mutex
+	handlers    map[string]Handler
+	status      func() map[string]interface{}
+	dataChannel *webrtc.DataChannel
+}
+
+// New creates a Controller for the PeerConnection.
+// The control data channel opened by the remote peer has to be passed to Accept.
+func New(peerConnection *webrtc.PeerConnection, logger *zap.Logger) *Controller {
+	return &Controller{
+		peerConnection: peerConnection,
+		logger:         logger,
+		handlers:       map[string]Handler{},
+	}
+}
+
+// Handle registers the handler of a command
+func (c *Controller) Handle(command string, handler Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[command] = handler
+}
+
+// SetStatus sets a function which returns the command specific state added to telemetry
+func (c *Controller) SetStatus(status func() map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+// Send sends a message on the control data channel.
+// Messages are dropped while the data channel is not open.
+func (c *Controller) Send(msg Message) error {
+	c.mu.Lock()
+	dataChannel := c.dataChannel
+	c.mu.Unlock()
+
+	if dataChannel == nil || dataChannel.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return dataChannel.SendText(string(data))
+}
+
+// Run pushes telemetry every TelemetryInterval until ctx is done
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(TelemetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.Send(Message{Type: TypeTelemetry, Telemetry: c.telemetry()}); err != nil {
+			c.logger.Warn("Failed to send telemetry", zap.Error(err))
+		}
+	}
+}
+
+// Accept starts handling the messages of a data channel opened by the remote peer.
+// Data channels with other labels are ignored, so that Accept can be passed to
+// PeerConnection.OnDataChannel directly.
+func (c *Controller) Accept(dataChannel *webrtc.DataChannel) {
+	if dataChannel.Label() != Label {
+		return
+	}
+	c.logger.Info("Control data channel has been opened")
+
+	c.mu.Lock()
+	c.dataChannel = dataChannel
+	c.mu.Unlock()
+
+	dataChannel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		msg := Message{}
+		if err := json.Unmarshal(raw.Data, &msg); err != nil {
+			c.logger.Warn("Invalid control message", zap.Error(err))
+			return
+		}
+		c.handle(msg)
+	})
+}
+
+func (c *Controller) handle(msg Message) {
+	switch msg.Type {
+	case TypeChat:
+		c.logger.Info("Chat", zap.String("text", msg.Text))
+		// 受け取ったことが分かるように送り返す
+		if err := c.Send(Message{Type: TypeChat, Text: msg.Text}); err != nil {
+			c.logger.Warn("Failed to send chat", zap.Error(err))
+		}
+
+	case TypeCommand:
+		c.mu.Lock()
+		handler, ok := c.handlers[msg.Command]
+		c.mu.Unlock()
+
+		result := Message{Type: TypeResult, ID: msg.ID, Command: msg.Command}
+		if !ok {
+			result.Error = fmt.Sprintf("unsupported command %q", msg.Command)
+		} else if err := handler(msg); err != nil {
+			result.Error = err.Error()
+		}
+		c.logger.Info("Command", zap.String("command", msg.Command), zap.String("result", resultString(result)))
+		if err := c.Send(result); err != nil {
+			c.logger.Warn("Failed to send result", zap.Error(err))
+		}
+
+	default:
+		c.logger.Warn("Unsupported control message", zap.String("type", msg.Type))
+	}
+}
+
+func (c *Controller) telemetry() *Telemetry {
+	t := &Telemetry{
+		Timestamp:           time.Now(),
+		PeerConnectionState: c.peerConnection.ConnectionState().String(),
+		ICEConnectionState:  c.peerConnection.ICEConnectionState().String(),
+	}
+	for _, s := range c.peerConnection.GetStats() {
+		switch stats := s.(type) {
+		case webrtc.TransportStats:
+			if stats.ID == "iceTransport" {
+				t.BytesSent = stats.BytesSent
+				t.BytesReceived = stats.BytesReceived
+			}
+		case webrtc.ICECandidatePairStats:
+			if stats.Nominated {
+				t.RoundTripTime = stats.CurrentRoundTripTime
+			}
+		}
+	}
+
+	c.mu.Lock()
+	status := c.status
+	c.mu.Unlock()
+	if status != nil {
+		t.Status = status()
+	}
+	return t
+}
+
+func resultString(result Message) string {
+	if result.Error != "" {
+		return result.Error
+	}
+	return "ok"
+}
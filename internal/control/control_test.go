@@ -0,0 +1,263 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// remoteは、制御用のデータチャネルを開くリモートのPeerConnectionです
+type remote struct {
+	dataChannel *webrtc.DataChannel
+	// messagesは、Controllerから受信したメッセージです
+	messages chan Message
+}
+
+// connectは、仮想ネットワークでつながった2つのPeerConnectionを作成し、
+// 応答側でControllerを、オファー側で制御用のデータチャネルを開きます
+func connect(t *testing.T, setup func(c *Controller)) (*Controller, *remote) {
+	t.Helper()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peerConnections []*webrtc.PeerConnection
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		vnetNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err := router.AddNet(vnetNet); err != nil {
+			t.Fatal(err)
+		}
+		settingEngine := webrtc.SettingEngine{}
+		settingEngine.SetVNet(vnetNet)
+		pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = pc.Close() })
+		peerConnections = append(peerConnections, pc)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Stop() })
+	offerer, answerer := peerConnections[0], peerConnections[1]
+
+	c := New(answerer, zap.NewNop())
+	setup(c)
+	answerer.OnDataChannel(c.Accept)
+
+	r := &remote{messages: make(chan Message, 16)}
+	opened := make(chan struct{})
+	if r.dataChannel, err = offerer.CreateDataChannel(Label, nil); err != nil {
+		t.Fatal(err)
+	}
+	r.dataChannel.OnOpen(func() { close(opened) })
+	r.dataChannel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		msg := Message{}
+		if err := json.Unmarshal(raw.Data, &msg); err != nil {
+			t.Errorf("invalid message %q: %s", raw.Data, err)
+			return
+		}
+		r.messages <- msg
+	})
+
+	// 候補の収集が終わってからセッション記述を交換する
+	exchange := func(pc *webrtc.PeerConnection, desc webrtc.SessionDescription) webrtc.SessionDescription {
+		gatherComplete := webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(desc); err != nil {
+			t.Fatal(err)
+		}
+		<-gatherComplete
+		return *pc.LocalDescription()
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := answerer.SetRemoteDescription(exchange(offerer, offer)); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.SetRemoteDescription(exchange(answerer, answer)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the control data channel is not opened")
+	}
+	return c, r
+}
+
+func (r *remote) send(t *testing.T, msg Message) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.dataChannel.SendText(string(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recvは、typ以外のメッセージ(テレメトリなど)を読み飛ばして、typのメッセージを返します
+func (r *remote) recv(t *testing.T, typ string) Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-r.messages:
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %s message", typ)
+		}
+	}
+}
+
+// commandは、コマンドを送信して結果を返します
+func (r *remote) command(t *testing.T, id int, command string) Message {
+	t.Helper()
+	r.send(t, Message{Type: TypeCommand, ID: id, Command: command})
+	result := r.recv(t, TypeResult)
+	if result.ID != id || result.Command != command {
+		t.Fatalf("got result %+v for command %d %s", result, id, command)
+	}
+	return result
+}
+
+// TestCommandは、コマンドが登録したハンドラーに振り分けられ、結果が同じIDで返されることを確認します
+func TestCommand(t *testing.T) {
+	var files []string
+	_, r := connect(t, func(c *Controller) {
+		c.Handle(CommandSwitchFile, func(msg Message) error {
+			if msg.File == "" {
+				return errors.New("no file")
+			}
+			files = append(files, msg.File)
+			return nil
+		})
+	})
+
+	r.send(t, Message{Type: TypeCommand, ID: 1, Command: CommandSwitchFile, File: "a.ivf"})
+	if result := r.recv(t, TypeResult); result.ID != 1 || result.Error != "" {
+		t.Errorf("got result %+v", result)
+	}
+	if len(files) != 1 || files[0] != "a.ivf" {
+		t.Errorf("got files %v", files)
+	}
+
+	// ハンドラーのエラーは結果として返される
+	if result := r.command(t, 2, CommandSwitchFile); result.Error != "no file" {
+		t.Errorf("got result %+v", result)
+	}
+
+	// 登録されていないコマンドはエラーになる
+	if result := r.command(t, 3, CommandPause); result.Error != `unsupported command "pause"` {
+		t.Errorf("got result %+v", result)
+	}
+}
+
+// TestChatは、チャットのメッセージがそのまま送り返されることを確認します
+func TestChat(t *testing.T) {
+	_, r := connect(t, func(*Controller) {})
+
+	r.send(t, Message{Type: TypeChat, Text: "こんにちは"})
+	if msg := r.recv(t, TypeChat); msg.Text != "こんにちは" {
+		t.Errorf("got chat %q", msg.Text)
+	}
+}
+
+// TestRecordingは、録画の開始・停止のコマンドで状態が変わり、テレメトリの状態に反映されることを確認します
+func TestRecording(t *testing.T) {
+	recording := make(chan bool, 1)
+	recording <- false
+	c, r := connect(t, func(c *Controller) {
+		c.Handle(CommandStartRecording, func(Message) error {
+			if <-recording {
+				recording <- true
+				return errors.New("already recording")
+			}
+			recording <- true
+			return nil
+		})
+		c.Handle(CommandStopRecording, func(Message) error {
+			if !<-recording {
+				recording <- false
+				return errors.New("not recording")
+			}
+			recording <- false
+			return nil
+		})
+		c.SetStatus(func() map[string]interface{} {
+			r := <-recording
+			recording <- r
+			return map[string]interface{}{"recording": r}
+		})
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	for i, step := range []struct {
+		command   string
+		err       string
+		recording bool
+	}{
+		{CommandStartRecording, "", true},
+		{CommandStartRecording, "already recording", true},
+		{CommandStopRecording, "", false},
+		{CommandStopRecording, "not recording", false},
+	} {
+		if result := r.command(t, i+1, step.command); result.Error != step.err {
+			t.Errorf("%d: got result %+v, want error %q", i, result, step.err)
+		}
+		// コマンドの後に送られたテレメトリに状態が反映される
+		r.recv(t, TypeTelemetry)
+		if got := r.recv(t, TypeTelemetry).Telemetry.Status["recording"]; got != step.recording {
+			t.Errorf("%d: got recording %v in telemetry, want %v", i, got, step.recording)
+		}
+	}
+}
+
+// TestTelemetryは、テレメトリが接続の状態と転送量を伝えることを確認します
+func TestTelemetry(t *testing.T) {
+	c, r := connect(t, func(*Controller) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	start := time.Now()
+	msg := r.recv(t, TypeTelemetry)
+	if elapsed := time.Since(start); elapsed > 2*TelemetryInterval {
+		t.Errorf("telemetry arrived after %s", elapsed)
+	}
+	telemetry := msg.Telemetry
+	if telemetry == nil {
+		t.Fatal("no telemetry")
+	}
+	if telemetry.PeerConnectionState != webrtc.PeerConnectionStateConnected.String() {
+		t.Errorf("got peer connection state %s", telemetry.PeerConnectionState)
+	}
+	if telemetry.ICEConnectionState != webrtc.ICEConnectionStateConnected.String() {
+		t.Errorf("got ICE connection state %s", telemetry.ICEConnectionState)
+	}
+	if telemetry.BytesSent == 0 || telemetry.BytesReceived == 0 {
+		t.Errorf("got %d bytes sent and %d bytes received", telemetry.BytesSent, telemetry.BytesReceived)
+	}
+	if telemetry.Status != nil {
+		t.Errorf("got status %v without SetStatus", telemetry.Status)
+	}
+}
@@ -0,0 +1,430 @@
+// Package filetransfer transfers files over RTCDataChannels.
+//
+// The remote peer opens a data channel labeled "file" for each transfer and
+// sends one JSON request (see Message) as its first message:
+//
+//   - list: the files in Config.Dir and its subdirectories, such as the
+//     recording directories of the sessions, are returned in a "list" message.
+//     The names of the files in a subdirectory are slash separated paths.
+//   - download: a "file" message with the size and the SHA-256 of the file is
+//     sent, followed by the contents from Offset as binary chunks and a "done"
+//     message. A broken transfer is resumed by requesting the same file with
+//     Offset set to the number of bytes already received.
+//   - upload: a "ready" message with the offset to send from is returned.
+//     The remote peer sends the contents as binary chunks, and the file is
+//     stored in Config.UploadDir once all bytes have arrived and the SHA-256
+//     matches. The partial file is kept so that a broken upload can be resumed.
+//
+// Errors are reported with an "error" message.
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// Label is the label of the data channels used for file transfers
+const Label = "file"
+
+const (
+	// chunkSize is the size of the binary messages. 16KiB can be received by every browser.
+	chunkSize = 16 * 1024
+	// maxBufferedAmount is the amount of buffered data sending is paused at
+	maxBufferedAmount = 1024 * 1024
+	// bufferedAmountLowThreshold is the amount of buffered data sending is resumed at
+	bufferedAmountLowThreshold = 512 * 1024
+	// partialSuffix is appended to the name of a file being uploaded
+	partialSuffix = ".part"
+)
+
+// Message types
+const (
+	// TypeList requests (and answers with) the list of files
+	TypeList = "list"
+	// TypeDownload requests a file
+	TypeDownload = "download"
+	// TypeFile describes the file being downloaded
+	TypeFile = "file"
+	// TypeUpload starts an upload
+	TypeUpload = "upload"
+	// TypeReady tells the offset an upload has to be sent from
+	TypeReady = "ready"
+	// TypeDone completes a transfer
+	TypeDone = "done"
+	// TypeError aborts a transfer
+	TypeError = "error"
+)
+
+// Message is the JSON message exchanged on a file transfer data channel
+type Message struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	// Size is the size of the whole file in bytes
+	Size int64 `json:"size,omitempty"`
+	// Offset is the position the transfer starts from
+	Offset int64 `json:"offset,omitempty"`
+	// SHA256 is the hex encoded checksum of the whole file
+	SHA256 string `json:"sha256,omitempty"`
+	Files  []File `json:"files,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// File is an entry of the list message
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Config is the configuration of the file transfer
+type Config struct {
+	// Dir is the directory files are downloaded from
+	Dir string
+	// UploadDir is the directory uploaded files are stored in
+	UploadDir string
+}
+
+// Flags registers the file transfer flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Dir, "transfer-dir", "./out", "directory whose files can be downloaded over the data channel")
+	flag.StringVar(&c.UploadDir, "upload-dir", "./upload", "directory files uploaded over the data channel are stored in")
+	return c
+}
+
+// Server serves the file transfer data channels of a PeerConnection
+type Server struct {
+	config Config
+	logger *zap.Logger
+}
+
+// NewServer creates a Server
+func NewServer(config Config, logger *zap.Logger) *Server {
+	return &Server{config: config, logger: logger}
+}
+
+// Accept starts serving a data channel opened by the remote peer.
+// Data channels with other labels are ignored. Running transfers are
+// aborted when ctx is done.
+func (s *Server) Accept(ctx context.Context, dataChannel *webrtc.DataChannel) {
+	if dataChannel.Label() != Label {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var mu sync.Mutex
+	var upload *upload
+	dataChannel.OnMessage(func(raw webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// 最初のリクエスト以降のバイナリメッセージはアップロードの内容
+		if !raw.IsString {
+			if upload == nil {
+				s.sendError(dataChannel, errors.New("no upload has been started"))
+				return
+			}
+			done, err := upload.write(raw.Data)
+			if err != nil {
+				s.sendError(dataChannel, err)
+				upload = nil
+				return
+			}
+			if done {
+				s.logger.Info("Upload completed", zap.String("file", upload.name))
+				s.send(dataChannel, Message{Type: TypeDone, Name: filepath.Base(upload.name)})
+				upload = nil
+			}
+			return
+		}
+
+		req := Message{}
+		if err := json.Unmarshal(raw.Data, &req); err != nil {
+			s.sendError(dataChannel, fmt.Errorf("invalid request: %w", err))
+			return
+		}
+		switch req.Type {
+		case TypeList:
+			files, err := s.list()
+			if err != nil {
+				s.sendError(dataChannel, err)
+				return
+			}
+			s.send(dataChannel, Message{Type: TypeList, Files: files})
+
+		case TypeDownload:
+			// 送信はバッファの空きを待つため、メッセージの受信をブロックしないようにする
+			go func() {
+				err := s.download(ctx, dataChannel, req)
+				if err != nil && ctx.Err() != nil {
+					// データチャネルが閉じられた場合は、同じファイルを要求し直すことで再開できる
+					s.logger.Info("Download aborted", zap.String("file", req.Name))
+				} else if err != nil {
+					s.logger.Warn("Download failed", zap.String("file", req.Name), zap.Error(err))
+					s.sendError(dataChannel, err)
+				}
+			}()
+
+		case TypeUpload:
+			if upload != nil {
+				upload.close()
+			}
+			u, err := s.startUpload(req)
+			if err != nil {
+				s.sendError(dataChannel, err)
+				return
+			}
+			upload = u
+			s.send(dataChannel, Message{Type: TypeReady, Name: req.Name, Offset: u.written})
+
+		default:
+			s.sendError(dataChannel, fmt.Errorf("unsupported request type %q", req.Type))
+		}
+	})
+	dataChannel.OnClose(func() {
+		cancel()
+
+		mu.Lock()
+		defer mu.Unlock()
+		// 途中までアップロードされたファイルは、再開できるように残しておく
+		if upload != nil {
+			upload.close()
+		}
+	})
+}
+
+func (s *Server) list() ([]File, error) {
+	files := []File{}
+	err := filepath.Walk(s.config.Dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(s.config.Dir, file)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Name: filepath.ToSlash(name), Size: info.Size()})
+		return nil
+	})
+	return files, err
+}
+
+// download sends the file from the requested offset, pausing while
+// the data channel has more than maxBufferedAmount bytes buffered
+func (s *Server) download(ctx context.Context, dataChannel *webrtc.DataChannel, req Message) error {
+	path, err := resolvePath(s.config.Dir, req.Name)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", req.Name)
+	}
+	if req.Offset < 0 || req.Offset > info.Size() {
+		return fmt.Errorf("invalid offset %d", req.Offset)
+	}
+	// 書き込み中のファイルでも、サイズとチェックサムが一致するようにStatした時点のサイズまでを送信する
+	sum, err := checksum(io.LimitReader(file, info.Size()))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(req.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := io.LimitReader(file, info.Size()-req.Offset)
+
+	s.logger.Info("Download started", zap.String("file", req.Name), zap.Int64("offset", req.Offset), zap.Int64("size", info.Size()))
+	s.send(dataChannel, Message{Type: TypeFile, Name: req.Name, Size: info.Size(), Offset: req.Offset, SHA256: sum})
+
+	bufferedAmountLow := make(chan struct{}, 1)
+	dataChannel.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	dataChannel.OnBufferedAmountLow(func() {
+		select {
+		case bufferedAmountLow <- struct{}{}:
+		default:
+		}
+	})
+
+	buf := make([]byte, chunkSize)
+	for {
+		// バッファが溜まっている間は、閾値を下回るまで送信を待つ
+		for dataChannel.BufferedAmount() > maxBufferedAmount {
+			select {
+			case <-bufferedAmountLow:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if sendErr := dataChannel.Send(buf[:n]); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("Download completed", zap.String("file", req.Name))
+	s.send(dataChannel, Message{Type: TypeDone, Name: req.Name})
+	return nil
+}
+
+// upload is a file being received from the remote peer
+type upload struct {
+	name     string
+	file     *os.File
+	size     int64
+	written  int64
+	checksum string
+}
+
+func (s *Server) startUpload(req Message) (*upload, error) {
+	if req.Size <= 0 {
+		return nil, fmt.Errorf("invalid size %d", req.Size)
+	}
+	if _, err := hex.DecodeString(req.SHA256); err != nil || len(req.SHA256) != sha256.Size*2 {
+		return nil, errors.New("a hex encoded SHA-256 checksum is required")
+	}
+	path, err := resolve(s.config.UploadDir, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.config.UploadDir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path+partialSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// 途中までアップロードされたファイルがあれば、その続きから受信する
+	written := info.Size()
+	if written >= req.Size {
+		written = 0
+	}
+	if err := file.Truncate(written); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(written, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s.logger.Info("Upload started", zap.String("file", req.Name), zap.Int64("offset", written), zap.Int64("size", req.Size))
+	return &upload{name: path, file: file, size: req.Size, written: written, checksum: req.SHA256}, nil
+}
+
+// write appends a chunk and returns true once the whole file has been received and verified
+func (u *upload) write(data []byte) (bool, error) {
+	if u.written+int64(len(data)) > u.size {
+		u.close()
+		return false, errors.New("received more bytes than the size of the file")
+	}
+	if _, err := u.file.Write(data); err != nil {
+		u.close()
+		return false, err
+	}
+	u.written += int64(len(data))
+	if u.written < u.size {
+		return false, nil
+	}
+
+	if _, err := u.file.Seek(0, io.SeekStart); err != nil {
+		u.close()
+		return false, err
+	}
+	sum, err := checksum(u.file)
+	u.close()
+	if err != nil {
+		return false, err
+	}
+	if sum != u.checksum {
+		// 壊れたファイルからは再開できないため削除する
+		os.Remove(u.name + partialSuffix)
+		return false, fmt.Errorf("checksum mismatch: %s", filepath.Base(u.name))
+	}
+	return true, os.Rename(u.name+partialSuffix, u.name)
+}
+
+func (u *upload) close() {
+	u.file.Close()
+}
+
+func (s *Server) send(dataChannel *webrtc.DataChannel, msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Warn("Failed to encode message", zap.String("type", msg.Type), zap.Error(err))
+		return
+	}
+	if err := dataChannel.SendText(string(data)); err != nil {
+		s.logger.Warn("Failed to send message", zap.String("type", msg.Type), zap.Error(err))
+	}
+}
+
+func (s *Server) sendError(dataChannel *webrtc.DataChannel, err error) {
+	s.send(dataChannel, Message{Type: TypeError, Error: err.Error()})
+}
+
+// resolve returns the path of name in dir. Names containing a directory are rejected.
+func resolve(dir, name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// resolvePath returns the path of name in dir, where name may be a slash separated path in a subdirectory.
+// Names leading out of dir are rejected.
+func resolvePath(dir, name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if name == "" || clean != name {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func checksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,307 @@
+package filetransfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// connectは、仮想ネットワークでつながったオファー側とServerを提供する応答側を接続し、オファー側を返します
+func connect(ctx context.Context, t *testing.T, config Config) *webrtc.PeerConnection {
+	t.Helper()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peerConnections []*webrtc.PeerConnection
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		vnetNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err := router.AddNet(vnetNet); err != nil {
+			t.Fatal(err)
+		}
+		settingEngine := webrtc.SettingEngine{}
+		settingEngine.SetVNet(vnetNet)
+		pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = pc.Close() })
+		peerConnections = append(peerConnections, pc)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Stop() })
+	offerer, answerer := peerConnections[0], peerConnections[1]
+
+	server := NewServer(config, zap.NewNop())
+	answerer.OnDataChannel(func(d *webrtc.DataChannel) { server.Accept(ctx, d) })
+
+	// ファイル転送のデータチャネルは接続後に開くため、SCTPを使うことを伝えるデータチャネルを作っておく
+	if _, err := offerer.CreateDataChannel("control", nil); err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan struct{})
+	offerer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	// 候補の収集が終わってからセッション記述を交換する
+	exchange := func(pc *webrtc.PeerConnection, desc webrtc.SessionDescription) webrtc.SessionDescription {
+		gatherComplete := webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(desc); err != nil {
+			t.Fatal(err)
+		}
+		<-gatherComplete
+		return *pc.LocalDescription()
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := answerer.SetRemoteDescription(exchange(offerer, offer)); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.SetRemoteDescription(exchange(answerer, answer)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatal("not connected")
+	}
+	return offerer
+}
+
+// transferは、オファー側から開いたファイル転送のデータチャネルです
+type transfer struct {
+	dataChannel *webrtc.DataChannel
+	messages    chan webrtc.DataChannelMessage
+}
+
+func open(ctx context.Context, t *testing.T, pc *webrtc.PeerConnection) *transfer {
+	t.Helper()
+	dataChannel, err := pc.CreateDataChannel(Label, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &transfer{dataChannel: dataChannel, messages: make(chan webrtc.DataChannelMessage, 1024)}
+	opened := make(chan struct{})
+	dataChannel.OnOpen(func() { close(opened) })
+	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) { tr.messages <- msg })
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		t.Fatal("the data channel is not opened")
+	}
+	return tr
+}
+
+func (tr *transfer) request(t *testing.T, msg Message) {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.dataChannel.SendText(string(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tr *transfer) recv(ctx context.Context, t *testing.T) webrtc.DataChannelMessage {
+	t.Helper()
+	select {
+	case msg := <-tr.messages:
+		return msg
+	case <-ctx.Done():
+		t.Fatal("no message is received")
+		return webrtc.DataChannelMessage{}
+	}
+}
+
+// recvMessageは、want型のJSONメッセージを受信します
+func (tr *transfer) recvMessage(ctx context.Context, t *testing.T, want string) Message {
+	t.Helper()
+	raw := tr.recv(ctx, t)
+	if !raw.IsString {
+		t.Fatalf("got %d bytes, want a %s message", len(raw.Data), want)
+	}
+	var msg Message
+	if err := json.Unmarshal(raw.Data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != want {
+		t.Fatalf("got %+v, want a %s message", msg, want)
+	}
+	return msg
+}
+
+// downloadは、offsetからファイルをダウンロードし、fileメッセージと受信した内容を返します
+func (tr *transfer) download(ctx context.Context, t *testing.T, name string, offset int64) (Message, []byte) {
+	t.Helper()
+	tr.request(t, Message{Type: TypeDownload, Name: name, Offset: offset})
+	file := tr.recvMessage(ctx, t, TypeFile)
+	var data []byte
+	for {
+		raw := tr.recv(ctx, t)
+		if raw.IsString {
+			break
+		}
+		data = append(data, raw.Data...)
+	}
+	return file, data
+}
+
+func (tr *transfer) send(t *testing.T, data []byte) {
+	t.Helper()
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if err := tr.dataChannel.Send(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func sum(data []byte) string {
+	s := sha256.Sum256(data)
+	return hex.EncodeToString(s[:])
+}
+
+// TestDownloadは、一覧とダウンロード、途中からのダウンロードの再開ができることを確認します
+func TestDownload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	dir := t.TempDir()
+	// 複数のチャンクに分かれるサイズにする
+	content := randomBytes(5*chunkSize + 100)
+	// 録画のディレクトリのように、サブディレクトリのファイルも一覧に含める
+	if err := os.Mkdir(filepath.Join(dir, "session"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "session", "video.ivf"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pc := connect(ctx, t, Config{Dir: dir, UploadDir: t.TempDir()})
+
+	tr := open(ctx, t, pc)
+	tr.request(t, Message{Type: TypeList})
+	list := tr.recvMessage(ctx, t, TypeList)
+	if len(list.Files) != 1 || list.Files[0] != (File{Name: "session/video.ivf", Size: int64(len(content))}) {
+		t.Errorf("got files %+v", list.Files)
+	}
+
+	file, data := tr.download(ctx, t, "session/video.ivf", 0)
+	if file.Size != int64(len(content)) || file.SHA256 != sum(content) {
+		t.Errorf("got file %+v", file)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("got %d bytes, which differ from the file", len(data))
+	}
+
+	// 途中まで受信したファイルは、受信したバイト数を指定して再開する
+	const received = 2*chunkSize + 10
+	resumed := open(ctx, t, pc)
+	file, data = resumed.download(ctx, t, "session/video.ivf", received)
+	if file.Offset != received || file.SHA256 != sum(content) {
+		t.Errorf("got file %+v when resumed", file)
+	}
+	if whole := append(append([]byte(nil), content[:received]...), data...); sum(whole) != file.SHA256 {
+		t.Errorf("got %d bytes from offset %d, which do not match the checksum", len(data), received)
+	}
+
+	for _, name := range []string{"../video.ivf", "/etc/passwd", "session/../../video.ivf", "missing"} {
+		resumed.request(t, Message{Type: TypeDownload, Name: name})
+		resumed.recvMessage(ctx, t, TypeError)
+	}
+}
+
+// TestUploadは、アップロードの中断と再開ができ、チェックサムが一致しないファイルは保存しないことを確認します
+func TestUpload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	uploadDir := t.TempDir()
+	pc := connect(ctx, t, Config{Dir: t.TempDir(), UploadDir: uploadDir})
+	content := randomBytes(4*chunkSize + 100)
+	upload := Message{Type: TypeUpload, Name: "upload.bin", Size: int64(len(content)), SHA256: sum(content)}
+
+	// 途中まで送ってデータチャネルを閉じる
+	const sent = 2 * chunkSize
+	tr := open(ctx, t, pc)
+	tr.request(t, upload)
+	if ready := tr.recvMessage(ctx, t, TypeReady); ready.Offset != 0 {
+		t.Fatalf("got offset %d, want 0", ready.Offset)
+	}
+	tr.send(t, content[:sent])
+	partial := filepath.Join(uploadDir, "upload.bin"+partialSuffix)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if info, err := os.Stat(partial); err == nil && info.Size() == sent {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sent bytes are not written")
+		}
+	}
+	if err := tr.dataChannel.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じファイルのアップロードを始めると、受信済みのバイト数から再開する
+	tr = open(ctx, t, pc)
+	tr.request(t, upload)
+	if ready := tr.recvMessage(ctx, t, TypeReady); ready.Offset != sent {
+		t.Fatalf("got offset %d, want %d", ready.Offset, sent)
+	}
+	tr.send(t, content[sent:])
+	tr.recvMessage(ctx, t, TypeDone)
+	if data, err := ioutil.ReadFile(filepath.Join(uploadDir, "upload.bin")); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("got %d bytes (%v), which differ from the uploaded file", len(data), err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("the partial file is kept: %v", err)
+	}
+
+	// チェックサムが一致しない場合はエラーになり、ファイルは残らない
+	corrupted := Message{Type: TypeUpload, Name: "corrupted.bin", Size: int64(len(content)), SHA256: sum(content[1:])}
+	tr.request(t, corrupted)
+	tr.recvMessage(ctx, t, TypeReady)
+	tr.send(t, content)
+	if msg := tr.recvMessage(ctx, t, TypeError); !strings.Contains(msg.Error, "checksum mismatch") {
+		t.Errorf("got error %q", msg.Error)
+	}
+	for _, name := range []string{"corrupted.bin", "corrupted.bin" + partialSuffix} {
+		if _, err := os.Stat(filepath.Join(uploadDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s is kept: %v", name, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 #include "gst.h"
 
 #include <gst/app/gstappsrc.h>
+#include <gst/video/video.h>
 
 typedef struct SampleHandlerUserData {
   int pipelineId;
@@ -14,24 +15,43 @@ void gstreamer_send_start_mainloop(void) {
 }
 
 static gboolean gstreamer_send_bus_call(GstBus *bus, GstMessage *msg, gpointer data) {
+  int pipelineId = GPOINTER_TO_INT(data);
+
   switch (GST_MESSAGE_TYPE(msg)) {
 
   case GST_MESSAGE_EOS:
-    g_print("End of stream\n");
-    exit(1);
+    goHandlePipelineEvent(pipelineId, GSTREAMER_SEND_EVENT_EOS, NULL, NULL, 0, 0);
     break;
 
-  case GST_MESSAGE_ERROR: {
+  case GST_MESSAGE_ERROR:
+  case GST_MESSAGE_WARNING: {
     gchar *debug;
     GError *error;
-
-    gst_message_parse_error(msg, &error, &debug);
+    int eventType;
+
+    if (GST_MESSAGE_TYPE(msg) == GST_MESSAGE_ERROR) {
+      gst_message_parse_error(msg, &error, &debug);
+      eventType = GSTREAMER_SEND_EVENT_ERROR;
+    } else {
+      gst_message_parse_warning(msg, &error, &debug);
+      eventType = GSTREAMER_SEND_EVENT_WARNING;
+    }
     g_free(debug);
 
-    g_printerr("Error: %s\n", error->message);
+    goHandlePipelineEvent(pipelineId, eventType, GST_OBJECT_NAME(GST_MESSAGE_SRC(msg)), error->message, 0, 0);
     g_error_free(error);
-    exit(1);
+    break;
   }
+
+  case GST_MESSAGE_STATE_CHANGED:
+    // only the state of the pipeline itself, not of every element
+    if (GST_IS_PIPELINE(GST_MESSAGE_SRC(msg))) {
+      GstState oldState, newState;
+      gst_message_parse_state_changed(msg, &oldState, &newState, NULL);
+      goHandlePipelineEvent(pipelineId, GSTREAMER_SEND_EVENT_STATE_CHANGED, NULL, NULL, oldState, newState);
+    }
+    break;
+
   default:
     break;
   }
@@ -59,25 +79,47 @@ GstFlowReturn gstreamer_send_new_sample_handler(GstElement *object, gpointer use
   return GST_FLOW_OK;
 }
 
-GstElement *gstreamer_send_create_pipeline(char *pipeline) {
+GstElement *gstreamer_send_create_pipeline(char *pipeline, char **errorMessage) {
   gst_init(NULL, NULL);
   GError *error = NULL;
-  return gst_parse_launch(pipeline, &error);
+  GstElement *element = gst_parse_launch(pipeline, &error);
+  if (error != NULL) {
+    // gst_parse_launch may return a pipeline with a recoverable error, e.g. a missing property,
+    // which is treated as a failure as well
+    *errorMessage = g_strdup(error->message);
+    g_error_free(error);
+    if (element != NULL) {
+      gst_object_unref(element);
+    }
+    return NULL;
+  }
+  return element;
 }
 
-void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId) {
-  SampleHandlerUserData *s = calloc(1, sizeof(SampleHandlerUserData));
-  s->pipelineId = pipelineId;
+static void gstreamer_send_free_user_data(gpointer data, GClosure *closure) {
+  free(data);
+}
 
+void gstreamer_send_register_pipeline(GstElement *pipeline, int pipelineId) {
   GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
-  gst_bus_add_watch(bus, gstreamer_send_bus_call, NULL);
+  gst_bus_add_watch(bus, gstreamer_send_bus_call, GINT_TO_POINTER(pipelineId));
   gst_object_unref(bus);
 
+  // a pipeline ending with a network sink, e.g. a restream pipeline, has no appsink
   GstElement *appsink = gst_bin_get_by_name(GST_BIN(pipeline), "appsink");
+  if (appsink == NULL) {
+    return;
+  }
+
+  // the user data is freed by the closure when the handler is disconnected in gstreamer_send_destroy_pipeline
+  SampleHandlerUserData *s = calloc(1, sizeof(SampleHandlerUserData));
+  s->pipelineId = pipelineId;
   g_object_set(appsink, "emit-signals", TRUE, NULL);
-  g_signal_connect(appsink, "new-sample", G_CALLBACK(gstreamer_send_new_sample_handler), s);
+  g_signal_connect_data(appsink, "new-sample", G_CALLBACK(gstreamer_send_new_sample_handler), s, gstreamer_send_free_user_data, 0);
   gst_object_unref(appsink);
+}
 
+void gstreamer_send_start_pipeline(GstElement *pipeline) {
   gst_element_set_state(pipeline, GST_STATE_PLAYING);
 }
 
@@ -85,4 +127,112 @@ void gstreamer_send_stop_pipeline(GstElement *pipeline) {
   gst_element_set_state(pipeline, GST_STATE_NULL);
 }
 
+void gstreamer_send_destroy_pipeline(GstElement *pipeline) {
+  // the streaming threads have stopped when the state has changed to NULL,
+  // so that no sample is handled after the handler is disconnected
+  gst_element_set_state(pipeline, GST_STATE_NULL);
+
+  GstBus *bus = gst_pipeline_get_bus(GST_PIPELINE(pipeline));
+  gst_bus_remove_watch(bus);
+  gst_object_unref(bus);
+
+  GstElement *appsink = gst_bin_get_by_name(GST_BIN(pipeline), "appsink");
+  if (appsink != NULL) {
+    g_signal_handlers_disconnect_matched(appsink, G_SIGNAL_MATCH_FUNC, 0, 0, NULL, G_CALLBACK(gstreamer_send_new_sample_handler), NULL);
+    gst_object_unref(appsink);
+  }
+
+  gst_object_unref(pipeline);
+}
 
+int gstreamer_send_set_encoder_property(GstElement *pipeline, char *property, int value) {
+  GstElement *encoder = gst_bin_get_by_name(GST_BIN(pipeline), "encoder");
+  if (encoder == NULL) {
+    return 0;
+  }
+
+  // the type of the property differs between encoders (gint, guint), so let GObject transform it
+  GValue v = G_VALUE_INIT;
+  g_value_init(&v, G_TYPE_INT);
+  g_value_set_int(&v, value);
+  g_object_set_property(G_OBJECT(encoder), property, &v);
+  g_value_unset(&v);
+
+  gst_object_unref(encoder);
+  return 1;
+}
+
+int gstreamer_send_get_source_size(GstElement *pipeline, int *width, int *height) {
+  int found = 0;
+  GstElement *scaler = gst_bin_get_by_name(GST_BIN(pipeline), "scaler");
+  if (scaler == NULL) {
+    return 0;
+  }
+
+  GstPad *pad = gst_element_get_static_pad(scaler, "sink");
+  GstCaps *caps = gst_pad_get_current_caps(pad);
+  if (caps != NULL) {
+    GstStructure *structure = gst_caps_get_structure(caps, 0);
+    if (gst_structure_get_int(structure, "width", width) && gst_structure_get_int(structure, "height", height)) {
+      found = 1;
+    }
+    gst_caps_unref(caps);
+  }
+
+  gst_object_unref(pad);
+  gst_object_unref(scaler);
+  return found;
+}
+
+void gstreamer_send_set_video_caps(GstElement *pipeline, int width, int height, int frame_rate) {
+  GstElement *scale = gst_bin_get_by_name(GST_BIN(pipeline), "scale");
+  if (scale == NULL) {
+    return;
+  }
+
+  // 0 leaves the field unconstrained so that the value of the source is kept
+  GstCaps *caps = gst_caps_new_empty_simple("video/x-raw");
+  if (width > 0 && height > 0) {
+    gst_caps_set_simple(caps, "width", G_TYPE_INT, width, "height", G_TYPE_INT, height, NULL);
+  }
+  if (frame_rate > 0) {
+    gst_caps_set_simple(caps, "framerate", GST_TYPE_FRACTION, frame_rate, 1, NULL);
+  }
+  g_object_set(scale, "caps", caps, NULL);
+  gst_caps_unref(caps);
+  gst_object_unref(scale);
+}
+
+int gstreamer_send_force_key_unit(GstElement *pipeline) {
+  GstElement *encoder = gst_bin_get_by_name(GST_BIN(pipeline), "encoder");
+  if (encoder == NULL) {
+    return 0;
+  }
+
+  // the upstream event is handled on the source pad of the encoder, which encodes the next frame as a key frame
+  GstPad *pad = gst_element_get_static_pad(encoder, "src");
+  gst_pad_send_event(pad, gst_video_event_new_upstream_force_key_unit(GST_CLOCK_TIME_NONE, TRUE, 0));
+  gst_object_unref(pad);
+  gst_object_unref(encoder);
+  return 1;
+}
+
+int gstreamer_send_get_state(GstElement *pipeline) {
+  GstState state = GST_STATE_VOID_PENDING;
+  gst_element_get_state(pipeline, &state, NULL, 0);
+  return state;
+}
+
+int gstreamer_send_push_buffer(GstElement *pipeline, char *name, void *buffer, int len) {
+  GstElement *src = gst_bin_get_by_name(GST_BIN(pipeline), name);
+  if (src == NULL) {
+    free(buffer);
+    return 0;
+  }
+
+  // the buffer allocated by Go (malloc) is owned by the GstBuffer and freed with it
+  GstBuffer *b = gst_buffer_new_wrapped_full(0, buffer, len, 0, len, buffer, free);
+  gst_app_src_push_buffer(GST_APP_SRC(src), b);
+  gst_object_unref(src);
+  return 1;
+}
@@ -1,20 +1,29 @@
 // Package gst provides an easy API to create an appsink pipeline
+//
+// The source of a pipeline is a GStreamer element generating raw media, e.g.
+// videotestsrc, or the RTP packets pushed by Push and decoded by the elements
+// returned by RTPSource, so that received video can be transcoded.
+//
+// A Pipeline is created by CreatePipeline, started and stopped any number of
+// times by Start and Stop, and released by Destroy, which removes it from the
+// registry of pipelines and frees its native resources.
 package gst
 
 /*
-#cgo pkg-config: gstreamer-1.0 gstreamer-app-1.0
+#cgo pkg-config: gstreamer-1.0 gstreamer-app-1.0 gstreamer-video-1.0
 
 #include "gst.h"
 
 */
 import "C"
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
 
-	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 )
 
@@ -22,48 +31,204 @@ func init() {
 	go C.gstreamer_send_start_mainloop()
 }
 
+// SampleWriter is written the encoded samples of a Pipeline, e.g. *webrtc.TrackLocalStaticSample
+type SampleWriter interface {
+	WriteSample(sample media.Sample) error
+}
+
 // Pipeline is a wrapper for a GStreamer Pipeline
 type Pipeline struct {
 	Pipeline  *C.GstElement
-	tracks    []*webrtc.TrackLocalStaticSample
+	tracks    []SampleWriter
 	id        int
 	codecName string
 	clockRate float32
+
+	// mu guards the video settings applied to the "scale" capsfilter
+	mu sync.Mutex
+	// bitrate is the bitrate set by SetBitrate, 0 until it is called
+	bitrate int
+	// width and height are set by SetResolution. The resolution follows the bitrate when they are 0.
+	width  int
+	height int
+	// frameRate is set by SetFrameRate. The frame rate of the source is kept when it is 0.
+	frameRate int
+
+	// lifecycleLock guards the GstElement against Destroy
+	lifecycleLock sync.RWMutex
+	destroyed     bool
+
+	eventLock sync.Mutex
+	onEvent   func(Event)
+}
+
+// EventType is the type of an Event
+type EventType int
+
+// Event types, in the same order as GstreamerSendEventType in gst.h
+const (
+	// EventError is an error of an element. The pipeline does not produce samples any more
+	// and has to be stopped, and can be created again.
+	EventError EventType = iota
+	// EventWarning is a warning of an element. The pipeline keeps running.
+	EventWarning
+	// EventEOS is the end of the stream, e.g. the end of a file source
+	EventEOS
+	// EventStateChanged is a change of the state of the pipeline
+	EventStateChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventError:
+		return "error"
+	case EventWarning:
+		return "warning"
+	case EventEOS:
+		return "eos"
+	case EventStateChanged:
+		return "state-changed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a message of the GStreamer bus of a Pipeline
+type Event struct {
+	Type EventType
+	// Source is the name of the element which posted an error or a warning
+	Source string
+	// Message is the message of an error or a warning
+	Message string
+	// OldState and NewState are the states of a state change
+	OldState State
+	NewState State
+}
+
+// State is the state of a GStreamer Pipeline
+type State int
+
+// States of a Pipeline, the same as GstState
+const (
+	StateVoidPending State = iota
+	StateNull
+	StateReady
+	StatePaused
+	StatePlaying
+)
+
+func (s State) String() string {
+	switch s {
+	case StateVoidPending:
+		return "void-pending"
+	case StateNull:
+		return "null"
+	case StateReady:
+		return "ready"
+	case StatePaused:
+		return "paused"
+	case StatePlaying:
+		return "playing"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
 }
 
+// ErrDestroyed is returned by the methods of a Pipeline which has been destroyed
+var ErrDestroyed = errors.New("the pipeline has been destroyed")
+
+// pipelines is the registry of the pipelines which have not been destroyed, keyed by id.
+// The id is passed to the C callbacks to find the Pipeline.
 var pipelines = make(map[int]*Pipeline)
 var pipelinesLock sync.Mutex
 
+// nextPipelineID is the id of the next Pipeline. Ids are not reused after Destroy
+// so that a callback of a destroyed pipeline is not delivered to another one.
+var nextPipelineID int
+
+// videoScale scales the raw video and changes its frame rate to the caps of the "scale" capsfilter,
+// which are set by SetBitrate, SetResolution and SetFrameRate
+const videoScale = "videoscale name=scaler ! videorate ! capsfilter name=scale"
+
+// rtpDecoders are the elements depayloading and decoding the RTP packets of RTPSource, by codec
+var rtpDecoders = map[string]struct {
+	encodingName string
+	elements     string
+}{
+	"video/vp8":  {encodingName: "VP8", elements: "rtpvp8depay ! vp8dec"},
+	"video/vp9":  {encodingName: "VP9", elements: "rtpvp9depay ! vp9dec"},
+	"video/h264": {encodingName: "H264", elements: "rtph264depay ! h264parse ! avdec_h264"},
+}
+
+// rtpSourceName is the name of the appsrc of RTPSource
+const rtpSourceName = "src"
+
+// rtpLatency is the latency of the jitter buffer reordering the RTP packets of RTPSource in milliseconds
+const rtpLatency = 100
+
 const (
 	videoClockRate = 90000
 	audioClockRate = 48000
 	pcmClockRate   = 8000
 )
 
-// CreatePipeline creates a GStreamer Pipeline
-func CreatePipeline(codecName string, tracks []*webrtc.TrackLocalStaticSample, pipelineSrc string) *Pipeline {
+// resolutions is the resolution of video pipelines at a target bitrate,
+// as a divisor of the resolution of the source. See Pipeline.SetBitrate.
+var resolutions = []struct {
+	minBitrate int
+	divisor    int
+}{
+	{minBitrate: 1000000, divisor: 1},
+	{minBitrate: 500000, divisor: 2},
+	{minBitrate: 0, divisor: 4},
+}
+
+// opusenc accepts bitrates between 4kbps and 650kbps
+const (
+	opusMinBitrate = 4000
+	opusMaxBitrate = 650000
+)
+
+// RTPSource returns the source of a pipeline which decodes the video RTP packets
+// pushed by Push to raw video, e.g. to transcode VP8 to H.264 with CreatePipeline("h264", ...).
+// mimeType is the MIME type of the received codec, e.g. video/VP8.
+func RTPSource(mimeType string, payloadType uint8) (string, error) {
+	decoder, ok := rtpDecoders[strings.ToLower(mimeType)]
+	if !ok {
+		return "", fmt.Errorf("%s cannot be decoded", mimeType)
+	}
+	// 受信した時刻をタイムスタンプにし、並べ替えはrtpjitterbufferに任せる
+	return fmt.Sprintf("appsrc name=%s format=time is-live=true do-timestamp=true ! application/x-rtp,media=video,clock-rate=%d,encoding-name=%s,payload=%d ! rtpjitterbuffer latency=%d ! %s ! videoconvert",
+		rtpSourceName, videoClockRate, decoder.encodingName, payloadType, rtpLatency, decoder.elements), nil
+}
+
+// CreatePipeline creates a GStreamer Pipeline.
+// The encoder is named "encoder" and video is scaled by the "scaler" and "scale"
+// elements so that the encoder settings can be changed while the pipeline is running.
+// An error is returned when the pipeline cannot be parsed.
+func CreatePipeline(codecName string, tracks []SampleWriter, pipelineSrc string) (*Pipeline, error) {
 	pipelineStr := "appsink name=appsink"
 	var clockRate float32
 
 	switch codecName {
 	case "vp8":
-		pipelineStr = pipelineSrc + " ! vp8enc error-resilient=partitions keyframe-max-dist=10 auto-alt-ref=true cpu-used=5 deadline=1 ! " + pipelineStr
+		pipelineStr = pipelineSrc + " ! " + videoScale + " ! vp8enc name=encoder error-resilient=partitions keyframe-max-dist=10 auto-alt-ref=true cpu-used=5 deadline=1 ! " + pipelineStr
 		clockRate = videoClockRate
 
 	case "vp9":
-		pipelineStr = pipelineSrc + " ! vp9enc ! " + pipelineStr
+		pipelineStr = pipelineSrc + " ! " + videoScale + " ! vp9enc name=encoder ! " + pipelineStr
 		clockRate = videoClockRate
 
 	case "h264":
-		pipelineStr = pipelineSrc + " ! video/x-raw,format=I420 ! x264enc speed-preset=ultrafast tune=zerolatency key-int-max=20 ! video/x-h264,stream-format=byte-stream ! " + pipelineStr
+		pipelineStr = pipelineSrc + " ! " + videoScale + " ! video/x-raw,format=I420 ! x264enc name=encoder speed-preset=ultrafast tune=zerolatency key-int-max=20 ! video/x-h264,stream-format=byte-stream ! " + pipelineStr
 		clockRate = videoClockRate
 
 	case "opus":
-		pipelineStr = pipelineSrc + " ! opusenc ! " + pipelineStr
+		pipelineStr = pipelineSrc + " ! opusenc name=encoder ! " + pipelineStr
 		clockRate = audioClockRate
 
 	case "g722":
-		pipelineStr = pipelineSrc + " ! avenc_g722 ! " + pipelineStr
+		pipelineStr = pipelineSrc + " ! avenc_g722 name=encoder ! " + pipelineStr
 		clockRate = audioClockRate
 
 	case "pcmu":
@@ -75,37 +240,265 @@ func CreatePipeline(codecName string, tracks []*webrtc.TrackLocalStaticSample, p
 		clockRate = pcmClockRate
 
 	default:
-		panic("Unhandled codec " + codecName)
+		return nil, fmt.Errorf("unhandled codec %s", codecName)
 	}
+	return createPipeline(pipelineStr, codecName, clockRate, tracks)
+}
 
+// createPipeline parses pipelineStr and registers the pipeline, so that its samples
+// are written to tracks and its events are delivered to the OnEvent handler
+func createPipeline(pipelineStr string, codecName string, clockRate float32, tracks []SampleWriter) (*Pipeline, error) {
 	pipelineStrUnsafe := C.CString(pipelineStr)
 	defer C.free(unsafe.Pointer(pipelineStrUnsafe))
 
+	var errorMessage *C.char
+	element := C.gstreamer_send_create_pipeline(pipelineStrUnsafe, &errorMessage)
+	if element == nil {
+		defer C.g_free(C.gpointer(unsafe.Pointer(errorMessage)))
+		return nil, fmt.Errorf("failed to create the pipeline %q: %s", pipelineStr, C.GoString(errorMessage))
+	}
+
 	pipelinesLock.Lock()
 	defer pipelinesLock.Unlock()
 
 	pipeline := &Pipeline{
-		Pipeline:  C.gstreamer_send_create_pipeline(pipelineStrUnsafe),
+		Pipeline:  element,
 		tracks:    tracks,
-		id:        len(pipelines),
+		id:        nextPipelineID,
 		codecName: codecName,
 		clockRate: clockRate,
 	}
 
+	nextPipelineID++
 	pipelines[pipeline.id] = pipeline
-	return pipeline
+	// バスのメッセージはOnEventのハンドラに、サンプルはtracksに渡す
+	C.gstreamer_send_register_pipeline(element, C.int(pipeline.id))
+	return pipeline, nil
 }
 
-// Start starts the GStreamer Pipeline
+// OnEvent sets a handler which is called with the errors, warnings, EOS and state changes
+// posted on the bus of the pipeline, and with warnings when a sample cannot be written.
+// The handler is called on the GLib main loop or a streaming thread and must not block.
+func (p *Pipeline) OnEvent(f func(Event)) {
+	p.eventLock.Lock()
+	defer p.eventLock.Unlock()
+	p.onEvent = f
+}
+
+func (p *Pipeline) handleEvent(event Event) {
+	p.eventLock.Lock()
+	onEvent := p.onEvent
+	p.eventLock.Unlock()
+
+	if onEvent != nil {
+		onEvent(event)
+	}
+}
+
+// Start starts the GStreamer Pipeline. A stopped pipeline can be started again.
+// It does nothing after Destroy.
 func (p *Pipeline) Start() {
-	C.gstreamer_send_start_pipeline(p.Pipeline, C.int(p.id))
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return
+	}
+	C.gstreamer_send_start_pipeline(p.Pipeline)
 }
 
-// Stop stops the GStreamer Pipeline
+// Stop stops the GStreamer Pipeline. It does nothing after Destroy.
 func (p *Pipeline) Stop() {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return
+	}
 	C.gstreamer_send_stop_pipeline(p.Pipeline)
 }
 
+// Destroy stops the GStreamer Pipeline if it is running, removes it from the registry
+// and frees it. No sample or event is delivered after Destroy returns, and calling it
+// again does nothing.
+func (p *Pipeline) Destroy() {
+	p.lifecycleLock.Lock()
+	defer p.lifecycleLock.Unlock()
+	if p.destroyed {
+		return
+	}
+	p.destroyed = true
+
+	// 先にストリーミングスレッドを止めてから登録を解除する
+	C.gstreamer_send_destroy_pipeline(p.Pipeline)
+	p.Pipeline = nil
+
+	pipelinesLock.Lock()
+	delete(pipelines, p.id)
+	pipelinesLock.Unlock()
+}
+
+// State returns the current state of the pipeline, StateNull after Destroy
+func (p *Pipeline) State() State {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return StateNull
+	}
+	return State(C.gstreamer_send_get_state(p.Pipeline))
+}
+
+// RequestKeyFrame asks the encoder to produce a key frame, e.g. when a PLI or FIR is received
+func (p *Pipeline) RequestKeyFrame() error {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return ErrDestroyed
+	}
+	if C.gstreamer_send_force_key_unit(p.Pipeline) == 0 {
+		return fmt.Errorf("the pipeline has no %s encoder", p.codecName)
+	}
+	return nil
+}
+
+// SetBitrate sets the target bitrate of the encoder in bits per second while the pipeline is running.
+// Unless the resolution is set by SetResolution, video pipelines are also scaled down to 1/2 or 1/4
+// of the source resolution at low bitrates so that the encoder does not run out of bits.
+func (p *Pipeline) SetBitrate(bitrate int) error {
+	var property string
+	value := bitrate
+	switch p.codecName {
+	case "vp8", "vp9":
+		property = "target-bitrate"
+	case "h264":
+		// x264encのbitrateはkbit/s
+		property = "bitrate"
+		value = bitrate / 1000
+		if value < 1 {
+			value = 1
+		}
+	case "opus":
+		property = "bitrate"
+		if value < opusMinBitrate {
+			value = opusMinBitrate
+		} else if value > opusMaxBitrate {
+			value = opusMaxBitrate
+		}
+	default:
+		return fmt.Errorf("the bitrate of %s cannot be changed", p.codecName)
+	}
+
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return ErrDestroyed
+	}
+
+	propertyUnsafe := C.CString(property)
+	defer C.free(unsafe.Pointer(propertyUnsafe))
+	if C.gstreamer_send_set_encoder_property(p.Pipeline, propertyUnsafe, C.int(value)) == 0 {
+		return fmt.Errorf("the pipeline has no %s encoder", p.codecName)
+	}
+
+	if p.clockRate == videoClockRate {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.bitrate = bitrate
+		p.applyVideoCaps()
+	}
+	return nil
+}
+
+// SetResolution scales the video to width x height while the pipeline is running.
+// Passing 0 for both lets the resolution follow the bitrate again (see SetBitrate).
+func (p *Pipeline) SetResolution(width, height int) error {
+	if p.clockRate != videoClockRate {
+		return fmt.Errorf("the resolution of %s cannot be changed", p.codecName)
+	}
+	if width < 0 || height < 0 || (width == 0) != (height == 0) {
+		return fmt.Errorf("invalid resolution %dx%d", width, height)
+	}
+
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return ErrDestroyed
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// I420は幅と高さが偶数である必要がある
+	p.width = width &^ 1
+	p.height = height &^ 1
+	p.applyVideoCaps()
+	return nil
+}
+
+// SetFrameRate changes the frame rate of the video while the pipeline is running.
+// Passing 0 keeps the frame rate of the source.
+func (p *Pipeline) SetFrameRate(frameRate int) error {
+	if p.clockRate != videoClockRate {
+		return fmt.Errorf("the frame rate of %s cannot be changed", p.codecName)
+	}
+	if frameRate < 0 {
+		return fmt.Errorf("invalid frame rate %d", frameRate)
+	}
+
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return ErrDestroyed
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frameRate = frameRate
+	p.applyVideoCaps()
+	return nil
+}
+
+// applyVideoCaps sets the resolution and the frame rate to the "scale" capsfilter.
+// It is called with p.mu and a read lock of p.lifecycleLock held.
+// The resolution following the bitrate is not changed until the resolution of the source has been negotiated.
+func (p *Pipeline) applyVideoCaps() {
+	width, height := p.width, p.height
+	if width == 0 && p.bitrate != 0 {
+		var sourceWidth, sourceHeight C.int
+		if C.gstreamer_send_get_source_size(p.Pipeline, &sourceWidth, &sourceHeight) != 0 {
+			divisor := resolutions[len(resolutions)-1].divisor
+			for _, r := range resolutions {
+				if p.bitrate >= r.minBitrate {
+					divisor = r.divisor
+					break
+				}
+			}
+			// I420は幅と高さが偶数である必要がある
+			width = int(sourceWidth) / divisor &^ 1
+			height = int(sourceHeight) / divisor &^ 1
+		}
+	}
+	C.gstreamer_send_set_video_caps(p.Pipeline, C.int(width), C.int(height), C.int(p.frameRate))
+}
+
+// Push pushes an RTP packet to the source of a pipeline created with RTPSource
+func (p *Pipeline) Push(packet []byte) error {
+	return p.PushTo(rtpSourceName, packet)
+}
+
+// PushTo pushes an RTP packet to the appsrc named name, e.g. RestreamVideo of a restream pipeline
+func (p *Pipeline) PushTo(name string, packet []byte) error {
+	p.lifecycleLock.RLock()
+	defer p.lifecycleLock.RUnlock()
+	if p.destroyed {
+		return ErrDestroyed
+	}
+	nameUnsafe := C.CString(name)
+	defer C.free(unsafe.Pointer(nameUnsafe))
+	// Cで確保したバッファーはGstBufferと一緒に解放される
+	if C.gstreamer_send_push_buffer(p.Pipeline, nameUnsafe, C.CBytes(packet), C.int(len(packet))) == 0 {
+		return fmt.Errorf("the pipeline has no RTP source %q", name)
+	}
+	return nil
+}
+
 //export goHandlePipelineBuffer
 func goHandlePipelineBuffer(buffer unsafe.Pointer, bufferLen C.int, duration C.int, pipelineID C.int) {
 	pipelinesLock.Lock()
@@ -115,7 +508,7 @@ func goHandlePipelineBuffer(buffer unsafe.Pointer, bufferLen C.int, duration C.i
 	if ok {
 		for _, t := range pipeline.tracks {
 			if err := t.WriteSample(media.Sample{Data: C.GoBytes(buffer, bufferLen), Duration: time.Duration(duration)}); err != nil {
-				panic(err)
+				pipeline.handleEvent(Event{Type: EventWarning, Source: "appsink", Message: fmt.Sprintf("failed to write a sample: %s", err)})
 			}
 		}
 	} else {
@@ -123,3 +516,21 @@ func goHandlePipelineBuffer(buffer unsafe.Pointer, bufferLen C.int, duration C.i
 	}
 	C.free(buffer)
 }
+
+//export goHandlePipelineEvent
+func goHandlePipelineEvent(pipelineID C.int, eventType C.int, source *C.char, message *C.char, oldState C.int, newState C.int) {
+	pipelinesLock.Lock()
+	pipeline, ok := pipelines[int(pipelineID)]
+	pipelinesLock.Unlock()
+
+	if !ok {
+		return
+	}
+	pipeline.handleEvent(Event{
+		Type:     EventType(eventType),
+		Source:   C.GoString(source),
+		Message:  C.GoString(message),
+		OldState: State(oldState),
+		NewState: State(newState),
+	})
+}
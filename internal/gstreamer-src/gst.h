@@ -6,11 +6,28 @@
 #include <stdint.h>
 #include <stdlib.h>
 
+// the types of the events delivered to goHandlePipelineEvent, in the same order as gst.EventType
+typedef enum {
+  GSTREAMER_SEND_EVENT_ERROR,
+  GSTREAMER_SEND_EVENT_WARNING,
+  GSTREAMER_SEND_EVENT_EOS,
+  GSTREAMER_SEND_EVENT_STATE_CHANGED,
+} GstreamerSendEventType;
+
 extern void goHandlePipelineBuffer(void *buffer, int bufferLen, int samples, int pipelineId);
+extern void goHandlePipelineEvent(int pipelineId, int eventType, char *source, char *message, int oldState, int newState);
 
-GstElement *gstreamer_send_create_pipeline(char *pipeline);
-void gstreamer_send_start_pipeline(GstElement *pipeline, int pipelineId);
+GstElement *gstreamer_send_create_pipeline(char *pipeline, char **errorMessage);
+void gstreamer_send_register_pipeline(GstElement *pipeline, int pipelineId);
+void gstreamer_send_start_pipeline(GstElement *pipeline);
 void gstreamer_send_stop_pipeline(GstElement *pipeline);
+void gstreamer_send_destroy_pipeline(GstElement *pipeline);
+int gstreamer_send_set_encoder_property(GstElement *pipeline, char *property, int value);
+int gstreamer_send_get_source_size(GstElement *pipeline, int *width, int *height);
+void gstreamer_send_set_video_caps(GstElement *pipeline, int width, int height, int frame_rate);
+int gstreamer_send_force_key_unit(GstElement *pipeline);
+int gstreamer_send_get_state(GstElement *pipeline);
+int gstreamer_send_push_buffer(GstElement *pipeline, char *name, void *buffer, int len);
 void gstreamer_send_start_mainloop(void);
 
 #endif
@@ -0,0 +1,218 @@
+package gst
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+)
+
+// testSrc is a small live source so that the pipelines produce samples quickly
+const testSrc = "videotestsrc is-live=true ! video/x-raw,width=64,height=48,framerate=30/1"
+
+// countingWriter counts the written samples
+type countingWriter struct {
+	samples int64
+}
+
+func (w *countingWriter) WriteSample(sample media.Sample) error {
+	atomic.AddInt64(&w.samples, 1)
+	return nil
+}
+
+func (w *countingWriter) count() int64 {
+	return atomic.LoadInt64(&w.samples)
+}
+
+// waitForSamples waits until more than n samples have been written
+func waitForSamples(t *testing.T, w *countingWriter, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.count() <= n {
+		if time.Now().After(deadline) {
+			t.Fatalf("no sample has been written after %d samples", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func registered() int {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+	return len(pipelines)
+}
+
+func TestPipelineLifecycle(t *testing.T) {
+	before := registered()
+	writer := &countingWriter{}
+	pipeline, err := CreatePipeline("vp8", []SampleWriter{writer}, testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered() != before+1 {
+		t.Fatalf("the pipeline is not registered")
+	}
+
+	// 停止したパイプラインは再び開始できる
+	pipeline.Start()
+	waitForSamples(t, writer, 0)
+	pipeline.Stop()
+	pipeline.Start()
+	waitForSamples(t, writer, writer.count())
+
+	pipeline.Destroy()
+	if registered() != before {
+		t.Fatalf("the pipeline is still registered after Destroy")
+	}
+
+	// 破棄した後はサンプルが届かず、操作はErrDestroyedを返す
+	n := writer.count()
+	time.Sleep(100 * time.Millisecond)
+	if writer.count() != n {
+		t.Errorf("%d samples have been written after Destroy", writer.count()-n)
+	}
+	if err := pipeline.SetBitrate(500000); err != ErrDestroyed {
+		t.Errorf("SetBitrate after Destroy returned %v", err)
+	}
+	if err := pipeline.RequestKeyFrame(); err != ErrDestroyed {
+		t.Errorf("RequestKeyFrame after Destroy returned %v", err)
+	}
+	if state := pipeline.State(); state != StateNull {
+		t.Errorf("State after Destroy returned %s", state)
+	}
+	pipeline.Start()
+	pipeline.Stop()
+	pipeline.Destroy()
+}
+
+func TestCreatePipelineError(t *testing.T) {
+	before := registered()
+	if _, err := CreatePipeline("vp8", nil, "nosuchelement"); err == nil {
+		t.Error("no error for an unknown element")
+	}
+	if _, err := CreatePipeline("nosuchcodec", nil, testSrc); err == nil {
+		t.Error("no error for an unknown codec")
+	}
+	if _, err := RTPSource("video/nosuchcodec", 96); err == nil {
+		t.Error("no error for an RTP source of an unknown codec")
+	}
+	if registered() != before {
+		t.Errorf("a pipeline which failed to be created is registered")
+	}
+}
+
+// TestTranscode pushes the VP8 RTP packets of the test source to a pipeline
+// encoding to H.264, and checks that the transcoded samples are written
+func TestTranscode(t *testing.T) {
+	src, err := RTPSource("video/VP8", 96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &countingWriter{}
+	pipeline, err := CreatePipeline("h264", []SampleWriter{writer}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Destroy()
+	if err := pipeline.SetResolution(32, 24); err != nil {
+		t.Fatal(err)
+	}
+	pipeline.Start()
+
+	video, err := testsrc.NewVideo(testsrc.Config{Width: 64, Height: 48, FrameRate: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetizer := rtp.NewPacketizer(1200, 96, 1, &codecs.VP8Payloader{}, rtp.NewRandomSequencer(), 90000)
+	deadline := time.Now().Add(5 * time.Second)
+	for writer.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no transcoded sample has been written")
+		}
+		frame, err := video.Next(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, packet := range packetizer.Packetize(frame, 90000/30) {
+			buf, err := packet.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pipeline.Push(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(33 * time.Millisecond)
+	}
+
+	// RTPSourceを使わないパイプラインにはパケットを渡せない
+	other, err := CreatePipeline("vp8", nil, testSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Destroy()
+	if err := other.Push([]byte{0x80}); err == nil {
+		t.Error("no error for a pipeline without an RTP source")
+	}
+	pipeline.Destroy()
+	if err := pipeline.Push([]byte{0x80}); err != ErrDestroyed {
+		t.Errorf("Push after Destroy returned %v", err)
+	}
+}
+
+// TestPipelineStress cycles hundreds of pipelines through Create, Start, Stop and Destroy
+// concurrently, and checks that the ids are unique and every pipeline is unregistered
+func TestPipelineStress(t *testing.T) {
+	const workers = 4
+	cycles := 100
+	if testing.Short() {
+		cycles = 10
+	}
+
+	before := registered()
+	var mu sync.Mutex
+	ids := map[int]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < cycles; j++ {
+				writer := &countingWriter{}
+				pipeline, err := CreatePipeline("vp8", []SampleWriter{writer}, testSrc)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mu.Lock()
+				duplicated := ids[pipeline.id]
+				ids[pipeline.id] = true
+				mu.Unlock()
+				if duplicated {
+					t.Errorf("the id %d is duplicated", pipeline.id)
+				}
+
+				pipeline.Start()
+				// 一部のパイプラインは停止せずに破棄する
+				if j%2 == 0 {
+					pipeline.Stop()
+				}
+				pipeline.Destroy()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(ids) != workers*cycles {
+		t.Errorf("%d pipelines have been created, expected %d", len(ids), workers*cycles)
+	}
+	if registered() != before {
+		t.Errorf("%d pipelines are still registered", registered()-before)
+	}
+}
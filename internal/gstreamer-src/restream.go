@@ -0,0 +1,132 @@
+package gst
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Names of the appsrc elements of a restream pipeline, to be passed to PushTo
+const (
+	RestreamVideo = "video"
+	RestreamAudio = "audio"
+)
+
+// restreamAudioBitrate is the bitrate of the AAC audio of a restream pipeline
+const restreamAudioBitrate = 128000
+
+// restreamKeyFrameInterval is the maximum number of frames between the key frames
+// of the video transcoded to H.264, so that viewers can join within a few seconds
+const restreamKeyFrameInterval = 60
+
+// rtpAudioDecoders are the elements depayloading and decoding the audio RTP packets of a restream pipeline, by codec
+var rtpAudioDecoders = map[string]struct {
+	encodingName string
+	clockRate    int
+	elements     string
+}{
+	"audio/opus": {encodingName: "OPUS", clockRate: audioClockRate, elements: "rtpopusdepay ! opusdec"},
+	"audio/pcmu": {encodingName: "PCMU", clockRate: pcmClockRate, elements: "rtppcmudepay ! mulawdec"},
+	"audio/pcma": {encodingName: "PCMA", clockRate: pcmClockRate, elements: "rtppcmadepay ! alawdec"},
+}
+
+// restreamOutputs are the muxer and the sink of a restream pipeline by the scheme or the extension of the output.
+// The sink is a format string of the output.
+var restreamOutputs = []struct {
+	match func(output string) bool
+	mux   string
+	sink  string
+}{
+	{
+		match: func(output string) bool {
+			return strings.HasPrefix(output, "rtmp://") || strings.HasPrefix(output, "rtmps://")
+		},
+		mux: "flvmux name=mux streamable=true",
+		// librtmpのオプションで、ライブ配信として送信する
+		sink: `rtmpsink location="%s live=1"`,
+	},
+	{
+		match: func(output string) bool { return strings.HasPrefix(output, "srt://") },
+		mux:   "mpegtsmux name=mux alignment=7",
+		sink:  `srtsink uri="%s"`,
+	},
+	{
+		match: func(output string) bool { return strings.EqualFold(filepath.Ext(output), ".flv") },
+		mux:   "flvmux name=mux streamable=true",
+		sink:  `filesink location="%s"`,
+	},
+	{
+		match: func(output string) bool { return strings.EqualFold(filepath.Ext(output), ".ts") },
+		mux:   "mpegtsmux name=mux",
+		sink:  `filesink location="%s"`,
+	},
+}
+
+// CreateRestreamPipeline creates a pipeline which muxes the video RTP packets pushed to RestreamVideo
+// and the audio RTP packets pushed to RestreamAudio, and sends them to output:
+//
+//   - rtmp://... or rtmps://...: FLV to an RTMP server
+//   - srt://...: MPEG-TS to an SRT listener
+//   - a path ending with .flv or .ts: a file
+//
+// The video is sent as H.264, transcoded from VP8 or VP9 when needed, and the audio as AAC,
+// transcoded from Opus, PCMU or PCMA. A kind is left out when its MIME type is empty.
+// The pipeline has no appsink, so no sample is written.
+func CreateRestreamPipeline(output, videoMimeType, audioMimeType string) (*Pipeline, error) {
+	pipelineStr, err := restreamPipeline(output, videoMimeType, audioMimeType)
+	if err != nil {
+		return nil, err
+	}
+	return createPipeline(pipelineStr, "restream", 0, nil)
+}
+
+// restreamPipeline returns the description of a restream pipeline
+func restreamPipeline(output, videoMimeType, audioMimeType string) (string, error) {
+	if videoMimeType == "" && audioMimeType == "" {
+		return "", errors.New("nothing to restream")
+	}
+	// 出力先はパイプラインの記述に引用符で埋め込むため、区切りになる文字は受け付けない
+	if output == "" || strings.ContainsAny(output, "\"\\ \t\n") {
+		return "", fmt.Errorf("invalid restream output %q", output)
+	}
+
+	var mux, sink string
+	for _, o := range restreamOutputs {
+		if o.match(output) {
+			mux, sink = o.mux, fmt.Sprintf(o.sink, output)
+			break
+		}
+	}
+	if mux == "" {
+		return "", fmt.Errorf("unsupported restream output %q (rtmp://, srt://, .flv or .ts)", output)
+	}
+
+	branches := []string{mux + " ! " + sink}
+	if videoMimeType != "" {
+		var video string
+		if strings.EqualFold(videoMimeType, "video/H264") {
+			// H.264はデコードせずにそのまま多重化する
+			video = fmt.Sprintf("appsrc name=%s format=time is-live=true do-timestamp=true ! application/x-rtp,media=video,clock-rate=%d,encoding-name=H264 ! rtpjitterbuffer latency=%d ! rtph264depay",
+				RestreamVideo, videoClockRate, rtpLatency)
+		} else {
+			decoder, ok := rtpDecoders[strings.ToLower(videoMimeType)]
+			if !ok {
+				return "", fmt.Errorf("%s cannot be restreamed", videoMimeType)
+			}
+			video = fmt.Sprintf("appsrc name=%s format=time is-live=true do-timestamp=true ! application/x-rtp,media=video,clock-rate=%d,encoding-name=%s ! rtpjitterbuffer latency=%d ! %s ! videoconvert ! video/x-raw,format=I420 ! x264enc name=encoder speed-preset=ultrafast tune=zerolatency key-int-max=%d",
+				RestreamVideo, videoClockRate, decoder.encodingName, rtpLatency, decoder.elements, restreamKeyFrameInterval)
+		}
+		// 途中から受信する視聴者のために、キーフレームごとにSPS・PPSを送る
+		branches = append(branches, video+" ! h264parse config-interval=-1 ! queue ! mux.")
+	}
+	if audioMimeType != "" {
+		decoder, ok := rtpAudioDecoders[strings.ToLower(audioMimeType)]
+		if !ok {
+			return "", fmt.Errorf("%s cannot be restreamed", audioMimeType)
+		}
+		branches = append(branches, fmt.Sprintf("appsrc name=%s format=time is-live=true do-timestamp=true ! application/x-rtp,media=audio,clock-rate=%d,encoding-name=%s ! rtpjitterbuffer latency=%d ! %s ! audioconvert ! audioresample ! avenc_aac bitrate=%d ! aacparse ! queue ! mux.",
+			RestreamAudio, decoder.clockRate, decoder.encodingName, rtpLatency, decoder.elements, restreamAudioBitrate))
+	}
+	return strings.Join(branches, " "), nil
+}
@@ -0,0 +1,176 @@
+package gst
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+)
+
+// opusSilence is an Opus frame of 20ms of silence
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+// pushRestream pushes VP8 color bars and Opus silence to a restream pipeline until done returns true
+func pushRestream(t *testing.T, pipeline *Pipeline, done func() bool) {
+	t.Helper()
+	video, err := testsrc.NewVideo(testsrc.Config{Width: 64, Height: 48, FrameRate: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	videoPacketizer := rtp.NewPacketizer(1200, 96, 1, &codecs.VP8Payloader{}, rtp.NewRandomSequencer(), videoClockRate)
+	audioPacketizer := rtp.NewPacketizer(1200, 111, 2, &codecs.OpusPayloader{}, rtp.NewRandomSequencer(), audioClockRate)
+	push := func(name string, packets []*rtp.Packet) {
+		for _, packet := range packets {
+			buf, err := packet.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pipeline.PushTo(name, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing has been restreamed")
+		}
+		frame, err := video.Next(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		push(RestreamVideo, videoPacketizer.Packetize(frame, videoClockRate/30))
+		// 映像の1フレーム(33ms)の間に、音声の20msのフレームを送る
+		push(RestreamAudio, audioPacketizer.Packetize(opusSilence, audioClockRate/50))
+		push(RestreamAudio, audioPacketizer.Packetize(opusSilence, audioClockRate/50))
+		time.Sleep(33 * time.Millisecond)
+	}
+}
+
+func TestRestreamPipeline(t *testing.T) {
+	for _, c := range []struct {
+		output, video, audio string
+		// containsは、パイプラインの記述に含まれる要素です(空の場合はエラーになる)
+		contains []string
+	}{
+		{"rtmp://localhost/live/key", "video/H264", "audio/opus", []string{"flvmux", `rtmpsink location="rtmp://localhost/live/key live=1"`, "rtph264depay ! h264parse", "avenc_aac"}},
+		{"srt://localhost:9000", "video/VP8", "", []string{"mpegtsmux", `srtsink uri="srt://localhost:9000"`, "vp8dec", "x264enc"}},
+		{"out.ts", "", "audio/PCMU", []string{"mpegtsmux", "filesink", "mulawdec"}},
+		{"out.flv", "video/VP9", "audio/opus", []string{"flvmux", "vp9dec", "opusdec"}},
+		{"out.flv", "", "", nil},
+		{"out.mp4", "video/H264", "", nil},
+		{"rtmp://localhost/live/key live=0", "video/H264", "", nil},
+		{"out.flv", "video/AV1", "", nil},
+		{"out.flv", "", "audio/G722", nil},
+	} {
+		pipeline, err := restreamPipeline(c.output, c.video, c.audio)
+		if c.contains == nil {
+			if err == nil {
+				t.Errorf("no error for %q, %q, %q", c.output, c.video, c.audio)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, %q, %q: %v", c.output, c.video, c.audio, err)
+			continue
+		}
+		for _, s := range c.contains {
+			if !strings.Contains(pipeline, s) {
+				t.Errorf("%q does not contain %q", pipeline, s)
+			}
+		}
+	}
+}
+
+// TestRestreamToFile transcodes VP8 and Opus to H.264 and AAC, and checks that an FLV file is written
+func TestRestreamToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "out.flv")
+
+	pipeline, err := CreateRestreamPipeline(output, "video/VP8", "audio/opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Destroy()
+	pipeline.Start()
+
+	// ヘッダーの後にタグが書き込まれるまで送る
+	pushRestream(t, pipeline, func() bool {
+		info, err := os.Stat(output)
+		return err == nil && info.Size() > 1024
+	})
+	pipeline.Destroy()
+
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("FLV")) {
+		t.Errorf("%s is not an FLV file", output)
+	}
+}
+
+// TestRestreamRTMP checks that the pipeline connects to an RTMP server and starts the handshake
+func TestRestreamRTMP(t *testing.T) {
+	// RTMPサーバーの代わりに、ハンドシェイクのC0・C1を受け取るだけのサーバーを立てる
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	handshake := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			handshake <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		c0c1 := make([]byte, 1+1536)
+		if _, err := io.ReadFull(conn, c0c1); err != nil {
+			handshake <- err
+			return
+		}
+		if c0c1[0] != 0x03 {
+			handshake <- io.ErrUnexpectedEOF
+			return
+		}
+		handshake <- nil
+	}()
+
+	pipeline, err := CreateRestreamPipeline("rtmp://"+listener.Addr().String()+"/live/test", "video/VP8", "audio/opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Destroy()
+	pipeline.Start()
+
+	var handshakeErr error
+	received := false
+	pushRestream(t, pipeline, func() bool {
+		select {
+		case handshakeErr = <-handshake:
+			received = true
+		default:
+		}
+		return received
+	})
+	if handshakeErr != nil {
+		t.Fatalf("invalid RTMP handshake: %v", handshakeErr)
+	}
+}
@@ -0,0 +1,296 @@
+// Package lifecycle contains helpers to manage the lifetime of a
+// PeerConnection session: signal handling, ordered cleanup and exit codes.
+package lifecycle
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// Reason describes why a session has ended
+type Reason int
+
+const (
+	// ReasonNone means the session is still running
+	ReasonNone Reason = iota
+	// ReasonCompleted means the session finished its work (e.g. the whole file was sent)
+	ReasonCompleted
+	// ReasonClosed means the PeerConnection was closed by the remote peer
+	ReasonClosed
+	// ReasonSignal means the process received SIGINT or SIGTERM
+	ReasonSignal
+	// ReasonDisconnected means the PeerConnection stayed disconnected for too long
+	ReasonDisconnected
+	// ReasonFailed means the PeerConnection failed
+	ReasonFailed
+	// ReasonError means an unrecoverable error happened while reading or writing media
+	ReasonError
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonNone:
+		return "none"
+	case ReasonCompleted:
+		return "completed"
+	case ReasonClosed:
+		return "closed"
+	case ReasonSignal:
+		return "signal"
+	case ReasonDisconnected:
+		return "disconnected"
+	case ReasonFailed:
+		return "failed"
+	case ReasonError:
+		return "error"
+	default:
+		return fmt.Sprintf("Reason(%d)", int(r))
+	}
+}
+
+// ExitCode returns the process exit code for the reason
+func (r Reason) ExitCode() int {
+	switch r {
+	case ReasonNone, ReasonCompleted, ReasonClosed:
+		return 0
+	case ReasonError:
+		return 1
+	case ReasonFailed:
+		return 2
+	case ReasonDisconnected:
+		return 3
+	case ReasonSignal:
+		return 130
+	default:
+		return 1
+	}
+}
+
+// Config is the configuration of the session lifecycle
+type Config struct {
+	// AutoRestart waits for a new offer when a session has ended
+	AutoRestart bool
+	// DisconnectedTimeout is how long a disconnected PeerConnection is given to recover
+	DisconnectedTimeout time.Duration
+	// FailedTimeout is how long a failed PeerConnection is given to recover by an ICE restart
+	FailedTimeout time.Duration
+}
+
+// Flags registers the lifecycle flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.BoolVar(&c.AutoRestart, "restart", false, "wait for a new offer when the session has ended")
+	flag.DurationVar(&c.DisconnectedTimeout, "disconnected-timeout", 10*time.Second, "time a disconnected PeerConnection is given to recover")
+	flag.DurationVar(&c.FailedTimeout, "failed-timeout", 5*time.Second, "time a failed PeerConnection is given to recover by an ICE restart (0 ends the session at once)")
+	return c
+}
+
+// Delays between automatic restarts, see Backoff
+const (
+	minRestartDelay = 100 * time.Millisecond
+	maxRestartDelay = 10 * time.Second
+)
+
+// Backoff is the delay before automatically restarting a session.
+// The delay doubles for each session which ends within maxRestartDelay of its
+// start, so that a session failing immediately does not restart in a busy loop.
+type Backoff struct {
+	delay time.Duration
+}
+
+// Next returns the delay before restarting a session which ran for elapsed
+func (b *Backoff) Next(elapsed time.Duration) time.Duration {
+	if b.delay == 0 || elapsed >= maxRestartDelay {
+		b.delay = minRestartDelay
+	} else if b.delay *= 2; b.delay > maxRestartDelay {
+		b.delay = maxRestartDelay
+	}
+	return b.delay
+}
+
+// Sleep waits for d and returns false when ctx is done before that
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// SignalContext returns a context which is cancelled when the process
+// receives SIGINT or SIGTERM
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigChan)
+		select {
+		case <-sigChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+type closer struct {
+	name string
+	fn   func() error
+}
+
+// Session manages the lifetime of a single PeerConnection session.
+// Cleanup functions registered with OnClose run in reverse order of registration
+// once the session is stopped, after which goroutines started with Go are awaited.
+type Session struct {
+	id     string
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	reason  Reason
+	err     error
+	closers []closer
+
+	wg sync.WaitGroup
+}
+
+// sessionCount is used to number the sessions of the process
+var sessionCount uint64
+
+// NewSession creates a Session which is stopped with ReasonSignal when parent is done.
+// The logger of the session is a child of logger with the session ID.
+func NewSession(parent context.Context, logger *zap.Logger) *Session {
+	ctx, cancel := context.WithCancel(parent)
+	id := strconv.FormatUint(atomic.AddUint64(&sessionCount, 1), 10)
+	return &Session{id: id, logger: logger.With(zap.String("session", id)), ctx: ctx, cancel: cancel}
+}
+
+// ID returns the number of the session, unique within the process
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Logger returns the logger of the session
+func (s *Session) Logger() *zap.Logger {
+	return s.logger
+}
+
+// Context returns a context which is cancelled when the session is stopped
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// Stop stops the session. Only the first call has effect.
+func (s *Session) Stop(reason Reason, err error) {
+	s.mu.Lock()
+	if s.reason == ReasonNone {
+		s.reason = reason
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// OnClose registers a cleanup function which is called when the session is stopped
+func (s *Session) OnClose(name string, fn func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers = append(s.closers, closer{name: name, fn: fn})
+}
+
+// Go runs f in a goroutine which Wait waits for
+func (s *Session) Go(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// connectionStateNotifier is the part of webrtc.PeerConnection used by WatchPeerConnection
+type connectionStateNotifier interface {
+	OnConnectionStateChange(f func(webrtc.PeerConnectionState))
+}
+
+// WatchPeerConnection stops the session according to the PeerConnectionState.
+// A disconnected PeerConnection is given disconnectedTimeout to recover and a
+// failed one failedTimeout, so that an ICE restart by either peer can still
+// bring it back.
+func (s *Session) WatchPeerConnection(peerConnection connectionStateNotifier, disconnectedTimeout, failedTimeout time.Duration, onChange func(webrtc.PeerConnectionState)) {
+	var timerLock sync.Mutex
+	var stopTimer *time.Timer
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if onChange != nil {
+			onChange(state)
+		}
+
+		timerLock.Lock()
+		defer timerLock.Unlock()
+		if stopTimer != nil {
+			stopTimer.Stop()
+			stopTimer = nil
+		}
+
+		switch state {
+		case webrtc.PeerConnectionStateDisconnected:
+			stopTimer = time.AfterFunc(disconnectedTimeout, func() {
+				s.Stop(ReasonDisconnected, nil)
+			})
+		case webrtc.PeerConnectionStateFailed:
+			stopTimer = time.AfterFunc(failedTimeout, func() {
+				s.Stop(ReasonFailed, nil)
+			})
+		case webrtc.PeerConnectionStateClosed:
+			s.Stop(ReasonClosed, nil)
+		}
+	})
+}
+
+// Wait blocks until the session is stopped, runs the cleanup functions and
+// returns the reason the session ended
+func (s *Session) Wait() (Reason, error) {
+	<-s.ctx.Done()
+
+	s.mu.Lock()
+	if s.reason == ReasonNone {
+		// 親のcontext(シグナル)によって停止された
+		s.reason = ReasonSignal
+	}
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		s.logger.Debug("Closing", zap.String("name", closers[i].name))
+		if err := closers[i].fn(); err != nil {
+			s.mu.Lock()
+			if s.err == nil {
+				s.err = fmt.Errorf("failed to close %s: %w", closers[i].name, err)
+			}
+			s.mu.Unlock()
+		}
+	}
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason, s.err
+}
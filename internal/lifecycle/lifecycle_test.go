@@ -0,0 +1,207 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"go.uber.org/zap"
+)
+
+// fakePeerConnectionは、テストから接続状態を変化させるPeerConnectionです
+type fakePeerConnection struct {
+	onChange func(webrtc.PeerConnectionState)
+}
+
+func (f *fakePeerConnection) OnConnectionStateChange(fn func(webrtc.PeerConnectionState)) {
+	f.onChange = fn
+}
+
+func stopped(s *Session) bool {
+	select {
+	case <-s.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func waitStopped(t *testing.T, s *Session, want Reason) {
+	t.Helper()
+	select {
+	case <-s.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session is not stopped")
+	}
+	if reason, err := s.Wait(); reason != want || err != nil {
+		t.Errorf("got %s (%v), want %s", reason, err, want)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for reason, want := range map[Reason]int{
+		ReasonNone:         0,
+		ReasonCompleted:    0,
+		ReasonClosed:       0,
+		ReasonError:        1,
+		ReasonFailed:       2,
+		ReasonDisconnected: 3,
+		ReasonSignal:       130,
+		Reason(100):        1,
+	} {
+		if got := reason.ExitCode(); got != want {
+			t.Errorf("%s: got exit code %d, want %d", reason, got, want)
+		}
+	}
+}
+
+// TestWatchPeerConnectionは、接続状態に応じてセッションを停止することを確認します
+func TestWatchPeerConnection(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	watch := func() (*Session, *fakePeerConnection, *[]webrtc.PeerConnectionState) {
+		s := NewSession(context.Background(), zap.NewNop())
+		pc := &fakePeerConnection{}
+		var states []webrtc.PeerConnectionState
+		s.WatchPeerConnection(pc, timeout, timeout, func(state webrtc.PeerConnectionState) { states = append(states, state) })
+		return s, pc, &states
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		s, pc, states := watch()
+		pc.onChange(webrtc.PeerConnectionStateConnected)
+		start := time.Now()
+		pc.onChange(webrtc.PeerConnectionStateFailed)
+		waitStopped(t, s, ReasonFailed)
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("stopped after %s, before the failed timeout", elapsed)
+		}
+		if want := []webrtc.PeerConnectionState{webrtc.PeerConnectionStateConnected, webrtc.PeerConnectionStateFailed}; !reflect.DeepEqual(*states, want) {
+			t.Errorf("got states %v, want %v", *states, want)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s, pc, _ := watch()
+		pc.onChange(webrtc.PeerConnectionStateClosed)
+		waitStopped(t, s, ReasonClosed)
+	})
+
+	t.Run("disconnected", func(t *testing.T) {
+		s, pc, _ := watch()
+		start := time.Now()
+		pc.onChange(webrtc.PeerConnectionStateDisconnected)
+		waitStopped(t, s, ReasonDisconnected)
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("stopped after %s, before the disconnected timeout", elapsed)
+		}
+	})
+
+	t.Run("reconnected", func(t *testing.T) {
+		s, pc, _ := watch()
+		pc.onChange(webrtc.PeerConnectionStateDisconnected)
+		time.Sleep(timeout / 2)
+		// 再接続するとタイマーは止まる
+		pc.onChange(webrtc.PeerConnectionStateConnected)
+		time.Sleep(2 * timeout)
+		if stopped(s) {
+			t.Fatal("stopped after reconnecting")
+		}
+		// 再び切断された場合は、改めてタイムアウトまで待つ
+		pc.onChange(webrtc.PeerConnectionStateDisconnected)
+		waitStopped(t, s, ReasonDisconnected)
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		s, pc, _ := watch()
+		pc.onChange(webrtc.PeerConnectionStateFailed)
+		time.Sleep(timeout / 2)
+		// ICEリスタートで再接続するとタイマーは止まる
+		pc.onChange(webrtc.PeerConnectionStateConnecting)
+		pc.onChange(webrtc.PeerConnectionStateConnected)
+		time.Sleep(2 * timeout)
+		if stopped(s) {
+			t.Fatal("stopped after recovering from failed")
+		}
+		pc.onChange(webrtc.PeerConnectionStateFailed)
+		waitStopped(t, s, ReasonFailed)
+	})
+}
+
+// TestWaitは、停止後にクリーンアップを登録と逆順に実行し、Goで起動したgoroutineを待つことを確認します
+func TestWait(t *testing.T) {
+	parent, cancel := context.WithCancel(context.Background())
+	s := NewSession(parent, zap.NewNop())
+	var order []string
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		s.OnClose(name, func() error {
+			order = append(order, name)
+			if name == "second" {
+				return errors.New("close error")
+			}
+			return nil
+		})
+	}
+	finished := false
+	s.Go(func() {
+		<-s.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+	})
+
+	// 親のcontextが終了した場合はシグナルによる停止になる
+	cancel()
+	reason, err := s.Wait()
+	if reason != ReasonSignal {
+		t.Errorf("got %s, want signal", reason)
+	}
+	if err == nil || err.Error() != "failed to close second: close error" {
+		t.Errorf("got error %v", err)
+	}
+	if want := []string{"third", "second", "first"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got closers run in %v, want %v", order, want)
+	}
+	if !finished {
+		t.Error("Wait returned before the goroutine finished")
+	}
+
+	// 最初の停止理由だけが残る
+	s = NewSession(context.Background(), zap.NewNop())
+	s.Stop(ReasonCompleted, nil)
+	s.Stop(ReasonError, errors.New("later"))
+	if reason, err := s.Wait(); reason != ReasonCompleted || err != nil {
+		t.Errorf("got %s (%v), want completed", reason, err)
+	}
+}
+
+// TestBackoffは、すぐに終了したセッションが続くと再起動の間隔が上限まで倍になり、
+// 長く続いたセッションの後は最小の間隔に戻ることを確認します
+func TestBackoff(t *testing.T) {
+	var b Backoff
+	var got []time.Duration
+	for i := 0; i < 9; i++ {
+		got = append(got, b.Next(time.Millisecond))
+	}
+	want := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		1600 * time.Millisecond, 3200 * time.Millisecond, 6400 * time.Millisecond, 10 * time.Second, 10 * time.Second,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got delays %v, want %v", got, want)
+	}
+	if d := b.Next(time.Minute); d != minRestartDelay {
+		t.Errorf("got %s after a long session, want %s", d, minRestartDelay)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if Sleep(ctx, time.Minute) {
+		t.Error("Sleep did not return when the context is done")
+	}
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Error("Sleep returned false")
+	}
+}
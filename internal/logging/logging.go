@@ -0,0 +1,97 @@
+// Package logging builds the zap logger shared by the commands and routes
+// pion's own logs (ICE, DTLS, SCTP, ...) into it.
+package logging
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/pion/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Config is the configuration of the logger
+type Config struct {
+	// Level is the minimum level of the logs: debug, info, warn or error
+	Level string
+	// Format is the encoding of the logs: console or json
+	Format string
+	// PionLevel is the minimum level of the logs written by pion
+	PionLevel string
+}
+
+// Flags registers the logging flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Level, "log-level", "info", "minimum log level: debug, info, warn or error")
+	flag.StringVar(&c.Format, "log-format", "console", "log format: console or json")
+	flag.StringVar(&c.PionLevel, "pion-log-level", "warn", "minimum level of the logs written by pion: debug, info, warn or error")
+	return c
+}
+
+// New creates a logger according to the configuration
+func New(c Config) (*zap.Logger, error) {
+	level := zapcore.InfoLevel
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", c.Level)
+	}
+
+	var config zap.Config
+	switch c.Format {
+	case "console":
+		config = zap.NewDevelopmentConfig()
+	case "json":
+		config = zap.NewProductionConfig()
+	default:
+		return nil, fmt.Errorf("invalid log format %q", c.Format)
+	}
+	config.Level = zap.NewAtomicLevelAt(level)
+	return config.Build()
+}
+
+// LoggerFactory is a pion logging.LoggerFactory which writes to a zap logger.
+// Set it to webrtc.SettingEngine.LoggerFactory so that pion's logs are written
+// with the fields of the logger, e.g. the session ID.
+type LoggerFactory struct {
+	logger *zap.Logger
+	level  zapcore.Level
+}
+
+// NewLoggerFactory creates a LoggerFactory writing the logs of pion at or above
+// Config.PionLevel to logger
+func NewLoggerFactory(logger *zap.Logger, c Config) (*LoggerFactory, error) {
+	level := zapcore.WarnLevel
+	if err := level.UnmarshalText([]byte(c.PionLevel)); err != nil {
+		return nil, fmt.Errorf("invalid pion log level %q", c.PionLevel)
+	}
+	return &LoggerFactory{logger: logger, level: level}, nil
+}
+
+// NewLogger creates a logger for a pion subsystem, e.g. "ice" or "dtls"
+func (f *LoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	// loggerのレベルで出力されるもののうち、PionLevel以上のものだけを出力する
+	core := f.logger.Core()
+	level := zap.LevelEnablerFunc(func(l zapcore.Level) bool { return l >= f.level && core.Enabled(l) })
+	// 呼び出し元としてpionのコードを表示する
+	logger := f.logger.Named("pion."+scope).WithOptions(zap.AddCallerSkip(1), zap.IncreaseLevel(level))
+	return &leveledLogger{logger: logger.Sugar()}
+}
+
+// leveledLogger adapts a zap logger to logging.LeveledLogger.
+// pion's trace logs are written as debug logs.
+type leveledLogger struct {
+	logger *zap.SugaredLogger
+}
+
+func (l *leveledLogger) Trace(msg string)                          { l.logger.Debug(msg) }
+func (l *leveledLogger) Tracef(format string, args ...interface{}) { l.logger.Debugf(format, args...) }
+func (l *leveledLogger) Debug(msg string)                          { l.logger.Debug(msg) }
+func (l *leveledLogger) Debugf(format string, args ...interface{}) { l.logger.Debugf(format, args...) }
+func (l *leveledLogger) Info(msg string)                           { l.logger.Info(msg) }
+func (l *leveledLogger) Infof(format string, args ...interface{})  { l.logger.Infof(format, args...) }
+func (l *leveledLogger) Warn(msg string)                           { l.logger.Warn(msg) }
+func (l *leveledLogger) Warnf(format string, args ...interface{})  { l.logger.Warnf(format, args...) }
+func (l *leveledLogger) Error(msg string)                          { l.logger.Error(msg) }
+func (l *leveledLogger) Errorf(format string, args ...interface{}) { l.logger.Errorf(format, args...) }
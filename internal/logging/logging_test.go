@@ -0,0 +1,161 @@
+package logging
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	pionlogging "github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestNewは、-log-levelと-log-formatの値から、そのレベル以上を出力するloggerを作成できることを確認します
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		config Config
+		level  zapcore.Level
+		valid  bool
+	}{
+		{Config{Level: "debug", Format: "console"}, zapcore.DebugLevel, true},
+		{Config{Level: "info", Format: "json"}, zapcore.InfoLevel, true},
+		{Config{Level: "warn", Format: "console"}, zapcore.WarnLevel, true},
+		{Config{Level: "error", Format: "json"}, zapcore.ErrorLevel, true},
+		{Config{Level: "verbose", Format: "console"}, 0, false},
+		{Config{Level: "info", Format: "text"}, 0, false},
+	} {
+		logger, err := New(c.config)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%+v: got no error", c.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %s", c.config, err)
+			continue
+		}
+		if !logger.Core().Enabled(c.level) || (c.level > zapcore.DebugLevel && logger.Core().Enabled(c.level-1)) {
+			t.Errorf("%+v: the logger is not enabled from %s", c.config, c.level)
+		}
+	}
+
+	if _, err := NewLoggerFactory(zap.NewNop(), Config{PionLevel: "verbose"}); err == nil {
+		t.Error("got no error for an invalid pion log level")
+	}
+}
+
+// TestLoggerFactoryは、pionのログが-pion-log-level以上かつloggerのレベル以上の場合のみ、
+// loggerのフィールドを付けて出力されることを確認します
+func TestLoggerFactory(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	session := lifecycle.NewSession(context.Background(), zap.New(core))
+	factory, err := NewLoggerFactory(session.Logger(), Config{PionLevel: "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := factory.NewLogger("ice")
+	logger.Trace("trace")
+	logger.Debugf("debug %d", 1)
+	logger.Infof("info %d", 2)
+	logger.Warn("warn")
+	logger.Errorf("error %d", 3)
+
+	entries := logs.AllUntimed()
+	want := []struct {
+		level   zapcore.Level
+		message string
+	}{
+		{zapcore.InfoLevel, "info 2"},
+		{zapcore.WarnLevel, "warn"},
+		{zapcore.ErrorLevel, "error 3"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d logs, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Level != want[i].level || entry.Message != want[i].message {
+			t.Errorf("got %s %q, want %s %q", entry.Level, entry.Message, want[i].level, want[i].message)
+		}
+		if entry.LoggerName != "pion.ice" {
+			t.Errorf("got logger name %q", entry.LoggerName)
+		}
+		if got := entry.ContextMap()["session"]; got != session.ID() {
+			t.Errorf("got session %v, want %s", got, session.ID())
+		}
+	}
+
+	// -pion-log-levelより低いレベルは出力しない
+	logs.TakeAll()
+	factory, err = NewLoggerFactory(session.Logger(), Config{PionLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger = factory.NewLogger("dtls")
+	logger.Warn("warn")
+	logger.Error("error")
+	if entries := logs.TakeAll(); len(entries) != 1 || entries[0].Message != "error" {
+		t.Errorf("got logs %+v", entries)
+	}
+}
+
+// TestPeerConnectionLogsは、SettingEngineに設定したLoggerFactoryで、
+// PeerConnectionが出力するpionのログにセッションのフィールドが付くことを確認します
+func TestPeerConnectionLogs(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	session := lifecycle.NewSession(context.Background(), zap.New(core))
+	factory, err := NewLoggerFactory(session.Logger(), Config{PionLevel: "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: pionlogging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vnetNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{"10.0.0.1"}})
+	if err := router.AddNet(vnetNet); err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = router.Stop() }()
+
+	settingEngine := webrtc.SettingEngine{LoggerFactory: factory}
+	settingEngine.SetVNet(vnetNet)
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err := pc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := logs.FilterField(zap.String("session", session.ID())).AllUntimed()
+	if len(entries) == 0 || len(entries) != logs.Len() {
+		t.Fatalf("got %d logs with the session out of %d", len(entries), logs.Len())
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.LoggerName, "pion.") {
+			t.Errorf("got logger name %q", entry.LoggerName)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package loopback
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/transport/vnet"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+)
+
+// maxQueueDelay is how long a packet may wait for the bandwidth cap before it is
+// dropped, the same as the queue of netsim
+const maxQueueDelay = 500 * time.Millisecond
+
+// errReorder is returned by NewImpaired, as the router of the simulated network
+// delivers the packets in order
+var errReorder = errors.New("the simulated network cannot reorder packets")
+
+// impairment drops the packets crossing the router of the simulated network:
+// at random following netsim.Config.Loss, and over netsim.Config.Bandwidth.
+// The router cannot hold a packet back, so the bandwidth cap polices the packets
+// that would wait longer than maxQueueDelay instead of delaying the others.
+// Delay and jitter are added by the router itself (vnet.RouterConfig).
+type impairment struct {
+	config netsim.Config
+	now    func() time.Time
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// busyUntil is when the bandwidth capped network would have sent the accepted packets
+	busyUntil time.Time
+	stats     netsim.LinkStats
+}
+
+func newImpairment(config netsim.Config) *impairment {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &impairment{config: config, now: time.Now, rand: rand.New(rand.NewSource(seed))}
+}
+
+// filter is the vnet.ChunkFilter of the router. It returns false to drop the chunk.
+func (i *impairment) filter(c vnet.Chunk) bool {
+	return i.pass(len(c.UserData()))
+}
+
+// pass returns false when a packet of size bytes is dropped
+func (i *impairment) pass(size int) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stats.Sent++
+
+	if i.config.Loss > 0 && i.rand.Float64()*100 < i.config.Loss {
+		i.stats.Dropped++
+		return false
+	}
+	if i.config.Bandwidth > 0 {
+		now := i.now()
+		departure := now
+		if i.busyUntil.After(departure) {
+			departure = i.busyUntil
+		}
+		if departure.Sub(now) > maxQueueDelay {
+			i.stats.Dropped++
+			return false
+		}
+		i.busyUntil = departure.Add(time.Duration(size) * 8 * time.Second / time.Duration(i.config.Bandwidth))
+	}
+	return true
+}
+
+func (i *impairment) linkStats() netsim.LinkStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stats
+}
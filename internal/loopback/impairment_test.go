@@ -0,0 +1,130 @@
+package loopback
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"go.uber.org/zap"
+)
+
+// TestImpairmentLossは、指定した割合のパケットを破棄することを確認します
+func TestImpairmentLoss(t *testing.T) {
+	for _, loss := range []float64{0, 30, 100} {
+		i := newImpairment(netsim.Config{Loss: loss, Seed: 1})
+		for n := 0; n < 1000; n++ {
+			i.pass(100)
+		}
+		stats := i.linkStats()
+		if got := float64(stats.Dropped) / float64(stats.Sent) * 100; got < loss-5 || got > loss+5 {
+			t.Errorf("loss %g%%: dropped %d of %d packets", loss, stats.Dropped, stats.Sent)
+		}
+	}
+}
+
+// TestImpairmentBandwidthは、帯域の上限を超えて送られたパケットのうち、
+// キューで待つ時間がmaxQueueDelayを超えるものを破棄することを確認します
+func TestImpairmentBandwidth(t *testing.T) {
+	now := time.Unix(0, 0)
+	i := newImpairment(netsim.Config{Bandwidth: 80000})
+	i.now = func() time.Time { return now }
+
+	// 1000バイトのパケットは100msで送れるため、同時に送ると0〜500ms待つ6つまでが送られる
+	passed := 0
+	for n := 0; n < 10; n++ {
+		if i.pass(1000) {
+			passed++
+		}
+	}
+	if passed != 6 {
+		t.Errorf("passed %d packets at once, want 6", passed)
+	}
+	// 送り終えた後は、再び送れる
+	now = now.Add(time.Second)
+	if !i.pass(1000) {
+		t.Error("dropped a packet after the queue has been sent")
+	}
+	if stats := i.linkStats(); stats.Sent != 11 || stats.Dropped != 4 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+// TestNewImpairedは、仮想ネットワークで並べ替えられない設定と、範囲外の設定を拒否することを確認します
+func TestNewImpaired(t *testing.T) {
+	for _, config := range []netsim.Config{{Reorder: 10}, {Loss: 101}, {Delay: -time.Second}} {
+		if l, err := NewImpaired(nil, config); err == nil {
+			l.Close()
+			t.Errorf("created a loopback with %+v", config)
+		}
+	}
+}
+
+// TestImpairedNetworkは、パケットロスと遅延のある仮想ネットワークでも、ICE・DTLSの再送で接続でき、
+// データチャネルのメッセージがSCTPの再送で全て届くことを確認します
+func TestImpairedNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	l, err := NewImpaired(zap.NewNop(), netsim.Config{Loss: 10, Delay: 20 * time.Millisecond, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// 応答側は、受け取ったメッセージをそのまま送り返す
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetVNet(l.Net)
+	answerer, err := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+	answerer.OnDataChannel(func(d *webrtc.DataChannel) {
+		d.OnMessage(func(msg webrtc.DataChannelMessage) {
+			_ = d.Send(msg.Data)
+		})
+	})
+	negotiator := negotiation.New(answerer, negotiation.Config{}, l.Channel, zap.NewNop())
+	answerer.OnICEConnectionStateChange(negotiator.ICEConnectionStateChange)
+	go negotiator.Run(ctx)
+
+	echo, err := l.Offerer.CreateDataChannel("echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	echo.OnOpen(func() { close(opened) })
+	echoed := make(chan string, 100)
+	echo.OnMessage(func(msg webrtc.DataChannelMessage) { echoed <- string(msg.Data) })
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		t.Fatal("the data channel is not opened")
+	}
+
+	const messages = 50
+	for n := 0; n < messages; n++ {
+		if err := echo.SendText(strconv.Itoa(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for n := 0; n < messages; n++ {
+		select {
+		case got := <-echoed:
+			if got != strconv.Itoa(n) {
+				t.Fatalf("got message %s, want %d", got, n)
+			}
+		case <-ctx.Done():
+			t.Fatalf("received %d messages, want %d", n, messages)
+		}
+	}
+	if stats := l.Stats(); stats.Dropped == 0 {
+		t.Errorf("no packet has been dropped of %d packets", stats.Sent)
+	}
+}
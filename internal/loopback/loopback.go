@@ -0,0 +1,148 @@
+// Package loopback connects an offering PeerConnection to an example in the
+// same process, so that the examples can be tested end to end with go test
+// and without network access.
+//
+// The peers are connected through a simulated network (pion vnet) and an
+// in-memory signaling channel (signal.NewPipe). The offering peer plays the
+// role of the browser: add tracks and transceivers to Offerer before Connect.
+//
+// NewImpaired impairs the simulated network itself, so unlike the netsim
+// interceptor every packet is affected, including ICE, DTLS and the data channels.
+package loopback
+
+import (
+	"context"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"go.uber.org/zap"
+)
+
+const (
+	// networkCIDR is the address range of the simulated network
+	networkCIDR = "10.0.0.0/24"
+	// offererIP and answererIP are the addresses of the peers
+	offererIP  = "10.0.0.1"
+	answererIP = "10.0.0.2"
+)
+
+// Loopback is an offering peer connected to an answering peer, the example under test
+type Loopback struct {
+	// Net is the simulated network of the answering peer.
+	// Set it to the SettingEngine of the answering peer with SetVNet.
+	Net *vnet.Net
+	// Channel is the signaling channel of the answering peer
+	Channel signal.Channel
+	// Offerer is the offering PeerConnection
+	Offerer *webrtc.PeerConnection
+
+	router     *vnet.Router
+	impairment *impairment
+	negotiator *negotiation.Negotiator
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// New creates a simulated network with an offering peer on it.
+// logger receives the logs of the offering peer and of the network.
+func New(logger *zap.Logger) (*Loopback, error) {
+	return NewImpaired(logger, netsim.Config{})
+}
+
+// NewImpaired is like New, but the simulated network drops and delays the packets
+// in both directions following config: Loss and Bandwidth as netsim does, and
+// Delay plus a random jitter up to Jitter. Reorder is not supported.
+func NewImpaired(logger *zap.Logger, config netsim.Config) (*Loopback, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Reorder > 0 {
+		return nil, errReorder
+	}
+	loggerFactory, err := logging.NewLoggerFactory(logger, logging.Config{PionLevel: "warn"})
+	if err != nil {
+		return nil, err
+	}
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: networkCIDR, MinDelay: config.Delay, MaxJitter: config.Jitter, LoggerFactory: loggerFactory})
+	if err != nil {
+		return nil, err
+	}
+	impairment := newImpairment(config)
+	router.AddChunkFilter(impairment.filter)
+	offererNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{offererIP}})
+	answererNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{answererIP}})
+	for _, n := range []*vnet.Net{offererNet, answererNet} {
+		if err := router.AddNet(n); err != nil {
+			return nil, err
+		}
+	}
+	if err := router.Start(); err != nil {
+		return nil, err
+	}
+
+	offerer, err := newOfferer(offererNet, loggerFactory)
+	if err != nil {
+		_ = router.Stop()
+		return nil, err
+	}
+
+	offererChannel, answererChannel := signal.NewPipe()
+	l := &Loopback{
+		Net:        answererNet,
+		Channel:    answererChannel,
+		Offerer:    offerer,
+		router:     router,
+		impairment: impairment,
+		negotiator: negotiation.New(offerer, negotiation.Config{}, offererChannel, logger),
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	offerer.OnICEConnectionStateChange(l.negotiator.ICEConnectionStateChange)
+	return l, nil
+}
+
+// newOfferer creates a PeerConnection with the default codecs and interceptors on the simulated network
+func newOfferer(n *vnet.Net, loggerFactory *logging.LoggerFactory) (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	settingEngine := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	settingEngine.SetVNet(n)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(settingEngine))
+	return api.NewPeerConnection(webrtc.Configuration{})
+}
+
+// Connect sends an offer to the answering peer and blocks until ICE is connected or ctx is done.
+// Later offers and answers, e.g. a renegotiation by the answering peer, are handled until Close.
+func (l *Loopback) Connect(ctx context.Context) error {
+	go l.negotiator.Run(l.ctx)
+	if err := l.negotiator.Negotiate(); err != nil {
+		return err
+	}
+	return l.negotiator.WaitConnected(ctx)
+}
+
+// Stats returns the number of packets which crossed the simulated network and were dropped by it
+func (l *Loopback) Stats() netsim.LinkStats {
+	return l.impairment.linkStats()
+}
+
+// Close closes the offering peer and stops the simulated network
+func (l *Loopback) Close() error {
+	l.cancel()
+	err := l.Offerer.Close()
+	if stopErr := l.router.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
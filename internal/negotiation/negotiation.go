@@ -0,0 +1,307 @@
+// Package negotiation exchanges session descriptions with the remote peer
+// over a persistent signaling channel: the initial offer/answer,
+// renegotiation when tracks are added and ICE restarts.
+//
+// Glare (both peers sending an offer at the same time) is resolved with
+// perfect negotiation: the polite peer rolls back its own offer and accepts
+// the remote one, the impolite peer ignores the remote offer.
+// pion accepts SDPTypeRollback, but a rollback only drops the pending local
+// description: the mids CreateOffer assigned to new transceivers and the
+// credentials of an ICE restart are kept, so the next offer would not match
+// what the remote peer has seen. The Negotiator is therefore always the
+// impolite peer and the remote peer (the browser) has to be polite.
+// See https://w3c.github.io/webrtc-pc/#perfect-negotiation-example
+package negotiation
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"go.uber.org/zap"
+)
+
+// Config is the configuration of the Negotiator
+type Config struct {
+	// ICERestartTimeout is how long ICE may stay disconnected before an ICE restart
+	// is triggered locally. Zero disables local ICE restarts.
+	ICERestartTimeout time.Duration
+}
+
+// Flags registers the negotiation flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.DurationVar(&c.ICERestartTimeout, "ice-restart-timeout", 0, "restart ICE when disconnected for this long, shorter than -disconnected-timeout (0 disables local ICE restarts)")
+	return c
+}
+
+// Validate returns an error when the configuration is invalid.
+// disconnectedTimeout is how long the session survives a disconnection (lifecycle.Config):
+// a local ICE restart has to be triggered before the session is closed.
+func (c Config) Validate(disconnectedTimeout time.Duration) error {
+	if c.ICERestartTimeout < 0 {
+		return fmt.Errorf("invalid ICE restart timeout %s", c.ICERestartTimeout)
+	}
+	if c.ICERestartTimeout > 0 && c.ICERestartTimeout >= disconnectedTimeout {
+		return fmt.Errorf("ICE restart timeout %s is not shorter than the disconnected timeout %s", c.ICERestartTimeout, disconnectedTimeout)
+	}
+	return nil
+}
+
+// Negotiator exchanges session descriptions for a PeerConnection
+type Negotiator struct {
+	peerConnection *webrtc.PeerConnection
+	config         Config
+	channel        signal.Channel
+	logger         *zap.Logger
+
+	// negotiationLock serializes offer/answer exchanges
+	negotiationLock sync.Mutex
+	beforeAnswer    func() error
+	// offerPending is set when a local offer has to be sent once the signaling state is stable again.
+	// restartPending is set when that offer has to restart ICE.
+	offerPending   bool
+	restartPending bool
+
+	stateLock    sync.Mutex
+	connected    chan struct{}
+	restartTimer *time.Timer
+}
+
+// New creates a Negotiator which exchanges session descriptions over channel
+func New(peerConnection *webrtc.PeerConnection, config Config, channel signal.Channel, logger *zap.Logger) *Negotiator {
+	return &Negotiator{
+		peerConnection: peerConnection,
+		config:         config,
+		channel:        channel,
+		logger:         logger,
+		connected:      make(chan struct{}),
+	}
+}
+
+// OnBeforeAnswer sets a handler which is called after a remote offer has been
+// applied and before the answer is created, e.g. to add tracks for new transceivers
+func (n *Negotiator) OnBeforeAnswer(f func() error) {
+	n.negotiationLock.Lock()
+	defer n.negotiationLock.Unlock()
+	n.beforeAnswer = f
+}
+
+// AddTrack adds a track to the PeerConnection and sends an offer for it.
+// When a negotiation is in progress the offer is sent once it has completed.
+func (n *Negotiator) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	sender, err := n.peerConnection.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	return sender, n.Negotiate()
+}
+
+// RemoveTrack removes a track from the PeerConnection and sends an offer for it.
+// When a negotiation is in progress the offer is sent once it has completed.
+func (n *Negotiator) RemoveTrack(sender *webrtc.RTPSender) error {
+	if err := n.peerConnection.RemoveTrack(sender); err != nil {
+		return err
+	}
+	return n.Negotiate()
+}
+
+// Run receives session descriptions from the channel and applies them until ctx is done
+func (n *Negotiator) Run(ctx context.Context) {
+	for {
+		desc, err := n.channel.Recv(ctx)
+		if errors.Is(err, signal.ErrInvalidSessionDescription) {
+			n.logger.Warn("Invalid session description", zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		if err := n.HandleRemoteDescription(desc); err != nil {
+			n.logger.Warn("Failed to handle session description", zap.Stringer("type", desc.Type), zap.Error(err))
+		}
+	}
+}
+
+// HandleRemoteDescription applies a session description received from the remote peer.
+// An offer (a renegotiation or an ICE restart with a fresh ufrag/pwd) is answered through the channel.
+func (n *Negotiator) HandleRemoteDescription(desc webrtc.SessionDescription) error {
+	n.negotiationLock.Lock()
+	defer n.negotiationLock.Unlock()
+
+	switch desc.Type {
+	case webrtc.SDPTypeOffer:
+		// 自身のオファーと衝突した場合(glare)は、impoliteな側としてリモートのオファーを無視する
+		// politeなリモートは自身のオファーを取り下げ、こちらのオファーに応答した後に送り直す
+		if n.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+			n.logger.Info("Ignoring the remote offer which collided with the local offer")
+			return nil
+		}
+
+		if err := n.peerConnection.SetRemoteDescription(desc); err != nil {
+			return err
+		}
+		if n.beforeAnswer != nil {
+			if err := n.beforeAnswer(); err != nil {
+				return err
+			}
+		}
+		answer, err := n.peerConnection.CreateAnswer(nil)
+		if err != nil {
+			return err
+		}
+		if err := n.setLocalDescriptionAndSend(answer); err != nil {
+			return err
+		}
+
+	case webrtc.SDPTypeAnswer:
+		if n.peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			return errors.New("received an answer without a pending local offer")
+		}
+		if err := n.peerConnection.SetRemoteDescription(desc); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported session description type %s", desc.Type)
+	}
+
+	// ネゴシエーション中に保留したオファーを送信する
+	if n.offerPending {
+		go func() {
+			if err := n.offer(nil); err != nil {
+				n.logger.Warn("Failed to renegotiate", zap.Error(err))
+			}
+		}()
+	}
+	return nil
+}
+
+// Negotiate creates an offer and sends it through the channel.
+// The answer is applied by Run. When a negotiation is in progress
+// the offer is sent once it has completed.
+func (n *Negotiator) Negotiate() error {
+	return n.offer(nil)
+}
+
+// RestartICE creates an offer with fresh ICE credentials and sends it through the channel.
+// The answer is applied by Run.
+func (n *Negotiator) RestartICE() error {
+	n.logger.Info("Restarting ICE")
+	return n.offer(&webrtc.OfferOptions{ICERestart: true})
+}
+
+func (n *Negotiator) offer(options *webrtc.OfferOptions) error {
+	n.negotiationLock.Lock()
+	defer n.negotiationLock.Unlock()
+
+	if n.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		n.offerPending = true
+		if options != nil && options.ICERestart {
+			n.restartPending = true
+		}
+		return nil
+	}
+	// 保留したオファーがICEリスタートを含む場合は、ICEリスタートのオファーにする
+	if n.restartPending {
+		options = &webrtc.OfferOptions{ICERestart: true}
+	}
+	n.offerPending = false
+	n.restartPending = false
+
+	offer, err := n.peerConnection.CreateOffer(options)
+	if err != nil {
+		return err
+	}
+	return n.setLocalDescriptionAndSend(offer)
+}
+
+// setLocalDescriptionAndSend sends the description once ICE gathering is complete
+func (n *Negotiator) setLocalDescriptionAndSend(desc webrtc.SessionDescription) error {
+	// Create channel that is blocked until ICE Gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(n.peerConnection)
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err := n.peerConnection.SetLocalDescription(desc); err != nil {
+		return err
+	}
+	// Block until ICE Gathering is complete, disabling trickle ICE
+	// in a production application you should exchange ICE Candidates via OnICECandidate
+	<-gatherComplete
+
+	return n.channel.Send(*n.peerConnection.LocalDescription())
+}
+
+// ICEConnectionStateChange has to be called from OnICEConnectionStateChange.
+// It schedules a local ICE restart when ICE stays disconnected and restarts
+// ICE at once when it has failed.
+func (n *Negotiator) ICEConnectionStateChange(state webrtc.ICEConnectionState) {
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+
+	if n.restartTimer != nil {
+		n.restartTimer.Stop()
+		n.restartTimer = nil
+	}
+
+	switch state {
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		select {
+		case <-n.connected:
+		default:
+			close(n.connected)
+		}
+
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		select {
+		case <-n.connected:
+			n.connected = make(chan struct{})
+		default:
+		}
+
+		if n.config.ICERestartTimeout > 0 {
+			delay := n.config.ICERestartTimeout
+			if state == webrtc.ICEConnectionStateFailed {
+				delay = 0
+			}
+			n.restartTimer = time.AfterFunc(delay, func() {
+				if err := n.RestartICE(); err != nil {
+					n.logger.Warn("Failed to restart ICE", zap.Error(err))
+				}
+			})
+		}
+	}
+}
+
+// WaitConnected blocks until ICE is connected or ctx is done
+func (n *Negotiator) WaitConnected(ctx context.Context) error {
+	n.stateLock.Lock()
+	connected := n.connected
+	n.stateLock.Unlock()
+
+	select {
+	case <-connected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Connected returns true while ICE is connected, without blocking like WaitConnected
+func (n *Negotiator) Connected() bool {
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+
+	select {
+	case <-n.connected:
+		return true
+	default:
+		return false
+	}
+}
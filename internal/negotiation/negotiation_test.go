@@ -0,0 +1,375 @@
+package negotiation
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"go.uber.org/zap"
+)
+
+// networkは、2つのPeerConnectionをつなぐ仮想ネットワークです。filterがfalseを返すパケットは破棄されます
+type network struct {
+	router *vnet.Router
+	nets   []*vnet.Net
+
+	mu     sync.Mutex
+	filter func(vnet.Chunk) bool
+}
+
+func newNetwork(t *testing.T) *network {
+	t.Helper()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &network{router: router}
+	router.AddChunkFilter(func(c vnet.Chunk) bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.filter == nil || n.filter(c)
+	})
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		vnetNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err := router.AddNet(vnetNet); err != nil {
+			t.Fatal(err)
+		}
+		n.nets = append(n.nets, vnetNet)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Stop() })
+	return n
+}
+
+func (n *network) setFilter(filter func(vnet.Chunk) bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.filter = filter
+}
+
+// newPeerConnectionは、i番目の仮想ネットワーク上に、切断を1秒で検出するPeerConnectionを作成します
+func (n *network) newPeerConnection(t *testing.T, i int) *webrtc.PeerConnection {
+	t.Helper()
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetVNet(n.nets[i])
+	settingEngine.SetICETimeouts(time.Second, 30*time.Second, 200*time.Millisecond)
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	return pc
+}
+
+func newTrack(t *testing.T, mimeType, id string) *webrtc.TrackLocalStaticRTP {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, id, "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+func recv(ctx context.Context, t *testing.T, channel signal.Channel, want webrtc.SDPType) webrtc.SessionDescription {
+	t.Helper()
+	desc, err := channel.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Type != want {
+		t.Fatalf("got %s, want %s", desc.Type, want)
+	}
+	return desc
+}
+
+// answerは、手動で操作するリモートのPeerConnectionでオファーに応答します
+func answer(t *testing.T, pc *webrtc.PeerConnection, channel signal.Channel, offer webrtc.SessionDescription) {
+	t.Helper()
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLocalDescriptionAndSend(t, pc, channel, desc)
+}
+
+func setLocalDescriptionAndSend(t *testing.T, pc *webrtc.PeerConnection, channel signal.Channel, desc webrtc.SessionDescription) {
+	t.Helper()
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err := channel.Send(*pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitStable(t *testing.T, pc *webrtc.PeerConnection) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); pc.SignalingState() != webrtc.SignalingStateStable; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("signaling state is %s", pc.SignalingState())
+		}
+	}
+}
+
+func countMedia(t *testing.T, desc *webrtc.SessionDescription) int {
+	t.Helper()
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		t.Fatal(err)
+	}
+	return len(parsed.MediaDescriptions)
+}
+
+func iceUfrag(t *testing.T, desc *webrtc.SessionDescription) string {
+	t.Helper()
+	for _, line := range strings.Split(desc.SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	t.Fatal("no ice-ufrag in the session description")
+	return ""
+}
+
+// TestNegotiateは、最初のネゴシエーションと、応答側からのトラック追加による再ネゴシエーションができることを確認します
+func TestNegotiate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n := newNetwork(t)
+	offererChannel, answererChannel := signal.NewPipe()
+	offerer := New(n.newPeerConnection(t, 0), Config{}, offererChannel, zap.NewNop())
+	answerer := New(n.newPeerConnection(t, 1), Config{}, answererChannel, zap.NewNop())
+	for _, negotiator := range []*Negotiator{offerer, answerer} {
+		negotiator.peerConnection.OnICEConnectionStateChange(negotiator.ICEConnectionStateChange)
+		go negotiator.Run(ctx)
+	}
+
+	if _, err := offerer.AddTrack(newTrack(t, webrtc.MimeTypeVP8, "video")); err != nil {
+		t.Fatal(err)
+	}
+	for _, negotiator := range []*Negotiator{offerer, answerer} {
+		if err := negotiator.WaitConnected(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 応答側からトラックを追加すると、応答側がオファーを送る
+	if _, err := answerer.AddTrack(newTrack(t, webrtc.MimeTypeOpus, "audio")); err != nil {
+		t.Fatal(err)
+	}
+	waitStable(t, answerer.peerConnection)
+	waitStable(t, offerer.peerConnection)
+	if got := countMedia(t, offerer.peerConnection.RemoteDescription()); got != 2 {
+		t.Errorf("got %d media sections after the renegotiation, want 2", got)
+	}
+	if !offerer.Connected() || !answerer.Connected() {
+		t.Error("disconnected by the renegotiation")
+	}
+}
+
+// TestGlareは、オファーが衝突した場合にリモートのオファーを無視し、
+// ネゴシエーション中に要求されたオファーを応答を受け取った後に送ることを確認します
+func TestGlare(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n := newNetwork(t)
+	channel, remoteChannel := signal.NewPipe()
+	negotiator := New(n.newPeerConnection(t, 0), Config{}, channel, zap.NewNop())
+	go negotiator.Run(ctx)
+	// リモートはpoliteな側として手動で操作する
+	remote := n.newPeerConnection(t, 1)
+
+	if _, err := negotiator.AddTrack(newTrack(t, webrtc.MimeTypeVP8, "video")); err != nil {
+		t.Fatal(err)
+	}
+	answer(t, remote, remoteChannel, recv(ctx, t, remoteChannel, webrtc.SDPTypeOffer))
+	waitStable(t, negotiator.peerConnection)
+
+	// 双方が同時にオファーを送る。リモートのオファーは無視されるため、別のPeerConnectionで作成する
+	// (pionのCreateOfferはトランシーバーにmidを割り当て、取り下げられないため)
+	colliding := n.newPeerConnection(t, 1)
+	if _, err := colliding.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	remoteOffer, err := colliding.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := negotiator.AddTrack(newTrack(t, webrtc.MimeTypeVP8, "video2")); err != nil {
+		t.Fatal(err)
+	}
+	// ネゴシエーション中のオファーは、応答を受け取るまで保留される
+	if err := negotiator.Negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteChannel.Send(remoteOffer); err != nil {
+		t.Fatal(err)
+	}
+
+	// politeなリモートは自身のオファーを取り下げて応答する
+	offer := recv(ctx, t, remoteChannel, webrtc.SDPTypeOffer)
+	if got := countMedia(t, &offer); got != 2 {
+		t.Errorf("got %d media sections in the offer, want 2", got)
+	}
+	answer(t, remote, remoteChannel, offer)
+
+	// リモートのオファーには応答せず、保留したオファーを送る
+	answer(t, remote, remoteChannel, recv(ctx, t, remoteChannel, webrtc.SDPTypeOffer))
+	waitStable(t, negotiator.peerConnection)
+
+	// 安定した後に送り直したリモートのオファーには応答する
+	if _, err := remote.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	remoteOffer, err = remote.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLocalDescriptionAndSend(t, remote, remoteChannel, remoteOffer)
+	if err := remote.SetRemoteDescription(recv(ctx, t, remoteChannel, webrtc.SDPTypeAnswer)); err != nil {
+		t.Fatal(err)
+	}
+	waitStable(t, negotiator.peerConnection)
+	if got := countMedia(t, negotiator.peerConnection.LocalDescription()); got != 3 {
+		t.Errorf("got %d media sections after the glare, want 3", got)
+	}
+}
+
+// TestPendingICERestartは、ネゴシエーション中に要求されたICEリスタートが、
+// 応答を受け取った後に送るオファーで行われることを確認します
+func TestPendingICERestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	n := newNetwork(t)
+	channel, remoteChannel := signal.NewPipe()
+	negotiator := New(n.newPeerConnection(t, 0), Config{}, channel, zap.NewNop())
+	go negotiator.Run(ctx)
+	remote := n.newPeerConnection(t, 1)
+
+	if _, err := negotiator.AddTrack(newTrack(t, webrtc.MimeTypeVP8, "video")); err != nil {
+		t.Fatal(err)
+	}
+	offer := recv(ctx, t, remoteChannel, webrtc.SDPTypeOffer)
+	ufrag := iceUfrag(t, &offer)
+
+	// 応答する前にICEリスタートを要求すると、オファーは保留される
+	if err := negotiator.RestartICE(); err != nil {
+		t.Fatal(err)
+	}
+	answer(t, remote, remoteChannel, offer)
+
+	restart := recv(ctx, t, remoteChannel, webrtc.SDPTypeOffer)
+	if got := iceUfrag(t, &restart); got == ufrag {
+		t.Error("the pending offer did not restart ICE")
+	}
+	answer(t, remote, remoteChannel, restart)
+	waitStable(t, negotiator.peerConnection)
+}
+
+// TestICERestartは、ICEが切断された場合にICEリスタートで再接続し、
+// -disconnected-timeoutを過ぎてもセッションが継続することを確認します
+func TestICERestart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	n := newNetwork(t)
+	offererChannel, answererChannel := signal.NewPipe()
+	offerer := New(n.newPeerConnection(t, 0), Config{}, offererChannel, zap.NewNop())
+	restarting := New(n.newPeerConnection(t, 1), Config{ICERestartTimeout: 500 * time.Millisecond}, answererChannel, zap.NewNop())
+	disconnected := make(chan struct{})
+	var disconnectedOnce sync.Once
+	restarting.peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		restarting.ICEConnectionStateChange(state)
+		if state == webrtc.ICEConnectionStateDisconnected {
+			disconnectedOnce.Do(func() { close(disconnected) })
+		}
+	})
+	offerer.peerConnection.OnICEConnectionStateChange(offerer.ICEConnectionStateChange)
+	go offerer.Run(ctx)
+	go restarting.Run(ctx)
+
+	const disconnectedTimeout = 3 * time.Second
+	session := lifecycle.NewSession(ctx, zap.NewNop())
+	session.WatchPeerConnection(restarting.peerConnection, disconnectedTimeout, disconnectedTimeout, nil)
+
+	if _, err := offerer.AddTrack(newTrack(t, webrtc.MimeTypeVP8, "video")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarting.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ufrag := iceUfrag(t, restarting.peerConnection.LocalDescription())
+
+	// 接続中の候補のペアのパケットを破棄し続け、ICEリスタートで集めた新しい候補でのみ再接続できるようにする
+	pair, err := restarting.peerConnection.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		t.Fatalf("no selected candidate pair: %v", err)
+	}
+	blocked := map[string]bool{}
+	for _, c := range []*webrtc.ICECandidate{pair.Local, pair.Remote} {
+		blocked[c.Address+":"+strconv.Itoa(int(c.Port))] = true
+	}
+	n.setFilter(func(c vnet.Chunk) bool {
+		return !blocked[c.SourceAddr().String()] && !blocked[c.DestinationAddr().String()]
+	})
+
+	select {
+	case <-disconnected:
+	case <-ctx.Done():
+		t.Fatal("not disconnected")
+	}
+	disconnectedAt := time.Now()
+	if err := restarting.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := iceUfrag(t, restarting.peerConnection.LocalDescription()); got == ufrag {
+		t.Errorf("reconnected without an ICE restart")
+	}
+
+	// 切断から-disconnected-timeoutが過ぎてもセッションは終了しない
+	select {
+	case <-session.Context().Done():
+		t.Fatal("the session ended after the ICE restart")
+	case <-time.After(time.Until(disconnectedAt.Add(disconnectedTimeout + 500*time.Millisecond))):
+	}
+	if state := restarting.peerConnection.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+		t.Errorf("got connection state %s", state)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		restart time.Duration
+		valid   bool
+	}{
+		{0, true},
+		{3 * time.Second, true},
+		{10 * time.Second, false},
+		{time.Minute, false},
+		{-time.Second, false},
+	} {
+		err := Config{ICERestartTimeout: c.restart}.Validate(10 * time.Second)
+		if (err == nil) != c.valid {
+			t.Errorf("ICE restart timeout %s: got %v", c.restart, err)
+		}
+	}
+}
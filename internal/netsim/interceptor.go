@@ -0,0 +1,153 @@
+package netsim
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// readBuffer is the number of received packets buffered for a reader which does not keep up.
+// Packets arriving when the buffer is full are dropped, like the receive buffer of a socket.
+const readBuffer = 1000
+
+// receiveMTU is the size of the buffer packets are read into, the same as pion
+const receiveMTU = 1460
+
+// Interceptor impairs the sent and received RTP and RTCP packets of a PeerConnection.
+// It has to be registered before the other interceptors, so that it is the closest to the network.
+// An Interceptor must not be shared between PeerConnections.
+type Interceptor struct {
+	interceptor.NoOp
+
+	outbound *Link
+	inbound  *Link
+}
+
+// NewInterceptor creates an Interceptor impairing each direction with config
+func NewInterceptor(config Config) *Interceptor {
+	inbound := config
+	// 送信と受信で異なる乱数を使う
+	if inbound.Seed != 0 {
+		inbound.Seed++
+	}
+	return &Interceptor{outbound: NewLink(config), inbound: NewLink(inbound)}
+}
+
+// Stats returns the number of packets sent and dropped in each direction
+func (i *Interceptor) Stats() (outbound, inbound LinkStats) {
+	return i.outbound.Stats(), i.inbound.Stats()
+}
+
+// BindLocalStream impairs the sent RTP packets
+func (i *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		// 送信するまでの間にバッファーが再利用されるため、コピーしておく
+		buf, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal()
+		if err != nil {
+			return 0, err
+		}
+		i.outbound.Send(len(buf), func() {
+			packet := &rtp.Packet{}
+			if packet.Unmarshal(buf) == nil {
+				_, _ = writer.Write(&packet.Header, packet.Payload, attributes)
+			}
+		})
+		return len(buf), nil
+	})
+}
+
+// BindRTCPWriter impairs the sent RTCP packets
+func (i *Interceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(packets []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		buf, err := rtcp.Marshal(packets)
+		if err != nil {
+			return 0, err
+		}
+		i.outbound.Send(len(buf), func() {
+			if delivered, err := rtcp.Unmarshal(buf); err == nil {
+				_, _ = writer.Write(delivered, attributes)
+			}
+		})
+		return len(buf), nil
+	})
+}
+
+// BindRemoteStream impairs the received RTP packets
+func (i *Interceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	r := newImpairedReader(i.inbound, reader.Read)
+	return interceptor.RTPReaderFunc(r.read)
+}
+
+// BindRTCPReader impairs the received RTCP packets
+func (i *Interceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	r := newImpairedReader(i.inbound, reader.Read)
+	return interceptor.RTCPReaderFunc(r.read)
+}
+
+// Close stops both directions. The packets in flight are dropped.
+func (i *Interceptor) Close() error {
+	i.outbound.Close()
+	i.inbound.Close()
+	return nil
+}
+
+// received is a packet which has arrived through the inbound Link
+type received struct {
+	buf        []byte
+	attributes interceptor.Attributes
+}
+
+// impairedReader reads the packets from the next reader in a goroutine,
+// sends them over the Link and returns them when they arrive
+type impairedReader struct {
+	link *Link
+	next func([]byte, interceptor.Attributes) (int, interceptor.Attributes, error)
+
+	once    sync.Once
+	arrived chan received
+	// err is the error of the next reader, set before done is closed
+	err  error
+	done chan struct{}
+}
+
+func newImpairedReader(link *Link, next func([]byte, interceptor.Attributes) (int, interceptor.Attributes, error)) *impairedReader {
+	return &impairedReader{
+		link:    link,
+		next:    next,
+		arrived: make(chan received, readBuffer),
+		done:    make(chan struct{}),
+	}
+}
+
+// pump reads the packets from the next reader until it returns an error
+func (r *impairedReader) pump() {
+	buf := make([]byte, receiveMTU)
+	for {
+		n, attributes, err := r.next(buf, nil)
+		if err != nil {
+			r.err = err
+			close(r.done)
+			return
+		}
+		packet := received{buf: append([]byte(nil), buf[:n]...), attributes: attributes}
+		r.link.Send(n, func() {
+			select {
+			case r.arrived <- packet:
+			default:
+			}
+		})
+	}
+}
+
+func (r *impairedReader) read(b []byte, _ interceptor.Attributes) (int, interceptor.Attributes, error) {
+	// 読み込まれるまではパケットを読まない
+	r.once.Do(func() { go r.pump() })
+	select {
+	case packet := <-r.arrived:
+		return copy(b, packet.buf), packet.attributes, nil
+	case <-r.done:
+		return 0, nil, r.err
+	}
+}
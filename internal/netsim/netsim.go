@@ -0,0 +1,245 @@
+// Package netsim impairs the RTP and RTCP packets of a PeerConnection like a
+// bad network: packet loss, latency, jitter, reordering and a bandwidth cap.
+//
+// The impairment is applied by an interceptor, so it works the same over the
+// real network and over the simulated network of the loopback tests (pion
+// vnet). ICE, DTLS and the data channels are not impaired, so that a session
+// can always be established.
+package netsim
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxQueueDelay is how long a packet may wait for the bandwidth cap before it is dropped,
+// the size of the queue of the bottleneck link
+const maxQueueDelay = 500 * time.Millisecond
+
+// Config is the configuration of the impairment, applied to each direction
+type Config struct {
+	// Loss is the percentage of packets dropped at random
+	Loss float64
+	// Delay is the latency added to every packet
+	Delay time.Duration
+	// Jitter is the maximum random variation of Delay, uniform in [-Jitter, Jitter]
+	Jitter time.Duration
+	// Reorder is the percentage of packets sent without Delay,
+	// so that they overtake the delayed packets sent before them
+	Reorder float64
+	// Bandwidth is the bandwidth cap in bits per second. There is no cap when it is 0.
+	Bandwidth int
+	// Seed is the seed of the random numbers. The current time is used when it is 0.
+	Seed int64
+}
+
+// Flags registers the network impairment flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.Float64Var(&c.Loss, "net-loss", 0, "percentage of RTP and RTCP packets dropped in each direction")
+	flag.DurationVar(&c.Delay, "net-delay", 0, "latency added to the RTP and RTCP packets in each direction, e.g. 100ms")
+	flag.DurationVar(&c.Jitter, "net-jitter", 0, "maximum random variation of -net-delay")
+	flag.Float64Var(&c.Reorder, "net-reorder", 0, "percentage of packets sent without -net-delay, so that they are reordered")
+	flag.IntVar(&c.Bandwidth, "net-bandwidth", 0, "bandwidth cap in bits per second in each direction (no cap when 0)")
+	flag.Int64Var(&c.Seed, "net-seed", 0, "seed of the random numbers of the impairment (the current time when 0)")
+	return c
+}
+
+// Enabled returns true when any impairment is configured
+func (c Config) Enabled() bool {
+	return c.Loss > 0 || c.Delay > 0 || c.Jitter > 0 || c.Reorder > 0 || c.Bandwidth > 0
+}
+
+// Validate returns an error when the configuration is out of range
+func (c Config) Validate() error {
+	if c.Loss < 0 || c.Loss > 100 {
+		return fmt.Errorf("invalid packet loss %g%%", c.Loss)
+	}
+	if c.Reorder < 0 || c.Reorder > 100 {
+		return fmt.Errorf("invalid reordering %g%%", c.Reorder)
+	}
+	if c.Delay < 0 || c.Jitter < 0 {
+		return fmt.Errorf("invalid delay %s and jitter %s", c.Delay, c.Jitter)
+	}
+	if c.Bandwidth < 0 {
+		return fmt.Errorf("invalid bandwidth %d", c.Bandwidth)
+	}
+	return nil
+}
+
+// LinkStats is the number of packets which went through a Link
+type LinkStats struct {
+	Sent    uint64
+	Dropped uint64
+}
+
+// Link is one direction of an impaired network. Packets are delivered in the
+// order of their arrival time by a single goroutine.
+type Link struct {
+	config Config
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// busyUntil is when the bandwidth capped link has sent the queued packets
+	busyUntil time.Time
+	queue     packetQueue
+	seq       uint64
+	stats     LinkStats
+	closed    bool
+	// wake is signaled when a packet is queued, so that the next arrival time is recalculated
+	wake chan struct{}
+	done chan struct{}
+}
+
+// NewLink creates a Link and starts delivering the packets sent to it
+func NewLink(config Config) *Link {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	l := &Link{
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Send sends a packet of size bytes over the link. deliver is called when the
+// packet arrives, and is not called when the packet is lost.
+func (l *Link) Send(size int, deliver func()) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.stats.Sent++
+
+	if l.config.Loss > 0 && l.rand.Float64()*100 < l.config.Loss {
+		l.stats.Dropped++
+		return
+	}
+
+	// 帯域の上限がある場合は、先に送信したパケットを送り終えてから送信する
+	departure := now
+	if l.config.Bandwidth > 0 {
+		if l.busyUntil.After(departure) {
+			departure = l.busyUntil
+		}
+		if departure.Sub(now) > maxQueueDelay {
+			l.stats.Dropped++
+			return
+		}
+		departure = departure.Add(time.Duration(size) * 8 * time.Second / time.Duration(l.config.Bandwidth))
+		l.busyUntil = departure
+	}
+
+	delay := l.config.Delay
+	if l.config.Reorder > 0 && l.rand.Float64()*100 < l.config.Reorder {
+		delay = 0
+	} else if l.config.Jitter > 0 {
+		delay += time.Duration(l.rand.Int63n(int64(2*l.config.Jitter)+1)) - l.config.Jitter
+		if delay < 0 {
+			delay = 0
+		}
+	}
+
+	l.seq++
+	heap.Push(&l.queue, &packet{arrival: departure.Add(delay), seq: l.seq, deliver: deliver})
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the number of packets sent and dropped
+func (l *Link) Stats() LinkStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// Close stops the link. The packets which have not arrived yet are dropped.
+func (l *Link) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+}
+
+func (l *Link) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		var next *packet
+		wait := time.Hour
+		if len(l.queue) > 0 {
+			if wait = time.Until(l.queue[0].arrival); wait <= 0 {
+				next = heap.Pop(&l.queue).(*packet)
+			}
+		}
+		l.mu.Unlock()
+
+		if next != nil {
+			next.deliver()
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-l.done:
+			return
+		case <-l.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// packet is a packet in flight
+type packet struct {
+	arrival time.Time
+	// seq keeps the order of the packets which arrive at the same time
+	seq     uint64
+	deliver func()
+}
+
+// packetQueue is a heap of the packets in flight ordered by their arrival time
+type packetQueue []*packet
+
+func (q packetQueue) Len() int { return len(q) }
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].arrival.Equal(q[j].arrival) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].arrival.Before(q[j].arrival)
+}
+func (q packetQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *packetQueue) Push(x interface{}) { *q = append(*q, x.(*packet)) }
+func (q *packetQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,130 @@
+package netsim
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// sendAll sends n packets of size bytes every interval and waits wait for the last packet.
+// It returns the arrival times of the delivered packets by index, the indexes in the order
+// of arrival and the send times.
+func sendAll(l *Link, n, size int, interval, wait time.Duration) (map[int]time.Time, []int, []time.Time) {
+	var mu sync.Mutex
+	arrivals := map[int]time.Time{}
+	var order []int
+	sentAt := make([]time.Time, n)
+	for i := 0; i < n; i++ {
+		i := i
+		sentAt[i] = time.Now()
+		l.Send(size, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			arrivals[i] = time.Now()
+			order = append(order, i)
+		})
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+	}
+	time.Sleep(wait)
+	mu.Lock()
+	defer mu.Unlock()
+	return arrivals, order, sentAt
+}
+
+func TestLinkLoss(t *testing.T) {
+	l := NewLink(Config{Loss: 20, Seed: 1})
+	defer l.Close()
+
+	const n = 5000
+	arrivals, order, _ := sendAll(l, n, 100, 0, 100*time.Millisecond)
+	lost := n - len(arrivals)
+	if lost < n*15/100 || lost > n*25/100 {
+		t.Errorf("lost %d of %d packets, want about 20%%", lost, n)
+	}
+	if stats := l.Stats(); stats.Sent != n || stats.Dropped != uint64(lost) {
+		t.Errorf("got %+v, want %d sent and %d dropped", stats, n, lost)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			t.Fatalf("packet %d arrived after packet %d without reordering", order[i-1], order[i])
+		}
+	}
+}
+
+func TestLinkDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	l := NewLink(Config{Delay: delay})
+	defer l.Close()
+
+	arrivals, order, sentAt := sendAll(l, 20, 100, time.Millisecond, 2*delay)
+	if len(arrivals) != 20 {
+		t.Fatalf("%d of 20 packets arrived", len(arrivals))
+	}
+	for i, arrival := range arrivals {
+		if d := arrival.Sub(sentAt[i]); d < delay {
+			t.Errorf("packet %d arrived in %s, want at least %s", i, d, delay)
+		}
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			t.Fatalf("packet %d arrived after packet %d without reordering", order[i-1], order[i])
+		}
+	}
+}
+
+func TestLinkReorder(t *testing.T) {
+	l := NewLink(Config{Delay: 50 * time.Millisecond, Reorder: 50, Seed: 1})
+	defer l.Close()
+
+	arrivals, order, _ := sendAll(l, 20, 100, time.Millisecond, 100*time.Millisecond)
+	if len(arrivals) != 20 {
+		t.Fatalf("%d of 20 packets arrived", len(arrivals))
+	}
+	reordered := 0
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			reordered++
+		}
+	}
+	if reordered == 0 {
+		t.Errorf("no packet has been reordered: %v", order)
+	}
+}
+
+func TestLinkBandwidth(t *testing.T) {
+	// 1000バイトのパケットを8Mbpsで送ると、1パケットあたり1ms
+	const bandwidth = 8000000
+	l := NewLink(Config{Bandwidth: bandwidth})
+	defer l.Close()
+
+	start := time.Now()
+	arrivals, _, _ := sendAll(l, 100, 1000, 0, 200*time.Millisecond)
+	if len(arrivals) != 100 {
+		t.Fatalf("%d of 100 packets arrived", len(arrivals))
+	}
+	if d := arrivals[99].Sub(start); d < 100*time.Millisecond {
+		t.Errorf("the last packet arrived in %s, want at least 100ms", d)
+	}
+
+	// キューの上限(maxQueueDelay)を超えるパケットは捨てられる
+	arrivals, _, _ = sendAll(l, 1000, 1000, 0, maxQueueDelay+200*time.Millisecond)
+	if len(arrivals) >= 1000 || len(arrivals) < 400 {
+		t.Errorf("%d of 1000 packets arrived, want about 500", len(arrivals))
+	}
+}
+
+func TestLinkClose(t *testing.T) {
+	l := NewLink(Config{Delay: 50 * time.Millisecond})
+	arrived := make(chan struct{}, 1)
+	l.Send(100, func() { arrived <- struct{}{} })
+	l.Close()
+	l.Send(100, func() { arrived <- struct{}{} })
+
+	select {
+	case <-arrived:
+		t.Error("a packet arrived after Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,655 @@
+// Package recording writes the received media of each session to its own
+// directory of a storage.Storage, together with a JSON manifest describing the
+// tracks, and keeps the total size and the age of the recordings within limits.
+//
+// A session directory is named after the start time and the session ID, e.g.
+// 20061102T150405Z-1, and contains a file per track (video-<track ID>.ivf,
+// audio-<track ID>.ogg, ...), the files written with WriteFile such as JPEG
+// snapshots, and manifest.json. Only directories containing manifest.json are
+// considered recordings, so other files in the storage are never removed.
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/storage"
+	"go.uber.org/zap"
+)
+
+// ManifestName is the name of the manifest in a session directory
+const ManifestName = "manifest.json"
+
+const (
+	// maxGaps is the maximum number of gaps listed in the manifest of a track
+	maxGaps = 100
+	// pruneInterval is the minimum interval of the prunes started by writing over the quota
+	pruneInterval = 10 * time.Second
+)
+
+var (
+	// ErrUnsupportedCodec is returned by AddTrack when the codec of the track cannot be written to a file
+	ErrUnsupportedCodec = errors.New("recording: unsupported codec")
+	// ErrQuotaExceeded is returned when writing would exceed Config.Quota.
+	// The recording is truncated and nothing more is written.
+	ErrQuotaExceeded = errors.New("recording: quota exceeded")
+	// ErrClosed is returned when the recording has been closed
+	ErrClosed = errors.New("recording: closed")
+)
+
+// Config is the configuration of the recordings
+type Config struct {
+	// Dir is the directory the session directories are created in, or an s3://bucket/prefix URL
+	// of the S3-compatible storage (see storage.Open)
+	Dir string
+	// Quota is the maximum total size in bytes of the recordings in Dir. Unlimited when 0.
+	Quota int64
+	// Retention is how long a recording is kept after it was last written. Kept forever when 0.
+	Retention time.Duration
+}
+
+// Flags registers the recording flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Dir, "record-dir", "./out", "directory a recording directory is created in for each session, or an s3://bucket/prefix URL to upload the recordings to S3 (see -s3-*)")
+	flag.Var((*megabytes)(&c.Quota), "record-quota-mb", "maximum total size in MB of the recordings; the oldest are removed, and the current one is truncated when it is not enough (unlimited when 0)")
+	flag.DurationVar(&c.Retention, "record-retention", 0, "remove the recordings older than this, e.g. 168h (kept forever when 0)")
+	return c
+}
+
+// megabytes is a flag.Value setting a size in bytes from a number of megabytes
+type megabytes int64
+
+func (m *megabytes) String() string {
+	return fmt.Sprint(int64(*m) >> 20)
+}
+
+func (m *megabytes) Set(s string) error {
+	var mb int64
+	if _, err := fmt.Sscan(s, &mb); err != nil {
+		return err
+	}
+	*m = megabytes(mb << 20)
+	return nil
+}
+
+// Validate returns an error when the configuration is invalid
+func (c Config) Validate() error {
+	if c.Dir == "" {
+		return errors.New("no recording directory is given")
+	}
+	if c.Quota < 0 || c.Retention < 0 {
+		return fmt.Errorf("invalid recording quota %d and retention %s", c.Quota, c.Retention)
+	}
+	return nil
+}
+
+// Manifest is the content of manifest.json of a session directory
+type Manifest struct {
+	Session string     `json:"session"`
+	Start   time.Time  `json:"start"`
+	End     *time.Time `json:"end,omitempty"`
+	// Truncated is true when the recording was stopped because of the quota
+	Truncated bool            `json:"truncated,omitempty"`
+	Tracks    []TrackManifest `json:"tracks"`
+	Files     []FileManifest  `json:"files,omitempty"`
+}
+
+// TrackManifest describes a track of a recording
+type TrackManifest struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	File        string `json:"file"`
+	MimeType    string `json:"mimeType"`
+	PayloadType uint8  `json:"payloadType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    uint16 `json:"channels,omitempty"`
+	// SSRCs are the SSRCs of the packets written, in the order they appeared
+	SSRCs []uint32 `json:"ssrcs"`
+	// Start and End are the times the first and the last packets were written
+	Start   *time.Time `json:"start,omitempty"`
+	End     *time.Time `json:"end,omitempty"`
+	Packets uint64     `json:"packets"`
+	Bytes   int64      `json:"bytes"`
+	// MissingPackets is the number of packets skipped by the sequence numbers
+	MissingPackets uint64 `json:"missingPackets"`
+	// GapCount is the number of gaps, of which the first maxGaps are listed in Gaps
+	GapCount int   `json:"gapCount"`
+	Gaps     []Gap `json:"gaps,omitempty"`
+}
+
+// Gap is a range of sequence numbers missing in a track
+type Gap struct {
+	Time time.Time `json:"time"`
+	// After is the sequence number of the packet before the gap
+	After   uint16 `json:"after"`
+	Missing uint16 `json:"missing"`
+}
+
+// FileManifest describes a file written with WriteFile
+type FileManifest struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// Manager creates the session directories in the storage and removes the old
+// recordings. A Manager is shared by the sessions of the process.
+type Manager struct {
+	config  Config
+	storage storage.Storage
+	logger  *zap.Logger
+	now     func() time.Time
+
+	// pruneLock serializes the prunes and the start of the recordings. The storage is
+	// listed and the files are removed without holding mu, so that writing never waits for the storage.
+	pruneLock sync.Mutex
+
+	mu sync.Mutex
+	// active are the recordings not closed yet, which are never removed
+	active map[*Recording]struct{}
+	// activeSize is the total size of the active recordings
+	activeSize int64
+	// finishedSize is the size of the recordings which are not active, as of the last prune
+	// plus the recordings finished since
+	finishedSize int64
+	// pruneActive are the recordings active when the running prune started, nil while not pruning.
+	// The prune skips them, and finishedDuringPrune is the size of those finished meanwhile
+	pruneActive         map[*Recording]bool
+	finishedDuringPrune int64
+	// lastPrune is the time a prune was last started by writing over the quota
+	lastPrune time.Time
+}
+
+// NewManager returns a Manager of the recordings in the storage opened from config.Dir
+func NewManager(config Config, storage storage.Storage, logger *zap.Logger) *Manager {
+	return &Manager{config: config, storage: storage, logger: logger, now: time.Now, active: map[*Recording]struct{}{}}
+}
+
+// Start removes the old recordings and creates the directory of a new recording of the session
+func (m *Manager) Start(sessionID string) (*Recording, error) {
+	m.pruneLock.Lock()
+	defer m.pruneLock.Unlock()
+	if err := m.pruneLocked(); err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	name := now.UTC().Format("20060102T150405Z") + "-" + sanitize(sessionID)
+	r := &Recording{manager: m, name: name, manifest: Manifest{Session: sessionID, Start: now, Tracks: []TrackManifest{}}}
+	if err := r.writeManifest(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.active[r] = struct{}{}
+	m.mu.Unlock()
+	m.logger.Info("Recording has started", zap.String("dir", r.Location()))
+	return r, nil
+}
+
+// Prune removes the recordings older than Config.Retention, and then the oldest
+// recordings until the total size is within Config.Quota. Active recordings are not removed.
+func (m *Manager) Prune() error {
+	m.pruneLock.Lock()
+	defer m.pruneLock.Unlock()
+	return m.pruneLocked()
+}
+
+// sessionDir is a recording found in the storage
+type sessionDir struct {
+	name string
+	// modTime is the time the manifest was last written
+	modTime time.Time
+	size    int64
+	// hasManifest is false for the directories which are not recordings
+	hasManifest bool
+}
+
+// pruneLocked prunes the storage while holding pruneLock. mu is held only to read and update the sizes.
+func (m *Manager) pruneLocked() error {
+	m.mu.Lock()
+	active := map[string]bool{}
+	m.pruneActive = map[*Recording]bool{}
+	for r := range m.active {
+		active[r.name] = true
+		m.pruneActive[r] = true
+	}
+	m.finishedDuringPrune = 0
+	m.mu.Unlock()
+
+	total, err := m.removeOld(active)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneActive = nil
+	if err != nil {
+		return err
+	}
+	m.finishedSize = total + m.finishedDuringPrune
+	return nil
+}
+
+// removeOld removes the recordings which are not active following Config.Retention and Config.Quota,
+// and returns the total size of the recordings kept. The recordings in active are skipped even
+// when they finish meanwhile, as they are counted by uncountedSize instead.
+func (m *Manager) removeOld(active map[string]bool) (int64, error) {
+	files, err := m.storage.List()
+	if err != nil {
+		return 0, err
+	}
+	found := map[string]*sessionDir{}
+	for _, file := range files {
+		i := strings.IndexByte(file.Name, '/')
+		if i < 0 || active[file.Name[:i]] {
+			continue
+		}
+		dir := found[file.Name[:i]]
+		if dir == nil {
+			dir = &sessionDir{name: file.Name[:i]}
+			found[dir.name] = dir
+		}
+		dir.size += file.Size
+		if file.Name[i+1:] == ManifestName {
+			dir.modTime, dir.hasManifest = file.ModTime, true
+		}
+	}
+	var dirs []sessionDir
+	for _, dir := range found {
+		if dir.hasManifest {
+			dirs = append(dirs, *dir)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].modTime.Before(dirs[j].modTime) })
+
+	now := m.now()
+	var total int64
+	kept := dirs[:0]
+	for _, dir := range dirs {
+		if m.config.Retention > 0 && now.Sub(dir.modTime) > m.config.Retention {
+			if err := m.remove(dir, "retention"); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		kept = append(kept, dir)
+		total += dir.size
+	}
+	// 古い録画から、合計がクォータに収まるまで削除する
+	for len(kept) > 0 && m.config.Quota > 0 && total+m.uncountedSize() > m.config.Quota {
+		if err := m.remove(kept[0], "quota"); err != nil {
+			return 0, err
+		}
+		total -= kept[0].size
+		kept = kept[1:]
+	}
+	return total, nil
+}
+
+func (m *Manager) remove(dir sessionDir, reason string) error {
+	if err := m.storage.RemoveAll(dir.name); err != nil {
+		return err
+	}
+	m.logger.Info("Recording has been removed", zap.String("dir", m.storage.Location(dir.name)), zap.String("reason", reason), zap.Int64("bytes", dir.size))
+	return nil
+}
+
+// uncountedSize is the size of the recordings skipped by the running prune:
+// the active recordings and those finished since the prune started
+func (m *Manager) uncountedSize() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeSize + m.finishedDuringPrune
+}
+
+// reserve returns ErrQuotaExceeded when the recordings have reached the quota and no
+// finished recording is left to remove. Otherwise the oldest recordings are removed in
+// the background, and the recordings may exceed the quota until they have been removed.
+// reserve is called for every write and never waits for the storage.
+func (m *Manager) reserve() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.config.Quota == 0 || m.finishedSize+m.activeSize < m.config.Quota {
+		return nil
+	}
+	if m.finishedSize == 0 {
+		return ErrQuotaExceeded
+	}
+	if now := m.now(); now.Sub(m.lastPrune) >= pruneInterval {
+		m.lastPrune = now
+		go func() {
+			if err := m.Prune(); err != nil {
+				m.logger.Warn("Failed to remove the old recordings", zap.Error(err))
+			}
+		}()
+	}
+	return nil
+}
+
+// written adds the bytes written to a recording
+func (m *Manager) written(r *Recording, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.size += n
+	m.activeSize += n
+}
+
+// finished stops counting the recording as active
+func (m *Manager) finished(r *Recording) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.active, r)
+	m.activeSize -= r.size
+	m.finishedSize += r.size
+	if m.pruneActive[r] {
+		m.finishedDuringPrune += r.size
+	}
+}
+
+// Recording is the directory of a session. The methods of Recording and Track may be called concurrently.
+type Recording struct {
+	manager *Manager
+	name    string
+
+	mu       sync.Mutex
+	manifest Manifest
+	tracks   []*Track
+	closed   bool
+	// size is the number of bytes written, guarded by manager.mu
+	size int64
+}
+
+// Name returns the name of the session directory in the storage
+func (r *Recording) Name() string {
+	return r.name
+}
+
+// Location returns where the session directory is stored, for the logs
+func (r *Recording) Location() string {
+	return r.manager.storage.Location(r.name)
+}
+
+// Manifest returns a copy of the manifest
+func (r *Recording) Manifest() Manifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updateTracks()
+	manifest := r.manifest
+	manifest.Tracks = append([]TrackManifest(nil), r.manifest.Tracks...)
+	manifest.Files = append([]FileManifest(nil), r.manifest.Files...)
+	return manifest
+}
+
+// AddTrack creates the file of a track. VP8 is written to IVF, Opus to Ogg and H.264 to an Annex B byte stream;
+// ErrUnsupportedCodec is returned for the other codecs.
+func (r *Recording) AddTrack(id string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters) (*Track, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrClosed
+	}
+	var extension string
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		extension = ".ivf"
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		extension = ".ogg"
+	case strings.ToLower(webrtc.MimeTypeH264):
+		extension = ".h264"
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedCodec, codec.MimeType)
+	}
+
+	// 同じIDのトラックを受信した場合は番号を付ける
+	base := kind.String() + "-" + sanitize(id)
+	name := base + extension
+	for i := 2; r.hasFile(name); i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, extension)
+	}
+	file, err := r.manager.storage.Create(r.name + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	t := &Track{recording: r}
+	t.manifest = TrackManifest{
+		ID: id, Kind: kind.String(), File: name, MimeType: codec.MimeType, PayloadType: uint8(codec.PayloadType),
+		ClockRate: codec.ClockRate, Channels: codec.Channels, SSRCs: []uint32{},
+	}
+	// 書き込みはr.muを保持したまま行われる
+	counter := &countingWriter{w: file, grown: func(n int64) {
+		t.manifest.Bytes += n
+		r.manager.written(r, n)
+	}}
+	// ローカルのファイルでは、閉じる時にIVFのヘッダーのフレーム数を書き直せるようにする
+	var out io.Writer = counter
+	if seeker, ok := file.(io.Seeker); ok {
+		out = &countingSeeker{countingWriter: counter, seeker: seeker}
+	}
+	switch extension {
+	case ".ivf":
+		t.writer, err = ivfwriter.NewWith(out)
+	case ".ogg":
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 1
+		}
+		t.writer, err = oggwriter.NewWith(out, codec.ClockRate, channels)
+	case ".h264":
+		t.writer = h264writer.NewWith(out)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.tracks = append(r.tracks, t)
+	r.manifest.Tracks = append(r.manifest.Tracks, t.manifest)
+	return t, r.writeManifest()
+}
+
+// WriteFile writes a file such as a snapshot to the session directory
+func (r *Recording) WriteFile(name string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reserveLocked(); err != nil {
+		return err
+	}
+	if name != path.Base(name) || r.hasFile(name) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	if err := r.manager.storage.WriteFile(r.name+"/"+name, data); err != nil {
+		return err
+	}
+	r.manager.written(r, int64(len(data)))
+	r.manifest.Files = append(r.manifest.Files, FileManifest{Name: name, Time: r.manager.now(), Size: int64(len(data))})
+	return nil
+}
+
+// Close closes the files of the tracks and writes the manifest with the end time.
+// Close may be called more than once.
+func (r *Recording) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	var err error
+	for _, t := range r.tracks {
+		// S3では、ここで最後のパートをアップロードする
+		if closeErr := t.writer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	end := r.manager.now()
+	r.manifest.End = &end
+	r.updateTracks()
+	if manifestErr := r.writeManifest(); manifestErr != nil && err == nil {
+		err = manifestErr
+	}
+	r.manager.finished(r)
+	r.manager.logger.Info("Recording has finished", zap.String("dir", r.Location()), zap.Bool("truncated", r.manifest.Truncated))
+	return err
+}
+
+// reserveLocked returns an error when nothing can be written anymore
+func (r *Recording) reserveLocked() error {
+	if r.closed {
+		return ErrClosed
+	}
+	if r.manifest.Truncated {
+		return ErrQuotaExceeded
+	}
+	if err := r.manager.reserve(); err != nil {
+		if errors.Is(err, ErrQuotaExceeded) {
+			r.manifest.Truncated = true
+			r.manager.logger.Warn("Recording has been truncated because of the quota", zap.String("dir", r.Location()), zap.Int64("quota", r.manager.config.Quota))
+		}
+		return err
+	}
+	return nil
+}
+
+// updateTracks copies the manifests of the tracks to the manifest
+func (r *Recording) updateTracks() {
+	for i, t := range r.tracks {
+		r.manifest.Tracks[i] = t.manifest
+		r.manifest.Tracks[i].SSRCs = append([]uint32(nil), t.manifest.SSRCs...)
+		r.manifest.Tracks[i].Gaps = append([]Gap(nil), t.manifest.Gaps...)
+	}
+}
+
+func (r *Recording) hasFile(name string) bool {
+	for _, t := range r.tracks {
+		if t.manifest.File == name {
+			return true
+		}
+	}
+	for _, f := range r.manifest.Files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeManifest replaces manifest.json at once, so that a partially written manifest is never read
+func (r *Recording) writeManifest() error {
+	b, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.manager.storage.WriteFile(r.name+"/"+ManifestName, append(b, '\n'))
+}
+
+// Track is the file of a track of a Recording
+type Track struct {
+	recording *Recording
+	writer    interface {
+		WriteRTP(packet *rtp.Packet) error
+		Close() error
+	}
+	// manifest is guarded by recording.mu
+	manifest TrackManifest
+	// lastSequenceNumber is the sequence number of the last packet of the current SSRC
+	lastSequenceNumber uint16
+}
+
+// WriteRTP writes a packet to the file and records the SSRC, the time and the gaps of the sequence numbers
+func (t *Track) WriteRTP(packet *rtp.Packet) error {
+	r := t.recording
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reserveLocked(); err != nil {
+		return err
+	}
+	now := r.manager.now()
+	m := &t.manifest
+	if len(m.SSRCs) == 0 || m.SSRCs[len(m.SSRCs)-1] != packet.SSRC {
+		// SSRCが変わった場合は、シーケンス番号の連続性を確認し直す
+		m.SSRCs = append(m.SSRCs, packet.SSRC)
+		t.lastSequenceNumber = packet.SequenceNumber
+	} else if diff := packet.SequenceNumber - t.lastSequenceNumber; diff > 0 && diff < 0x8000 {
+		if diff > 1 {
+			m.MissingPackets += uint64(diff - 1)
+			m.GapCount++
+			if len(m.Gaps) < maxGaps {
+				m.Gaps = append(m.Gaps, Gap{Time: now, After: t.lastSequenceNumber, Missing: diff - 1})
+			}
+		}
+		t.lastSequenceNumber = packet.SequenceNumber
+	}
+	// 重複・順序が入れ替わったパケットは、間隔に含めずにそのまま書き込む
+	if err := t.writer.WriteRTP(packet); err != nil {
+		return err
+	}
+	if m.Start == nil {
+		m.Start = &now
+	}
+	end := now
+	m.End = &end
+	m.Packets++
+	return nil
+}
+
+// countingWriter counts the bytes by which a file grows
+type countingWriter struct {
+	w      io.WriteCloser
+	offset int64
+	size   int64
+	grown  func(n int64)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.offset += int64(n)
+	if c.offset > c.size {
+		c.grown(c.offset - c.size)
+		c.size = c.offset
+	}
+	return n, err
+}
+
+func (c *countingWriter) Close() error {
+	return c.w.Close()
+}
+
+// countingSeeker is a countingWriter of a file which can seek
+type countingSeeker struct {
+	*countingWriter
+	seeker io.Seeker
+}
+
+func (c *countingSeeker) Seek(offset int64, whence int) (int64, error) {
+	position, err := c.seeker.Seek(offset, whence)
+	if err == nil {
+		c.offset = position
+	}
+	return position, err
+}
+
+// sanitize replaces the characters which cannot be used safely in a file name
+func sanitize(s string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+	if sanitized == "" {
+		return "_"
+	}
+	return sanitized
+}
@@ -0,0 +1,471 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/storage"
+	"go.uber.org/zap"
+)
+
+var opus = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, PayloadType: 111}
+
+// clockは、テストで進める時刻です
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestManager(t *testing.T, config Config) (*Manager, *clock) {
+	t.Helper()
+	config.Dir = t.TempDir()
+	c := &clock{t: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	m := NewManager(config, storage.NewLocal(config.Dir), zap.NewNop())
+	m.now = c.now
+	return m, c
+}
+
+// vp8Packetは、1パケットで1フレームのVP8のキーフレームです
+func vp8Packet(ssrc uint32, seq uint16) *rtp.Packet {
+	return &rtp.Packet{
+		Header: rtp.Header{Version: 2, PayloadType: 96, SSRC: ssrc, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+		// VP8のペイロードディスクリプタ(S=1)と、キーフレームのヘッダー
+		Payload: []byte{0x10, 0x00, 0x00, 0x00, 0x9d, 0x01, 0x2a, 0x40, 0x00, 0x30, 0x00},
+	}
+}
+
+func readManifest(t *testing.T, dir string) Manifest {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+// waitRemovedは、バックグラウンドで録画が削除され、削除が終わるのを待ちます
+func waitRemoved(t *testing.T, m *Manager, dir string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not removed", dir)
+		}
+	}
+	m.pruneLock.Lock()
+	m.pruneLock.Unlock()
+}
+
+func TestRecording(t *testing.T) {
+	m, c := newTestManager(t, Config{})
+	r, err := m.Start("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name() != "20210601T120000Z-1" {
+		t.Fatalf("got directory %s, want 20210601T120000Z-1", r.Name())
+	}
+	dir := filepath.Join(m.config.Dir, r.Name())
+
+	video, err := r.AddTrack("{video/1}", webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AddTrack("audio", webrtc.RTPCodecTypeAudio, opus); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.AddTrack("video", webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9}}); !errors.Is(err, ErrUnsupportedCodec) {
+		t.Errorf("got %v for VP9, want ErrUnsupportedCodec", err)
+	}
+
+	// 3と4、9が抜けている。2の重複と、SSRCの変更は間隔に含めない
+	for _, p := range []struct {
+		ssrc uint32
+		seq  uint16
+	}{{1, 1}, {1, 2}, {1, 2}, {1, 5}, {1, 6}, {2, 100}, {2, 101}, {2, 103}} {
+		c.t = c.t.Add(time.Second)
+		if err := video.WriteRTP(vp8Packet(p.ssrc, p.seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.WriteFile("frame-1.jpg", []byte("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WriteFile("../frame.jpg", nil); err == nil {
+		t.Error("a file outside of the directory has been written")
+	}
+	c.t = c.t.Add(time.Second)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := video.WriteRTP(vp8Packet(2, 104)); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v after Close, want ErrClosed", err)
+	}
+
+	manifest := readManifest(t, dir)
+	if manifest.Session != "1" || manifest.End == nil || !manifest.End.Equal(c.t) || manifest.Truncated {
+		t.Errorf("got session %q ending at %v (truncated %v)", manifest.Session, manifest.End, manifest.Truncated)
+	}
+	if len(manifest.Tracks) != 2 || len(manifest.Files) != 1 || manifest.Files[0].Name != "frame-1.jpg" {
+		t.Fatalf("got %d tracks and files %+v", len(manifest.Tracks), manifest.Files)
+	}
+	track := manifest.Tracks[0]
+	if track.File != "video-_video_1_.ivf" || track.MimeType != webrtc.MimeTypeVP8 || track.Packets != 8 {
+		t.Errorf("got %s (%s) with %d packets", track.File, track.MimeType, track.Packets)
+	}
+	if len(track.SSRCs) != 2 || track.SSRCs[0] != 1 || track.SSRCs[1] != 2 {
+		t.Errorf("got SSRCs %v, want [1 2]", track.SSRCs)
+	}
+	if track.MissingPackets != 3 || track.GapCount != 2 || len(track.Gaps) != 2 || track.Gaps[0].After != 2 || track.Gaps[0].Missing != 2 || track.Gaps[1].After != 101 {
+		t.Errorf("got %d missing packets in gaps %+v", track.MissingPackets, track.Gaps)
+	}
+	info, err := os.Stat(filepath.Join(dir, track.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.Bytes != info.Size() {
+		t.Errorf("got %d bytes, want %d", track.Bytes, info.Size())
+	}
+	if manifest.Tracks[1].File != "audio-audio.ogg" || manifest.Tracks[1].Start != nil {
+		t.Errorf("got audio track %+v", manifest.Tracks[1])
+	}
+
+	f, err := os.Open(filepath.Join(dir, track.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.NumFrames != 8 {
+		t.Errorf("got %d frames, want 8", header.NumFrames)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	m, c := newTestManager(t, Config{Retention: time.Hour})
+	var dirs []string
+	for _, id := range []string{"1", "2"} {
+		r, err := m.Start(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, filepath.Join(m.config.Dir, r.Name()))
+		// 保持期間は最後にマニフェストを書き込んだ時刻から数える
+		modTime := c.t.Add(-2 * time.Hour)
+		if id == "2" {
+			modTime = c.t.Add(-30 * time.Minute)
+		}
+		if err := os.Chtimes(filepath.Join(dirs[len(dirs)-1], ManifestName), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		c.t = c.t.Add(time.Second)
+	}
+	// マニフェストのないディレクトリは録画ではない
+	other := filepath.Join(m.config.Dir, "other")
+	if err := os.Mkdir(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		dir  string
+		kept bool
+	}{{dirs[0], false}, {dirs[1], true}, {other, true}} {
+		if _, err := os.Stat(c.dir); os.IsNotExist(err) == c.kept {
+			t.Errorf("%s: got kept %v, want %v", c.dir, !os.IsNotExist(err), c.kept)
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	m, c := newTestManager(t, Config{Quota: 4096})
+	// 3KBの録画を2つ作る。2つ目を始める時は、合計はまだクォータに収まる
+	var dirs []string
+	for _, id := range []string{"1", "2"} {
+		r, err := m.Start(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, filepath.Join(m.config.Dir, r.Name()))
+		if err := r.WriteFile("data", make([]byte, 3072)); err != nil {
+			t.Fatalf("session %s: %v", id, err)
+		}
+		if id == "2" {
+			// 書き込む前に確認するため、超えた後の次の書き込みで最も古い録画の削除が始まる
+			if _, err := os.Stat(dirs[0]); err != nil {
+				t.Errorf("the oldest recording is removed too early: %v", err)
+			}
+			// 古い録画はバックグラウンドで削除され、削除されるまではクォータを超えて書き込む
+			if err := r.WriteFile("more", make([]byte, 1024)); err != nil {
+				t.Fatal(err)
+			}
+			waitRemoved(t, m, dirs[0])
+			// 自分自身は削除できないため、以降は書き込まない
+			if err := r.WriteFile("last", make([]byte, 1024)); !errors.Is(err, ErrQuotaExceeded) {
+				t.Errorf("got %v, want ErrQuotaExceeded", err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		c.t = c.t.Add(time.Second)
+	}
+	manifest := readManifest(t, dirs[1])
+	if !manifest.Truncated || len(manifest.Files) != 2 {
+		t.Errorf("got truncated %v with files %+v", manifest.Truncated, manifest.Files)
+	}
+}
+
+// slowStorageは、releaseが閉じられるまでListをブロックし、呼び出し回数を数えるストレージです
+type slowStorage struct {
+	storage.Storage
+	release chan struct{}
+
+	mu    sync.Mutex
+	lists int
+}
+
+func (s *slowStorage) List() ([]storage.FileInfo, error) {
+	s.mu.Lock()
+	s.lists++
+	s.mu.Unlock()
+	<-s.release
+	return s.Storage.List()
+}
+
+func (s *slowStorage) listCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lists
+}
+
+// TestQuotaWritePathは、クォータを超えた後の書き込みがストレージの一覧を待たず、
+// 古い録画の削除が一定の間隔でしか始まらないことを確認します
+func TestQuotaWritePath(t *testing.T) {
+	m, c := newTestManager(t, Config{Quota: 4096})
+	first, err := m.Start("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.WriteFile("data", make([]byte, 3072)); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.t = c.t.Add(time.Second)
+	r, err := m.Start("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	track, err := r.AddTrack("video", webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := &slowStorage{Storage: m.storage, release: make(chan struct{})}
+	m.storage = slow
+	done := make(chan error)
+	go func() {
+		// 約5KBを書き込み、クォータを超えた後も書き込み続ける
+		for seq := uint16(1); seq <= 200; seq++ {
+			if err := track.WriteRTP(vp8Packet(1, seq)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing waits for the storage")
+	}
+	if got := slow.listCount(); got > 1 {
+		t.Errorf("listed the storage %d times, want at most once", got)
+	}
+
+	close(slow.release)
+	waitRemoved(t, m, filepath.Join(m.config.Dir, first.Name()))
+	if slow.listCount() != 1 {
+		t.Errorf("listed the storage %d times, want once", slow.listCount())
+	}
+	// 削除できる録画がなくなった後は、書き込みを打ち切る
+	if err := track.WriteRTP(vp8Packet(1, 201)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("got %v, want ErrQuotaExceeded", err)
+	}
+}
+
+// TestFinishedDuringPruneは、削除の途中で終了した録画を一度だけ数え、
+// クォータの判定に含めることを確認します
+func TestFinishedDuringPrune(t *testing.T) {
+	m, c := newTestManager(t, Config{})
+	old, err := m.Start("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.WriteFile("data", make([]byte, 3072)); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.t = c.t.Add(time.Second)
+	r, err := m.Start("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.WriteFile("data", make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+
+	m.config.Quota = 4096
+	slow := &slowStorage{Storage: m.storage, release: make(chan struct{})}
+	m.storage = slow
+	done := make(chan error)
+	go func() { done <- m.Prune() }()
+	for slow.listCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// 一覧を取得している間に録画が終了する
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(slow.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// 終了した録画を含めるとクォータを超えるため、古い録画は削除される
+	if _, err := os.Stat(filepath.Join(m.config.Dir, old.Name())); !os.IsNotExist(err) {
+		t.Errorf("the oldest recording is not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(m.config.Dir, r.Name())); err != nil {
+		t.Errorf("the finished recording is removed: %v", err)
+	}
+	// 終了した録画は一度だけ数える(マニフェストは書き込みとして数えないため、一覧より小さくなる)
+	finished := m.finishedSize
+	if err := m.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if finished < 2048 || finished > m.finishedSize {
+		t.Errorf("got finished size %d, want between 2048 and %d as listed", finished, m.finishedSize)
+	}
+}
+
+// TestRecordingS3は、S3互換のストレージに録画のファイルをマルチパートアップロードし、
+// 古い録画をクォータに応じて削除できることを確認します
+func TestRecordingS3(t *testing.T) {
+	server, err := storage.NewServer("127.0.0.1:0", "access", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	const partSize = 1024
+	server.SetMinPartSize(partSize)
+	// テストではパートを小さくする
+	config := storage.S3Config{Endpoint: server.URL(), Region: "us-east-1", AccessKeyID: "access", SecretAccessKey: "secret", PathStyle: true, PartSize: partSize, Timeout: 5 * time.Second}
+	s, err := storage.NewS3(config, "recordings", "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(Config{Dir: "s3://recordings/receive", Quota: 8192}, s, zap.NewNop())
+
+	var names []string
+	for _, id := range []string{"1", "2"} {
+		r, err := m.Start(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, r.Name())
+		if location := r.Location(); location != "s3://recordings/receive/"+r.Name() {
+			t.Errorf("got location %s", location)
+		}
+		video, err := r.AddTrack("video", webrtc.RTPCodecTypeVideo, webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 約5KBを書き込む
+		for seq := uint16(1); seq <= 200; seq++ {
+			if err := video.WriteRTP(vp8Packet(1, seq)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// 同じ秒に開始しないように時刻を進める
+		m.now = func() time.Time { return time.Now().Add(time.Minute) }
+	}
+
+	key := "receive/" + names[1] + "/video-video.ivf"
+	data, parts, ok := server.Object("recordings", key)
+	if !ok || parts < 2 {
+		t.Fatalf("got %s in %d parts (exists %v), want a multipart upload", key, parts, ok)
+	}
+	f, header, err := ivfreader.NewWith(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := 0
+	for ; ; frames++ {
+		if _, _, err := f.ParseNextFrame(); err != nil {
+			break
+		}
+	}
+	// S3のファイルはシークできないため、ヘッダーのフレーム数は書き直されない
+	if frames != 200 || header.NumFrames == 200 {
+		t.Errorf("got %d frames (%d in the header), want 200 (not in the header)", frames, header.NumFrames)
+	}
+	b, _, ok := server.Object("recordings", "receive/"+names[1]+"/"+ManifestName)
+	if !ok {
+		t.Fatal("no manifest is uploaded")
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Tracks) != 1 || manifest.Tracks[0].Bytes != int64(len(data)) || manifest.End == nil {
+		t.Errorf("got manifest %+v for %d bytes", manifest, len(data))
+	}
+
+	// 2つの録画の合計(約10KB)がクォータを超えるため、次の録画を始める時に古い録画が削除される
+	r, err := m.Start("3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, ok := server.Object("recordings", "receive/"+names[0]+"/"+ManifestName); ok {
+		t.Error("the oldest recording is kept")
+	}
+	if _, _, ok := server.Object("recordings", key); !ok {
+		t.Error("the newer recording is removed")
+	}
+}
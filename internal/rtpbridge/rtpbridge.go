@@ -0,0 +1,169 @@
+// Package rtpbridge exchanges plain RTP packets over UDP with other tools such
+// as ffmpeg and GStreamer, without RTSP or WebRTC signaling.
+//
+// Reader receives the RTP packets sent by e.g. ffmpeg -f rtp, and Writer sends
+// RTP packets to a host:port. WriteSDP writes the SDP file describing the
+// packets sent by Writer, so that they can be played with
+// ffplay -protocol_whitelist file,udp,rtp -i stream.sdp.
+package rtpbridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// maxPacketSize is the maximum size of a received RTP packet
+const maxPacketSize = 65536
+
+// Reader receives RTP packets on a UDP port
+type Reader struct {
+	conn *net.UDPConn
+}
+
+// Listen starts receiving RTP packets on addr, e.g. :5004
+func Listen(addr string) (*Reader, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{conn: conn}, nil
+}
+
+// Addr returns the address the packets are received on
+func (r *Reader) Addr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// ReadRTP returns the next RTP packet. Datagrams which are not RTP packets are skipped.
+// A timeout error is returned when no packet arrives within timeout (no timeout when 0).
+func (r *Reader) ReadRTP(timeout time.Duration) (*rtp.Packet, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	r.conn.SetReadDeadline(deadline)
+	for {
+		buf := make([]byte, maxPacketSize)
+		n, _, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		packet := &rtp.Packet{}
+		// RTCPなど、RTPとして解釈できないデータグラムは読み捨てる
+		if err := packet.Unmarshal(buf[:n]); err != nil || packet.Version != 2 {
+			continue
+		}
+		return packet, nil
+	}
+}
+
+// Close stops receiving
+func (r *Reader) Close() error {
+	return r.conn.Close()
+}
+
+// Writer sends RTP packets to a UDP address
+type Writer struct {
+	conn net.Conn
+}
+
+// Dial returns a Writer sending to addr, e.g. 127.0.0.1:5004
+func Dial(addr string) (*Writer, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{conn: conn}, nil
+}
+
+// WriteRTP sends a packet. Errors of the unreachable port (nobody is listening yet) are ignored.
+func (w *Writer) WriteRTP(packet *rtp.Packet) error {
+	buf, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := w.conn.Write(buf); err != nil && !isConnectionRefused(err) {
+		return err
+	}
+	return nil
+}
+
+// Close stops sending
+func (w *Writer) Close() error {
+	return w.conn.Close()
+}
+
+// isConnectionRefused returns true for the ICMP port unreachable reported on a connected UDP socket
+func isConnectionRefused(err error) bool {
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+// Stream is a stream of RTP packets described in the SDP file
+type Stream struct {
+	// Kind is video or audio
+	Kind  webrtc.RTPCodecType
+	Port  int
+	Codec webrtc.RTPCodecParameters
+}
+
+// SDP returns the description of the streams sent to host
+func SDP(host string, streams []Stream) []byte {
+	network := "IP4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "IP6"
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "v=0\r\no=- 0 0 IN %s %s\r\ns=pion-webrtc_sample\r\nc=IN %s %s\r\nt=0 0\r\n", network, host, network, host)
+	for _, stream := range streams {
+		codec := stream.Codec
+		encoding := strings.SplitN(codec.MimeType, "/", 2)
+		name := encoding[len(encoding)-1]
+		fmt.Fprintf(b, "m=%s %d RTP/AVP %d\r\n", stream.Kind, stream.Port, codec.PayloadType)
+		if codec.Channels > 1 {
+			fmt.Fprintf(b, "a=rtpmap:%d %s/%d/%d\r\n", codec.PayloadType, name, codec.ClockRate, codec.Channels)
+		} else {
+			fmt.Fprintf(b, "a=rtpmap:%d %s/%d\r\n", codec.PayloadType, name, codec.ClockRate)
+		}
+		if codec.SDPFmtpLine != "" {
+			fmt.Fprintf(b, "a=fmtp:%d %s\r\n", codec.PayloadType, codec.SDPFmtpLine)
+		}
+		b.WriteString("a=recvonly\r\n")
+	}
+	return []byte(b.String())
+}
+
+// WriteSDP writes the description of the streams to a file.
+// The file is replaced at once, so that a player never reads a partially written file.
+func WriteSDP(file, host string, streams []Stream) error {
+	dir := filepath.Dir(file)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// プレイヤーを別のユーザーで実行しても読み込めるようにする
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(SDP(host, streams)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,97 @@
+package rtpbridge
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestWriterReader(t *testing.T) {
+	reader, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	writer, err := Dial(reader.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	// RTPではないデータグラムは読み捨てられる
+	conn, err := net.Dial("udp", reader.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint16(1); seq <= 3; seq++ {
+		if err := writer.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq}, Payload: []byte{byte(seq)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for seq := uint16(1); seq <= 3; seq++ {
+		packet, err := reader.ReadRTP(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.SequenceNumber != seq || packet.Payload[0] != byte(seq) {
+			t.Errorf("got packet %d, want %d", packet.SequenceNumber, seq)
+		}
+	}
+	if _, err := reader.ReadRTP(50 * time.Millisecond); err == nil {
+		t.Error("no timeout without packets")
+	}
+}
+
+func TestWriteSDP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtpbridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "stream.sdp")
+
+	streams := []Stream{
+		{Kind: webrtc.RTPCodecTypeVideo, Port: 5004, Codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "packetization-mode=1"},
+			PayloadType:        102,
+		}},
+		{Kind: webrtc.RTPCodecTypeAudio, Port: 5006, Codec: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+			PayloadType:        111,
+		}},
+	}
+	if err := WriteSDP(file, "127.0.0.1", streams); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"c=IN IP4 127.0.0.1",
+		"m=video 5004 RTP/AVP 102",
+		"a=rtpmap:102 H264/90000",
+		"a=fmtp:102 packetization-mode=1",
+		"m=audio 5006 RTP/AVP 111",
+		"a=rtpmap:111 opus/48000/2",
+	} {
+		if !strings.Contains(string(data), line+"\r\n") {
+			t.Errorf("%q does not contain %q", data, line)
+		}
+	}
+	// 一時ファイルは残らない
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files in the directory", len(files))
+	}
+}
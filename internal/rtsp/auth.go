@@ -0,0 +1,131 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// newAuthorizer returns a function generating the Authorization header from the WWW-Authenticate challenges
+// of a 401 response. Digest is preferred to Basic.
+func newAuthorizer(challenges []string, user *url.Userinfo) (func(method, uri string) string, error) {
+	username := user.Username()
+	password, _ := user.Password()
+	for _, challenge := range challenges {
+		scheme, parameters := parseChallenge(challenge)
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		realm, nonce, opaque := parameters["realm"], parameters["nonce"], parameters["opaque"]
+		if algorithm := parameters["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+			continue
+		}
+		// qopがauthを含む場合は、リクエストごとにncを増やす
+		qop := ""
+		for _, q := range strings.Split(parameters["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		var mu sync.Mutex
+		nc := 0
+		return func(method, uri string) string {
+			ha1 := md5Hex(username + ":" + realm + ":" + password)
+			ha2 := md5Hex(method + ":" + uri)
+			header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, username, realm, nonce, uri)
+			if qop == "" {
+				header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+			} else {
+				mu.Lock()
+				nc++
+				count := fmt.Sprintf("%08x", nc)
+				mu.Unlock()
+				cnonce := randomHex(8)
+				header += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`, md5Hex(ha1+":"+nonce+":"+count+":"+cnonce+":auth:"+ha2), count, cnonce)
+			}
+			if opaque != "" {
+				header += fmt.Sprintf(`, opaque="%s"`, opaque)
+			}
+			return header
+		}, nil
+	}
+	for _, challenge := range challenges {
+		if scheme, _ := parseChallenge(challenge); strings.EqualFold(scheme, "Basic") {
+			header := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+			return func(string, string) string { return header }, nil
+		}
+	}
+	return nil, errors.New("no supported authentication (Digest or Basic) is offered")
+}
+
+// parseChallenge parses a WWW-Authenticate or Authorization header into the scheme and the parameters
+func parseChallenge(header string) (string, map[string]string) {
+	header = strings.TrimSpace(header)
+	scheme := header
+	rest := ""
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		scheme, rest = header[:i], header[i+1:]
+	}
+	parameters := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		i := strings.IndexByte(rest, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:i]))
+		rest = rest[i+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// 引用符で囲まれた値はカンマを含むことがある
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end+1:]
+			}
+		}
+		parameters[key] = strings.TrimSpace(value)
+	}
+	return scheme, parameters
+}
+
+// verifyDigest returns true when the Authorization header is a valid Digest response of the credentials
+func verifyDigest(authorization, method, username, password, realm, nonce string) bool {
+	scheme, parameters := parseChallenge(authorization)
+	if !strings.EqualFold(scheme, "Digest") || parameters["username"] != username || parameters["realm"] != realm || parameters["nonce"] != nonce {
+		return false
+	}
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(method + ":" + parameters["uri"])
+	expected := md5Hex(ha1 + ":" + nonce + ":" + ha2)
+	if parameters["qop"] == "auth" {
+		expected = md5Hex(ha1 + ":" + nonce + ":" + parameters["nc"] + ":" + parameters["cnonce"] + ":auth:" + ha2)
+	}
+	return parameters["response"] == expected
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
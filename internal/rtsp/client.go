@@ -0,0 +1,398 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// defaultPort is the port of RTSP when the URL has none
+	defaultPort = "554"
+	// defaultSessionTimeout is the session timeout when the server does not tell it
+	defaultSessionTimeout = 60 * time.Second
+	// userAgent is the User-Agent of the requests
+	userAgent = "pion-webrtc_sample"
+	// maxPacketSize is the maximum size of a RTP packet received over UDP
+	maxPacketSize = 65536
+)
+
+// ErrClosed is returned by ReadRTP after Close
+var ErrClosed = errors.New("rtsp: connection closed")
+
+// Conn is a connection to an RTSP server playing a video stream
+type Conn struct {
+	config Config
+	// baseURL is the URL of the stream without the user and the password
+	baseURL *url.URL
+	user    *url.Userinfo
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// mu guards the writes to conn and the state of the requests below
+	mu   sync.Mutex
+	cseq int
+	// authorize returns the Authorization header of a request, set after a 401 response
+	authorize func(method, uri string) string
+	session   string
+
+	stream Stream
+	// keepAliveMethod is GET_PARAMETER when the server supports it, otherwise OPTIONS
+	keepAliveMethod string
+	// keepAliveInterval is the interval of the keep-alive requests, half of the session timeout
+	keepAliveInterval time.Duration
+
+	// rtpChannel is the interleaved channel of the RTP packets (TransportTCP)
+	rtpChannel byte
+	// rtpConn and rtcpConn receive the RTP and RTCP packets (TransportUDP)
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to the RTSP server of config.URL and starts playing the first H.264 or H.265 video stream.
+// The RTP packets are read with ReadRTP. The session is kept alive until Close.
+func Dial(ctx context.Context, config Config) (*Conn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{config: config, user: u.User, keepAliveMethod: "OPTIONS", keepAliveInterval: defaultSessionTimeout / 2, closed: make(chan struct{})}
+	base := *u
+	base.User = nil
+	c.baseURL = &base
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if c.conn, err = dialer.DialContext(ctx, "tcp", host); err != nil {
+		return nil, err
+	}
+	c.reader = bufio.NewReader(c.conn)
+
+	// キャンセルされたら接続を閉じて、応答を待っているリクエストを終わらせる
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := c.setup(); err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	go c.keepAlive()
+	return c, nil
+}
+
+// setup sends OPTIONS, DESCRIBE, SETUP and PLAY
+func (c *Conn) setup() error {
+	res, err := c.do(&request{method: "OPTIONS", url: c.baseURL.String()})
+	if err != nil {
+		return err
+	}
+	if strings.Contains(res.header.Get("Public"), "GET_PARAMETER") {
+		c.keepAliveMethod = "GET_PARAMETER"
+	}
+
+	res, err = c.do(&request{method: "DESCRIBE", url: c.baseURL.String(), header: textproto.MIMEHeader{"Accept": {"application/sdp"}}})
+	if err != nil {
+		return err
+	}
+	// Content-Baseがある場合は、controlはContent-Baseからの相対URLになる
+	base := c.baseURL
+	if contentBase := res.header.Get("Content-Base"); contentBase != "" {
+		if base, err = url.Parse(contentBase); err != nil {
+			return fmt.Errorf("invalid Content-Base %q: %w", contentBase, err)
+		}
+	}
+	if c.stream, err = parseStream(res.body, base); err != nil {
+		return err
+	}
+
+	transport := "RTP/AVP/TCP;unicast;interleaved=0-1"
+	if c.config.Transport == TransportUDP {
+		if transport, err = c.listenUDP(); err != nil {
+			return err
+		}
+	}
+	res, err = c.do(&request{method: "SETUP", url: c.stream.Control, header: textproto.MIMEHeader{"Transport": {transport}}})
+	if err != nil {
+		return err
+	}
+	session := strings.Split(res.header.Get("Session"), ";")
+	if session[0] == "" {
+		return errors.New("no session in the SETUP response")
+	}
+	c.mu.Lock()
+	c.session = strings.TrimSpace(session[0])
+	c.mu.Unlock()
+	for _, parameter := range session[1:] {
+		if value := strings.TrimPrefix(strings.TrimSpace(parameter), "timeout="); value != parameter {
+			if timeout, err := strconv.Atoi(value); err == nil && timeout > 0 {
+				c.keepAliveInterval = time.Duration(timeout) * time.Second / 2
+			}
+		}
+	}
+	if c.config.Transport == TransportTCP {
+		channel, ok := transportParameter(res.header.Get("Transport"), "interleaved")
+		if ok {
+			rtpChannel, err := strconv.ParseUint(strings.Split(channel, "-")[0], 10, 8)
+			if err != nil {
+				return fmt.Errorf("invalid interleaved channel %q", channel)
+			}
+			c.rtpChannel = byte(rtpChannel)
+		}
+	}
+
+	_, err = c.do(&request{method: "PLAY", url: c.baseURL.String(), header: textproto.MIMEHeader{"Range": {"npt=0.000-"}}})
+	return err
+}
+
+// listenUDP listens on the ports of the RTP and RTCP packets and returns the Transport header of SETUP
+func (c *Conn) listenUDP() (string, error) {
+	var err error
+	if c.rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+		return "", err
+	}
+	if c.rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+		return "", err
+	}
+	rtpPort := c.rtpConn.LocalAddr().(*net.UDPAddr).Port
+	rtcpPort := c.rtcpConn.LocalAddr().(*net.UDPAddr).Port
+	return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", rtpPort, rtcpPort), nil
+}
+
+// do sends a request and waits for the response. A 401 response is retried once with the credentials of the URL.
+func (c *Conn) do(req *request) (*response, error) {
+	res, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.statusCode == 401 && c.user != nil {
+		c.mu.Lock()
+		c.authorize, err = newAuthorizer(res.header["Www-Authenticate"], c.user)
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if res, err = c.roundTrip(req); err != nil {
+			return nil, err
+		}
+	}
+	if res.statusCode != 200 {
+		return nil, fmt.Errorf("%s %s: %d %s", req.method, req.url, res.statusCode, res.status)
+	}
+	return res, nil
+}
+
+// roundTrip writes a request and reads its response, skipping the interleaved packets before it
+func (c *Conn) roundTrip(req *request) (*response, error) {
+	if err := c.write(req); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '$' {
+			if _, _, err := c.readInterleaved(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return readResponse(c.reader)
+	}
+}
+
+// write writes a request with the common headers
+func (c *Conn) write(req *request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if req.header == nil {
+		req.header = textproto.MIMEHeader{}
+	}
+	req.header.Set("User-Agent", userAgent)
+	if c.session != "" {
+		req.header.Set("Session", c.session)
+	}
+	if c.authorize != nil {
+		req.header.Set("Authorization", c.authorize(req.method, req.url))
+	}
+	c.cseq++
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+	return req.write(c.conn, c.cseq)
+}
+
+// keepAlive sends a request every keepAliveInterval so that the server does not end the session
+func (c *Conn) keepAlive() {
+	ticker := time.NewTicker(c.keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		req := &request{method: c.keepAliveMethod, url: c.baseURL.String()}
+		// TCPの場合、応答はReadRTPがRTPパケットと一緒に読み捨てる
+		// UDPの場合は、RTSPの接続を読み込むのはこのゴルーチンだけになる
+		var err error
+		if c.config.Transport == TransportTCP {
+			err = c.write(req)
+		} else {
+			_, err = c.do(req)
+		}
+		if err != nil {
+			// 接続が切れた場合は、ReadRTPがタイムアウトで検知する
+			return
+		}
+	}
+}
+
+// Stream returns the played video stream
+func (c *Conn) Stream() Stream {
+	return c.stream
+}
+
+// ReadRTP returns the next RTP packet of the stream.
+// An error is returned when no packet arrives within the timeout, or the connection is lost or closed.
+func (c *Conn) ReadRTP() (*rtp.Packet, error) {
+	for {
+		var buf []byte
+		var err error
+		if c.config.Transport == TransportUDP {
+			buf, err = c.readUDP()
+		} else {
+			buf, err = c.readTCP()
+		}
+		if err != nil {
+			select {
+			case <-c.closed:
+				return nil, ErrClosed
+			default:
+				return nil, err
+			}
+		}
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(buf); err != nil {
+			continue
+		}
+		// 他のペイロードタイプ(音声など)は読み捨てる
+		if packet.PayloadType != c.stream.PayloadType {
+			continue
+		}
+		return packet, nil
+	}
+}
+
+// readTCP returns the next interleaved RTP packet, skipping the RTCP packets and the responses of keep-alive
+func (c *Conn) readTCP() ([]byte, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			if _, err := readResponse(c.reader); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		channel, buf, err := c.readInterleaved()
+		if err != nil {
+			return nil, err
+		}
+		if channel == c.rtpChannel {
+			return buf, nil
+		}
+	}
+}
+
+// readInterleaved reads a packet interleaved in the RTSP connection: '$', channel, 16 bit length and the packet
+func (c *Conn) readInterleaved() (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.reader, buf); err != nil {
+		return 0, nil, err
+	}
+	return header[1], buf, nil
+}
+
+// readUDP returns the next packet received on the RTP port
+func (c *Conn) readUDP() ([]byte, error) {
+	c.rtpConn.SetReadDeadline(time.Now().Add(c.config.Timeout))
+	buf := make([]byte, maxPacketSize)
+	n, _, err := c.rtpConn.ReadFrom(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Close sends TEARDOWN and closes the connection
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		// 応答は待たない
+		c.mu.Lock()
+		session := c.session
+		c.mu.Unlock()
+		if session != "" {
+			c.write(&request{method: "TEARDOWN", url: c.baseURL.String()})
+		}
+		err = c.conn.Close()
+		if c.rtpConn != nil {
+			c.rtpConn.Close()
+		}
+		if c.rtcpConn != nil {
+			c.rtcpConn.Close()
+		}
+	})
+	return err
+}
+
+// transportParameter returns the value of a parameter of a Transport header
+func transportParameter(transport, name string) (string, bool) {
+	for _, parameter := range strings.Split(transport, ";") {
+		keyValue := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+		if keyValue[0] == name {
+			if len(keyValue) == 2 {
+				return keyValue[1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,156 @@
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// testStream is the stream published by the test server
+var testStream = Stream{MimeType: MimeTypeH264, ClockRate: 90000, PayloadType: 96, ParameterSets: [][]byte{{0x67, 0x42, 0x00, 0x1f}, {0x68, 0xce, 0x3c, 0x80}}}
+
+// startServer starts a test server and writes a packet every 10ms until the test ends
+func startServer(t *testing.T) *Server {
+	t.Helper()
+	server, err := NewServer("127.0.0.1:0", testStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			server.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 900, SSRC: 1234}, Payload: []byte{0x65, byte(seq)}})
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+	return server
+}
+
+func TestClient(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		transport string
+		auth      bool
+	}{
+		{"tcp", TransportTCP, false},
+		{"udp", TransportUDP, false},
+		{"digest", TransportTCP, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := startServer(t)
+			rawURL := server.URL()
+			if c.auth {
+				server.SetCredentials("camera", "secret")
+				u, _ := url.Parse(rawURL)
+				u.User = url.UserPassword("camera", "secret")
+				rawURL = u.String()
+			}
+			conn, err := Dial(context.Background(), Config{URL: rawURL, Transport: c.transport, Timeout: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			stream := conn.Stream()
+			if stream.MimeType != MimeTypeH264 || stream.ClockRate != 90000 || stream.PayloadType != 96 || stream.Control != server.URL()+"/trackID=1" {
+				t.Errorf("unexpected stream %+v", stream)
+			}
+			if len(stream.ParameterSets) != 2 || !bytes.Equal(stream.ParameterSets[0], testStream.ParameterSets[0]) {
+				t.Errorf("unexpected parameter sets %x", stream.ParameterSets)
+			}
+			// 連続したパケットが届くことを確認する
+			var last uint16
+			for i := 0; i < 10; i++ {
+				packet, err := conn.ReadRTP()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i > 0 && packet.SequenceNumber != last+1 {
+					t.Errorf("sequence number %d after %d", packet.SequenceNumber, last)
+				}
+				last = packet.SequenceNumber
+			}
+
+			// カメラが切断されたら、ReadRTPがエラーを返す
+			server.DropClients()
+			for {
+				if _, err := conn.ReadRTP(); err != nil {
+					break
+				}
+			}
+			conn.Close()
+			if _, err := conn.ReadRTP(); err != ErrClosed {
+				t.Errorf("ReadRTP after Close returned %v", err)
+			}
+		})
+	}
+}
+
+func TestDialError(t *testing.T) {
+	server := startServer(t)
+	server.SetCredentials("camera", "secret")
+	// 認証情報が間違っている場合は401でエラーになる
+	u, _ := url.Parse(server.URL())
+	u.User = url.UserPassword("camera", "wrong")
+	if _, err := Dial(context.Background(), Config{URL: u.String(), Transport: TransportTCP, Timeout: time.Second}); err == nil {
+		t.Error("no error for wrong credentials")
+	}
+	if _, err := Dial(context.Background(), Config{URL: server.URL(), Transport: TransportTCP, Timeout: time.Second}); err == nil {
+		t.Error("no error without credentials")
+	}
+	// キャンセルされたら接続をやめる
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Dial(ctx, Config{URL: server.URL(), Transport: TransportTCP, Timeout: time.Second}); err == nil {
+		t.Error("no error for a canceled context")
+	}
+}
+
+func TestParseStream(t *testing.T) {
+	base, _ := url.Parse("rtsp://192.168.0.10/live")
+	description := "v=0\r\no=- 0 0 IN IP4 192.168.0.10\r\ns=Camera\r\nt=0 0\r\n" +
+		"m=audio 0 RTP/AVP 0\r\na=control:audio\r\n" +
+		"m=video 0 RTP/AVP 97 98\r\na=rtpmap:97 VP8/90000\r\na=rtpmap:98 H265/90000\r\n" +
+		"a=fmtp:98 sprop-vps=QAEMAf//;sprop-sps=QgEBAWAAAAMAAAMAAAMAAAMAlqAFAgFx8uE=;sprop-pps=RAHA8vA8kAA=\r\na=control:video\r\n"
+	stream, err := parseStream([]byte(description), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.MimeType != MimeTypeH265 || stream.PayloadType != 98 || stream.Control != "rtsp://192.168.0.10/live/video" || len(stream.ParameterSets) != 3 {
+		t.Errorf("unexpected stream %+v", stream)
+	}
+
+	if _, err := parseStream([]byte("v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\nm=audio 0 RTP/AVP 0\r\n"), base); err == nil {
+		t.Error("no error without a video stream")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		config Config
+		valid  bool
+	}{
+		{Config{URL: "rtsp://192.168.0.10/stream", Transport: TransportTCP, Timeout: time.Second, ReconnectInterval: time.Second}, true},
+		{Config{URL: "http://192.168.0.10/stream", Transport: TransportTCP, Timeout: time.Second, ReconnectInterval: time.Second}, false},
+		{Config{URL: "rtsp://192.168.0.10/stream", Transport: "sctp", Timeout: time.Second, ReconnectInterval: time.Second}, false},
+		{Config{URL: "rtsp://192.168.0.10/stream", Transport: TransportUDP, ReconnectInterval: time.Second}, false},
+	} {
+		if err := c.config.Validate(); (err == nil) != c.valid {
+			t.Errorf("Validate(%+v) = %v", c.config, err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// serverPath is the path of the stream published by Server
+	serverPath = "/stream"
+	// serverRealm is the realm of the Digest authentication of Server
+	serverRealm = "pion-webrtc_sample"
+	// serverSessionTimeout is the session timeout told by Server
+	serverSessionTimeout = 60
+	// writeTimeout is how long a packet may wait to be written to a client of Server
+	writeTimeout = time.Second
+)
+
+// Server is a minimal RTSP server publishing one video stream, used as a stand-in for a camera in tests.
+// The RTP packets passed to WriteRTP are sent to every playing client over TCP or UDP.
+type Server struct {
+	listener net.Listener
+	stream   Stream
+
+	mu       sync.Mutex
+	username string
+	password string
+	nonce    string
+	clients  map[*serverClient]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// serverClient is a connection of a client to Server
+type serverClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// mu guards the writes to conn and the state below
+	mu      sync.Mutex
+	playing bool
+	// rtpChannel is the interleaved channel of the RTP packets (TCP)
+	rtpChannel byte
+	// udpConn sends the RTP packets to the client port (UDP)
+	udpConn net.Conn
+}
+
+// NewServer starts a server publishing stream on addr, e.g. 127.0.0.1:0.
+// The Control of stream is ignored.
+func NewServer(addr string, stream Stream) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, stream: stream, nonce: randomHex(16), clients: map[*serverClient]struct{}{}}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// SetCredentials requires the Digest authentication with the user and the password
+func (s *Server) SetCredentials(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+// URL returns the URL of the stream
+func (s *Server) URL() string {
+	return "rtsp://" + s.listener.Addr().String() + serverPath
+}
+
+// Playing returns the number of the clients playing the stream
+func (s *Server) Playing() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.clients {
+		c.mu.Lock()
+		if c.playing {
+			n++
+		}
+		c.mu.Unlock()
+	}
+	return n
+}
+
+// WriteRTP sends a packet to every playing client
+func (s *Server) WriteRTP(packet *rtp.Packet) error {
+	buf, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	clients := make([]*serverClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if err := c.writeRTP(buf); err != nil {
+			// 書き込めないクライアントは切断する
+			c.conn.Close()
+		}
+	}
+	return nil
+}
+
+// DropClients closes the connections of all the clients, like a camera losing the network
+func (s *Server) DropClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// Close stops the server and closes the connections of all the clients
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.listener.Close()
+	s.DropClients()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &serverClient{conn: conn, reader: bufio.NewReader(conn)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// serve handles the requests of a client until the connection is closed
+func (s *Server) serve(c *serverClient) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+		c.mu.Lock()
+		if c.udpConn != nil {
+			c.udpConn.Close()
+		}
+		c.mu.Unlock()
+	}()
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		// クライアントからのRTCPパケットは読み捨てる
+		if b[0] == '$' {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(c.reader, header); err != nil {
+				return
+			}
+			if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+		req, err := readRequest(c.reader)
+		if err != nil {
+			return
+		}
+		res := s.handle(c, req)
+		c.mu.Lock()
+		err = res.write(c.conn, req.header.Get("CSeq"))
+		c.mu.Unlock()
+		if err != nil || req.method == "TEARDOWN" {
+			return
+		}
+	}
+}
+
+// handle returns the response of a request
+func (s *Server) handle(c *serverClient, req *request) *response {
+	s.mu.Lock()
+	username, password, nonce := s.username, s.password, s.nonce
+	s.mu.Unlock()
+	if username != "" && !verifyDigest(req.header.Get("Authorization"), req.method, username, password, serverRealm, nonce) {
+		return &response{statusCode: 401, status: "Unauthorized", header: textproto.MIMEHeader{
+			"WWW-Authenticate": {fmt.Sprintf(`Digest realm="%s", nonce="%s"`, serverRealm, nonce)},
+		}}
+	}
+
+	ok := func(header textproto.MIMEHeader, body []byte) *response {
+		return &response{statusCode: 200, status: "OK", header: header, body: body}
+	}
+	session := textproto.MIMEHeader{"Session": {fmt.Sprintf("%s;timeout=%d", nonce[:8], serverSessionTimeout)}}
+	switch req.method {
+	case "OPTIONS":
+		return ok(textproto.MIMEHeader{"Public": {"OPTIONS, DESCRIBE, SETUP, PLAY, GET_PARAMETER, TEARDOWN"}}, nil)
+	case "DESCRIBE":
+		return ok(textproto.MIMEHeader{"Content-Type": {"application/sdp"}, "Content-Base": {s.URL() + "/"}}, s.sdp())
+	case "SETUP":
+		transport, err := c.setup(req.header.Get("Transport"))
+		if err != nil {
+			return &response{statusCode: 461, status: "Unsupported Transport"}
+		}
+		session.Set("Transport", transport)
+		return ok(session, nil)
+	case "PLAY":
+		c.mu.Lock()
+		c.playing = true
+		c.mu.Unlock()
+		return ok(session, nil)
+	case "GET_PARAMETER", "TEARDOWN":
+		return ok(session, nil)
+	default:
+		return &response{statusCode: 501, status: "Not Implemented"}
+	}
+}
+
+// sdp returns the description of the stream
+func (s *Server) sdp() []byte {
+	encoding := "H264"
+	if s.stream.MimeType == MimeTypeH265 {
+		encoding = "H265"
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Stream\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n")
+	fmt.Fprintf(b, "m=video 0 RTP/AVP %d\r\n", s.stream.PayloadType)
+	fmt.Fprintf(b, "a=rtpmap:%d %s/%d\r\n", s.stream.PayloadType, encoding, s.stream.ClockRate)
+	if len(s.stream.ParameterSets) > 0 {
+		sets := make([]string, 0, len(s.stream.ParameterSets))
+		for _, nal := range s.stream.ParameterSets {
+			sets = append(sets, base64.StdEncoding.EncodeToString(nal))
+		}
+		fmt.Fprintf(b, "a=fmtp:%d packetization-mode=1;sprop-parameter-sets=%s\r\n", s.stream.PayloadType, strings.Join(sets, ","))
+	}
+	b.WriteString("a=control:trackID=1\r\n")
+	return []byte(b.String())
+}
+
+// setup prepares the transport of the RTP packets and returns the Transport header of the response
+func (c *serverClient) setup(transport string) (string, error) {
+	if channels, ok := transportParameter(transport, "interleaved"); ok {
+		rtpChannel, err := strconv.ParseUint(strings.Split(channels, "-")[0], 10, 8)
+		if err != nil {
+			return "", err
+		}
+		c.mu.Lock()
+		c.rtpChannel = byte(rtpChannel)
+		c.mu.Unlock()
+		return "RTP/AVP/TCP;unicast;interleaved=" + channels, nil
+	}
+	ports, ok := transportParameter(transport, "client_port")
+	if !ok {
+		return "", fmt.Errorf("unsupported transport %q", transport)
+	}
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+	udpConn, err := net.Dial("udp", net.JoinHostPort(host, strings.Split(ports, "-")[0]))
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.udpConn = udpConn
+	c.mu.Unlock()
+	_, serverPort, _ := net.SplitHostPort(udpConn.LocalAddr().String())
+	return fmt.Sprintf("RTP/AVP;unicast;client_port=%s;server_port=%s-%s", ports, serverPort, serverPort), nil
+}
+
+// writeRTP sends a marshaled packet when the client is playing
+func (c *serverClient) writeRTP(buf []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.playing {
+		return nil
+	}
+	if c.udpConn != nil {
+		_, err := c.udpConn.Write(buf)
+		return err
+	}
+	frame := make([]byte, 4, 4+len(buf))
+	frame[0], frame[1] = '$', c.rtpChannel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(buf)))
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(append(frame, buf...))
+	return err
+}
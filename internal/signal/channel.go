@@ -0,0 +1,103 @@
+package signal
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrInvalidSessionDescription is returned by Channel.Recv when a malformed
+// message was received. The channel can still be used afterwards.
+var ErrInvalidSessionDescription = errors.New("invalid session description")
+
+// Channel is a persistent channel to exchange session descriptions with the remote peer
+type Channel interface {
+	// Recv blocks until a session description is received or ctx is done
+	Recv(ctx context.Context) (webrtc.SessionDescription, error)
+	// Send sends a session description to the remote peer
+	Send(desc webrtc.SessionDescription) error
+}
+
+// Config is the configuration of the signaling channel
+type Config struct {
+	// Addr is the address the WebSocket signaling server listens on.
+	// Session descriptions are exchanged on stdin/stdout when empty.
+	Addr string
+}
+
+// Flags registers the signaling flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Addr, "signal-addr", "", "address of the WebSocket signaling server, e.g. :8081 (stdin/stdout is used when empty)")
+	return c
+}
+
+// NewChannel creates the signaling channel selected by the configuration
+func NewChannel(c Config) (Channel, error) {
+	if c.Addr == "" {
+		return NewStdioChannel(), nil
+	}
+	return NewWebSocketChannel(c.Addr)
+}
+
+// ClientConfig is the configuration of the signaling channel of a peer
+// which sends the offer, e.g. the replay command
+type ClientConfig struct {
+	// URL is the URL of the signaling server of the answering peer, ws://<addr>/ws
+	// for WebSocket or http://<addr>/sdp for HTTP.
+	// Session descriptions are exchanged on stdin/stdout when empty.
+	URL string
+}
+
+// ClientFlags registers the signaling flags of an offering peer on the default FlagSet.
+// The returned ClientConfig is filled in when flag.Parse is called.
+func ClientFlags() *ClientConfig {
+	c := &ClientConfig{}
+	flag.StringVar(&c.URL, "signal-url", "", "URL of the signaling server to connect to, e.g. ws://localhost:8081/ws or http://localhost:8081/sdp (stdin/stdout is used when empty)")
+	return c
+}
+
+// NewClientChannel creates the signaling channel selected by the configuration
+func NewClientChannel(c ClientConfig) (Channel, error) {
+	switch {
+	case c.URL == "":
+		return NewStdioChannel(), nil
+	case strings.HasPrefix(c.URL, "ws://") || strings.HasPrefix(c.URL, "wss://"):
+		return DialWebSocket(c.URL)
+	case strings.HasPrefix(c.URL, "http://") || strings.HasPrefix(c.URL, "https://"):
+		return NewHTTPClientChannel(c.URL), nil
+	default:
+		return nil, fmt.Errorf("unsupported signaling URL %q", c.URL)
+	}
+}
+
+// stdioChannel exchanges base64 encoded session descriptions on stdin/stdout
+type stdioChannel struct{}
+
+// NewStdioChannel creates a Channel which reads session descriptions from stdin
+// and prints them to stdout so that they can be copied to the browser
+func NewStdioChannel() Channel {
+	return stdioChannel{}
+}
+
+func (stdioChannel) Recv(ctx context.Context) (webrtc.SessionDescription, error) {
+	desc := webrtc.SessionDescription{}
+	in, err := ReadStdin(ctx)
+	if err != nil {
+		return desc, err
+	}
+	if err := Unmarshal(in, &desc); err != nil {
+		return desc, fmt.Errorf("%w: %s", ErrInvalidSessionDescription, err)
+	}
+	return desc, nil
+}
+
+func (stdioChannel) Send(desc webrtc.SessionDescription) error {
+	PrintSessionDescription(desc)
+	return nil
+}
@@ -1,11 +1,18 @@
 package signal
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
 )
 
 // HTTPSDPServer starts a HTTP Server that consumes SDPs
@@ -29,3 +36,64 @@ func HTTPSDPServer() chan string {
 
 	return sdpChan
 }
+
+// httpClientChannel posts offers to the signaling server of the answering peer
+// and receives the answers in the responses
+type httpClientChannel struct {
+	url     string
+	client  *http.Client
+	answers chan webrtc.SessionDescription
+}
+
+// NewHTTPClientChannel creates a Channel which posts offers as JSON to url,
+// e.g. http://localhost:8081/sdp, and receives the answers in the responses.
+// Only offers can be sent, so the answering peer cannot start a renegotiation.
+func NewHTTPClientChannel(url string) Channel {
+	return &httpClientChannel{
+		url:     url,
+		client:  &http.Client{Timeout: httpAnswerTimeout},
+		answers: make(chan webrtc.SessionDescription, 1),
+	}
+}
+
+func (c *httpClientChannel) Recv(ctx context.Context) (webrtc.SessionDescription, error) {
+	select {
+	case desc := <-c.answers:
+		return desc, nil
+	case <-ctx.Done():
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+}
+
+func (c *httpClientChannel) Send(desc webrtc.SessionDescription) error {
+	if desc.Type != webrtc.SDPTypeOffer {
+		return fmt.Errorf("only offers can be sent over HTTP, not %s", desc.Type)
+	}
+	body, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("signaling server responded %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	answer := webrtc.SessionDescription{}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSessionDescription, err)
+	}
+	if answer.Type != webrtc.SDPTypeAnswer {
+		return fmt.Errorf("%w: got %s instead of an answer", ErrInvalidSessionDescription, answer.Type)
+	}
+	select {
+	case c.answers <- answer:
+		return nil
+	default:
+		return errors.New("the previous answer has not been received")
+	}
+}
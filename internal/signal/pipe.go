@@ -0,0 +1,47 @@
+package signal
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// pipeBuffer is the number of session descriptions which can be sent before the other end receives them
+const pipeBuffer = 16
+
+// errPipeFull is returned by Send when the other end of the pipe does not receive the session descriptions
+var errPipeFull = errors.New("signaling pipe is full")
+
+// pipeChannel is one end of a pair of in-memory channels
+type pipeChannel struct {
+	recv <-chan webrtc.SessionDescription
+	send chan<- webrtc.SessionDescription
+}
+
+// NewPipe creates a pair of connected in-memory Channels. A session description
+// sent to one of them is received from the other, e.g. to connect an offering
+// and an answering peer in the same process.
+func NewPipe() (Channel, Channel) {
+	a := make(chan webrtc.SessionDescription, pipeBuffer)
+	b := make(chan webrtc.SessionDescription, pipeBuffer)
+	return &pipeChannel{recv: a, send: b}, &pipeChannel{recv: b, send: a}
+}
+
+func (c *pipeChannel) Recv(ctx context.Context) (webrtc.SessionDescription, error) {
+	select {
+	case desc := <-c.recv:
+		return desc, nil
+	case <-ctx.Done():
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+}
+
+func (c *pipeChannel) Send(desc webrtc.SessionDescription) error {
+	select {
+	case c.send <- desc:
+		return nil
+	default:
+		return errPipeFull
+	}
+}
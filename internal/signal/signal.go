@@ -6,40 +6,59 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
 )
 
 // Allows compressing offer/answer to bypass terminal input limits.
 const compress = false
 
-// MustReadStdin blocks until input is received from stdin
-func MustReadStdin() string {
-	r := bufio.NewReader(os.Stdin)
+// stdinLines delivers the non-empty lines of stdin. It is read by a single
+// goroutine so that successive reads do not lose buffered input.
+var stdinLines = make(chan string)
+var stdinErr error
+var stdinOnce sync.Once
 
-	var in string
+func readStdinLines() {
+	r := bufio.NewReader(os.Stdin)
 	for {
-		var err error
-		in, err = r.ReadString('\n')
-		if err != io.EOF {
-			if err != nil {
-				panic(err)
-			}
-		}
+		in, err := r.ReadString('\n')
 		in = strings.TrimSpace(in)
 		if len(in) > 0 {
-			break
+			stdinLines <- in
+		}
+		if err != nil {
+			stdinErr = err
+			close(stdinLines)
+			return
 		}
 	}
+}
 
-	fmt.Println("")
+// ReadStdin blocks until a non-empty line is received from stdin or ctx is done
+func ReadStdin(ctx context.Context) (string, error) {
+	stdinOnce.Do(func() {
+		go readStdinLines()
+	})
 
-	return in
+	select {
+	case in, ok := <-stdinLines:
+		if !ok {
+			return "", stdinErr
+		}
+		fmt.Println("")
+		return in, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 }
 
 // Encode encodes the input in base64
@@ -60,19 +79,33 @@ func Encode(obj interface{}) string {
 // Decode decodes the input from base64
 // It can optionally unzip the input after decoding
 func Decode(in string, obj interface{}) {
+	if err := Unmarshal(in, obj); err != nil {
+		panic(err)
+	}
+}
+
+// Unmarshal decodes the input from base64 like Decode,
+// but returns an error instead of panicking on malformed input
+func Unmarshal(in string, obj interface{}) error {
 	b, err := base64.StdEncoding.DecodeString(in)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if compress {
 		b = unzip(b)
 	}
 
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
+	return json.Unmarshal(b, obj)
+}
+
+// PrintSessionDescription outputs the session description in base64 so we can paste it in browser
+func PrintSessionDescription(desc webrtc.SessionDescription) {
+	title := "Answer"
+	if desc.Type == webrtc.SDPTypeOffer {
+		title = "Offer"
 	}
+	fmt.Printf("%s Session Description: \n%s\n", title, Encode(desc))
 }
 
 func zip(in []byte) []byte {
@@ -0,0 +1,158 @@
+package signal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
+)
+
+// httpAnswerTimeout is how long a client which posted an offer over HTTP waits for the answer
+const httpAnswerTimeout = 30 * time.Second
+
+// webSocketChannel exchanges session descriptions as JSON messages with
+// the most recently connected WebSocket client, or answers an offer posted over HTTP
+type webSocketChannel struct {
+	messages chan webrtc.SessionDescription
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// httpAnswer receives the next session description sent, the answer to
+	// the offer posted over HTTP. It is nil when no HTTP client is waiting.
+	httpAnswer chan webrtc.SessionDescription
+}
+
+// NewWebSocketChannel starts a WebSocket signaling server on addr.
+// Clients connect to ws://<addr>/ws and exchange session descriptions as JSON,
+// e.g. {"type": "offer", "sdp": "..."}. Clients which cannot keep a connection
+// open can also POST an offer as JSON to http://<addr>/sdp and receive the answer
+// in the response, but they cannot receive offers for a renegotiation.
+func NewWebSocketChannel(addr string) (Channel, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &webSocketChannel{messages: make(chan webrtc.SessionDescription)}
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocket.Handler(c.handle))
+	mux.HandleFunc("/sdp", c.handleHTTP)
+	go func() {
+		// リスナーはプロセスの終了まで閉じない
+		_ = http.Serve(listener, mux)
+	}()
+	return c, nil
+}
+
+// DialWebSocket connects to the WebSocket signaling server at url, e.g. ws://localhost:8081/ws,
+// and exchanges session descriptions with it as JSON
+func DialWebSocket(url string) (Channel, error) {
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &webSocketChannel{messages: make(chan webrtc.SessionDescription), conn: conn}
+	go c.handle(conn)
+	return c, nil
+}
+
+func (c *webSocketChannel) handle(conn *websocket.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mu.Unlock()
+	}()
+
+	for {
+		desc := webrtc.SessionDescription{}
+		if err := websocket.JSON.Receive(conn, &desc); err != nil {
+			return
+		}
+		c.messages <- desc
+	}
+}
+
+// handleHTTP receives an offer posted as JSON and responds with the answer
+func (c *webSocketChannel) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	desc := webrtc.SessionDescription{}
+	if err := json.NewDecoder(r.Body).Decode(&desc); err != nil || desc.Type != webrtc.SDPTypeOffer {
+		http.Error(w, "the body has to be an offer as JSON", http.StatusBadRequest)
+		return
+	}
+
+	answer := make(chan webrtc.SessionDescription, 1)
+	c.mu.Lock()
+	c.httpAnswer = answer
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.httpAnswer == answer {
+			c.httpAnswer = nil
+		}
+		c.mu.Unlock()
+	}()
+
+	timeout := time.NewTimer(httpAnswerTimeout)
+	defer timeout.Stop()
+	select {
+	case c.messages <- desc:
+	case <-r.Context().Done():
+		return
+	case <-timeout.C:
+		http.Error(w, "the offer was not received", http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case desc = <-answer:
+	case <-r.Context().Done():
+		return
+	case <-timeout.C:
+		http.Error(w, "no answer was created", http.StatusGatewayTimeout)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(desc)
+}
+
+func (c *webSocketChannel) Recv(ctx context.Context) (webrtc.SessionDescription, error) {
+	select {
+	case desc := <-c.messages:
+		return desc, nil
+	case <-ctx.Done():
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+}
+
+func (c *webSocketChannel) Send(desc webrtc.SessionDescription) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 再ネゴシエーションのオファーはHTTPのクライアントには送れない
+	if c.httpAnswer != nil && desc.Type == webrtc.SDPTypeAnswer {
+		c.httpAnswer <- desc
+		c.httpAnswer = nil
+		return nil
+	}
+	if c.conn == nil {
+		return errors.New("no signaling client is connected")
+	}
+	return websocket.JSON.Send(c.conn, desc)
+}
@@ -0,0 +1,298 @@
+// Package simulcast forwards one of the simulcast layers received from a
+// publisher to a single outgoing track, switching layers on key frames.
+package simulcast
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// measureInterval is the interval layer bitrates are measured and layers are selected at
+	measureInterval = time.Second
+	// bitrateHeadroom is the ratio of the estimated bandwidth a layer may use
+	bitrateHeadroom = 0.85
+	// defaultTimestampStep is the timestamp gap inserted on a layer switch (one frame at 30fps)
+	defaultTimestampStep = 90000 / 30
+)
+
+// Config is the configuration of the layer selection
+type Config struct {
+	// Layer is the RID of the layer to forward. The layer is selected by the estimated bandwidth when empty.
+	Layer string
+}
+
+// Flags registers the simulcast flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Layer, "simulcast-layer", "", "RID of the simulcast layer to reflect (empty selects the layer by the estimated bandwidth)")
+	return c
+}
+
+type layer struct {
+	rid     string
+	ssrc    webrtc.SSRC
+	bytes   uint64
+	bitrate float64
+}
+
+// outputTrack is the part of a webrtc.TrackLocalStaticRTP the packets are written to
+type outputTrack interface {
+	Codec() webrtc.RTPCodecCapability
+	WriteRTP(packet *rtp.Packet) error
+}
+
+// Forwarder writes the packets of the selected layer to an outgoing track.
+// Sequence numbers and timestamps are rewritten so that the receiver sees a
+// single continuous stream across layer switches. The SSRC is rewritten by the track.
+type Forwarder struct {
+	track           outputTrack
+	requestKeyFrame func(ssrc webrtc.SSRC)
+
+	mu       sync.Mutex
+	layers   map[string]*layer
+	current  string
+	target   string
+	auto     bool
+	estimate uint64
+
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+}
+
+// NewForwarder creates a Forwarder which selects layers automatically.
+// requestKeyFrame is called to request a key frame on the layer being switched to.
+func NewForwarder(track *webrtc.TrackLocalStaticRTP, requestKeyFrame func(ssrc webrtc.SSRC)) *Forwarder {
+	return newForwarder(track, requestKeyFrame)
+}
+
+func newForwarder(track outputTrack, requestKeyFrame func(ssrc webrtc.SSRC)) *Forwarder {
+	return &Forwarder{
+		track:           track,
+		requestKeyFrame: requestKeyFrame,
+		layers:          map[string]*layer{},
+		auto:            true,
+	}
+}
+
+// AddLayer registers a layer received from the publisher.
+// A track without simulcast is registered with an empty RID.
+func (f *Forwarder) AddLayer(rid string, ssrc webrtc.SSRC) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.layers[rid] = &layer{rid: rid, ssrc: ssrc}
+	// 最初のレイヤーか、手動で選択されたレイヤーが届いた場合は切り替えを開始する
+	if f.target == "" || (!f.auto && f.target == rid) {
+		f.switchTo(rid)
+	}
+}
+
+// RemoveLayer unregisters a layer which is no longer received
+func (f *Forwarder) RemoveLayer(rid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.layers, rid)
+	if f.target == rid {
+		f.target = ""
+		if best := f.selectLayer(); best != "" {
+			f.switchTo(best)
+		}
+	}
+}
+
+// Layers returns the RIDs of the registered layers ordered by ascending bitrate
+func (f *Forwarder) Layers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rids := []string{}
+	for _, l := range f.sortedLayers() {
+		rids = append(rids, l.rid)
+	}
+	return rids
+}
+
+// CurrentLayer returns the RID of the layer being forwarded
+func (f *Forwarder) CurrentLayer() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current
+}
+
+// SelectLayer switches to the layer with the given RID.
+// An empty RID enables automatic selection based on the estimated bandwidth.
+func (f *Forwarder) SelectLayer(rid string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if rid == "" {
+		f.auto = true
+		if best := f.selectLayer(); best != "" {
+			f.switchTo(best)
+		}
+		return nil
+	}
+
+	f.auto = false
+	if _, ok := f.layers[rid]; !ok {
+		// レイヤーが届いた時点で切り替える
+		f.target = rid
+		return fmt.Errorf("layer %q is not received yet", rid)
+	}
+	f.switchTo(rid)
+	return nil
+}
+
+// SetEstimatedBitrate updates the bandwidth estimate of the subscriber in bits per second
+func (f *Forwarder) SetEstimatedBitrate(bitrate uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.estimate = bitrate
+}
+
+// RequestKeyFrame requests a key frame on the forwarded layer,
+// e.g. when the subscriber sent a PLI
+func (f *Forwarder) RequestKeyFrame() {
+	f.mu.Lock()
+	l, ok := f.layers[f.target]
+	f.mu.Unlock()
+
+	if ok {
+		f.requestKeyFrame(l.ssrc)
+	}
+}
+
+// WriteRTP forwards the packet if it belongs to the selected layer
+func (f *Forwarder) WriteRTP(rid string, packet *rtp.Packet) error {
+	f.mu.Lock()
+	if l, ok := f.layers[rid]; ok {
+		l.bytes += uint64(len(packet.Payload))
+	}
+
+	// 切り替え先のレイヤーのキーフレームが届いたら切り替える
+	if rid == f.target && rid != f.current && IsKeyFrame(f.track.Codec().MimeType, packet.Payload) {
+		if f.started {
+			f.seqOffset = f.lastSeq + 1 - packet.SequenceNumber
+			f.tsOffset = f.lastTS + defaultTimestampStep - packet.Timestamp
+		}
+		f.current = rid
+	}
+	if rid != f.current {
+		f.mu.Unlock()
+		return nil
+	}
+
+	packet.SequenceNumber += f.seqOffset
+	packet.Timestamp += f.tsOffset
+	if !f.started || int16(packet.SequenceNumber-f.lastSeq) > 0 {
+		f.lastSeq = packet.SequenceNumber
+	}
+	if !f.started || int32(packet.Timestamp-f.lastTS) > 0 {
+		f.lastTS = packet.Timestamp
+	}
+	f.started = true
+	f.mu.Unlock()
+
+	return f.track.WriteRTP(packet)
+}
+
+// Run measures the bitrate of each layer and selects a layer
+// according to the estimated bandwidth until ctx is done
+func (f *Forwarder) Run(ctx context.Context) {
+	ticker := time.NewTicker(measureInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			f.measure(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+func (f *Forwarder) measure(elapsed time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, l := range f.layers {
+		bitrate := float64(l.bytes*8) / elapsed.Seconds()
+		if l.bitrate == 0 {
+			l.bitrate = bitrate
+		} else {
+			l.bitrate = l.bitrate*0.7 + bitrate*0.3
+		}
+		l.bytes = 0
+	}
+
+	if f.auto {
+		if best := f.selectLayer(); best != "" && best != f.target {
+			f.switchTo(best)
+		}
+	}
+
+	// キーフレームが届かず切り替えが完了していなければ、再度要求する
+	if l, ok := f.layers[f.target]; ok && f.target != f.current {
+		go f.requestKeyFrame(l.ssrc)
+	}
+}
+
+// selectLayer returns the highest layer which fits in the estimated bandwidth
+func (f *Forwarder) selectLayer() string {
+	layers := f.sortedLayers()
+	if len(layers) == 0 {
+		return ""
+	}
+	if f.estimate == 0 {
+		return layers[len(layers)-1].rid
+	}
+
+	best := layers[0].rid
+	for _, l := range layers {
+		if l.bitrate <= float64(f.estimate)*bitrateHeadroom {
+			best = l.rid
+		}
+	}
+	return best
+}
+
+func (f *Forwarder) sortedLayers() []*layer {
+	layers := make([]*layer, 0, len(f.layers))
+	for _, l := range f.layers {
+		layers = append(layers, l)
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		if layers[i].bitrate == layers[j].bitrate {
+			return layers[i].rid < layers[j].rid
+		}
+		return layers[i].bitrate < layers[j].bitrate
+	})
+	return layers
+}
+
+// switchTo starts switching to the layer. The switch completes on its next key frame.
+func (f *Forwarder) switchTo(rid string) {
+	f.target = rid
+	if rid == f.current {
+		return
+	}
+	if l, ok := f.layers[rid]; ok {
+		go f.requestKeyFrame(l.ssrc)
+	}
+}
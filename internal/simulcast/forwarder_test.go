@@ -0,0 +1,172 @@
+package simulcast
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeTrackは、書き込まれたパケットを記録する送信トラックです
+type fakeTrack struct {
+	packets []rtp.Packet
+}
+
+func (t *fakeTrack) Codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+}
+
+func (t *fakeTrack) WriteRTP(packet *rtp.Packet) error {
+	t.packets = append(t.packets, *packet)
+	return nil
+}
+
+// keyFrameRequestsは、キーフレームを要求されたSSRCを記録します
+type keyFrameRequests struct {
+	mu    sync.Mutex
+	ssrcs map[webrtc.SSRC]int
+}
+
+func (k *keyFrameRequests) request(ssrc webrtc.SSRC) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.ssrcs[ssrc]++
+}
+
+func (k *keyFrameRequests) count(ssrc webrtc.SSRC) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.ssrcs[ssrc]
+}
+
+var (
+	vp8KeyFrame   = []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}
+	vp8InterFrame = []byte{0x10, 0x01, 0x00, 0x00, 0x00}
+)
+
+func write(t *testing.T, f *Forwarder, rid string, seq uint16, ts uint32, payload []byte) {
+	t.Helper()
+	if err := f.WriteRTP(rid, &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitRequest(t *testing.T, requests *keyFrameRequests, ssrc webrtc.SSRC) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); requests.count(ssrc) == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no key frame is requested for SSRC %d", ssrc)
+		}
+	}
+}
+
+// TestForwarderSwitchは、キーフレームでのみレイヤーを切り替え、切り替えの前後でシーケンス番号が連続し、タイムスタンプが増加し続けることを確認します
+func TestForwarderSwitch(t *testing.T) {
+	track := &fakeTrack{}
+	requests := &keyFrameRequests{ssrcs: map[webrtc.SSRC]int{}}
+	f := newForwarder(track, requests.request)
+	f.AddLayer("q", 1)
+	f.AddLayer("f", 2)
+	waitRequest(t, requests, 1)
+
+	// キーフレームが届くまでは送らない
+	write(t, f, "q", 10, 1000, vp8InterFrame)
+	if len(track.packets) != 0 || f.CurrentLayer() != "" {
+		t.Fatalf("forwarded %d packets before a key frame", len(track.packets))
+	}
+	// 最初のレイヤーは、最初のキーフレームからシーケンス番号・タイムスタンプを変えずに送る
+	write(t, f, "q", 11, 4000, vp8KeyFrame)
+	write(t, f, "q", 12, 4000, vp8InterFrame)
+	write(t, f, "f", 500, 90000, vp8InterFrame)
+	write(t, f, "q", 13, 7000, vp8InterFrame)
+	if f.CurrentLayer() != "q" {
+		t.Fatalf("got layer %q, want q", f.CurrentLayer())
+	}
+
+	// 切り替え先のキーフレームが届くまでは、元のレイヤーを送り続ける
+	if err := f.SelectLayer("f"); err != nil {
+		t.Fatal(err)
+	}
+	waitRequest(t, requests, 2)
+	write(t, f, "f", 501, 93000, vp8InterFrame)
+	write(t, f, "q", 14, 10000, vp8InterFrame)
+	// 元のレイヤーのキーフレームでは切り替えない
+	write(t, f, "q", 15, 13000, vp8KeyFrame)
+	if f.CurrentLayer() != "q" {
+		t.Fatalf("switched to %q before a key frame of f", f.CurrentLayer())
+	}
+	write(t, f, "f", 502, 99000, vp8KeyFrame)
+	write(t, f, "q", 16, 16000, vp8InterFrame)
+	write(t, f, "f", 503, 99000, vp8InterFrame)
+	write(t, f, "f", 504, 102000, vp8InterFrame)
+	if f.CurrentLayer() != "f" {
+		t.Fatalf("got layer %q, want f", f.CurrentLayer())
+	}
+
+	// 送ったパケット: q 11-15、f 502-504
+	wantPayloads := [][]byte{vp8KeyFrame, vp8InterFrame, vp8InterFrame, vp8InterFrame, vp8KeyFrame, vp8KeyFrame, vp8InterFrame, vp8InterFrame}
+	if len(track.packets) != len(wantPayloads) {
+		t.Fatalf("forwarded %d packets, want %d", len(track.packets), len(wantPayloads))
+	}
+	for i, packet := range track.packets {
+		if want := uint16(11 + i); packet.SequenceNumber != want {
+			t.Errorf("packet %d: got sequence number %d, want %d", i, packet.SequenceNumber, want)
+		}
+		if i > 0 && int32(packet.Timestamp-track.packets[i-1].Timestamp) < 0 {
+			t.Errorf("packet %d: timestamp %d goes back from %d", i, packet.Timestamp, track.packets[i-1].Timestamp)
+		}
+		if string(packet.Payload) != string(wantPayloads[i]) {
+			t.Errorf("packet %d: got payload %x", i, packet.Payload)
+		}
+	}
+	// 切り替え後のキーフレームは、元のレイヤーの最後のフレームの1フレーム後になる
+	switched := track.packets[5]
+	if want := uint32(13000 + defaultTimestampStep); switched.Timestamp != want {
+		t.Errorf("got timestamp %d after the switch, want %d", switched.Timestamp, want)
+	}
+	// 切り替え後も、切り替え先のタイムスタンプの間隔を保つ
+	if got := track.packets[7].Timestamp - track.packets[6].Timestamp; got != 3000 {
+		t.Errorf("got timestamp step %d after the switch, want 3000", got)
+	}
+}
+
+// TestForwarderSelectLayerは、推定帯域に収まる最も高いレイヤーを自動で選択することを確認します
+func TestForwarderSelectLayer(t *testing.T) {
+	f := newForwarder(&fakeTrack{}, func(webrtc.SSRC) {})
+	for i, rid := range []string{"q", "h", "f"} {
+		f.AddLayer(rid, webrtc.SSRC(i+1))
+	}
+	// 1秒間にq: 100kbps、h: 500kbps、f: 2Mbpsを受信する
+	for rid, bytes := range map[string]int{"q": 100000 / 8, "h": 500000 / 8, "f": 2000000 / 8} {
+		write(t, f, rid, 1, 0, make([]byte, bytes))
+	}
+	f.SetEstimatedBitrate(1000000)
+	f.measure(time.Second)
+	if layers := f.Layers(); len(layers) != 3 || layers[0] != "q" || layers[2] != "f" {
+		t.Errorf("got layers %v ordered by bitrate", layers)
+	}
+	if f.target != "h" {
+		t.Errorf("got target %q with 1Mbps, want h", f.target)
+	}
+
+	// 推定帯域が最も低いレイヤーより少なくても、最も低いレイヤーを送る
+	f.SetEstimatedBitrate(50000)
+	f.measure(time.Second)
+	if f.target != "q" {
+		t.Errorf("got target %q with 50kbps, want q", f.target)
+	}
+
+	// 手動で選択している間は、推定帯域によらずそのレイヤーを送る
+	if err := f.SelectLayer("f"); err != nil {
+		t.Fatal(err)
+	}
+	f.measure(time.Second)
+	if f.target != "f" {
+		t.Errorf("got target %q after selecting f", f.target)
+	}
+	if err := f.SelectLayer("x"); err == nil {
+		t.Error("selected a layer which is not received")
+	}
+}
@@ -0,0 +1,70 @@
+package simulcast
+
+import (
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// IsKeyFrame reports whether the RTP payload starts a key frame.
+// VP8, VP9 and H264 are supported, false is returned for other codecs.
+func IsKeyFrame(mimeType string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		vp8 := &codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil {
+			return false
+		}
+		// パーティションの先頭で、VP8ペイロードヘッダのPビットが0ならキーフレーム
+		return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		// Pビット(インター予測)が0で、Bビット(フレームの先頭)が1ならキーフレーム
+		return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyFrame(payload)
+	}
+	return false
+}
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSPS   = 7
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+func isH264KeyFrame(payload []byte) bool {
+	switch naluType := payload[0] & 0x1F; naluType {
+	case h264NALUTypeIDR, h264NALUTypeSPS:
+		return true
+
+	case h264NALUTypeSTAPA:
+		// 集約されたNALユニットを順に確認する
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			if t := payload[offset] & 0x1F; t == h264NALUTypeIDR || t == h264NALUTypeSPS {
+				return true
+			}
+			offset += size
+		}
+
+	case h264NALUTypeFUA:
+		// 分割されたNALユニットの先頭のみを確認する
+		if len(payload) < 2 {
+			return false
+		}
+		return payload[1]&0x80 != 0 && payload[1]&0x1F == h264NALUTypeIDR
+	}
+	return false
+}
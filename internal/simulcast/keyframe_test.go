@@ -0,0 +1,39 @@
+package simulcast
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyFrame(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		// VP8ペイロードヘッダ(S=1、PID=0)の後のフレームヘッダのPビットが0ならキーフレーム
+		{"VP8 key frame", webrtc.MimeTypeVP8, []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{"VP8 inter frame", webrtc.MimeTypeVP8, []byte{0x10, 0x01, 0x00}, false},
+		{"VP8 key frame with picture ID", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{"VP8 inter frame with picture ID", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x01}, false},
+		{"VP8 continuation of a key frame", webrtc.MimeTypeVP8, []byte{0x00, 0x00, 0x00}, false},
+		{"VP8 second partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00, 0x00}, false},
+		{"VP8 descriptor only", webrtc.MimeTypeVP8, []byte{0x10}, false},
+		{"VP8 lower case MIME type", "video/vp8", []byte{0x10, 0x00, 0x9d, 0x01, 0x2a}, true},
+		{"empty", webrtc.MimeTypeVP8, nil, false},
+		{"VP9 key frame", webrtc.MimeTypeVP9, []byte{0x08, 0x00}, true},
+		{"VP9 inter frame", webrtc.MimeTypeVP9, []byte{0x48, 0x00}, false},
+		{"H264 IDR", webrtc.MimeTypeH264, []byte{0x65, 0x88}, true},
+		{"H264 non-IDR", webrtc.MimeTypeH264, []byte{0x41, 0x9a}, false},
+		{"H264 STAP-A with SPS", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"H264 first FU-A of IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x85, 0x88}, true},
+		{"H264 second FU-A of IDR", webrtc.MimeTypeH264, []byte{0x7c, 0x05, 0x88}, false},
+		{"Opus", webrtc.MimeTypeOpus, []byte{0x10, 0x00}, false},
+	} {
+		if got := IsKeyFrame(c.mimeType, c.payload); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package stats
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// Directions of a stream
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// StreamStats is the statistics of a single RTP stream (SSRC)
+type StreamStats struct {
+	SSRC      uint32 `json:"ssrc"`
+	Direction string `json:"direction"`
+	TrackID   string `json:"trackId"`
+	Kind      string `json:"kind"`
+	MimeType  string `json:"mimeType"`
+
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	// Frames is the number of RTP packets with the marker bit set (video only)
+	Frames uint64 `json:"frames"`
+	// PacketsLost is counted from sequence number gaps (inbound)
+	// or taken from the receiver reports of the remote peer (outbound)
+	PacketsLost int64 `json:"packetsLost"`
+	// Jitter is the interarrival jitter in seconds
+	Jitter float64 `json:"jitter"`
+	// RoundTripTime is calculated from the receiver reports in seconds (outbound)
+	RoundTripTime float64 `json:"roundTripTime"`
+
+	// NACKCount, PLICount and FIRCount are the feedback sent (inbound) or received (outbound)
+	NACKCount uint64 `json:"nackCount"`
+	PLICount  uint64 `json:"pliCount"`
+	FIRCount  uint64 `json:"firCount"`
+
+	// Bitrate and FrameRate are measured by the Collector over its interval
+	Bitrate   float64 `json:"bitrate"`
+	FrameRate float64 `json:"frameRate"`
+}
+
+type stream struct {
+	stats     StreamStats
+	clockRate uint32
+
+	// inbound
+	started     bool
+	baseSeq     uint32
+	maxSeq      uint32
+	cycles      uint32
+	lastTransit uint32
+}
+
+// Interceptor counts the RTP and RTCP packets of a PeerConnection.
+// pion's GetStats does not report RTP stream statistics yet, so they are collected here.
+// An Interceptor must not be shared between PeerConnections.
+type Interceptor struct {
+	interceptor.NoOp
+
+	mu      sync.Mutex
+	streams map[uint32]*stream
+}
+
+// NewInterceptor creates an Interceptor
+func NewInterceptor() *Interceptor {
+	return &Interceptor{streams: map[uint32]*stream{}}
+}
+
+// Streams returns a snapshot of the statistics of all streams
+func (i *Interceptor) Streams() []StreamStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	streams := make([]StreamStats, 0, len(i.streams))
+	for _, s := range i.streams {
+		streams = append(streams, s.stats)
+	}
+	return streams
+}
+
+func (i *Interceptor) addStream(info *interceptor.StreamInfo, direction string) *stream {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s := &stream{
+		stats: StreamStats{
+			SSRC:      info.SSRC,
+			Direction: direction,
+			TrackID:   info.ID,
+			Kind:      strings.SplitN(info.MimeType, "/", 2)[0],
+			MimeType:  info.MimeType,
+		},
+		clockRate: info.ClockRate,
+	}
+	i.streams[info.SSRC] = s
+	return s
+}
+
+func (i *Interceptor) removeStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.streams, info.SSRC)
+}
+
+// BindRemoteStream counts the received RTP packets
+func (i *Interceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	s := i.addStream(info, DirectionInbound)
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		header := rtp.Header{}
+		if _, headerErr := header.Unmarshal(b[:n]); headerErr != nil {
+			return n, attr, nil
+		}
+
+		i.mu.Lock()
+		s.received(&header, n, time.Now())
+		i.mu.Unlock()
+		return n, attr, nil
+	})
+}
+
+// UnbindRemoteStream removes the statistics of the stream
+func (i *Interceptor) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	i.removeStream(info)
+}
+
+// BindLocalStream counts the sent RTP packets
+func (i *Interceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	s := i.addStream(info, DirectionOutbound)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err != nil {
+			return n, err
+		}
+
+		i.mu.Lock()
+		s.stats.Packets++
+		s.stats.Bytes += uint64(header.MarshalSize() + len(payload))
+		if header.Marker && s.stats.Kind == "video" {
+			s.stats.Frames++
+		}
+		i.mu.Unlock()
+		return n, nil
+	})
+}
+
+// UnbindLocalStream removes the statistics of the stream
+func (i *Interceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.removeStream(info)
+}
+
+// BindRTCPReader reads the receiver reports and the feedback for the sent streams
+func (i *Interceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return n, attr, err
+		}
+		packets, unmarshalErr := rtcp.Unmarshal(b[:n])
+		if unmarshalErr != nil {
+			return n, attr, nil
+		}
+
+		now := time.Now()
+		i.mu.Lock()
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverReport:
+				i.receptionReports(p.Reports, now)
+			case *rtcp.SenderReport:
+				i.receptionReports(p.Reports, now)
+			default:
+				i.feedback(packet, DirectionOutbound)
+			}
+		}
+		i.mu.Unlock()
+		return n, attr, nil
+	})
+}
+
+// BindRTCPWriter counts the feedback sent for the received streams
+func (i *Interceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(packets []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		i.mu.Lock()
+		for _, packet := range packets {
+			i.feedback(packet, DirectionInbound)
+		}
+		i.mu.Unlock()
+		return writer.Write(packets, attributes)
+	})
+}
+
+func (i *Interceptor) receptionReports(reports []rtcp.ReceptionReport, now time.Time) {
+	for _, report := range reports {
+		s, ok := i.streams[report.SSRC]
+		if !ok || s.stats.Direction != DirectionOutbound {
+			continue
+		}
+		s.stats.PacketsLost = int64(report.TotalLost)
+		if s.clockRate != 0 {
+			s.stats.Jitter = float64(report.Jitter) / float64(s.clockRate)
+		}
+		// RTT = 受信時刻 - LSR - DLSR (NTPの中央32bit、1/65536秒単位)
+		if report.LastSenderReport != 0 {
+			rtt := ntpMiddle32(now) - report.LastSenderReport - report.Delay
+			s.stats.RoundTripTime = float64(rtt) / 65536
+		}
+	}
+}
+
+// feedback counts NACK, PLI and FIR packets for the streams in direction
+func (i *Interceptor) feedback(packet rtcp.Packet, direction string) {
+	var count func(*StreamStats)
+	switch packet.(type) {
+	case *rtcp.TransportLayerNack:
+		count = func(s *StreamStats) { s.NACKCount++ }
+	case *rtcp.PictureLossIndication:
+		count = func(s *StreamStats) { s.PLICount++ }
+	case *rtcp.FullIntraRequest:
+		count = func(s *StreamStats) { s.FIRCount++ }
+	default:
+		return
+	}
+	for _, ssrc := range packet.DestinationSSRC() {
+		if s, ok := i.streams[ssrc]; ok && s.stats.Direction == direction {
+			count(&s.stats)
+		}
+	}
+}
+
+// received updates the statistics of an inbound stream (RFC 3550 A.1, A.8)
+func (s *stream) received(header *rtp.Header, size int, now time.Time) {
+	s.stats.Packets++
+	s.stats.Bytes += uint64(size)
+	if header.Marker && s.stats.Kind == "video" {
+		s.stats.Frames++
+	}
+
+	seq := uint32(header.SequenceNumber)
+	if !s.started {
+		s.started = true
+		s.baseSeq = seq
+		s.maxSeq = seq
+	} else if delta := int16(header.SequenceNumber - uint16(s.maxSeq)); delta > 0 {
+		if header.SequenceNumber < uint16(s.maxSeq) {
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = seq
+	}
+	expected := int64(s.cycles+s.maxSeq) - int64(s.baseSeq) + 1
+	s.stats.PacketsLost = expected - int64(s.stats.Packets)
+
+	if s.clockRate == 0 {
+		return
+	}
+	// タイムスタンプの周回を考慮し、32bitで差分を計算する
+	arrival := uint32(now.UnixNano() / int64(time.Millisecond) * int64(s.clockRate) / 1000)
+	transit := arrival - header.Timestamp
+	if s.stats.Packets > 1 {
+		d := int32(transit - s.lastTransit)
+		if d < 0 {
+			d = -d
+		}
+		jitter := s.stats.Jitter * float64(s.clockRate)
+		jitter += (float64(d) - jitter) / 16
+		s.stats.Jitter = jitter / float64(s.clockRate)
+	}
+	s.lastTransit = transit
+}
+
+// ntpMiddle32 returns the middle 32 bits of the NTP timestamp of t
+func ntpMiddle32(t time.Time) uint32 {
+	// NTPの基準時刻(1900年)からの秒数
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return uint32((seconds<<32 | fraction) >> 16)
+}
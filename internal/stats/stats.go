@@ -0,0 +1,332 @@
+// Package stats collects the statistics of every session and exposes them
+// over HTTP: /metrics in the Prometheus text format and /stats as JSON.
+//
+// The connection level statistics are taken from PeerConnection.GetStats.
+// The RTP stream statistics (bitrate, packet loss, jitter, RTT, frame rate)
+// are counted by an Interceptor registered for each PeerConnection.
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Config is the configuration of the stats collection
+type Config struct {
+	// Addr is the address the HTTP server listens on. The server is not started when empty.
+	Addr string
+	// Interval is the interval statistics are collected at
+	Interval time.Duration
+}
+
+// Flags registers the stats flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.StringVar(&c.Addr, "stats-addr", "", "address of the HTTP server exposing /metrics and /stats, e.g. :9090 (disabled when empty)")
+	flag.DurationVar(&c.Interval, "stats-interval", time.Second, "interval statistics are collected at")
+	return c
+}
+
+// SessionStats is the statistics of a session
+type SessionStats struct {
+	Session             string    `json:"session"`
+	StartedAt           time.Time `json:"startedAt"`
+	PeerConnectionState string    `json:"peerConnectionState"`
+	ICEConnectionState  string    `json:"iceConnectionState"`
+	// BytesSent and BytesReceived are counted on the ICE transport
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	// RoundTripTime is the latest RTT of the nominated candidate pair in seconds
+	RoundTripTime float64       `json:"roundTripTime"`
+	Streams       []StreamStats `json:"streams"`
+}
+
+// peerConnection is the part of a webrtc.PeerConnection the statistics are collected from
+type peerConnection interface {
+	ConnectionState() webrtc.PeerConnectionState
+	ICEConnectionState() webrtc.ICEConnectionState
+	GetStats() webrtc.StatsReport
+	GetReceivers() []*webrtc.RTPReceiver
+	GetSenders() []*webrtc.RTPSender
+}
+
+type session struct {
+	peerConnection peerConnection
+	interceptor    *Interceptor
+	stats          SessionStats
+	lastCollected  time.Time
+}
+
+// Collector periodically collects the statistics of the registered sessions
+type Collector struct {
+	interval time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// NewCollector creates a Collector
+func NewCollector(interval time.Duration) *Collector {
+	return &Collector{interval: interval, sessions: map[string]*session{}}
+}
+
+// Start creates a Collector which collects statistics until ctx is done and
+// starts the HTTP server when Config.Addr is set
+func Start(ctx context.Context, c Config) (*Collector, error) {
+	collector := NewCollector(c.Interval)
+	if c.Addr != "" {
+		listener, err := net.Listen("tcp", c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		server := &http.Server{Handler: collector.Handler()}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		go func() {
+			// サーバーはctxが終了するまで閉じない
+			_ = server.Serve(listener)
+		}()
+	}
+	go collector.Run(ctx)
+	return collector, nil
+}
+
+// Add registers a session. interceptor has to be registered to the API the PeerConnection was created with.
+func (c *Collector) Add(id string, peerConnection *webrtc.PeerConnection, interceptor *Interceptor) {
+	c.add(id, peerConnection, interceptor)
+}
+
+func (c *Collector) add(id string, peerConnection peerConnection, interceptor *Interceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sessions[id] = &session{
+		peerConnection: peerConnection,
+		interceptor:    interceptor,
+		stats:          SessionStats{Session: id, StartedAt: now, Streams: []StreamStats{}},
+		lastCollected:  now,
+	}
+}
+
+// Remove unregisters a session
+func (c *Collector) Remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, id)
+}
+
+// Run collects statistics every interval until ctx is done
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.collect(now)
+		}
+	}
+}
+
+// Snapshot returns the statistics collected last, ordered by session
+func (c *Collector) Snapshot() []SessionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sessions := make([]SessionStats, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s.stats)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	return sessions
+}
+
+func (c *Collector) collect(now time.Time) {
+	c.mu.Lock()
+	sessions := make([]*session, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	c.mu.Unlock()
+
+	for _, s := range sessions {
+		// GetStatsはロックを取らずに呼び出す
+		collected := collectSession(s, now)
+		c.mu.Lock()
+		s.stats = collected
+		s.lastCollected = now
+		c.mu.Unlock()
+	}
+}
+
+func collectSession(s *session, now time.Time) SessionStats {
+	c := SessionStats{
+		Session:             s.stats.Session,
+		StartedAt:           s.stats.StartedAt,
+		PeerConnectionState: s.peerConnection.ConnectionState().String(),
+		ICEConnectionState:  s.peerConnection.ICEConnectionState().String(),
+	}
+	for _, report := range s.peerConnection.GetStats() {
+		switch r := report.(type) {
+		case webrtc.TransportStats:
+			if r.ID == "iceTransport" {
+				c.BytesSent = r.BytesSent
+				c.BytesReceived = r.BytesReceived
+			}
+		case webrtc.ICECandidatePairStats:
+			if r.Nominated {
+				c.RoundTripTime = r.CurrentRoundTripTime
+			}
+		}
+	}
+
+	// 前回の値との差分からビットレートとフレームレートを計算する
+	previous := map[uint32]StreamStats{}
+	for _, stream := range s.stats.Streams {
+		previous[stream.SSRC] = stream
+	}
+	trackIDs := trackIDs(s.peerConnection)
+	elapsed := now.Sub(s.lastCollected).Seconds()
+
+	c.Streams = s.interceptor.Streams()
+	for i := range c.Streams {
+		stream := &c.Streams[i]
+		if id, ok := trackIDs[stream.SSRC]; ok {
+			stream.TrackID = id
+		}
+		if last, ok := previous[stream.SSRC]; ok && elapsed > 0 {
+			stream.Bitrate = float64(stream.Bytes-last.Bytes) * 8 / elapsed
+			stream.FrameRate = float64(stream.Frames-last.Frames) / elapsed
+		}
+	}
+	sort.Slice(c.Streams, func(i, j int) bool {
+		if c.Streams[i].Direction == c.Streams[j].Direction {
+			return c.Streams[i].SSRC < c.Streams[j].SSRC
+		}
+		return c.Streams[i].Direction < c.Streams[j].Direction
+	})
+	return c
+}
+
+// trackIDs returns the IDs of the tracks by SSRC
+func trackIDs(peerConnection peerConnection) map[uint32]string {
+	ids := map[uint32]string{}
+	for _, receiver := range peerConnection.GetReceivers() {
+		for _, track := range receiver.Tracks() {
+			ids[uint32(track.SSRC())] = track.ID()
+		}
+	}
+	for _, sender := range peerConnection.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			ids[uint32(encoding.SSRC)] = sender.Track().ID()
+		}
+	}
+	return ids
+}
+
+// Handler returns an http.Handler serving /metrics and /stats
+func (c *Collector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, c.Snapshot())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(c.Snapshot()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return mux
+}
+
+// metric is a metric family of the Prometheus text format
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+func (m *metric) add(labels string, value float64) {
+	m.samples = append(m.samples, fmt.Sprintf("%s{%s} %v", m.name, labels, value))
+}
+
+func writeMetrics(w http.ResponseWriter, sessions []SessionStats) {
+	sessionMetrics := []*metric{
+		{name: "webrtc_session_bytes_sent_total", help: "Bytes sent on the ICE transport.", typ: "counter"},
+		{name: "webrtc_session_bytes_received_total", help: "Bytes received on the ICE transport.", typ: "counter"},
+		{name: "webrtc_session_round_trip_time_seconds", help: "RTT of the nominated ICE candidate pair.", typ: "gauge"},
+		{name: "webrtc_session_connected", help: "1 when the PeerConnection is connected.", typ: "gauge"},
+	}
+	streamMetrics := []*metric{
+		{name: "webrtc_rtp_packets_total", help: "RTP packets sent or received.", typ: "counter"},
+		{name: "webrtc_rtp_bytes_total", help: "RTP bytes sent or received.", typ: "counter"},
+		{name: "webrtc_rtp_frames_total", help: "Video frames sent or received.", typ: "counter"},
+		{name: "webrtc_rtp_packets_lost", help: "RTP packets lost.", typ: "gauge"},
+		{name: "webrtc_rtp_jitter_seconds", help: "Interarrival jitter.", typ: "gauge"},
+		{name: "webrtc_rtp_round_trip_time_seconds", help: "RTT calculated from RTCP receiver reports.", typ: "gauge"},
+		{name: "webrtc_rtp_bitrate_bits_per_second", help: "Bitrate of the RTP stream.", typ: "gauge"},
+		{name: "webrtc_rtp_frame_rate", help: "Frame rate of the video stream.", typ: "gauge"},
+		{name: "webrtc_rtcp_nack_total", help: "NACKs sent (inbound) or received (outbound).", typ: "counter"},
+		{name: "webrtc_rtcp_pli_total", help: "PLIs sent (inbound) or received (outbound).", typ: "counter"},
+		{name: "webrtc_rtcp_fir_total", help: "FIRs sent (inbound) or received (outbound).", typ: "counter"},
+	}
+
+	for _, s := range sessions {
+		labels := fmt.Sprintf(`session="%s"`, escapeLabel(s.Session))
+		connected := 0.0
+		if s.PeerConnectionState == webrtc.PeerConnectionStateConnected.String() {
+			connected = 1
+		}
+		for i, value := range []float64{float64(s.BytesSent), float64(s.BytesReceived), s.RoundTripTime, connected} {
+			sessionMetrics[i].add(labels, value)
+		}
+
+		for _, stream := range s.Streams {
+			labels := fmt.Sprintf(`session="%s",track="%s",ssrc="%d",direction="%s",kind="%s",mime_type="%s"`,
+				escapeLabel(s.Session), escapeLabel(stream.TrackID), stream.SSRC, stream.Direction, escapeLabel(stream.Kind), escapeLabel(stream.MimeType))
+			values := []float64{
+				float64(stream.Packets), float64(stream.Bytes), float64(stream.Frames), float64(stream.PacketsLost),
+				stream.Jitter, stream.RoundTripTime, stream.Bitrate, stream.FrameRate,
+				float64(stream.NACKCount), float64(stream.PLICount), float64(stream.FIRCount),
+			}
+			for i, value := range values {
+				streamMetrics[i].add(labels, value)
+			}
+		}
+	}
+
+	for _, m := range append(sessionMetrics, streamMetrics...) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, sample := range m.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
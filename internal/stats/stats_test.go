@@ -0,0 +1,151 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakePeerConnectionは、決まった統計情報を返すPeerConnectionです
+type fakePeerConnection struct {
+	report webrtc.StatsReport
+}
+
+func (f *fakePeerConnection) ConnectionState() webrtc.PeerConnectionState {
+	return webrtc.PeerConnectionStateConnected
+}
+
+func (f *fakePeerConnection) ICEConnectionState() webrtc.ICEConnectionState {
+	return webrtc.ICEConnectionStateConnected
+}
+
+func (f *fakePeerConnection) GetStats() webrtc.StatsReport        { return f.report }
+func (f *fakePeerConnection) GetReceivers() []*webrtc.RTPReceiver { return nil }
+func (f *fakePeerConnection) GetSenders() []*webrtc.RTPSender     { return nil }
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, resp.Status)
+	}
+	return string(body)
+}
+
+// TestHandlerは、偽の統計情報とRTPパケットから/metrics、/statsを公開できることを確認します
+func TestHandler(t *testing.T) {
+	pc := &fakePeerConnection{report: webrtc.StatsReport{
+		"iceTransport": webrtc.TransportStats{ID: "iceTransport", BytesSent: 1000, BytesReceived: 2000},
+		"pair":         webrtc.ICECandidatePairStats{ID: "pair", Nominated: true, CurrentRoundTripTime: 0.05},
+		"other":        webrtc.ICECandidatePairStats{ID: "other", CurrentRoundTripTime: 9},
+	}}
+	i := NewInterceptor()
+	collector := NewCollector(time.Second)
+	collector.add("1", pc, i)
+	start := time.Now()
+
+	// シーケンス番号3が抜けた映像のRTPパケットを受信する
+	var packets [][]byte
+	for _, seq := range []uint16{1, 2, 4, 5} {
+		b, err := (&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, SSRC: 1234, Marker: seq%2 == 0}, Payload: make([]byte, 88)}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, b)
+	}
+	reader := i.BindRemoteStream(&interceptor.StreamInfo{ID: "video-track", SSRC: 1234, MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+			n := copy(b, packets[0])
+			packets = packets[1:]
+			return n, a, nil
+		}))
+	read := func(n int) {
+		buf := make([]byte, 1500)
+		for ; n > 0; n-- {
+			if _, _, err := reader.Read(buf, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	read(2)
+	collector.collect(start.Add(time.Second))
+	// 2回目の収集では、1秒間に受信した2パケット(200バイト)からビットレートを計算する
+	read(2)
+	collector.collect(start.Add(2 * time.Second))
+
+	server := httptest.NewServer(collector.Handler())
+	defer server.Close()
+
+	metrics := get(t, server.URL+"/metrics")
+	streamLabels := `session="1",track="video-track",ssrc="1234",direction="inbound",kind="video",mime_type="video/VP8"`
+	for _, line := range []string{
+		"# TYPE webrtc_session_bytes_sent_total counter",
+		`webrtc_session_bytes_sent_total{session="1"} 1000`,
+		`webrtc_session_bytes_received_total{session="1"} 2000`,
+		`webrtc_session_round_trip_time_seconds{session="1"} 0.05`,
+		`webrtc_session_connected{session="1"} 1`,
+		"webrtc_rtp_packets_total{" + streamLabels + "} 4",
+		"webrtc_rtp_bytes_total{" + streamLabels + "} 400",
+		"webrtc_rtp_frames_total{" + streamLabels + "} 2",
+		"webrtc_rtp_packets_lost{" + streamLabels + "} 1",
+		"webrtc_rtp_bitrate_bits_per_second{" + streamLabels + "} 1600",
+		"webrtc_rtp_frame_rate{" + streamLabels + "} 1",
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("no %q in /metrics:\n%s", line, metrics)
+		}
+	}
+
+	var sessions []SessionStats
+	if err := json.Unmarshal([]byte(get(t, server.URL+"/stats")), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || len(sessions[0].Streams) != 1 {
+		t.Fatalf("got /stats %+v", sessions)
+	}
+	got, stream := sessions[0], sessions[0].Streams[0]
+	if got.Session != "1" || got.PeerConnectionState != "connected" || got.BytesSent != 1000 || got.RoundTripTime != 0.05 {
+		t.Errorf("got session %+v", got)
+	}
+	if stream.TrackID != "video-track" || stream.Packets != 4 || stream.PacketsLost != 1 || stream.Bitrate != 1600 {
+		t.Errorf("got stream %+v", stream)
+	}
+
+	// 削除したセッションは公開しない
+	collector.Remove("1")
+	if metrics := get(t, server.URL+"/metrics"); strings.Contains(metrics, `session="1"`) {
+		t.Errorf("got a removed session in /metrics:\n%s", metrics)
+	}
+}
+
+// TestStartは、HTTPサーバーを起動できない場合にエラーを返すことを確認します
+func TestStart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := Start(ctx, Config{Addr: listener.Addr().String(), Interval: time.Second}); err == nil {
+		t.Error("started on an address in use")
+	}
+}
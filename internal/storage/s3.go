@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinPartSize is the minimum size of the parts of a multipart upload except the last one
+const MinPartSize = 5 << 20
+
+// uploadQueue is the number of parts waiting to be uploaded before Write blocks
+const uploadQueue = 2
+
+// S3Config is the configuration of the S3 client
+type S3Config struct {
+	// Endpoint is the URL of the S3 API, e.g. http://localhost:9000 for MinIO.
+	// https://s3.<Region>.amazonaws.com is used when empty.
+	Endpoint string
+	Region   string
+	// AccessKeyID and SecretAccessKey are the credentials. Flags reads them from
+	// the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle addresses the bucket by the path (http://endpoint/bucket/key) instead of
+	// the host name (http://bucket.endpoint/key), which MinIO and most stand-ins need
+	PathStyle bool
+	// PartSize is the size of the parts of the multipart uploads
+	PartSize int64
+	// Timeout is how long a request may take
+	Timeout time.Duration
+}
+
+// Flags registers the S3 flags on the default FlagSet.
+// The returned S3Config is filled in when flag.Parse is called.
+func Flags() *S3Config {
+	c := &S3Config{AccessKeyID: os.Getenv("AWS_ACCESS_KEY_ID"), SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY")}
+	flag.StringVar(&c.Endpoint, "s3-endpoint", "", "URL of the S3-compatible API used with an s3:// recording directory, e.g. http://localhost:9000 for MinIO (AWS S3 of -s3-region when empty)")
+	flag.StringVar(&c.Region, "s3-region", "us-east-1", "region of the S3 bucket")
+	flag.BoolVar(&c.PathStyle, "s3-path-style", false, "address the bucket by the path instead of the host name (needed by MinIO)")
+	flag.Int64Var(&c.PartSize, "s3-part-size", 8<<20, "size in bytes of the parts uploaded while a file is recorded (at least 5 MiB)")
+	flag.DurationVar(&c.Timeout, "s3-timeout", 30*time.Second, "how long a request to S3 may take")
+	return c
+}
+
+// Validate returns an error when the configuration is invalid
+func (c S3Config) Validate() error {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("no S3 credentials are given in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if c.Region == "" {
+		return errors.New("no S3 region is given")
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid S3 endpoint %q", c.Endpoint)
+		}
+	}
+	if c.PartSize < MinPartSize {
+		return fmt.Errorf("S3 part size %d is smaller than %d", c.PartSize, MinPartSize)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid S3 timeout %s", c.Timeout)
+	}
+	return nil
+}
+
+// S3Storage stores the files as the objects of a bucket under a prefix
+type S3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	bucket   string
+	// prefix is prepended to the names with a slash, when not empty
+	prefix string
+	client *http.Client
+}
+
+// NewS3 returns a storage of the objects under prefix in the bucket.
+// The config is not validated, so that tests can use parts smaller than MinPartSize.
+func NewS3(config S3Config, bucket, prefix string) (*S3Storage, error) {
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Storage{config: config, endpoint: u, bucket: bucket, prefix: prefix, client: &http.Client{Timeout: config.Timeout}}, nil
+}
+
+// key returns the key of the object of name
+func (s *S3Storage) key(name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	if s.prefix == "" {
+		return name, nil
+	}
+	return s.prefix + "/" + name, nil
+}
+
+// Create starts writing an object. The object is sent with a single PutObject when it is smaller than
+// S3Config.PartSize, and otherwise with a multipart upload whose parts are uploaded while it is written.
+// Nothing is stored when Close fails.
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{storage: s, key: key}, nil
+}
+
+// WriteFile puts the object at once
+func (s *S3Storage) WriteFile(name string, data []byte) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(http.MethodPut, key, nil, data)
+	return err
+}
+
+// List returns the objects under the prefix with ListObjectsV2
+func (s *S3Storage) List() ([]FileInfo, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	files := []FileInfo{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("s3: invalid ListObjectsV2 response: %w", err)
+		}
+		for _, object := range result.Contents {
+			files = append(files, FileInfo{Name: strings.TrimPrefix(object.Key, prefix), Size: object.Size, ModTime: object.LastModified})
+		}
+		if !result.IsTruncated {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// RemoveAll deletes the objects in the directory one by one
+func (s *S3Storage) RemoveAll(dir string) error {
+	if err := validName(dir); err != nil {
+		return err
+	}
+	files, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name, dir+"/") {
+			continue
+		}
+		key, err := s.key(file.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := s.do(http.MethodDelete, key, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Location returns the s3:// URL of the object
+func (s *S3Storage) Location(name string) string {
+	key, _ := s.key(name)
+	return "s3://" + s.bucket + "/" + key
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// initiateMultipartUploadResult is the response of CreateMultipartUpload
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// completeMultipartUpload is the request of CompleteMultipartUpload
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Error is the error response of the S3 API
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// do sends a signed request for the object key (or the bucket when key is empty) and returns the response body.
+// A response other than 2xx is returned as an error.
+func (s *S3Storage) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	res, err := s.request(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		var e s3Error
+		xml.Unmarshal(b, &e)
+		return nil, fmt.Errorf("s3: %s %s: %d %s %s", method, s.bucket+"/"+key, res.StatusCode, e.Code, e.Message)
+	}
+	return b, nil
+}
+
+// request sends a signed request and returns the response
+func (s *S3Storage) request(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	if s.config.PathStyle {
+		u.Path = "/" + s.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	sign(req, body, s.config.AccessKeyID, s.config.SecretAccessKey, s.config.Region, time.Now())
+	return s.client.Do(req)
+}
+
+// s3Writer streams an object to S3. Write buffers the data, and each part of PartSize is
+// queued to a goroutine uploading the parts in order.
+type s3Writer struct {
+	storage *S3Storage
+	key     string
+	buf     []byte
+	// parts is the queue of the parts to upload, nil until the multipart upload is started
+	parts chan []byte
+	done  chan struct{}
+	// uploadID and completed are written by the uploading goroutine before done is closed
+	uploadID  string
+	completed []completedPart
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("s3: write to a closed object")
+	}
+	if err := w.uploadErr(); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf, b...)
+	for int64(len(w.buf)) >= w.storage.config.PartSize {
+		if w.parts == nil {
+			w.parts = make(chan []byte, uploadQueue)
+			w.done = make(chan struct{})
+			go w.upload()
+		}
+		part := w.buf[:w.storage.config.PartSize]
+		w.buf = append([]byte(nil), w.buf[w.storage.config.PartSize:]...)
+		// 前のパートのアップロードが遅れている場合は、ここで待つ
+		w.parts <- part
+	}
+	return len(b), nil
+}
+
+// upload starts the multipart upload and uploads the queued parts until the queue is closed.
+// After an error, the remaining parts are discarded.
+func (w *s3Writer) upload() {
+	defer close(w.done)
+	for part := range w.parts {
+		if w.uploadErr() != nil {
+			continue
+		}
+		if err := w.uploadPart(part); err != nil {
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *s3Writer) uploadPart(part []byte) error {
+	s := w.storage
+	if w.uploadID == "" {
+		body, err := s.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		var result initiateMultipartUploadResult
+		if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+			return fmt.Errorf("s3: invalid CreateMultipartUpload response: %s", body)
+		}
+		w.uploadID = result.UploadID
+	}
+	number := len(w.completed) + 1
+	res, err := s.request(http.MethodPut, w.key, url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}, part)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode/100 != 2 {
+		var e s3Error
+		xml.Unmarshal(b, &e)
+		return fmt.Errorf("s3: UploadPart %d of %s: %d %s %s", number, w.key, res.StatusCode, e.Code, e.Message)
+	}
+	w.completed = append(w.completed, completedPart{PartNumber: number, ETag: res.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) uploadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close puts the object, or uploads the last part and completes the multipart upload.
+// The multipart upload is aborted when a part has failed.
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	s := w.storage
+	if w.parts == nil {
+		_, err := s.do(http.MethodPut, w.key, nil, w.buf)
+		return err
+	}
+	if len(w.buf) > 0 {
+		w.parts <- w.buf
+	}
+	close(w.parts)
+	<-w.done
+
+	if err := w.uploadErr(); err != nil {
+		if w.uploadID != "" {
+			s.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil)
+		}
+		return err
+	}
+	body, err := xml.Marshal(completeMultipartUpload{Parts: w.completed})
+	if err != nil {
+		return err
+	}
+	b, err := s.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		return err
+	}
+	// CompleteMultipartUploadは、200 OKのボディでエラーを返すことがある
+	var e s3Error
+	if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: CompleteMultipartUpload of %s: %s %s", w.key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// sign adds the headers of AWS Signature Version 4 to the request
+func sign(req *http.Request, body []byte, accessKeyID, secretAccessKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	signedHeaders, canonical := canonicalRequest(req, []string{"host", "x-amz-content-sha256", "x-amz-date"}, payloadHash)
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature(secretAccessKey, date, region, stringToSign)))
+}
+
+// canonicalRequest returns the signed headers and the canonical request of Signature Version 4
+func canonicalRequest(req *http.Request, headers []string, payloadHash string) (string, string) {
+	sort.Strings(headers)
+	b := &strings.Builder{}
+	b.WriteString(req.Method + "\n")
+	b.WriteString(uriEncode(req.URL.Path, false) + "\n")
+	b.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if header == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		b.WriteString(header + ":" + strings.TrimSpace(value) + "\n")
+	}
+	b.WriteString("\n" + strings.Join(headers, ";") + "\n" + payloadHash)
+	return strings.Join(headers, ";"), b.String()
+}
+
+// signature derives the signing key and signs stringToSign
+func signature(secretAccessKey, date, region, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQuery returns the query sorted by the key and encoded as Signature Version 4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes every byte except the unreserved characters (and the slashes unless encodeSlash)
+func uriEncode(s string, encodeSlash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
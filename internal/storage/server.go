@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a minimal in-memory S3-compatible server, used as a stand-in for S3 or MinIO in tests.
+// It accepts the path-style requests signed with the credentials for PutObject, GetObject,
+// DeleteObject, ListObjectsV2 and the multipart upload. Buckets are created when first written.
+type Server struct {
+	accessKeyID     string
+	secretAccessKey string
+	listener        net.Listener
+	server          *http.Server
+
+	mu      sync.Mutex
+	objects map[string]serverObject
+	uploads map[string]*serverUpload
+	nextID  int
+	// minPartSize is the minimum size of the parts except the last one
+	minPartSize int64
+}
+
+type serverObject struct {
+	data    []byte
+	modTime time.Time
+	// parts is the number of parts when the object was uploaded with a multipart upload
+	parts int
+}
+
+type serverUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// NewServer starts a server on addr, e.g. 127.0.0.1:0, accepting the requests signed with the credentials
+func NewServer(addr, accessKeyID, secretAccessKey string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		accessKeyID: accessKeyID, secretAccessKey: secretAccessKey, listener: listener,
+		objects: map[string]serverObject{}, uploads: map[string]*serverUpload{}, minPartSize: MinPartSize,
+	}
+	s.server = &http.Server{Handler: s}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// URL returns the endpoint of the server
+func (s *Server) URL() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+// SetMinPartSize changes the minimum size of the parts, to test the multipart uploads with small parts
+func (s *Server) SetMinPartSize(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minPartSize = size
+}
+
+// Object returns the data of an object and the number of the parts it was uploaded in (0 for PutObject)
+func (s *Server) Object(bucket, key string) ([]byte, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[bucket+"/"+key]
+	return object.data, object.parts, ok
+}
+
+// Uploads returns the number of the multipart uploads neither completed nor aborted
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// ServeHTTP handles a request of the S3 API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	if code, message := s.verify(r, body); code != "" {
+		writeError(w, http.StatusForbidden, code, message)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.list(w, bucket, query)
+	case key == "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "bucket operations are not supported")
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &serverUpload{key: bucket + "/" + key, parts: map[int][]byte{}}
+		writeXML(w, initiateMultipartUploadResult{UploadID: id})
+	case query.Get("uploadId") != "":
+		s.multipart(w, r.Method, bucket+"/"+key, query, body)
+	case r.Method == http.MethodPut:
+		s.objects[bucket+"/"+key] = serverObject{data: body, modTime: time.Now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet:
+		object, ok := s.objects[bucket+"/"+key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "the object does not exist")
+			return
+		}
+		w.Write(object.data)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" is not supported")
+	}
+}
+
+// multipart handles UploadPart, CompleteMultipartUpload and AbortMultipartUpload
+func (s *Server) multipart(w http.ResponseWriter, method, key string, query map[string][]string, body []byte) {
+	id := query["uploadId"][0]
+	upload, ok := s.uploads[id]
+	if !ok || upload.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the upload does not exist")
+		return
+	}
+	switch method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(strings.Join(query["partNumber"], ""))
+		if err != nil || number < 1 || number > 10000 {
+			writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+			return
+		}
+		upload.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodPost:
+		var complete completeMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+			writeError(w, http.StatusBadRequest, "MalformedXML", "invalid CompleteMultipartUpload")
+			return
+		}
+		var data []byte
+		for i, part := range complete.Parts {
+			b, ok := upload.parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || etag(b) != part.ETag {
+				writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d is not uploaded", part.PartNumber))
+				return
+			}
+			if i < len(complete.Parts)-1 && int64(len(b)) < s.minPartSize {
+				writeError(w, http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("part %d is smaller than %d", part.PartNumber, s.minPartSize))
+				return
+			}
+			data = append(data, b...)
+		}
+		s.objects[key] = serverObject{data: data, modTime: time.Now(), parts: len(complete.Parts)}
+		delete(s.uploads, id)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+		}{Key: key})
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", method+" is not supported")
+	}
+}
+
+// listPageSize is the number of the objects in a page of ListObjectsV2, small to test the continuation
+const listPageSize = 100
+
+// list handles ListObjectsV2
+func (s *Server) list(w http.ResponseWriter, bucket string, query map[string][]string) {
+	prefix := bucket + "/" + strings.Join(query["prefix"], "")
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// 継続トークンは、前のページの最後のキーとする
+	if token := strings.Join(query["continuation-token"], ""); token != "" {
+		i := sort.SearchStrings(keys, bucket+"/"+token)
+		for i < len(keys) && keys[i] <= bucket+"/"+token {
+			i++
+		}
+		keys = keys[i:]
+	}
+	var result listBucketResult
+	if len(keys) > listPageSize {
+		keys = keys[:listPageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = strings.TrimPrefix(keys[len(keys)-1], bucket+"/")
+	}
+	for _, key := range keys {
+		object := s.objects[key]
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			LastModified time.Time
+			Size         int64
+		}{strings.TrimPrefix(key, bucket+"/"), object.modTime, int64(len(object.data))})
+	}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listBucketResult
+	}{listBucketResult: result})
+}
+
+// verify checks the Signature Version 4 of the request and returns the error code when it is invalid
+func (s *Server) verify(r *http.Request, body []byte) (string, string) {
+	authorization := r.Header.Get("Authorization")
+	const algorithm = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(authorization, algorithm) {
+		return "AccessDenied", "no Signature Version 4"
+	}
+	parameters := map[string]string{}
+	for _, parameter := range strings.Split(authorization[len(algorithm):], ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+		if len(keyValue) == 2 {
+			parameters[keyValue[0]] = keyValue[1]
+		}
+	}
+	credential := strings.Split(parameters["Credential"], "/")
+	if len(credential) != 5 || credential[0] != s.accessKeyID {
+		return "InvalidAccessKeyId", "unknown access key"
+	}
+	if sha256Hex(body) != r.Header.Get("X-Amz-Content-Sha256") {
+		return "XAmzContentSHA256Mismatch", "the payload hash does not match"
+	}
+	date, region := credential[1], credential[2]
+	amzDate := r.Header.Get("X-Amz-Date")
+	_, canonical := canonicalRequest(r, strings.Split(parameters["SignedHeaders"], ";"), r.Header.Get("X-Amz-Content-Sha256"))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + strings.Join(credential[1:], "/") + "\n" + sha256Hex([]byte(canonical))
+	if signature(s.secretAccessKey, date, region, stringToSign) != parameters["Signature"] {
+		return "SignatureDoesNotMatch", "the signature does not match"
+	}
+	return "", ""
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(append([]byte(xml.Header), b...))
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	b, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		s3Error
+	}{s3Error: s3Error{Code: code, Message: message}})
+	w.Write(b)
+}
@@ -0,0 +1,160 @@
+// Package storage stores the files of the recordings on the local disk or in
+// an S3-compatible object storage such as Amazon S3 or MinIO.
+//
+// Files are named by slash separated paths relative to the root of the
+// storage, e.g. 20210601T120000Z-1/video-1.ivf. A file being written with
+// Create is streamed to the storage: the S3 storage uploads it as a multipart
+// upload in parts of S3Config.PartSize while it is written, and completes the
+// upload when the file is closed.
+//
+// The S3 client implements the parts of the S3 REST API needed for this
+// (PutObject, the multipart upload, ListObjectsV2 and DeleteObject) with AWS
+// Signature Version 4, without depending on an SDK. Server is a minimal
+// in-memory stand-in of the API, used in tests.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage stores the files of the recordings. The methods may be called concurrently.
+type Storage interface {
+	// Create creates or truncates a file and returns its writer.
+	// The file is complete when the writer is closed.
+	Create(name string) (io.WriteCloser, error)
+	// WriteFile writes a small file at once, replacing it when it exists.
+	// A reader never sees a partially written file.
+	WriteFile(name string, data []byte) error
+	// List returns all the files in the storage
+	List() ([]FileInfo, error)
+	// RemoveAll removes the directory and the files in it
+	RemoveAll(dir string) error
+	// Location returns where the file is stored, such as a path or an s3:// URL, for the logs
+	Location(name string) string
+}
+
+// FileInfo describes a file in a Storage
+type FileInfo struct {
+	// Name is the slash separated path of the file
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Open returns the storage of location: an s3://bucket/prefix URL for S3Storage, and a directory for LocalStorage.
+// The config is validated only for S3Storage.
+func Open(location string, config S3Config) (Storage, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return NewLocal(location), nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket in %q", location)
+	}
+	return NewS3(config, u.Host, strings.Trim(u.Path, "/"))
+}
+
+// validName returns an error when name is not a clean relative path
+func validName(name string) error {
+	if name == "" || path.Clean("/" + name)[1:] != name {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// LocalStorage stores the files in a directory of the local disk
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocal returns a storage of the files in dir, which is created when a file is written
+func NewLocal(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) path(name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Create creates the file. The returned writer is an *os.File, so that it can also seek.
+func (s *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	file, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(file)
+}
+
+// WriteFile writes the file to a temporary file and renames it
+func (s *LocalStorage) WriteFile(name string, data []byte) error {
+	file, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// List returns the files in the directory and its subdirectories. It returns no files when the directory does not exist.
+func (s *LocalStorage) List() ([]FileInfo, error) {
+	files := []FileInfo{}
+	err := filepath.Walk(s.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if file == s.dir && errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: filepath.ToSlash(name), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// RemoveAll removes the directory
+func (s *LocalStorage) RemoveAll(dir string) error {
+	file, err := s.path(dir)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(file)
+}
+
+// Location returns the path of the file
+func (s *LocalStorage) Location(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStorageは、ストレージの実装によらない書き込み・一覧・削除を確認します
+// partSize以上のファイルを書き込むため、S3ではマルチパートアップロードになる
+func testStorage(t *testing.T, s Storage, partSize int) {
+	t.Helper()
+	large := bytes.Repeat([]byte("0123456789"), partSize/4)
+	w, err := s.Create("session-1/video-1.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 小さい書き込みを繰り返しても、パートの大きさにまとめて送信される
+	for i := 0; i < len(large); i += 1000 {
+		end := i + 1000
+		if end > len(large) {
+			end = len(large)
+		}
+		if _, err := w.Write(large[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = s.Create("session-1/audio-1.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "small"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"session-1/manifest.json", "session-2/manifest.json", "session-1/manifest.json"} {
+		if err := s.WriteFile(name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"", "../x", "/x", "a//b", "a/./b"} {
+		if err := s.WriteFile(name, nil); err == nil {
+			t.Errorf("%q has been written", name)
+		}
+	}
+
+	files, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	var got []string
+	for _, f := range files {
+		got = append(got, fmt.Sprintf("%s:%d", f.Name, f.Size))
+		if time.Since(f.ModTime) > time.Minute {
+			t.Errorf("%s: got modification time %v", f.Name, f.ModTime)
+		}
+	}
+	want := fmt.Sprintf("session-1/audio-1.ogg:5 session-1/manifest.json:2 session-1/video-1.ivf:%d session-2/manifest.json:2", len(large))
+	if strings.Join(got, " ") != want {
+		t.Errorf("got files %v, want %s", got, want)
+	}
+
+	if err := s.RemoveAll("session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err = s.List(); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "session-2/manifest.json" {
+		t.Errorf("got files %+v after removing session-1", files)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir+"/recordings", S3Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ディレクトリがなければ、ファイルはない
+	if files, err := s.List(); err != nil || len(files) != 0 {
+		t.Fatalf("got files %v and %v before writing", files, err)
+	}
+	testStorage(t, s, 4096)
+}
+
+func TestS3(t *testing.T) {
+	server, err := NewServer("127.0.0.1:0", "access", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	const partSize = 4096
+	server.SetMinPartSize(partSize)
+	config := S3Config{Endpoint: server.URL(), Region: "us-east-1", AccessKeyID: "access", SecretAccessKey: "secret", PathStyle: true, PartSize: MinPartSize, Timeout: 5 * time.Second}
+	s, err := Open("s3://recordings/receive", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// テストではパートを小さくする
+	s.(*S3Storage).config.PartSize = partSize
+	testStorage(t, s, partSize)
+
+	if location := s.Location("session-2/manifest.json"); location != "s3://recordings/receive/session-2/manifest.json" {
+		t.Errorf("got location %s", location)
+	}
+	if _, parts, ok := server.Object("recordings", "receive/session-2/manifest.json"); !ok || parts != 0 {
+		t.Errorf("got manifest with %d parts (exists %v)", parts, ok)
+	}
+
+	// 大きいファイルはマルチパートアップロードで送信される
+	data := bytes.Repeat([]byte{1, 2, 3}, partSize)
+	w, err := s.Create("session-3/video.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, parts, ok := server.Object("recordings", "receive/session-3/video.ivf")
+	if !ok || !bytes.Equal(got, data) || parts != 3 || server.Uploads() != 0 {
+		t.Errorf("got %d bytes in %d parts (exists %v, %d uploads left), want %d bytes in 3 parts", len(got), parts, ok, server.Uploads(), len(data))
+	}
+
+	// 署名が正しくなければ拒否される
+	config.SecretAccessKey = "wrong"
+	wrong, err := NewS3(config, "recordings", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrong.WriteFile("x", nil); err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("got %v with a wrong secret, want SignatureDoesNotMatch", err)
+	}
+}
+
+// TestS3MinIOは、S3_TEST_ENDPOINTに指定したMinIOなどのS3互換のストレージで確認します
+// 例: S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_BUCKET=test AWS_ACCESS_KEY_ID=minioadmin AWS_SECRET_ACCESS_KEY=minioadmin go test ./internal/storage
+func TestS3MinIO(t *testing.T) {
+	endpoint, bucket := os.Getenv("S3_TEST_ENDPOINT"), os.Getenv("S3_TEST_BUCKET")
+	if endpoint == "" || bucket == "" {
+		t.Skip("S3_TEST_ENDPOINT and S3_TEST_BUCKET are not set")
+	}
+	config := S3Config{
+		Endpoint: endpoint, Region: "us-east-1", AccessKeyID: os.Getenv("AWS_ACCESS_KEY_ID"), SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		PathStyle: true, PartSize: MinPartSize, Timeout: 30 * time.Second,
+	}
+	s, err := NewS3(config, bucket, fmt.Sprintf("storage-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.RemoveAll("session-1")
+		s.RemoveAll("session-2")
+	}()
+	testStorage(t, s, MinPartSize)
+}
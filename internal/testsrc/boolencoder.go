@@ -0,0 +1,66 @@
+package testsrc
+
+// boolEncoder is the boolean entropy encoder of VP8, RFC 6386 section 7.3
+type boolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// writeBool writes bit, which is false with the probability prob/256
+func (e *boolEncoder) writeBool(prob uint8, bit bool) {
+	split := 1 + (((e.rng - 1) * uint32(prob)) >> 8)
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// addOne propagates a carry to the bytes already written
+func (e *boolEncoder) addOne() {
+	i := len(e.out) - 1
+	for i >= 0 && e.out[i] == 255 {
+		e.out[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.out[i]++
+	}
+}
+
+// writeLiteral writes the n least significant bits of v, the most significant first
+func (e *boolEncoder) writeLiteral(v uint32, n int) {
+	for n > 0 {
+		n--
+		e.writeBool(128, v&(1<<uint(n)) != 0)
+	}
+}
+
+// bytes flushes the encoder and returns the encoded data
+func (e *boolEncoder) bytes() []byte {
+	// libvpxと同じく32ビットの0を書き込み、残りのビットを出力する
+	for i := 0; i < 32; i++ {
+		e.writeBool(128, false)
+	}
+	return e.out
+}
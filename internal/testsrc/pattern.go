@@ -0,0 +1,130 @@
+package testsrc
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+)
+
+// bars are the 75% color bars, from left to right
+var bars = []color.RGBA{
+	{191, 191, 191, 255}, // white
+	{191, 191, 0, 255},   // yellow
+	{0, 191, 191, 255},   // cyan
+	{0, 191, 0, 255},     // green
+	{191, 0, 191, 255},   // magenta
+	{191, 0, 0, 255},     // red
+	{0, 0, 191, 255},     // blue
+}
+
+// font is a 3x5 bitmap font of the characters of the overlay, one row per string
+var font = map[rune][5]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", "..#", "..#", "..#"},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	':': {"...", ".#.", "...", ".#.", "..."},
+	'.': {"...", "...", "...", "...", ".#."},
+	'#': {"#.#", "###", "#.#", "###", "#.#"},
+	' ': {"...", "...", "...", "...", "..."},
+}
+
+const (
+	// glyphWidth and glyphHeight are the size of a character in font pixels, with a space between characters
+	glyphWidth  = 4
+	glyphHeight = 6
+	// textScale is the size of a font pixel, the size of the blocks coded by the VP8Encoder
+	textScale = 4
+)
+
+// Pattern draws color bars with the time and the frame number below them
+type Pattern struct {
+	img *image.YCbCr
+	// barsHeight is the height of the color bars, the text is drawn below them
+	barsHeight int
+}
+
+// NewPattern creates a Pattern of width x height images
+func NewPattern(width, height int) *Pattern {
+	p := &Pattern{
+		img:        image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420),
+		barsHeight: height * 2 / 3 &^ 15,
+	}
+	// 色の境界を色差のブロック(8x8画素)に合わせる
+	barWidth := width / len(bars) &^ 7
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c color.RGBA
+			if y < p.barsHeight {
+				c = bars[minInt(x/maxInt(barWidth, 1), len(bars)-1)]
+			}
+			p.set(x, y, c)
+		}
+	}
+	return p
+}
+
+// Frame draws the time t and the frame number n and returns the image.
+// The image is reused by the next call.
+func (p *Pattern) Frame(t time.Time, n uint64) *image.YCbCr {
+	bounds := p.img.Rect
+	// 文字の領域を黒で塗りつぶしてから描画する
+	for y := p.barsHeight; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			p.img.Y[p.img.YOffset(x, y)] = 16
+		}
+	}
+	lineHeight := glyphHeight * textScale
+	top := p.barsHeight + textScale
+	p.drawText(t.Format("15:04:05.000"), textScale, top)
+	p.drawText(fmt.Sprintf("#%d", n), textScale, top+lineHeight)
+	return p.img
+}
+
+// drawText draws s in white with its top left corner at (x, y). Characters outside the image are clipped.
+func (p *Pattern) drawText(s string, x, y int) {
+	bounds := p.img.Rect
+	for _, r := range s {
+		glyph, ok := font[r]
+		if !ok {
+			glyph = font[' ']
+		}
+		for row, line := range glyph {
+			for col, pixel := range line {
+				if pixel != '#' {
+					continue
+				}
+				for j := 0; j < textScale; j++ {
+					for i := 0; i < textScale; i++ {
+						px, py := x+col*textScale+i, y+row*textScale+j
+						if px < bounds.Dx() && py < bounds.Dy() {
+							p.img.Y[p.img.YOffset(px, py)] = 235
+						}
+					}
+				}
+			}
+		}
+		x += glyphWidth * textScale
+	}
+}
+
+func (p *Pattern) set(x, y int, c color.RGBA) {
+	yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	p.img.Y[p.img.YOffset(x, y)] = yy
+	p.img.Cb[p.img.COffset(x, y)] = cb
+	p.img.Cr[p.img.COffset(x, y)] = cr
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,82 @@
+// Package testsrc generates synthetic media in pure Go, so that the send path
+// can be exercised without an encoded file or GStreamer.
+//
+// The video is color bars with the time and the frame number burned in, encoded
+// to VP8 key frames by a minimal encoder (VP8Encoder). The audio is a sine tone
+// encoded to G.711 μ-law (PCMU), since there is no Opus encoder in pure Go.
+package testsrc
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Config is the configuration of the test source
+type Config struct {
+	// Enabled sends the test source instead of the H.264 file
+	Enabled bool
+	// Width and Height are the size of the video
+	Width  int
+	Height int
+	// FrameRate is the number of video frames per second
+	FrameRate int
+	// ToneFrequency is the frequency of the audio tone in Hz. No audio is sent when it is 0.
+	ToneFrequency float64
+}
+
+// Flags registers the test source flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.BoolVar(&c.Enabled, "testsrc", false, "send color bars and a sine tone generated in Go (VP8 and PCMU) instead of the H.264 file")
+	flag.IntVar(&c.Width, "testsrc-width", 320, "width of the test source video")
+	flag.IntVar(&c.Height, "testsrc-height", 240, "height of the test source video")
+	flag.IntVar(&c.FrameRate, "testsrc-fps", 30, "frame rate of the test source video")
+	flag.Float64Var(&c.ToneFrequency, "testsrc-tone", 440, "frequency of the test source tone in Hz (no audio track when 0)")
+	return c
+}
+
+// Validate returns an error when the video cannot be generated with the configuration
+func (c Config) Validate() error {
+	if c.Width < 16 || c.Height < 16 || c.Width >= 1<<14 || c.Height >= 1<<14 {
+		return fmt.Errorf("invalid test source size %dx%d", c.Width, c.Height)
+	}
+	if c.FrameRate <= 0 {
+		return fmt.Errorf("invalid test source frame rate %d", c.FrameRate)
+	}
+	if c.ToneFrequency < 0 || c.ToneFrequency >= ToneSampleRate/2 {
+		return fmt.Errorf("invalid test source tone frequency %g", c.ToneFrequency)
+	}
+	return nil
+}
+
+// FrameDuration is the duration of a video frame
+func (c Config) FrameDuration() time.Duration {
+	return time.Second / time.Duration(c.FrameRate)
+}
+
+// Video generates the encoded video frames
+type Video struct {
+	pattern *Pattern
+	encoder *VP8Encoder
+	frames  uint64
+}
+
+// NewVideo creates a Video of the size of the configuration
+func NewVideo(c Config) (*Video, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	encoder, err := NewVP8Encoder(c.Width, c.Height)
+	if err != nil {
+		return nil, err
+	}
+	return &Video{pattern: NewPattern(c.Width, c.Height), encoder: encoder}, nil
+}
+
+// Next returns the next frame, showing the time t, encoded to a VP8 key frame
+func (v *Video) Next(t time.Time) ([]byte, error) {
+	v.frames++
+	return v.encoder.Encode(v.pattern.Frame(t, v.frames))
+}
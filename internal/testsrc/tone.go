@@ -0,0 +1,64 @@
+package testsrc
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// ToneSampleRate is the sample rate of the tone, the clock rate of PCMU
+	ToneSampleRate = 8000
+	// ToneFrameDuration is the duration of the audio frames returned by Tone.Next
+	ToneFrameDuration = 20 * time.Millisecond
+	// toneAmplitude is the amplitude of the tone, about -10 dBFS
+	toneAmplitude = 0.3 * math.MaxInt16
+)
+
+// Tone generates a sine tone encoded to G.711 μ-law
+type Tone struct {
+	frequency float64
+	phase     float64
+}
+
+// NewTone creates a Tone of frequency Hz
+func NewTone(frequency float64) *Tone {
+	return &Tone{frequency: frequency}
+}
+
+// Next returns the next ToneFrameDuration of the tone
+func (t *Tone) Next() []byte {
+	samples := make([]byte, ToneSampleRate*ToneFrameDuration/time.Second)
+	step := 2 * math.Pi * t.frequency / ToneSampleRate
+	for i := range samples {
+		samples[i] = linearToMulaw(int16(toneAmplitude * math.Sin(t.phase)))
+		// 位相が大きくなり続けて精度が落ちないようにする
+		t.phase = math.Mod(t.phase+step, 2*math.Pi)
+	}
+	return samples
+}
+
+// linearToMulaw encodes a 16 bit linear sample to G.711 μ-law
+func linearToMulaw(sample int16) byte {
+	const (
+		bias = 0x84
+		clip = 32635
+	)
+	s := int32(sample)
+	sign := byte(0)
+	if s < 0 {
+		sign = 0x80
+		s = -s
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+
+	// 最上位ビットの位置が指数になる
+	exponent := byte(7)
+	for mask := int32(0x4000); s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(s>>(exponent+3)) & 0x0f
+	return ^(sign | exponent<<4 | mantissa)
+}
@@ -0,0 +1,464 @@
+package testsrc
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+const (
+	// qIndex is the quantizer index of every frame
+	qIndex = 4
+	// y2DCQuant, y2ACQuant and uvDCQuant are the dequantization factors of qIndex, RFC 6386 section 14.1
+	y2DCQuant = 8 * 2
+	y2ACQuant = 8 * 155 / 100
+	uvDCQuant = 8
+	// maxToken is the largest absolute value of a coefficient, the base of the category 6 plus 11 extra bits
+	maxToken = 67 + 1<<11 - 1
+)
+
+// VP8Encoder encodes images to VP8 key frames.
+//
+// It is a minimal encoder for synthetic images: every macroblock is predicted
+// with DC_PRED and only the DC of each 4x4 block is coded, so that the decoded
+// image is the source averaged over blocks of 4x4 luma and chroma samples.
+// This is enough for color bars and large text, and needs neither motion
+// estimation nor the inverse DCT. Macroblocks which are predicted exactly, e.g.
+// the inside of a bar, are skipped.
+type VP8Encoder struct {
+	width, height int
+	mbw, mbh      int
+
+	// y, cb and cr are the reconstructed planes, the image the decoder outputs,
+	// from which the macroblocks are predicted
+	y, cb, cr []uint8
+}
+
+// macroblock is the coefficients of a macroblock to be coded
+type macroblock struct {
+	skip bool
+	// y2 is the Y2 (WHT) block in the scan order
+	y2 [16]int
+	// uv is the DC of the 4 U blocks followed by the 4 V blocks
+	uv [8]int
+}
+
+// NewVP8Encoder creates a VP8Encoder of width x height images
+func NewVP8Encoder(width, height int) (*VP8Encoder, error) {
+	if width <= 0 || height <= 0 || width >= 1<<14 || height >= 1<<14 {
+		return nil, fmt.Errorf("invalid VP8 frame size %dx%d", width, height)
+	}
+	mbw, mbh := (width+15)/16, (height+15)/16
+	return &VP8Encoder{
+		width:  width,
+		height: height,
+		mbw:    mbw,
+		mbh:    mbh,
+		y:      make([]uint8, mbw*16*mbh*16),
+		cb:     make([]uint8, mbw*8*mbh*8),
+		cr:     make([]uint8, mbw*8*mbh*8),
+	}, nil
+}
+
+// Encode encodes a 4:2:0 image of the size of the encoder to a VP8 key frame
+func (e *VP8Encoder) Encode(img *image.YCbCr) ([]byte, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return nil, fmt.Errorf("unsupported subsample ratio %s", img.SubsampleRatio)
+	}
+	if img.Rect.Dx() != e.width || img.Rect.Dy() != e.height {
+		return nil, fmt.Errorf("the image is %dx%d, expected %dx%d", img.Rect.Dx(), img.Rect.Dy(), e.width, e.height)
+	}
+
+	// 最初のパーティションに書き込むスキップの確率を求めるため、先に全てのマクロブロックを量子化する
+	mbs := make([]macroblock, e.mbw*e.mbh)
+	skipped := 0
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &mbs[mby*e.mbw+mbx]
+			e.quantize(img, mbx, mby, mb)
+			if mb.skip {
+				skipped++
+			}
+		}
+	}
+
+	first := e.writeHeader(skipProb(len(mbs)-skipped, len(mbs)), mbs)
+	second := e.writeTokens(mbs)
+
+	// frame tag, RFC 6386 section 9.1
+	frame := make([]byte, 0, 10+len(first)+len(second))
+	size := len(first)
+	frame = append(frame,
+		byte(1<<4|size<<5), byte(size>>3), byte(size>>11),
+		0x9d, 0x01, 0x2a,
+		byte(e.width), byte(e.width>>8), byte(e.height), byte(e.height>>8),
+	)
+	frame = append(frame, first...)
+	return append(frame, second...), nil
+}
+
+// skipProb is the probability that a macroblock is not skipped
+func skipProb(coded, total int) uint8 {
+	p := coded * 256 / total
+	if p < 1 {
+		return 1
+	}
+	if p > 255 {
+		return 255
+	}
+	return uint8(p)
+}
+
+// quantize computes the coefficients of a macroblock and reconstructs it as the decoder does
+func (e *VP8Encoder) quantize(img *image.YCbCr, mbx, mby int, mb *macroblock) {
+	// 輝度: 16x16のDC予測と、4x4ブロックごとの平均との差をY2ブロックで符号化する
+	yStride := e.mbw * 16
+	p := dcPredict(e.y, yStride, mbx*16, mby*16, 16, mbx > 0, mby > 0)
+	var d [16]float64
+	for n := 0; n < 16; n++ {
+		t := blockAverage(img.Y, img.YStride, e.width, e.height, mbx*16+n%4*4, mby*16+n/4*4)
+		// 逆DCTで(dc+4)>>3が加算されるため、差の8倍をDCにする
+		d[n] = float64(8 * (t - p))
+	}
+	var coeffs [16]int
+	for k, x := range forwardWHT(d) {
+		quant := y2ACQuant
+		if k == 0 {
+			quant = y2DCQuant
+		}
+		coeffs[k] = clampToken(int(math.Round(x / float64(quant))))
+	}
+	dequantized := coeffs
+	dequantized[0] *= y2DCQuant
+	for k := 1; k < 16; k++ {
+		dequantized[k] *= y2ACQuant
+	}
+	dc := inverseWHT(dequantized)
+	for n := 0; n < 16; n++ {
+		fill(e.y, yStride, mbx*16+n%4*4, mby*16+n/4*4, clip8(p+(dc[n]+4)>>3))
+	}
+
+	mb.skip = true
+	for i, z := range zigzag {
+		mb.y2[i] = coeffs[z]
+		if coeffs[z] != 0 {
+			mb.skip = false
+		}
+	}
+
+	// 色差: 8x8のDC予測と、4x4ブロックごとのDCを符号化する
+	cStride := e.mbw * 8
+	cw, ch := (e.width+1)/2, (e.height+1)/2
+	for c, plane := range []struct {
+		src, dst []uint8
+	}{{img.Cb, e.cb}, {img.Cr, e.cr}} {
+		p := dcPredict(plane.dst, cStride, mbx*8, mby*8, 8, mbx > 0, mby > 0)
+		for n := 0; n < 4; n++ {
+			x, y := mbx*8+n%2*4, mby*8+n/2*4
+			t := blockAverage(plane.src, img.CStride, cw, ch, x, y)
+			v := clampToken(int(math.Round(float64(8*(t-p)) / uvDCQuant)))
+			fill(plane.dst, cStride, x, y, clip8(p+(v*uvDCQuant+4)>>3))
+			mb.uv[c*4+n] = v
+			if v != 0 {
+				mb.skip = false
+			}
+		}
+	}
+}
+
+// dcPredict returns the DC prediction of the size x size block at (x, y), RFC 6386 section 12.2
+func dcPredict(plane []uint8, stride, x, y, size int, left, above bool) int {
+	sum, n := 0, 0
+	if above {
+		for i := 0; i < size; i++ {
+			sum += int(plane[(y-1)*stride+x+i])
+		}
+		n += size
+	}
+	if left {
+		for j := 0; j < size; j++ {
+			sum += int(plane[(y+j)*stride+x-1])
+		}
+		n += size
+	}
+	if n == 0 {
+		return 128
+	}
+	return (sum + n/2) / n
+}
+
+// blockAverage returns the average of the 4x4 block at (x, y), repeating the edges of the w x h plane
+func blockAverage(plane []uint8, stride, w, h, x, y int) int {
+	sum := 0
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			sum += int(plane[minInt(y+j, h-1)*stride+minInt(x+i, w-1)])
+		}
+	}
+	return (sum + 8) / 16
+}
+
+func fill(plane []uint8, stride, x, y int, v uint8) {
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			plane[(y+j)*stride+x+i] = v
+		}
+	}
+}
+
+// forwardWHT is the inverse of inverseWHT without the rounding:
+// the decoder computes A·X·Aᵀ/8 where A is the 4x4 Walsh-Hadamard matrix, so X = Aᵀ·D·A/2
+func forwardWHT(d [16]float64) [16]float64 {
+	a := [4][4]float64{
+		{1, 1, 1, 1},
+		{1, 1, -1, -1},
+		{1, -1, -1, 1},
+		{1, -1, 1, -1},
+	}
+	var x [16]float64
+	for r := 0; r < 4; r++ {
+		for c := 0; c < 4; c++ {
+			var sum float64
+			for i := 0; i < 4; i++ {
+				for j := 0; j < 4; j++ {
+					sum += a[i][r] * d[i*4+j] * a[j][c]
+				}
+			}
+			x[r*4+c] = sum / 2
+		}
+	}
+	return x
+}
+
+// inverseWHT is the inverse WHT of the decoder, RFC 6386 section 14.3.
+// It returns the DC of the 16 luma blocks from the dequantized Y2 block.
+func inverseWHT(in [16]int) [16]int {
+	var m, out [16]int
+	for i := 0; i < 4; i++ {
+		a0 := in[0+i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[0+i] - in[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		out[i*4+0] = (a0 + a1) >> 3
+		out[i*4+1] = (a3 + a2) >> 3
+		out[i*4+2] = (a0 - a1) >> 3
+		out[i*4+3] = (a3 - a2) >> 3
+	}
+	return out
+}
+
+// writeHeader writes the first partition: the frame header and the modes of the macroblocks
+func (e *VP8Encoder) writeHeader(skipProb uint8, mbs []macroblock) []byte {
+	w := newBoolEncoder()
+	// color space, clamping type
+	w.writeLiteral(0, 2)
+	// segmentation disabled
+	w.writeLiteral(0, 1)
+	// normal loop filter with level 0 (disabled), sharpness 0, no loop filter deltas
+	w.writeLiteral(0, 1+6+3+1)
+	// one token partition
+	w.writeLiteral(0, 2)
+	// quantizer index without deltas
+	w.writeLiteral(qIndex, 7)
+	w.writeLiteral(0, 5)
+	// refresh entropy probs
+	w.writeLiteral(1, 1)
+	// no token probability update
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for _, prob := range tokenProbUpdateProb[i][j][k] {
+					w.writeBool(prob, false)
+				}
+			}
+		}
+	}
+	// macroblocks without coefficients are skipped
+	w.writeLiteral(1, 1)
+	w.writeLiteral(uint32(skipProb), 8)
+
+	for _, mb := range mbs {
+		w.writeBool(skipProb, mb.skip)
+		// 16x16 DC_PRED, RFC 6386 section 11.2
+		w.writeBool(145, true)
+		w.writeBool(156, false)
+		w.writeBool(163, false)
+		// chroma DC_PRED
+		w.writeBool(142, false)
+	}
+	return w.bytes()
+}
+
+// writeTokens writes the second partition: the coefficients of the macroblocks which are not skipped
+func (e *VP8Encoder) writeTokens(mbs []macroblock) []byte {
+	w := newBoolEncoder()
+	// 左と上のブロックに係数があるかどうかが、確率のコンテキストになる
+	// 輝度のブロックはDC以外を符号化しないため、常にコンテキスト0になる
+	upY2 := make([]int, e.mbw)
+	upUV := make([][4]int, e.mbw)
+	var zero [16]int
+	for mby := 0; mby < e.mbh; mby++ {
+		leftY2 := 0
+		var leftUV [4]int
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &mbs[mby*e.mbw+mbx]
+			if mb.skip {
+				leftY2, upY2[mbx] = 0, 0
+				leftUV, upUV[mbx] = [4]int{}, [4]int{}
+				continue
+			}
+
+			nz := writeCoefficients(w, planeY2, leftY2+upY2[mbx], mb.y2, 0)
+			leftY2, upY2[mbx] = nz, nz
+			for n := 0; n < 16; n++ {
+				writeCoefficients(w, planeY1WithY2, 0, zero, 1)
+			}
+
+			// U、Vの順に2x2ブロックを符号化する
+			for c := 0; c < 4; c += 2 {
+				for y := 0; y < 2; y++ {
+					nz := leftUV[y+c]
+					for x := 0; x < 2; x++ {
+						var coeffs [16]int
+						coeffs[0] = mb.uv[c*2+y*2+x]
+						nz = writeCoefficients(w, planeUV, nz+upUV[mbx][x+c], coeffs, 0)
+						upUV[mbx][x+c] = nz
+					}
+					leftUV[y+c] = nz
+				}
+			}
+		}
+	}
+	return w.bytes()
+}
+
+// writeCoefficients writes the tokens of a block from the position first, RFC 6386 section 13.
+// coeffs are in the scan order. It returns 1 when a coefficient is coded, which is the context of the next blocks.
+func writeCoefficients(w *boolEncoder, plane, context int, coeffs [16]int, first int) int {
+	probs := &defaultTokenProb[plane]
+	last := -1
+	for i := first; i < 16; i++ {
+		if coeffs[i] != 0 {
+			last = i
+		}
+	}
+
+	p := probs[bands[first]][context]
+	if last < 0 {
+		// EOB
+		w.writeBool(p[0], false)
+		return 0
+	}
+	w.writeBool(p[0], true)
+
+	for i := first; i <= last; {
+		v := coeffs[i]
+		i++
+		if v == 0 {
+			w.writeBool(p[1], false)
+			p = probs[bands[i]][0]
+			continue
+		}
+		w.writeBool(p[1], true)
+
+		abs := v
+		if abs < 0 {
+			abs = -abs
+		}
+		if abs == 1 {
+			w.writeBool(p[2], false)
+			p = probs[bands[i]][1]
+		} else {
+			w.writeBool(p[2], true)
+			switch {
+			case abs <= 4:
+				w.writeBool(p[3], false)
+				if abs == 2 {
+					w.writeBool(p[4], false)
+				} else {
+					w.writeBool(p[4], true)
+					w.writeBool(p[5], abs == 4)
+				}
+			case abs <= 10:
+				w.writeBool(p[3], true)
+				w.writeBool(p[6], false)
+				if abs <= 6 {
+					// category 1
+					w.writeBool(p[7], false)
+					w.writeBool(159, abs == 6)
+				} else {
+					// category 2
+					w.writeBool(p[7], true)
+					extra := abs - 7
+					w.writeBool(165, extra&2 != 0)
+					w.writeBool(145, extra&1 != 0)
+				}
+			default:
+				// categories 3 to 6
+				w.writeBool(p[3], true)
+				w.writeBool(p[6], true)
+				cat := 3
+				for cat > 0 && abs < 3+8<<uint(cat) {
+					cat--
+				}
+				w.writeBool(p[8], cat >= 2)
+				w.writeBool(p[9+cat>>1], cat&1 != 0)
+				tab := cat3456[cat]
+				bits := 0
+				for tab[bits] != 0 {
+					bits++
+				}
+				extra := abs - (3 + 8<<uint(cat))
+				for b := 0; b < bits; b++ {
+					w.writeBool(tab[b], extra&(1<<uint(bits-1-b)) != 0)
+				}
+			}
+			p = probs[bands[i]][2]
+		}
+		// sign
+		w.writeBool(128, v < 0)
+		if i == 16 {
+			break
+		}
+		w.writeBool(p[0], i <= last)
+	}
+	return 1
+}
+
+func clampToken(v int) int {
+	if v > maxToken {
+		return maxToken
+	}
+	if v < -maxToken {
+		return -maxToken
+	}
+	return v
+}
+
+func clip8(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,114 @@
+// Package turnserver provides an embedded TURN server so that the examples
+// can relay media without relying on external services.
+package turnserver
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// Config is the configuration of the embedded TURN server
+type Config struct {
+	// Enabled starts the server when true
+	Enabled bool
+	// PublicIP is the IP address advertised for relayed candidates
+	PublicIP string
+	// Port is the UDP port the server listens on
+	Port int
+	// Realm, Username and Password are the static long-term credentials
+	Realm    string
+	Username string
+	Password string
+	// RelayOnly makes the PeerConnection use relayed candidates only
+	RelayOnly bool
+}
+
+// Flags registers the TURN server flags on the default FlagSet.
+// The returned Config is filled in when flag.Parse is called.
+func Flags() *Config {
+	c := &Config{}
+	flag.BoolVar(&c.Enabled, "turn", false, "start an embedded TURN server")
+	flag.StringVar(&c.PublicIP, "turn-public-ip", "127.0.0.1", "IP address advertised by the embedded TURN server")
+	flag.IntVar(&c.Port, "turn-port", 3478, "UDP port of the embedded TURN server")
+	flag.StringVar(&c.Realm, "turn-realm", "pion.ly", "realm of the embedded TURN server")
+	flag.StringVar(&c.Username, "turn-user", "pion", "username of the embedded TURN server")
+	flag.StringVar(&c.Password, "turn-password", "pion", "password of the embedded TURN server")
+	flag.BoolVar(&c.RelayOnly, "turn-relay-only", false, "use relayed ICE candidates only")
+	return c
+}
+
+// Server is a wrapper for an embedded pion/turn server
+type Server struct {
+	server *turn.Server
+	config Config
+}
+
+// Start starts a TURN server listening on the configured UDP port, or on a free port when it is 0
+func Start(c Config) (*Server, error) {
+	publicIP := net.ParseIP(c.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid TURN public IP: %q", c.PublicIP)
+	}
+
+	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:"+strconv.Itoa(c.Port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TURN server listener: %w", err)
+	}
+	// Portが0の場合は、割り当てられたポートをICEServerで通知する
+	c.Port = udpListener.LocalAddr().(*net.UDPAddr).Port
+
+	authKey := turn.GenerateAuthKey(c.Username, c.Realm, c.Password)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: c.Realm,
+		// 固定の認証情報のみを受け付ける
+		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if username != c.Username {
+				return nil, false
+			}
+			return authKey, true
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpListener,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: publicIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+	})
+	if err != nil {
+		udpListener.Close()
+		return nil, err
+	}
+
+	return &Server{server: server, config: c}, nil
+}
+
+// ICEServer returns the ICEServer entry which points to this TURN server
+func (s *Server) ICEServer() webrtc.ICEServer {
+	return webrtc.ICEServer{
+		URLs:           []string{fmt.Sprintf("turn:%s:%d?transport=udp", s.config.PublicIP, s.config.Port)},
+		Username:       s.config.Username,
+		Credential:     s.config.Password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+}
+
+// Apply adds the TURN server to the ICE servers of the configuration
+func (s *Server) Apply(config *webrtc.Configuration) {
+	config.ICEServers = append(config.ICEServers, s.ICEServer())
+	if s.config.RelayOnly {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+}
+
+// Close stops the TURN server
+func (s *Server) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,87 @@
+package turnserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// TestRelayは、ICETransportPolicyRelayの2つのPeerConnectionが組み込みのTurnサーバーを経由して接続することを確認します
+func TestRelay(t *testing.T) {
+	server, err := Start(Config{PublicIP: "127.0.0.1", Port: 0, Realm: "pion.ly", Username: "user", Password: "pass", RelayOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	config := webrtc.Configuration{}
+	server.Apply(&config)
+	if config.ICETransportPolicy != webrtc.ICETransportPolicyRelay || len(config.ICEServers) != 1 {
+		t.Fatalf("got configuration %+v", config)
+	}
+
+	offerer, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offerer.Close()
+	answerer, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	opened := make(chan struct{})
+	answerer.OnDataChannel(func(d *webrtc.DataChannel) {
+		d.OnOpen(func() { close(opened) })
+	})
+	if _, err := offerer.CreateDataChannel("data", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 候補の収集を待ってから、候補を含むSession Descriptionを返す
+	setLocal := func(pc *webrtc.PeerConnection, description webrtc.SessionDescription, err error) webrtc.SessionDescription {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gathered := webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(description); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-gathered:
+		case <-ctx.Done():
+			t.Fatal("ICE gathering has not completed")
+		}
+		return *pc.LocalDescription()
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err := answerer.SetRemoteDescription(setLocal(offerer, offer, err)); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err := offerer.SetRemoteDescription(setLocal(answerer, answer, err)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		t.Fatal("the data channel has not opened through the TURN server")
+	}
+
+	for _, pc := range []*webrtc.PeerConnection{offerer, answerer} {
+		pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pair == nil || pair.Local.Typ != webrtc.ICECandidateTypeRelay || pair.Remote.Typ != webrtc.ICECandidateTypeRelay {
+			t.Errorf("got selected candidate pair %v, want a relay pair", pair)
+		}
+	}
+}
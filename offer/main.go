@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"go.uber.org/zap"
+)
+
+// disconnectedTimeoutは、切断されたPeerConnectionの復帰を待つ時間です
+const disconnectedTimeout = 10 * time.Second
+
+// failedTimeoutは、失敗したPeerConnectionがICEリスタートで復帰するのを待つ時間です
+const failedTimeout = 5 * time.Second
+
+var logger *zap.Logger
+
+// simulatedNetは、テストで利用する仮想ネットワークです(nilの場合は実際のネットワークを利用する)
+var simulatedNet *vnet.Net
+
+// offerConfigは、送受信するトラックの設定です
+type offerConfig struct {
+	// video・audioは、送信するメディアです。nilの場合は送信しない
+	video *mediaSource
+	audio *mediaSource
+	// loopは、ファイルを最後まで送信したら先頭から送信し直します
+	loop bool
+	// recvは、送信しない種類のうち受信する種類です
+	recv []webrtc.RTPCodecType
+	// outputは、受信したトラックを保存するディレクトリです。空の場合は数えるだけ
+	output string
+	// durationは、セッションを終了するまでの時間です。0の場合は終了しない
+	duration time.Duration
+}
+
+// sendMediaは、ソースのフレームをフレームの長さの間隔で送信します
+// ファイルを最後まで送信するとcompletedを呼び出します
+func sendMedia(session *lifecycle.Session, connected <-chan struct{}, m *mediaSource, loop bool, track *webrtc.TrackLocalStaticSample, stats *trackStats, counter *trackCounter, completed func()) {
+	logger := session.Logger().With(zap.String("track", track.ID()), zap.String("source", m.name))
+	s, err := m.open()
+	if err != nil {
+		session.Stop(lifecycle.ReasonError, err)
+		return
+	}
+	defer func() { s.close() }()
+
+	select {
+	case <-session.Context().Done():
+		return
+	case <-connected:
+	}
+	logger.Info("Start sending", zap.String("mimeType", m.capability.MimeType))
+
+	// 送信にかかった時間の分だけずれないように、送信した長さの合計を基準に待つ
+	start := time.Now()
+	var elapsed time.Duration
+	for {
+		var frame []byte
+		var duration time.Duration
+		s, frame, duration, err = nextFrame(s, m, loop)
+		if err == io.EOF {
+			logger.Info("All frames have been sent")
+			completed()
+			return
+		}
+		if err != nil {
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read %s: %w", m.name, err))
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: frame, Duration: duration}); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to write %s: %w", m.name, err))
+			return
+		}
+		counter.count(stats, len(frame))
+
+		elapsed += duration
+		select {
+		case <-session.Context().Done():
+			return
+		case <-time.After(time.Until(start.Add(elapsed))):
+		}
+	}
+}
+
+// receiveTrackは、受信したトラックのパケットを数え、outputが指定されていれば保存します
+func receiveTrack(session *lifecycle.Session, track *webrtc.TrackRemote, output string, counter *trackCounter) {
+	logger := session.Logger().With(zap.String("track", track.ID()), zap.String("mimeType", track.Codec().MimeType))
+	logger.Info("Track has started", zap.Stringer("kind", track.Kind()))
+	stats := counter.add("received", track.ID(), track.Codec().MimeType)
+
+	var writer media.Writer
+	if output != "" {
+		var file string
+		var err error
+		writer, file, err = newTrackWriter(output, track)
+		if err != nil {
+			session.Stop(lifecycle.ReasonError, err)
+			return
+		}
+		if writer == nil {
+			logger.Warn("The codec cannot be recorded, only counting the packets")
+		} else {
+			counter.setFile(stats, file)
+			logger.Info("Recording the track", zap.String("file", file))
+			defer writer.Close()
+		}
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			// PeerConnectionが閉じられると読み込みが終了する
+			return
+		}
+		counter.count(stats, len(packet.Payload))
+		if writer == nil {
+			continue
+		}
+		if err := writer.WriteRTP(packet); err != nil {
+			logger.Warn("Failed to record a packet", zap.Error(err))
+		}
+	}
+}
+
+// newAPIは、デフォルトのコーデックとインターセプターを登録したAPIを生成します
+func newAPI(loggerFactory *logging.LoggerFactory) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	settingEngine := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	if simulatedNet != nil {
+		settingEngine.SetVNet(simulatedNet)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(settingEngine)), nil
+}
+
+// runSessionは、オファーを送信し、ファイルを最後まで送信するか-durationが経過するとセッションを終了します
+func runSession(ctx context.Context, config webrtc.Configuration, logConfig *logging.Config, channel signal.Channel, offerConfig *offerConfig, counter *trackCounter) (lifecycle.Reason, error) {
+	session := lifecycle.NewSession(ctx, logger)
+	// 以降はセッションIDを持つロガーを利用する
+	logger := session.Logger()
+	fail := func(err error) (lifecycle.Reason, error) {
+		session.Stop(lifecycle.ReasonError, err)
+		return session.Wait()
+	}
+
+	// pionのログ(ICE、DTLSなど)もセッションのロガーに出力する
+	loggerFactory, err := logging.NewLoggerFactory(logger, *logConfig)
+	if err != nil {
+		return fail(err)
+	}
+	api, err := newAPI(loggerFactory)
+	if err != nil {
+		return fail(err)
+	}
+	peerConnection, err := api.NewPeerConnection(config)
+	if err != nil {
+		return fail(err)
+	}
+	// Gracefully shutdown the peer connection
+	session.OnClose("PeerConnection", peerConnection.Close)
+
+	// シグナリングチャネルでオファー・アンサーを交換する
+	negotiator := negotiation.New(peerConnection, negotiation.Config{}, channel, logger)
+
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		logger.Info("ICE connection state has changed", zap.Stringer("state", connectionState))
+		negotiator.ICEConnectionStateChange(connectionState)
+	})
+
+	// DTLSの接続が完了してから送信を始める
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	session.WatchPeerConnection(peerConnection, disconnectedTimeout, failedTimeout, func(state webrtc.PeerConnectionState) {
+		logger.Info("Peer connection state has changed", zap.Stringer("state", state))
+		if state == webrtc.PeerConnectionStateConnected {
+			connectedOnce.Do(func() { close(connected) })
+		}
+	})
+
+	// 送信するトラックはsendrecvで追加し、reflectが送り返すトラックも受信する
+	type sending struct {
+		source *mediaSource
+		track  *webrtc.TrackLocalStaticSample
+		stats  *trackStats
+	}
+	var senders []sending
+	for _, m := range []*mediaSource{offerConfig.video, offerConfig.audio} {
+		if m == nil {
+			continue
+		}
+		kind := strings.SplitN(m.capability.MimeType, "/", 2)[0]
+		track, err := webrtc.NewTrackLocalStaticSample(m.capability, kind, "offer")
+		if err != nil {
+			return fail(err)
+		}
+		rtpSender, err := peerConnection.AddTrack(track)
+		if err != nil {
+			return fail(err)
+		}
+		// RTCPパケットはインターセプターで処理されるため、読み捨てる
+		go func() {
+			for {
+				if _, _, rtcpErr := rtpSender.ReadRTCP(); rtcpErr != nil {
+					return
+				}
+			}
+		}()
+		senders = append(senders, sending{source: m, track: track, stats: counter.add("sent", track.ID(), m.capability.MimeType)})
+	}
+	// 送信しない種類は、受信のみのトランシーバーを追加する
+	for _, kind := range offerConfig.recv {
+		if (kind == webrtc.RTPCodecTypeVideo && offerConfig.video != nil) || (kind == webrtc.RTPCodecTypeAudio && offerConfig.audio != nil) {
+			continue
+		}
+		if _, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return fail(err)
+		}
+	}
+	if len(peerConnection.GetTransceivers()) == 0 {
+		return fail(errors.New("no track to send or receive"))
+	}
+
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		receiveTrack(session, track, offerConfig.output, counter)
+	})
+
+	// (オファー) Local Session Descriptionをシグナリングチャネルへ送信し、アンサーを待つ
+	if err = negotiator.Negotiate(); err != nil {
+		return fail(err)
+	}
+	session.Go(func() { negotiator.Run(session.Context()) })
+
+	// ループしない全てのファイルを最後まで送信したらセッションを終了する
+	var remaining sync.WaitGroup
+	files := 0
+	for _, s := range senders {
+		s := s
+		completed := func() {}
+		if s.source.file && !offerConfig.loop {
+			remaining.Add(1)
+			files++
+			completed = remaining.Done
+		}
+		session.Go(func() {
+			sendMedia(session, connected, s.source, offerConfig.loop, s.track, s.stats, counter, completed)
+		})
+	}
+	if files > 0 {
+		go func() {
+			remaining.Wait()
+			session.Stop(lifecycle.ReasonCompleted, nil)
+		}()
+	}
+
+	if offerConfig.duration > 0 {
+		session.Go(func() {
+			select {
+			case <-session.Context().Done():
+			case <-time.After(offerConfig.duration):
+				logger.Info("Duration has elapsed", zap.Duration("duration", offerConfig.duration))
+				session.Stop(lifecycle.ReasonCompleted, nil)
+			}
+		})
+	}
+
+	return session.Wait()
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// runは、オファーを送信してセッションを1回実行し、終了理由に応じた終了コードを返します
+func run() int {
+	signalConfig := signal.ClientFlags()
+	logConfig := logging.Flags()
+	video := flag.String("video", "", "video to send: testsrc (VP8 color bars), a .ivf (VP8/VP9) or a .h264 file (no video is sent when empty)")
+	audio := flag.String("audio", "", "audio to send: testsrc (PCMU sine tone) or a .ogg (Opus) file (no audio is sent when empty)")
+	loop := flag.Bool("loop", false, "send the files again from the beginning when they end")
+	recv := flag.String("recv", "video,audio", "comma separated kinds to receive when they are not sent, e.g. video (sent tracks are always received too)")
+	output := flag.String("output", "", "directory to record the received tracks to as .ivf (VP8), .h264 and .ogg (Opus) (only counted when empty)")
+	duration := flag.Duration("duration", 0, "end the session after the duration, e.g. 30s (until the files end or forever when 0)")
+	flag.Parse()
+
+	var err error
+	if logger, err = logging.New(*logConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logger.Sync()
+
+	offerConfig := &offerConfig{loop: *loop, output: *output, duration: *duration}
+	if offerConfig.video, err = parseVideoSource(*video); err != nil {
+		logger.Error("Invalid video", zap.Error(err))
+		return 2
+	}
+	if offerConfig.audio, err = parseAudioSource(*audio); err != nil {
+		logger.Error("Invalid audio", zap.Error(err))
+		return 2
+	}
+	for _, kind := range strings.Split(*recv, ",") {
+		if kind = strings.TrimSpace(kind); kind == "" {
+			continue
+		}
+		codecType := webrtc.NewRTPCodecType(kind)
+		if codecType == 0 {
+			logger.Error("Invalid kind to receive", zap.String("kind", kind))
+			return 2
+		}
+		offerConfig.recv = append(offerConfig.recv, codecType)
+	}
+	if offerConfig.output != "" {
+		if err := os.MkdirAll(offerConfig.output, 0755); err != nil {
+			panic(err)
+		}
+	}
+
+	// SIGINT/SIGTERMを受け取ったらキャンセルされる
+	ctx, cancel := lifecycle.SignalContext(context.Background())
+	defer cancel()
+
+	// Prepare the configuration
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+
+	// オファー・アンサーを交換するシグナリングチャネル(標準入出力、HTTPまたはWebSocket)を準備する
+	channel, err := signal.NewClientChannel(*signalConfig)
+	if err != nil {
+		logger.Error("Failed to prepare the signaling channel", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+
+	counter := &trackCounter{}
+	reason, err := runSession(ctx, config, logConfig, channel, offerConfig, counter)
+	if err != nil {
+		logger.Error("Session has ended with error", zap.Stringer("reason", reason), zap.Error(err))
+	} else {
+		logger.Info("Session has ended", zap.Stringer("reason", reason))
+	}
+	counter.log(logger)
+	fmt.Print(counter.print())
+	return reason.ExitCode()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pionlogging "github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"go.uber.org/zap"
+)
+
+// answererは、offerのオファーに応答するPeerConnectionです
+// 受信したトラックの種類ごとにパケットを数え、映像トラックを送り返します
+type answerer struct {
+	mu      sync.Mutex
+	packets map[webrtc.RTPCodecType]int
+}
+
+// startAnswererは、仮想ネットワークの2番目のアドレスで応答側を動かします
+// offerは1番目のアドレスで接続します
+func startAnswerer(ctx context.Context, t *testing.T, channel signal.Channel) *answerer {
+	t.Helper()
+	logger = zap.NewNop()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: pionlogging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nets []*vnet.Net
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		vnetNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err := router.AddNet(vnetNet); err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, vnetNet)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Stop() })
+	simulatedNet = nets[0]
+	t.Cleanup(func() { simulatedNet = nil })
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetVNet(nets[1])
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+
+	a := &answerer{packets: map[webrtc.RTPCodecType]int{}}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+			a.mu.Lock()
+			a.packets[track.Kind()]++
+			a.mu.Unlock()
+		}
+	})
+
+	// オファーの映像トランシーバーで送り返す
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "answer-video", "answer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiator := negotiation.New(pc, negotiation.Config{}, channel, zap.NewNop())
+	negotiator.OnBeforeAnswer(func() error {
+		if len(pc.GetSenders()) > 0 {
+			return nil
+		}
+		_, err := pc.AddTrack(video)
+		return err
+	})
+	go negotiator.Run(ctx)
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// VP8のキーフレームに見える最小のペイロード
+			_ = video.WriteSample(media.Sample{Data: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, Duration: 33 * time.Millisecond})
+		}
+	}()
+	return a
+}
+
+func (a *answerer) received(kind webrtc.RTPCodecType) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.packets[kind]
+}
+
+// runOfferは、testsrcの映像と音声を送信するセッションを-duration 2sで実行し、
+// completedで終了したことと、双方向にメディアが届いたことを確認します
+func runOffer(ctx context.Context, t *testing.T, channel signal.Channel, a *answerer) {
+	t.Helper()
+	video, err := parseVideoSource("testsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := parseAudioSource("testsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &trackCounter{}
+	reason, err := runSession(ctx, webrtc.Configuration{}, &logging.Config{PionLevel: "warn"}, channel,
+		&offerConfig{video: video, audio: audio, duration: 2 * time.Second}, counter)
+	if reason != lifecycle.ReasonCompleted || err != nil {
+		t.Fatalf("session ended with %s: %v", reason, err)
+	}
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if a.received(kind) == 0 {
+			t.Errorf("no %s packet is received by the answerer", kind)
+		}
+	}
+	got := map[string]uint64{}
+	for _, s := range counter.snapshot() {
+		got[s.direction+" "+s.id] = s.packets
+	}
+	for _, track := range []string{"sent video", "sent audio", "received answer-video"} {
+		if got[track] == 0 {
+			t.Errorf("no packet is counted for %s: %v", track, got)
+		}
+	}
+}
+
+// freeAddrは、シグナリングサーバーが待ち受ける空いているアドレスを返します
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// TestWebSocketは、-signal-urlにws://を指定してWebSocketでシグナリングできることを確認します
+func TestWebSocket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	addr := freeAddr(t)
+	server, err := signal.NewWebSocketChannel(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := startAnswerer(ctx, t, server)
+	channel, err := signal.NewClientChannel(signal.ClientConfig{URL: "ws://" + addr + "/ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOffer(ctx, t, channel, a)
+}
+
+// TestHTTPは、-signal-urlにhttp://を指定してHTTPでシグナリングできることを確認します
+func TestHTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	addr := freeAddr(t)
+	server, err := signal.NewWebSocketChannel(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := startAnswerer(ctx, t, server)
+	channel, err := signal.NewClientChannel(signal.ClientConfig{URL: "http://" + addr + "/sdp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOffer(ctx, t, channel, a)
+}
+
+// TestStdioは、-signal-urlを指定しない場合に、標準出力のオファーに標準入力からアンサーを返して接続できることを確認します
+func TestStdio(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// 標準入出力をパイプに差し替え、コピー&ペーストの代わりにテストでセッション記述を受け渡す
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinReader, stdoutWriter
+	defer func() {
+		os.Stdin, os.Stdout = stdin, stdout
+		_ = stdoutWriter.Close()
+		_ = stdinWriter.Close()
+	}()
+
+	channel, remote := signal.NewPipe()
+	a := startAnswerer(ctx, t, remote)
+	go func() {
+		// 標準出力の"Offer Session Description:"の次の行がオファー
+		scanner := bufio.NewScanner(stdoutReader)
+		scanner.Buffer(nil, 1<<20)
+		offer := false
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if !offer {
+				offer = strings.HasPrefix(line, "Offer Session Description:")
+				continue
+			}
+			offer = false
+			desc := webrtc.SessionDescription{}
+			if err := signal.Unmarshal(line, &desc); err != nil {
+				t.Errorf("invalid offer %q: %s", line, err)
+				return
+			}
+			if err := channel.Send(desc); err != nil {
+				t.Error(err)
+				return
+			}
+			answer, err := channel.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if _, err := stdinWriter.WriteString(signal.Encode(answer) + "\n"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	runOffer(ctx, t, signal.NewStdioChannel(), a)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"go.uber.org/zap"
+)
+
+// trackStatsは、トラックごとの送受信したパケット数・バイト数です
+type trackStats struct {
+	// directionは、sentまたはreceivedです
+	direction string
+	id        string
+	mimeType  string
+	// fileは、受信したトラックを保存したファイルです
+	file string
+	// packetsは、送信したトラックではフレーム数、受信したトラックではRTPパケット数です
+	packets uint64
+	bytes   uint64
+}
+
+// trackCounterは、全てのトラックの統計を集計します
+type trackCounter struct {
+	mu     sync.Mutex
+	tracks []*trackStats
+}
+
+// addは、トラックを追加します。返された統計はcountで更新します
+func (c *trackCounter) add(direction, id, mimeType string) *trackStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &trackStats{direction: direction, id: id, mimeType: mimeType}
+	c.tracks = append(c.tracks, s)
+	return s
+}
+
+// countは、パケットを1つ数えます
+func (c *trackCounter) count(s *trackStats, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.packets++
+	s.bytes += uint64(size)
+}
+
+// setFileは、受信したトラックを保存したファイルを記録します
+func (c *trackCounter) setFile(s *trackStats, file string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.file = file
+}
+
+// snapshotは、送信したトラック、受信したトラックの順に統計を返します
+func (c *trackCounter) snapshot() []trackStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tracks := make([]trackStats, 0, len(c.tracks))
+	for _, s := range c.tracks {
+		tracks = append(tracks, *s)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool { return tracks[i].direction > tracks[j].direction })
+	return tracks
+}
+
+// logは、トラックごとの統計をログに出力します
+func (c *trackCounter) log(logger *zap.Logger) {
+	for _, s := range c.snapshot() {
+		logger.Info("Track summary", zap.String("direction", s.direction), zap.String("track", s.id), zap.String("mimeType", s.mimeType),
+			zap.Uint64("packets", s.packets), zap.Uint64("bytes", s.bytes), zap.String("file", s.file))
+	}
+}
+
+// printは、トラックごとの統計を表形式で出力します
+func (c *trackCounter) print() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%-9s %-24s %-12s %10s %12s  %s\n", "DIRECTION", "TRACK", "CODEC", "PACKETS", "BYTES", "FILE")
+	for _, s := range c.snapshot() {
+		fmt.Fprintf(b, "%-9s %-24s %-12s %10d %12d  %s\n", s.direction, s.id, s.mimeType, s.packets, s.bytes, s.file)
+	}
+	return b.String()
+}
+
+// newTrackWriterは、受信したトラックをコーデックに応じた形式で保存するWriterを作成します
+// 保存できないコーデックの場合は、ファイル名を空にしてnilを返します
+func newTrackWriter(dir string, track *webrtc.TrackRemote) (media.Writer, string, error) {
+	codec := track.Codec()
+	name := fmt.Sprintf("%s-%d", track.Kind(), track.SSRC())
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		file := filepath.Join(dir, name+".ivf")
+		writer, err := ivfwriter.New(file)
+		return writer, file, err
+	case strings.ToLower(webrtc.MimeTypeH264):
+		file := filepath.Join(dir, name+".h264")
+		writer, err := h264writer.New(file)
+		return writer, file, err
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		file := filepath.Join(dir, name+".ogg")
+		writer, err := oggwriter.New(file, codec.ClockRate, codec.Channels)
+		return writer, file, err
+	default:
+		return nil, "", nil
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+)
+
+const (
+	// sourceTestsrcは、Goで生成したカラーバー(VP8)・サイン波(PCMU)を送信するソースの名前です
+	sourceTestsrc = "testsrc"
+	// h264FrameDurationは、H.264ファイルのフレームの長さです(ファイルにフレームレートの情報がないため固定)
+	h264FrameDuration = 33 * time.Millisecond
+	// opusSampleRateは、Oggファイルのグラニュール位置の単位です
+	opusSampleRate = 48000
+)
+
+// errSkipは、送信しないページ(Oggのコメントヘッダー)を読み込んだことを表します
+var errSkip = errors.New("skip")
+
+// sourceは、送信するフレームを順に返します
+type source interface {
+	// nextは、次のフレームとその長さを返します。最後まで読み込むとio.EOFを返します
+	next() ([]byte, time.Duration, error)
+	close() error
+}
+
+// mediaSourceは、-video・-audioで指定された送信するメディアです
+type mediaSource struct {
+	// nameは、-video・-audioの値です
+	name       string
+	capability webrtc.RTPCodecCapability
+	// fileは、ファイルの場合にtrueです。ファイルは最後まで送信すると終了します
+	file bool
+	// openは、ソースを先頭から開きます(-loopの場合は最後まで送信するたびに開き直す)
+	open func() (source, error)
+}
+
+// parseVideoSourceは、-videoの値から映像のソースを作成します
+// 空の場合はnilを返します
+func parseVideoSource(name string) (*mediaSource, error) {
+	switch {
+	case name == "":
+		return nil, nil
+	case name == sourceTestsrc:
+		config := testsrc.Config{Width: 320, Height: 240, FrameRate: 30}
+		return &mediaSource{
+			name:       name,
+			capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
+			open: func() (source, error) {
+				video, err := testsrc.NewVideo(config)
+				if err != nil {
+					return nil, err
+				}
+				return &testsrcVideo{video: video, frameDuration: config.FrameDuration()}, nil
+			},
+		}, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ivf":
+		// コーデックを決めるためにヘッダーを読み込む
+		s, err := openIVF(name)
+		if err != nil {
+			return nil, err
+		}
+		mimeType := s.mimeType
+		s.close()
+		return &mediaSource{
+			name:       name,
+			capability: webrtc.RTPCodecCapability{MimeType: mimeType},
+			file:       true,
+			open:       func() (source, error) { return openIVF(name) },
+		}, nil
+	case ".h264", ".264":
+		return &mediaSource{
+			name:       name,
+			capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+			file:       true,
+			open:       func() (source, error) { return openH264(name) },
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported video source %q (testsrc, .ivf or .h264)", name)
+	}
+}
+
+// parseAudioSourceは、-audioの値から音声のソースを作成します
+// 空の場合はnilを返します
+func parseAudioSource(name string) (*mediaSource, error) {
+	switch {
+	case name == "":
+		return nil, nil
+	case name == sourceTestsrc:
+		return &mediaSource{
+			name:       name,
+			capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: testsrc.ToneSampleRate},
+			open: func() (source, error) {
+				return &testsrcTone{tone: testsrc.NewTone(440)}, nil
+			},
+		}, nil
+	case strings.ToLower(filepath.Ext(name)) == ".ogg":
+		return &mediaSource{
+			name:       name,
+			capability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: opusSampleRate, Channels: 2},
+			file:       true,
+			open:       func() (source, error) { return openOgg(name) },
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported audio source %q (testsrc or .ogg)", name)
+	}
+}
+
+// testsrcVideoは、カラーバーの映像を返します
+type testsrcVideo struct {
+	video         *testsrc.Video
+	frameDuration time.Duration
+}
+
+func (s *testsrcVideo) next() ([]byte, time.Duration, error) {
+	frame, err := s.video.Next(time.Now())
+	return frame, s.frameDuration, err
+}
+
+func (s *testsrcVideo) close() error { return nil }
+
+// testsrcToneは、サイン波の音声を返します
+type testsrcTone struct {
+	tone *testsrc.Tone
+}
+
+func (s *testsrcTone) next() ([]byte, time.Duration, error) {
+	return s.tone.Next(), testsrc.ToneFrameDuration, nil
+}
+
+func (s *testsrcTone) close() error { return nil }
+
+// ivfSourceは、IVFファイル(VP8・VP9)のフレームを返します
+type ivfSource struct {
+	file          *os.File
+	reader        *ivfreader.IVFReader
+	mimeType      string
+	frameDuration time.Duration
+}
+
+func openIVF(name string) (*ivfSource, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, header, err := ivfreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var mimeType string
+	switch string(header.FourCC[:]) {
+	case "VP80":
+		mimeType = webrtc.MimeTypeVP8
+	case "VP90":
+		mimeType = webrtc.MimeTypeVP9
+	default:
+		file.Close()
+		return nil, fmt.Errorf("unsupported IVF codec %q", header.FourCC)
+	}
+	// タイムベースを1フレームの長さとして扱う
+	frameDuration := h264FrameDuration
+	if header.TimebaseNumerator != 0 && header.TimebaseDenominator != 0 {
+		frameDuration = time.Second * time.Duration(header.TimebaseNumerator) / time.Duration(header.TimebaseDenominator)
+	}
+	return &ivfSource{file: file, reader: reader, mimeType: mimeType, frameDuration: frameDuration}, nil
+}
+
+func (s *ivfSource) next() ([]byte, time.Duration, error) {
+	frame, _, err := s.reader.ParseNextFrame()
+	return frame, s.frameDuration, err
+}
+
+func (s *ivfSource) close() error { return s.file.Close() }
+
+// h264Sourceは、H.264ファイルのNALユニットを返します
+type h264Source struct {
+	file   *os.File
+	reader *h264reader.H264Reader
+}
+
+func openH264(name string) (*h264Source, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := h264reader.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &h264Source{file: file, reader: reader}, nil
+}
+
+func (s *h264Source) next() ([]byte, time.Duration, error) {
+	nal, err := s.reader.NextNAL()
+	if err != nil {
+		return nil, 0, err
+	}
+	return nal.Data, h264FrameDuration, nil
+}
+
+func (s *h264Source) close() error { return s.file.Close() }
+
+// oggSourceは、Oggファイル(Opus)のページを返します
+type oggSource struct {
+	file   *os.File
+	reader *oggreader.OggReader
+	// granuleは、前のページのグラニュール位置です
+	granule uint64
+}
+
+func openOgg(name string) (*oggSource, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// IDヘッダーはここで読み込まれる
+	reader, _, err := oggreader.NewWith(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &oggSource{file: file, reader: reader}, nil
+}
+
+func (s *oggSource) next() ([]byte, time.Duration, error) {
+	page, header, err := s.reader.ParseNextPage()
+	if err != nil {
+		return nil, 0, err
+	}
+	// グラニュール位置の差がページの長さになる
+	// グラニュール位置が0のページ(コメントヘッダー)は送信しない
+	if header.GranulePosition == 0 {
+		return nil, 0, errSkip
+	}
+	samples := header.GranulePosition - s.granule
+	s.granule = header.GranulePosition
+	return page, time.Duration(samples) * time.Second / opusSampleRate, nil
+}
+
+func (s *oggSource) close() error { return s.file.Close() }
+
+// nextFrameは、送信しないページを読み飛ばして次のフレームを返します
+// loopがtrueの場合は、最後まで読み込むとソースを開き直して先頭から返します
+// 開き直したソースを返すため、呼び出し側は返されたソースを使い続けます
+func nextFrame(s source, m *mediaSource, loop bool) (source, []byte, time.Duration, error) {
+	// 空のファイルを開き直し続けないように、開き直してからフレームがあったかを記録する
+	reopened := false
+	for {
+		frame, duration, err := s.next()
+		switch {
+		case err == errSkip:
+			continue
+		case err == io.EOF && loop && !reopened:
+			reopenedSource, openErr := m.open()
+			if openErr != nil {
+				return s, nil, 0, openErr
+			}
+			s.close()
+			s, reopened = reopenedSource, true
+			continue
+		case err != nil:
+			return s, nil, 0, err
+		}
+		return s, frame, duration, nil
+	}
+}
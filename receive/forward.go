@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtpbridge"
+	"go.uber.org/zap"
+)
+
+// rtpForwardConfigは、受信したRTPパケットをffplayなどへUDPで転送する場合の設定です
+type rtpForwardConfig struct {
+	// addrは、映像を転送するhost:portです。音声はポート番号に2を加えたポートへ転送する
+	addr string
+	// sdpFileは、転送するRTPパケットを記述したSDPファイルです
+	sdpFile string
+}
+
+// audioPortOffsetは、映像のポートから音声のポートまでの差です(RTCPの分を空ける)
+const audioPortOffset = 2
+
+// validateは、-rtp-forwardの値を検証します
+func (c rtpForwardConfig) validate() error {
+	_, port, err := c.hostPort()
+	if err != nil {
+		return err
+	}
+	if port <= 0 || port+audioPortOffset > 65535 {
+		return fmt.Errorf("invalid RTP forwarding port %d", port)
+	}
+	if c.sdpFile == "" {
+		return fmt.Errorf("no SDP file is given")
+	}
+	return nil
+}
+
+// hostPortは、addrのホストとポート番号を返します
+func (c rtpForwardConfig) hostPort() (string, int, error) {
+	host, portString, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid RTP forwarding port %q", portString)
+	}
+	return host, port, nil
+}
+
+// rtpForwarderは、受信したトラックのRTPパケットをそのままUDPで転送します
+// トラックを受信するたびに、転送しているトラックを記述したSDPファイルを書き直します
+type rtpForwarder struct {
+	logger  *zap.Logger
+	config  rtpForwardConfig
+	host    string
+	port    int
+	mu      sync.Mutex
+	writers map[webrtc.RTPCodecType]*rtpbridge.Writer
+	streams []rtpbridge.Stream
+}
+
+// newRTPForwarderは、config.addrへ転送するrestreamerを作成します
+func newRTPForwarder(session *lifecycle.Session, config rtpForwardConfig) (restreamer, error) {
+	host, port, err := config.hostPort()
+	if err != nil {
+		return nil, err
+	}
+	return &rtpForwarder{
+		logger:  session.Logger().With(zap.String("addr", config.addr)),
+		config:  config,
+		host:    host,
+		port:    port,
+		writers: map[webrtc.RTPCodecType]*rtpbridge.Writer{},
+	}, nil
+}
+
+func (f *rtpForwarder) AddTrack(kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.writers[kind]; ok {
+		// 種類ごとに最初のトラックのみ転送する
+		f.logger.Warn("Track is not forwarded because a track of the same kind is forwarded", zap.Stringer("kind", kind), zap.String("mimeType", codec.MimeType))
+		return
+	}
+	port := f.port
+	if kind == webrtc.RTPCodecTypeAudio {
+		port += audioPortOffset
+	}
+	writer, err := rtpbridge.Dial(net.JoinHostPort(f.host, strconv.Itoa(port)))
+	if err != nil {
+		f.logger.Warn("Failed to forward the track", zap.Stringer("kind", kind), zap.Error(err))
+		return
+	}
+	f.writers[kind] = writer
+	f.streams = append(f.streams, rtpbridge.Stream{Kind: kind, Port: port, Codec: codec})
+	if err := os.MkdirAll(filepath.Dir(f.config.sdpFile), 0755); err != nil {
+		f.logger.Warn("Failed to create the directory of the SDP file", zap.String("file", f.config.sdpFile), zap.Error(err))
+	} else if err := rtpbridge.WriteSDP(f.config.sdpFile, f.host, f.streams); err != nil {
+		f.logger.Warn("Failed to write the SDP file", zap.String("file", f.config.sdpFile), zap.Error(err))
+	}
+	f.logger.Info("Forwarding RTP packets", zap.Stringer("kind", kind), zap.String("mimeType", codec.MimeType), zap.Int("port", port), zap.String("sdp", f.config.sdpFile))
+}
+
+func (f *rtpForwarder) WriteRTP(kind webrtc.RTPCodecType, packet *rtp.Packet) error {
+	f.mu.Lock()
+	writer := f.writers[kind]
+	f.mu.Unlock()
+	if writer == nil {
+		return nil
+	}
+	// SDPと同じペイロードタイプのまま転送するため、書き換えない
+	return writer.WriteRTP(packet)
+}
+
+func (f *rtpForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, writer := range f.writers {
+		writer.Close()
+	}
+	return nil
+}
@@ -8,11 +8,53 @@ let pc = new RTCPeerConnection({
   ]
 })
 
+// 制御用データチャネル(コマンド・チャットの送信とテレメトリの受信)
+// オファーに含めるため、オファーを作成する前に作成する
+let control = pc.createDataChannel('control')
+let commandID = 0
+control.onopen = () => log('control channel opened')
+control.onmessage = function (event) {
+  const msg = JSON.parse(event.data)
+  switch (msg.type) {
+    case 'telemetry':
+      document.getElementById('telemetry').textContent = JSON.stringify(msg.telemetry, null, 2)
+      break
+    case 'result':
+      log(msg.command + ': ' + (msg.error ? msg.error : 'ok'))
+      break
+    case 'chat':
+      log('chat: ' + msg.text)
+      break
+  }
+}
+
+// コマンドボタン押下時
+function SendCommand(command, file) {
+  if (control.readyState !== 'open') {
+    return alert('control channel is not open')
+  }
+  control.send(JSON.stringify({ type: 'command', id: ++commandID, command: command, file: file }))
+}
+
+// Send Chatボタン押下時
+function SendChat() {
+  if (control.readyState !== 'open') {
+    return alert('control channel is not open')
+  }
+  control.send(JSON.stringify({ type: 'chat', text: document.getElementById('chat').value }))
+}
+
 // WebRTCでサーバーへ映像を送信する
 sendVideoStream()
 
 // 接続状態を監視し、ロギングする
-pc.oniceconnectionstatechange = e => log(pc.iceConnectionState)
+// ICEがfailedになった場合は、ICEリスタートで再接続する
+pc.oniceconnectionstatechange = function () {
+  log(pc.iceConnectionState)
+  if (pc.iceConnectionState === 'failed') {
+    RestartICE()
+  }
+}
 
 // 接続先候補が見つ買った場合にlocalSessionDescriptionを記載するイベントハンドラを設定
 // SessionDescriptionとは、P2P接続に必要な情報をまとめたもの(IPやポートなどの情報)
@@ -32,6 +74,91 @@ pc.ontrack = function (event) {
   document.getElementById('remoteVideos').appendChild(el)
 }
 
+// WebSocketシグナリング(-signal-addr)用
+// 接続後は、トラックの追加やICEの再起動のたびにSessionDescriptionを自動で交換する
+// pionのロールバックはオファーで割り当てたmidなどを元に戻さないため、オファーが衝突した場合はブラウザ側(polite)が取り下げる
+let ws = null
+let makingOffer = false
+
+pc.onnegotiationneeded = async function () {
+  if (ws === null) {
+    return
+  }
+  try {
+    makingOffer = true
+    await pc.setLocalDescription()
+    await sendLocalDescription()
+  } catch (err) {
+    log(err)
+  } finally {
+    makingOffer = false
+  }
+}
+
+// ICE候補の収集が完了してからSessionDescriptionを送信する(Trickle ICEは利用しない)
+async function sendLocalDescription() {
+  if (pc.iceGatheringState !== 'complete') {
+    await new Promise(resolve => {
+      pc.addEventListener('icegatheringstatechange', function onChange() {
+        if (pc.iceGatheringState === 'complete') {
+          pc.removeEventListener('icegatheringstatechange', onChange)
+          resolve()
+        }
+      })
+    })
+  }
+  ws.send(JSON.stringify(pc.localDescription))
+}
+
+// Connectボタン押下時
+function Connect() {
+  ws = new WebSocket(document.getElementById('signalURL').value)
+  document.getElementById('connect').disabled = true
+
+  ws.onopen = async function () {
+    log('signaling connected')
+    // 接続前に作成したオファーを送信する
+    if (pc.signalingState === 'have-local-offer') {
+      await sendLocalDescription()
+    }
+  }
+  ws.onclose = () => log('signaling closed')
+
+  ws.onmessage = async function (event) {
+    const desc = JSON.parse(event.data)
+    const collision = desc.type === 'offer' && (makingOffer || pc.signalingState !== 'stable')
+    try {
+      if (collision) {
+        log('rollback the local offer')
+        await pc.setLocalDescription({ type: 'rollback' })
+      }
+      await pc.setRemoteDescription(desc)
+      if (desc.type === 'offer') {
+        await pc.setLocalDescription()
+        await sendLocalDescription()
+      }
+    } catch (err) {
+      log(err)
+    }
+  }
+}
+
+// Restart ICEボタン押下時
+// WebSocketシグナリングの場合は、onnegotiationneededでICEリスタートのオファーを送信する
+// それ以外の場合は、新しいufrag/pwdを持つオファーをBrowser base64 Session Descriptionに表示する
+async function RestartICE() {
+  log('restart ICE')
+  pc.restartIce()
+  if (ws !== null) {
+    return
+  }
+  try {
+    await pc.setLocalDescription(await pc.createOffer({ iceRestart: true }))
+  } catch (err) {
+    log(err)
+  }
+}
+
 // ログ出力用
 function log(msg) {
   document.getElementById('logs').innerHTML += msg + '<br>'
@@ -92,6 +219,10 @@ async function AddDisplayCapture() {
   stream.getTracks().forEach(function(track) {
     pc.addTrack(track, displayVideo(stream));
   });
+  // WebSocketシグナリングの場合は、onnegotiationneededでオファーを送信する
+  if (ws !== null) {
+    return
+  }
   offer = await pc.createOffer()
   try{
     pc.setLocalDescription(offer)
@@ -99,3 +230,121 @@ async function AddDisplayCapture() {
     alert(e)
   }
 }
+
+// ファイル転送(データチャネル)
+// 転送ごとに'file'ラベルのデータチャネルを作成し、最初のメッセージでリクエストを送信する
+const chunkSize = 16 * 1024
+const maxBufferedAmount = 1024 * 1024
+// 途中まで受信したファイル。同じファイルをダウンロードすると続きから受信する
+let downloads = {}
+
+function openFileChannel(onmessage) {
+  const dc = pc.createDataChannel('file')
+  dc.binaryType = 'arraybuffer'
+  dc.onmessage = onmessage
+  return new Promise(resolve => { dc.onopen = () => resolve(dc) })
+}
+
+async function sha256(buffer) {
+  const digest = await crypto.subtle.digest('SHA-256', buffer)
+  return Array.from(new Uint8Array(digest)).map(b => b.toString(16).padStart(2, '0')).join('')
+}
+
+// List Filesボタン押下時
+async function ListFiles() {
+  const dc = await openFileChannel(function (event) {
+    const msg = JSON.parse(event.data)
+    dc.close()
+    if (msg.type === 'error') {
+      return log('list: ' + msg.error)
+    }
+    const el = document.getElementById('files')
+    el.innerHTML = ''
+    msg.files.forEach(function (file) {
+      const button = document.createElement('button')
+      button.textContent = file.name + ' (' + file.size + ' bytes)'
+      button.onclick = () => DownloadFile(file.name)
+      el.appendChild(button)
+      el.appendChild(document.createElement('br'))
+    })
+  })
+  dc.send(JSON.stringify({ type: 'list' }))
+}
+
+// ファイル名のボタン押下時
+async function DownloadFile(name) {
+  const download = downloads[name] || { chunks: [], received: 0 }
+  downloads[name] = download
+  let meta = null
+
+  const dc = await openFileChannel(async function (event) {
+    if (typeof event.data !== 'string') {
+      download.chunks.push(event.data)
+      download.received += event.data.byteLength
+      return
+    }
+    const msg = JSON.parse(event.data)
+    switch (msg.type) {
+      case 'file':
+        meta = msg
+        break
+      case 'done':
+        dc.close()
+        delete downloads[name]
+        const blob = new Blob(download.chunks)
+        if (await sha256(await blob.arrayBuffer()) !== meta.sha256) {
+          return log('download: checksum mismatch ' + name)
+        }
+        const a = document.createElement('a')
+        a.href = URL.createObjectURL(blob)
+        // 録画のディレクトリ内のファイルは、ディレクトリ名を含めたファイル名で保存する
+        a.download = name.replace(/\//g, '_')
+        a.click()
+        log('download: ' + name)
+        break
+      case 'error':
+        dc.close()
+        log('download: ' + msg.error)
+        break
+    }
+  })
+  if (download.received > 0) {
+    log('download: resume ' + name + ' from ' + download.received)
+  }
+  dc.send(JSON.stringify({ type: 'download', name: name, offset: download.received }))
+}
+
+// Uploadボタン押下時
+async function UploadFile() {
+  const file = document.getElementById('uploadFile').files[0]
+  if (file === undefined) {
+    return alert('Select a file to upload')
+  }
+  const buffer = await file.arrayBuffer()
+  const checksum = await sha256(buffer)
+
+  const dc = await openFileChannel(async function (event) {
+    const msg = JSON.parse(event.data)
+    switch (msg.type) {
+      case 'ready':
+        // サーバーに途中まで受信済みのファイルがあれば、その続きから送信する
+        dc.bufferedAmountLowThreshold = maxBufferedAmount / 2
+        for (let offset = msg.offset || 0; offset < buffer.byteLength; offset += chunkSize) {
+          if (dc.bufferedAmount > maxBufferedAmount) {
+            await new Promise(resolve => { dc.onbufferedamountlow = resolve })
+          }
+          dc.send(buffer.slice(offset, offset + chunkSize))
+        }
+        break
+      case 'done':
+        dc.close()
+        log('upload: ' + file.name)
+        break
+      case 'error':
+        dc.close()
+        log('upload: ' + msg.error)
+        break
+    }
+  })
+  dc.send(JSON.stringify({ type: 'upload', name: file.name, size: buffer.byteLength, sha256: checksum }))
+}
@@ -3,26 +3,43 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"image/jpeg"
+	"io"
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/pion/interceptor"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+	"github.com/pion/transport/vnet"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
-	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
 	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/capture"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/control"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/filetransfer"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/recording"
 	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/stats"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/storage"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/turnserver"
 	"go.uber.org/zap"
 	"golang.org/x/image/vp8"
 )
 
 type rtpChanData struct {
+	trackID   string
+	kind      webrtc.RTPCodecType
 	codec     webrtc.RTPCodecParameters
 	rtpPacket *rtp.Packet
 }
@@ -36,55 +53,127 @@ const DECODE_INTERVAL = 200
 const SAVE_INTERVAL = time.Millisecond * 33
 const FrameDuration = time.Millisecond * 33
 
+// recordingEnabledは、受信したメディアをファイルへ書き込むかどうかを表します(1: 書き込む)
+// 制御用データチャネルのstart-recording/stop-recordingで切り替える
+var recordingEnabled int32 = 1
+
+// packetsWrittenは、ファイルへ書き込んだRTPパケットの数です
+var packetsWritten uint64
+
 var iceConnectedCtx context.Context
 var iceConnectedCtxCancel context.CancelFunc
 var logger *zap.Logger
 
-var ivfFile *ivfwriter.IVFWriter
-var oggFile *oggwriter.OggWriter
+// simulatedNetは、テストで利用する仮想ネットワークです(nilの場合は実際のネットワークを利用する)
+var simulatedNet *vnet.Net
+
+// restreamStartTimeoutは、最初のトラックを受信してから、もう一方の種類のトラックを待たずに再配信を開始するまでの時間です
+const restreamStartTimeout = 3 * time.Second
+
+// restreamerは、受信したトラックをファイルに保存せずに他のサーバー・ツールへ再配信します
+// RTMP・SRTへの再配信(restream.go)はgstreamerタグを付けてビルドした場合のみ利用できます
+// RTP/UDPへの転送(forward.go)は常に利用できます
+type restreamer interface {
+	// AddTrackは、再配信するトラックを追加します。種類ごとに最初のトラックのみ再配信します
+	AddTrack(kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters)
+	// WriteRTPは、トラックのRTPパケットを再配信します。再配信を開始するまでのパケットは捨てます
+	WriteRTP(kind webrtc.RTPCodecType, packet *rtp.Packet) error
+	Close() error
+}
+
+// errRestreamUnsupportedは、gstreamerタグを付けずにビルドしたため-restream-urlを利用できないことを表します
+var errRestreamUnsupported = errors.New("receive was built without GStreamer, build it with -tags gstreamer to use -restream-url")
 
 // receivePacketsは、RTP パケットを受信してrtpChanに格納します
-func receivePackets(peerConnection *webrtc.PeerConnection) {
+// restreamerがnilでなければ、rtpChanには格納せずに全てのパケットを再配信します
+func receivePackets(session *lifecycle.Session, peerConnection *webrtc.PeerConnection, restreamer restreamer) {
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		logger := session.Logger().With(zap.String("track", track.ID()), zap.String("mimeType", track.Codec().MimeType))
 		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
 		// これは何のために行っている？
 		go func() {
 			ticker := time.NewTicker(time.Second * 1)
-			for range ticker.C {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-session.Context().Done():
+					return
+				case <-ticker.C:
+				}
 				rtcpSendErr := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
 				if rtcpSendErr != nil {
-					fmt.Println(rtcpSendErr)
+					logger.Warn("Failed to send PLI", zap.Error(rtcpSendErr))
 				}
 			}
 		}()
 
-		codecName := strings.Split(track.Codec().RTPCodecCapability.MimeType, "/")[1]
-		fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), codecName)
+		logger.Info("Track has started", zap.Uint8("payloadType", uint8(track.PayloadType())))
+
+		if restreamer != nil {
+			restreamTrack(session, track, restreamer)
+			return
+		}
 
 		ticker := time.NewTicker(FrameDuration)
+		defer ticker.Stop()
 		for range ticker.C {
 			rtpPacket, _, readErr := track.ReadRTP()
 			if readErr != nil {
-				panic(readErr)
+				// セッション終了に伴うエラーは無視する
+				if readErr != io.EOF && session.Context().Err() == nil {
+					session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read RTP: %w", readErr))
+				}
+				return
 			}
 
 			select {
-			case rtpChan <- rtpChanData{codec: track.Codec(), rtpPacket: rtpPacket}:
+			case rtpChan <- rtpChanData{trackID: track.ID(), kind: track.Kind(), codec: track.Codec(), rtpPacket: rtpPacket}:
 			default:
 			}
 		}
 	})
 }
 
-// decodeToJpgAndSaveは、一定の周期でrtpChanに格納されたパケットをデコードし、JPGとして保存します
-func decodeToJpgAndSave() {
+// restreamTrackは、トラックのRTPパケットを間引かずに読み込み、restreamerへ渡します
+func restreamTrack(session *lifecycle.Session, track *webrtc.TrackRemote, restreamer restreamer) {
+	// PCMUなど静的なペイロードタイプでは、MimeTypeが空になる場合がある
+	codec := track.Codec()
+	if codec.MimeType == "" && track.PayloadType() == 0 {
+		codec.MimeType, codec.ClockRate, codec.PayloadType = webrtc.MimeTypePCMU, 8000, 0
+	}
+	restreamer.AddTrack(track.Kind(), codec)
+	for {
+		rtpPacket, _, readErr := track.ReadRTP()
+		if readErr != nil {
+			if readErr != io.EOF && session.Context().Err() == nil {
+				session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read RTP: %w", readErr))
+			}
+			return
+		}
+		if err := restreamer.WriteRTP(track.Kind(), rtpPacket); err != nil {
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to restream RTP: %w", err))
+			return
+		}
+	}
+}
+
+// decodeToJpgAndSaveは、一定の周期でrtpChanに格納されたパケットをデコードし、JPGとして録画のディレクトリに保存します
+func decodeToJpgAndSave(session *lifecycle.Session, rec *recording.Recording) {
+	logger := session.Logger()
 	decoder := vp8.NewDecoder()
 
 	// sampleBuilderは、rtpPacketを溜め込み、フレーム単位で取り出すことができる
 	sampleBuilder := samplebuilder.New(20, &codecs.VP8Packet{}, 90000)
 	i := 0
 	ticker := time.NewTicker(time.Millisecond * DECODE_INTERVAL)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
 		select {
 		case data := <-rtpChan:
 			if strings.EqualFold(data.codec.MimeType, webrtc.MimeTypeVP8) {
@@ -96,7 +185,7 @@ func decodeToJpgAndSave() {
 		// フレームが出来上がったら取得する。データが足りない場合は読み込みを続ける。
 		sample := sampleBuilder.Pop()
 		if sample == nil {
-			logger.Info("sample is not enough skip it.")
+			logger.Debug("Sample is not enough, skip it")
 			continue
 		}
 
@@ -107,22 +196,23 @@ func decodeToJpgAndSave() {
 		var err error
 		if fh, err = decoder.DecodeFrameHeader(); err != nil {
 			// logger.Error("Failed in DecodeFrameHeader", Stack=false)
-			logger.Warn("Failed in DecodeFrameHeader")
+			logger.Warn("Failed in DecodeFrameHeader", zap.Error(err))
 			continue
 		}
 		if !fh.KeyFrame {
 			// キーフレーム以外に対応していないのでスキップする
-			logger.Info("Not Key Frame")
+			logger.Debug("Not Key Frame")
 			continue
 		}
-		fmt.Println(fh)
+		logger.Debug("Frame header decoded", zap.Int("width", fh.Width), zap.Int("height", fh.Height))
 		// Decode Frame
 		img, err := decoder.DecodeFrame()
 		if err != nil {
-			panic(err)
+			logger.Warn("Failed in DecodeFrame", zap.Error(err))
+			continue
 		}
 		if img != nil {
-			logger.Info("image decoded!")
+			logger.Debug("Image decoded")
 		}
 
 		// save image to file
@@ -130,61 +220,149 @@ func decodeToJpgAndSave() {
 		buffer := new(bytes.Buffer)
 		if err = jpeg.Encode(buffer, img, nil); err != nil {
 			//  panic(err)
-			fmt.Printf("jpeg Encode Error: %s\r\n", err)
-		}
-
-		fo, err := os.Create(fmt.Sprintf("%s%d%s", "./out", i, ".jpg"))
-
-		if err != nil {
-			fmt.Printf("image create Error: %s\r\n", err)
-			//panic(err)
+			logger.Warn("Failed to encode jpeg", zap.Error(err))
 		}
 
-		if _, err := fo.Write(buffer.Bytes()); err != nil {
-			fmt.Printf("image write Error: %s\r\n", err)
-			//panic(err)
+		if err := rec.WriteFile(fmt.Sprintf("frame-%05d.jpg", i), buffer.Bytes()); err != nil {
+			if errors.Is(err, recording.ErrClosed) {
+				return
+			}
+			logger.Warn("Failed to write image file", zap.Error(err))
 		}
-		// close fo on exit and check for its returned error
-		fo.Close()
 	}
 }
 
-// saveWithoutDecodeは、R一定の周期でrtpChanに格納されたパケットをTPをデコードせずにファイルへ保存します
-func saveWithoutDecode() {
-	logger.Info("saveWithoutDecode!")
+// saveWithoutDecodeは、一定の周期でrtpChanに格納されたパケットをデコードせずに、録画のトラックごとのファイルへ保存します
+// ファイルはセッションが終了し、PeerConnectionが閉じられた後に閉じられます
+func saveWithoutDecode(session *lifecycle.Session, rec *recording.Recording) {
+	logger := session.Logger()
+	logger.Info("Start writing media files", zap.String("location", rec.Location()))
 	ticker := time.NewTicker(SAVE_INTERVAL)
-	var err error
+	defer ticker.Stop()
 
-	ivfFile, err = ivfwriter.New("./out/output.ivf")
-	if err != nil {
-		panic(err)
-	}
-	oggFile, err = oggwriter.New("./out/output.ogg", 48000, 2)
-	if err != nil {
-		panic(err)
-	}
-
-	defer oggFile.Close()
-	defer ivfFile.Close()
+	// tracksは、トラックIDごとのファイルです(nilの場合は保存できないコーデック)
+	tracks := map[string]*recording.Track{}
 	var data rtpChanData
-	for range ticker.C {
+	for {
+		select {
+		case <-session.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
 		select {
 		case data = <-rtpChan:
 		default:
 			continue
 		}
-		// RTPをファイルに書き込む
-		codec := data.codec
-		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
-			if err := oggFile.WriteRTP(data.rtpPacket); err != nil {
-				panic(err)
-			}
-		} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
-			if err := ivfFile.WriteRTP(data.rtpPacket); err != nil {
-				panic(err)
+		// 録画を停止している間は、ファイルを開いたままパケットを捨てる
+		if atomic.LoadInt32(&recordingEnabled) == 0 {
+			continue
+		}
+		track, ok := tracks[data.trackID]
+		if !ok {
+			var err error
+			track, err = rec.AddTrack(data.trackID, data.kind, data.codec)
+			switch {
+			case errors.Is(err, recording.ErrUnsupportedCodec):
+				logger.Warn("Track is not recorded", zap.String("track", data.trackID), zap.Error(err))
+			case errors.Is(err, recording.ErrClosed):
+				return
+			case err != nil:
+				session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to create the file of the track: %w", err))
+				return
 			}
+			tracks[data.trackID] = track
+		}
+		if track == nil {
+			continue
+		}
+		// RTPをファイルに書き込む
+		switch err := track.WriteRTP(data.rtpPacket); {
+		case err == nil:
+			atomic.AddUint64(&packetsWritten, 1)
+		case errors.Is(err, recording.ErrQuotaExceeded):
+			// クォータを超えた録画は、以降のパケットを捨てる
+		case errors.Is(err, recording.ErrClosed):
+			return
+		default:
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to write %s: %w", data.codec.MimeType, err))
+			return
+		}
+	}
+}
+
+// requestKeyFrameは、受信中の全ての映像トラックにPLIを送信します
+func requestKeyFrame(peerConnection *webrtc.PeerConnection) error {
+	pli := []rtcp.Packet{}
+	for _, receiver := range peerConnection.GetReceivers() {
+		track := receiver.Track()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		pli = append(pli, &rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())})
+	}
+	if len(pli) == 0 {
+		return errors.New("no video track is received")
+	}
+	return peerConnection.WriteRTCP(pli)
+}
+
+// handleControlは、制御用データチャネルのコマンドとテレメトリを設定します
+func handleControl(session *lifecycle.Session, peerConnection *webrtc.PeerConnection) *control.Controller {
+	atomic.StoreInt32(&recordingEnabled, 1)
+	atomic.StoreUint64(&packetsWritten, 0)
+
+	controller := control.New(peerConnection, session.Logger())
+	controller.Handle(control.CommandStartRecording, func(control.Message) error {
+		atomic.StoreInt32(&recordingEnabled, 1)
+		return nil
+	})
+	controller.Handle(control.CommandStopRecording, func(control.Message) error {
+		atomic.StoreInt32(&recordingEnabled, 0)
+		return nil
+	})
+	controller.Handle(control.CommandRequestKeyFrame, func(control.Message) error {
+		return requestKeyFrame(peerConnection)
+	})
+	controller.SetStatus(func() map[string]interface{} {
+		return map[string]interface{}{
+			"recording":      atomic.LoadInt32(&recordingEnabled) == 1,
+			"packetsWritten": atomic.LoadUint64(&packetsWritten),
 		}
+	})
+	session.Go(func() { controller.Run(session.Context()) })
+	return controller
+}
+
+// newAPIは、統計情報を収集するインターセプターを登録したAPIを生成します
+// captureInterceptorがnilでなければ、受信したパケットをキャプチャします
+// netInterceptorがnilでなければ、送受信するRTP・RTCPパケットにパケットロス・遅延などを加えます
+func newAPI(statsInterceptor *stats.Interceptor, captureInterceptor *capture.Interceptor, netInterceptor *netsim.Interceptor, loggerFactory *logging.LoggerFactory) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
 	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	// ネットワークに最も近い位置でパケットを落とす・遅らせるため、最初に登録する
+	if netInterceptor != nil {
+		interceptorRegistry.Add(netInterceptor)
+	}
+	// 他のインターセプターが処理する前のパケットを書き込むため、その次に登録する
+	if captureInterceptor != nil {
+		interceptorRegistry.Add(captureInterceptor)
+	}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(statsInterceptor)
+
+	settingEngine := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	if simulatedNet != nil {
+		settingEngine.SetVNet(simulatedNet)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(settingEngine)), nil
 }
 
 func init() {
@@ -193,93 +371,328 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func main() {
-	logger, _ = zap.NewDevelopment()
-	iceConnectedCtx, iceConnectedCtxCancel = context.WithCancel(context.Background())
+// sessionConfigは、runSessionに渡すセッションの設定です
+type sessionConfig struct {
+	webrtcConfig      webrtc.Configuration
+	collector         *stats.Collector
+	logConfig         *logging.Config
+	channel           signal.Channel
+	lifecycleConfig   *lifecycle.Config
+	negotiationConfig *negotiation.Config
+	transferConfig    *filetransfer.Config
+	captureConfig     *capture.Config
+	recorder          *recording.Manager
+	netConfig         *netsim.Config
+	restreamURL       string
+	forwardConfig     *rtpForwardConfig
+	decode            bool
+}
 
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+// runSessionは、オファーを1つ受け付けてセッションが終了するまでブロックします
+func runSession(ctx context.Context, c sessionConfig) (lifecycle.Reason, error) {
+	// (オファー) Remote Session Descriptionをシグナリングチャネルから読み込む
+	offer, err := c.channel.Recv(ctx)
+	for errors.Is(err, signal.ErrInvalidSessionDescription) {
+		logger.Warn("Invalid session description", zap.Error(err))
+		offer, err = c.channel.Recv(ctx)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return lifecycle.ReasonSignal, nil
+		}
+		return lifecycle.ReasonError, fmt.Errorf("failed to receive an offer: %w", err)
+	}
+
+	session := lifecycle.NewSession(ctx, logger)
+	// 以降はセッションIDを持つロガーを利用する
+	logger := session.Logger()
+	fail := func(err error) (lifecycle.Reason, error) {
+		session.Stop(lifecycle.ReasonError, err)
+		return session.Wait()
 	}
+	iceConnectedCtx, iceConnectedCtxCancel = context.WithCancel(session.Context())
 
 	// Create a new RTCPeerConnection
-	logger.Info("NewPeerConnection")
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	logger.Info("Creating PeerConnection")
+	statsInterceptor := stats.NewInterceptor()
+	// pionのログ(ICE、DTLSなど)もセッションのロガーに出力する
+	loggerFactory, err := logging.NewLoggerFactory(logger, *c.logConfig)
+	if err != nil {
+		return fail(err)
+	}
+	// -dumpが指定されていれば、受信したRTP・RTCPパケットをそのままファイルに書き込む
+	var captureInterceptor *capture.Interceptor
+	if c.captureConfig.File != "" {
+		if captureInterceptor, err = capture.NewInterceptor(c.captureConfig.File); err != nil {
+			return fail(err)
+		}
+		// PeerConnectionを閉じた後に閉じる
+		session.OnClose("Capture", captureInterceptor.Close)
+		logger.Info("Capturing RTP and RTCP packets", zap.String("file", c.captureConfig.File))
+	}
+	// 再配信しない場合は、セッションごとの録画のディレクトリへ保存する
+	var rec *recording.Recording
+	if c.restreamURL == "" && c.forwardConfig.addr == "" {
+		if rec, err = c.recorder.Start(session.ID()); err != nil {
+			return fail(err)
+		}
+		// PeerConnectionを閉じた後に、マニフェストに終了時刻を書き込んで閉じる
+		session.OnClose("Recording", rec.Close)
+	}
+	// -net-*が指定されていれば、送受信するRTP・RTCPパケットにパケットロス・遅延などを加える
+	var netInterceptor *netsim.Interceptor
+	if c.netConfig.Enabled() {
+		netInterceptor = netsim.NewInterceptor(*c.netConfig)
+		logger.Info("Simulating network impairment", zap.Float64("loss", c.netConfig.Loss), zap.Duration("delay", c.netConfig.Delay), zap.Duration("jitter", c.netConfig.Jitter),
+			zap.Float64("reorder", c.netConfig.Reorder), zap.Int("bandwidth", c.netConfig.Bandwidth))
+		session.OnClose("NetworkSimulation", func() error {
+			outbound, inbound := netInterceptor.Stats()
+			logger.Info("Network impairment statistics", zap.Uint64("outboundSent", outbound.Sent), zap.Uint64("outboundDropped", outbound.Dropped),
+				zap.Uint64("inboundSent", inbound.Sent), zap.Uint64("inboundDropped", inbound.Dropped))
+			return nil
+		})
+	}
+	api, err := newAPI(statsInterceptor, captureInterceptor, netInterceptor, loggerFactory)
+	if err != nil {
+		return fail(err)
+	}
+	peerConnection, err := api.NewPeerConnection(c.webrtcConfig)
 	if err != nil {
-		panic(err)
+		return fail(err)
 	}
+	// Gracefully shutdown the peer connection
+	session.OnClose("PeerConnection", peerConnection.Close)
+
+	// セッションの統計情報を収集する
+	c.collector.Add(session.ID(), peerConnection, statsInterceptor)
+	defer c.collector.Remove(session.ID())
+
+	// シグナリングチャネルでオファー・アンサーを交換する
+	negotiator := negotiation.New(peerConnection, *c.negotiationConfig, c.channel, logger)
 
 	// 候補先情報を受信した場合にそれを表示する
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		logger.Info("OnICECandidate")
 		if candidate == nil {
-			logger.Info("No candidate")
+			logger.Debug("ICE gathering has completed")
 			return
 		}
-		logger.Info(fmt.Sprintf("Address: %s, Port: %d", candidate.Address, candidate.Port))
+		logger.Debug("ICE candidate has been gathered", zap.String("address", candidate.Address), zap.Uint16("port", candidate.Port))
 	})
 
 	// 接続状態変更を検知した際に起動するイベントハンドラを設定する
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		logger.Info("ICE connection state has changed", zap.Stringer("state", connectionState))
+		negotiator.ICEConnectionStateChange(connectionState)
 		// 接続が成功したことをcontextに伝える
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			iceConnectedCtxCancel()
-		} else if connectionState == webrtc.ICEConnectionStateFailed {
-			if closeErr := oggFile.Close(); closeErr != nil {
-				panic(closeErr)
-			}
-
-			if closeErr := ivfFile.Close(); closeErr != nil {
-				panic(closeErr)
-			}
+		}
+	})
 
-			fmt.Println("Done writing media files")
+	// 切断・失敗・クローズを検知したらセッションを終了する
+	session.WatchPeerConnection(peerConnection, c.lifecycleConfig.DisconnectedTimeout, c.lifecycleConfig.FailedTimeout, func(state webrtc.PeerConnectionState) {
+		logger.Info("Peer connection state has changed", zap.Stringer("state", state))
+	})
 
-			// Gracefully shutdown the peer connection
-			if closeErr := peerConnection.Close(); closeErr != nil {
-				panic(closeErr)
-			}
+	// -restream-url、-rtp-forwardが指定されていれば、受信したトラックをファイルに保存せずに再配信する
+	var restream restreamer
+	switch {
+	case c.restreamURL != "":
+		restream, err = newRestreamer(session, c.restreamURL)
+	case c.forwardConfig.addr != "":
+		restream, err = newRTPForwarder(session, *c.forwardConfig)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if restream != nil {
+		// PeerConnectionを閉じた後に閉じる
+		session.OnClose("Restream", restream.Close)
+	}
 
-			os.Exit(0)
+	// トラック・データチャネルを受信した際のイベントハンドラは、アンサーを送信する前に設定する
+	receivePackets(session, peerConnection, restream)
+	controller := handleControl(session, peerConnection)
+	// ./out内のファイルのダウンロードと、ブラウザからのアップロードを受け付ける
+	transfer := filetransfer.NewServer(*c.transferConfig, logger)
+	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
+		switch dataChannel.Label() {
+		case control.Label:
+			controller.Accept(dataChannel)
+		case filetransfer.Label:
+			transfer.Accept(session.Context(), dataChannel)
 		}
 	})
 
-	// (オファー) Remote Session DescriptionをpeerConnectionに設定する
-	offer := webrtc.SessionDescription{}
-	signal.Decode(signal.MustReadStdin(), &offer)
-	err = peerConnection.SetRemoteDescription(offer)
-	if err != nil {
-		panic(err)
+	// (オファー)を適用し、(アンサー) Local Session Descriptionをシグナリングチャネルへ送信する
+	if err = negotiator.HandleRemoteDescription(offer); err != nil {
+		return fail(err)
+	}
+	// 2回目以降のオファー・アンサー(再ネゴシエーション、ICEリスタート)を受け付ける
+	session.Go(func() { negotiator.Run(session.Context()) })
+
+	switch {
+	case restream != nil:
+		// 再配信はトラックごとに行う(restreamTrack)
+	case c.decode:
+		session.Go(func() { decodeToJpgAndSave(session, rec) })
+	default:
+		session.Go(func() { saveWithoutDecode(session, rec) })
 	}
 
-	// (アンサー) Local Session Descriptionを生成する
-	answer, err := peerConnection.CreateAnswer(nil)
+	return session.Wait()
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// runは、セッションを実行し、終了理由に応じた終了コードを返します
+func run() int {
+	turnConfig := turnserver.Flags()
+	lifecycleConfig := lifecycle.Flags()
+	negotiationConfig := negotiation.Flags()
+	signalConfig := signal.Flags()
+	statsConfig := stats.Flags()
+	logConfig := logging.Flags()
+	transferConfig := filetransfer.Flags()
+	captureConfig := capture.Flags()
+	recordConfig := recording.Flags()
+	s3Config := storage.Flags()
+	netConfig := netsim.Flags()
+	decode := flag.Bool("decode", false, "decode the VP8 key frames and save them as JPEG files instead of writing the media files to the recording directory")
+	restreamURL := flag.String("restream-url", "", "restream the received video and audio as H.264 and AAC to rtmp://, rtmps:// or srt://, or to a .flv or .ts file, instead of recording them (requires -tags gstreamer)")
+	forwardConfig := &rtpForwardConfig{}
+	flag.StringVar(&forwardConfig.addr, "rtp-forward", "", "forward the received video RTP packets to this UDP host:port and the audio to the port + 2, e.g. 127.0.0.1:5004, instead of recording them")
+	flag.StringVar(&forwardConfig.sdpFile, "rtp-sdp", "./out/stream.sdp", "SDP file describing the forwarded RTP packets, to play them with ffplay")
+	flag.Parse()
+
+	var err error
+	if logger, err = logging.New(*logConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logger.Sync()
+
+	if err := netConfig.Validate(); err != nil {
+		logger.Error("Invalid network impairment", zap.Error(err))
+		return 2
+	}
+	if err := negotiationConfig.Validate(lifecycleConfig.DisconnectedTimeout); err != nil {
+		logger.Error("Invalid ICE restart", zap.Error(err))
+		return 2
+	}
+	if err := recordConfig.Validate(); err != nil {
+		logger.Error("Invalid recording", zap.Error(err))
+		return 2
+	}
+	// -record-dirがs3://bucket/prefixであれば、録画をS3互換のストレージにアップロードする
+	store, err := storage.Open(recordConfig.Dir, *s3Config)
 	if err != nil {
-		panic(err)
+		logger.Error("Invalid recording storage", zap.Error(err))
+		return 2
 	}
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
+	if *restreamURL != "" && *decode {
+		logger.Error("-restream-url and -decode cannot be used together")
+		return 2
+	}
+	if forwardConfig.addr != "" {
+		if *restreamURL != "" || *decode {
+			logger.Error("-rtp-forward cannot be used together with -restream-url or -decode")
+			return 2
+		}
+		if err := forwardConfig.validate(); err != nil {
+			logger.Error("Invalid RTP forwarding", zap.Error(err))
+			return 2
+		}
+	}
+	if *restreamURL != "" && !restreamSupported {
+		logger.Error("Restreaming is not supported", zap.Error(errRestreamUnsupported))
+		return 2
+	}
+
+	// SIGINT/SIGTERMを受け取ったらキャンセルされる
+	ctx, cancel := lifecycle.SignalContext(context.Background())
+	defer cancel()
+
+	// Prepare the configuration
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+
+	// 組み込みのTurnサーバーを起動し、ICEServersに追加する
+	if turnConfig.Enabled {
+		turnServer, err := turnserver.Start(*turnConfig)
+		if err != nil {
+			logger.Error("Failed to start the TURN server", zap.Error(err))
+			return lifecycle.ReasonError.ExitCode()
+		}
+		defer turnServer.Close()
+		turnServer.Apply(&config)
+		logger.Info("TURN server started", zap.String("publicIP", turnConfig.PublicIP), zap.Int("port", turnConfig.Port))
+	}
+
+	// 統計情報を収集し、-stats-addrが指定されていれば/metrics、/statsで公開する
+	collector, err := stats.Start(ctx, *statsConfig)
 	if err != nil {
-		panic(err)
+		logger.Error("Failed to start the stats server", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+	if statsConfig.Addr != "" {
+		logger.Info("Stats server started", zap.String("url", fmt.Sprintf("http://%s/metrics", statsConfig.Addr)))
 	}
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
 
-	// Output the answer in base64 so we can paste it in browser
-	fmt.Printf("Answer Session Description: \n%s\n", signal.Encode(*peerConnection.LocalDescription()))
+	// オファー・アンサーを交換するシグナリングチャネル(標準入出力またはWebSocket)を準備する
+	channel, err := signal.NewChannel(*signalConfig)
+	if err != nil {
+		logger.Error("Failed to prepare the signaling channel", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+	if signalConfig.Addr != "" {
+		logger.Info("WebSocket signaling server started", zap.String("url", fmt.Sprintf("ws://%s/ws", signalConfig.Addr)))
+	}
 
-	go receivePackets(peerConnection)
-	// go decodeToJpgAndSave()
-	go saveWithoutDecode()
+	// セッションごとの録画のディレクトリを作成し、古い録画を削除する
+	recorder := recording.NewManager(*recordConfig, store, logger)
+
+	var backoff lifecycle.Backoff
+	for {
+		started := time.Now()
+		reason, err := runSession(ctx, sessionConfig{
+			webrtcConfig:      config,
+			collector:         collector,
+			logConfig:         logConfig,
+			channel:           channel,
+			lifecycleConfig:   lifecycleConfig,
+			negotiationConfig: negotiationConfig,
+			transferConfig:    transferConfig,
+			captureConfig:     captureConfig,
+			recorder:          recorder,
+			netConfig:         netConfig,
+			restreamURL:       *restreamURL,
+			forwardConfig:     forwardConfig,
+			decode:            *decode,
+		})
+		if err != nil {
+			logger.Error("Session has ended with error", zap.Stringer("reason", reason), zap.Error(err))
+		} else {
+			logger.Info("Session has ended", zap.Stringer("reason", reason))
+		}
 
-	select {}
+		// 自動再起動が有効な場合は、新しいオファーを待つ
+		// シグナリングチャネルが閉じられた場合(標準入力のEOFなど)は、新しいオファーを受け取れないため終了する
+		if !lifecycleConfig.AutoRestart || reason == lifecycle.ReasonSignal || ctx.Err() != nil || errors.Is(err, io.EOF) {
+			return reason.ExitCode()
+		}
+		// すぐに終了するセッションを繰り返さないように、間隔を空けてから再起動する
+		delay := backoff.Next(time.Since(started))
+		logger.Info("Waiting for a new offer", zap.Duration("delay", delay))
+		if !lifecycle.Sleep(ctx, delay) {
+			return lifecycle.ReasonSignal.ExitCode()
+		}
+	}
 }
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/capture"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/filetransfer"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/loopback"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/recording"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtpbridge"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/stats"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/storage"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+	"go.uber.org/zap"
+	"golang.org/x/image/vp8"
+)
+
+// TestLoopbackは、仮想ネットワーク上のオファー側から映像(VP8)と音声(Opus)を送信し、
+// 保存されたIVF・Oggファイルが正しく読み込めることを確認します
+func TestLoopback(t *testing.T) {
+	testLoopback(t, &netsim.Config{})
+}
+
+// TestLoopbackImpairedは、パケットロス・遅延・ジッター・並べ替えのあるネットワークでも、
+// 保存されたIVF・Oggファイルが正しく読み込めることを確認します
+func TestLoopbackImpaired(t *testing.T) {
+	testLoopback(t, &netsim.Config{Loss: 10, Delay: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, Reorder: 5, Seed: 1})
+}
+
+func testLoopback(t *testing.T, netConfig *netsim.Config) {
+	chdirTemp(t)
+	if err := os.Mkdir("out", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	logger = zap.NewNop()
+	l, err := loopback.New(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	simulatedNet = l.Net
+	defer func() { simulatedNet = nil }()
+
+	videoTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range []webrtc.TrackLocal{videoTrack, audioTrack} {
+		if _, err := l.Offerer.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	type result struct {
+		reason lifecycle.Reason
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reason, err := runSession(sessionCtx, sessionConfig{
+			collector:         stats.NewCollector(time.Second),
+			logConfig:         &logging.Config{PionLevel: "warn"},
+			channel:           l.Channel,
+			lifecycleConfig:   &lifecycle.Config{DisconnectedTimeout: 5 * time.Second},
+			negotiationConfig: &negotiation.Config{},
+			transferConfig:    &filetransfer.Config{Dir: "out", UploadDir: "upload"},
+			captureConfig:     &capture.Config{},
+			recorder:          recording.NewManager(recording.Config{Dir: "out"}, storage.NewLocal("out"), logger),
+			netConfig:         netConfig,
+			forwardConfig:     &rtpForwardConfig{},
+		})
+		done <- result{reason, err}
+	}()
+
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 小さい映像にして、1フレームを1つのRTPパケットで送信する
+	video, err := testsrc.NewVideo(testsrc.Config{Width: 64, Height: 48, FrameRate: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Opusのペイロードとして正しい必要はないため、TOCバイトと固定のデータを送る
+			if err := audioTrack.WriteSample(media.Sample{Data: append([]byte{0xfc}, bytes.Repeat([]byte{byte(i)}, 40)...), Duration: 20 * time.Millisecond}); err != nil {
+				return
+			}
+			frame, err := video.Next(time.Now())
+			if err != nil {
+				return
+			}
+			if err := videoTrack.WriteSample(media.Sample{Data: frame, Duration: 20 * time.Millisecond}); err != nil {
+				return
+			}
+		}
+	}()
+
+	const minPackets = 30
+	for atomic.LoadUint64(&packetsWritten) < minPackets {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("only %d packets have been written", atomic.LoadUint64(&packetsWritten))
+		case r := <-done:
+			t.Fatalf("session ended early: %s %v", r.reason, r.err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	stopSession()
+	if r := <-done; r.err != nil {
+		t.Fatalf("session ended with an error: %s %v", r.reason, r.err)
+	}
+
+	// セッションごとのディレクトリに、トラックごとのファイルとマニフェストが書き込まれる
+	dir, manifest := readManifest(t)
+	if len(manifest.Tracks) != 2 || manifest.End == nil {
+		t.Fatalf("got %d tracks ending at %v, want 2 tracks", len(manifest.Tracks), manifest.End)
+	}
+	var frames, packets int
+	var manifestPackets uint64
+	for _, track := range manifest.Tracks {
+		switch track.MimeType {
+		case webrtc.MimeTypeVP8:
+			frames = readIVF(t, filepath.Join(dir, track.File))
+		case webrtc.MimeTypeOpus:
+			packets = readOgg(t, filepath.Join(dir, track.File))
+		}
+		if len(track.SSRCs) != 1 || track.Start == nil {
+			t.Errorf("%s: got SSRCs %v starting at %v", track.File, track.SSRCs, track.Start)
+		}
+		manifestPackets += track.Packets
+	}
+	if frames == 0 || packets == 0 {
+		t.Errorf("got %d video frames and %d audio packets, want both", frames, packets)
+	}
+	written := atomic.LoadUint64(&packetsWritten)
+	if uint64(frames+packets) != written || manifestPackets != written {
+		t.Errorf("got %d video frames and %d audio packets (%d in the manifest), want %d in total", frames, packets, manifestPackets, written)
+	}
+}
+
+// readManifestは、outにある1つの録画のディレクトリとマニフェストを返します
+func readManifest(t *testing.T) (string, recording.Manifest) {
+	t.Helper()
+	manifests, err := filepath.Glob(filepath.Join("out", "*", recording.ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 {
+		t.Fatalf("got manifests %v, want 1", manifests)
+	}
+	b, err := ioutil.ReadFile(manifests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest recording.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Dir(manifests[0]), manifest
+}
+
+// TestLoopbackRTPForwardは、受信した映像(VP8)と音声(Opus)のRTPパケットがUDPで転送され、
+// 転送先を記述したSDPファイルが書き出されることを確認します
+func TestLoopbackRTPForward(t *testing.T) {
+	chdirTemp(t)
+
+	logger = zap.NewNop()
+	l, err := loopback.New(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	simulatedNet = l.Net
+	defer func() { simulatedNet = nil }()
+
+	// 映像は5004番、音声は5006番のように、連続しないポートで受信する必要がある
+	var videoReader, audioReader *rtpbridge.Reader
+	for videoReader == nil {
+		reader, err := rtpbridge.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := reader.Addr().(*net.UDPAddr).Port
+		audio, err := rtpbridge.Listen(fmt.Sprintf("127.0.0.1:%d", port+audioPortOffset))
+		if err != nil {
+			reader.Close()
+			continue
+		}
+		videoReader, audioReader = reader, audio
+	}
+	defer videoReader.Close()
+	defer audioReader.Close()
+	forwardConfig := &rtpForwardConfig{addr: videoReader.Addr().String(), sdpFile: filepath.Join("out", "stream.sdp")}
+	if err := forwardConfig.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	videoTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range []webrtc.TrackLocal{videoTrack, audioTrack} {
+		if _, err := l.Offerer.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	done := make(chan error, 1)
+	go func() {
+		_, err := runSession(sessionCtx, sessionConfig{
+			collector:         stats.NewCollector(time.Second),
+			logConfig:         &logging.Config{PionLevel: "warn"},
+			channel:           l.Channel,
+			lifecycleConfig:   &lifecycle.Config{DisconnectedTimeout: 5 * time.Second},
+			negotiationConfig: &negotiation.Config{},
+			transferConfig:    &filetransfer.Config{Dir: "out", UploadDir: "upload"},
+			captureConfig:     &capture.Config{},
+			recorder:          recording.NewManager(recording.Config{Dir: "out"}, storage.NewLocal("out"), logger),
+			netConfig:         &netsim.Config{},
+			forwardConfig:     forwardConfig,
+		})
+		done <- err
+	}()
+
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	video, err := testsrc.NewVideo(testsrc.Config{Width: 64, Height: 48, FrameRate: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := audioTrack.WriteSample(media.Sample{Data: append([]byte{0xfc}, bytes.Repeat([]byte{byte(i)}, 40)...), Duration: 20 * time.Millisecond}); err != nil {
+				return
+			}
+			frame, err := video.Next(time.Now())
+			if err != nil {
+				return
+			}
+			if err := videoTrack.WriteSample(media.Sample{Data: frame, Duration: 20 * time.Millisecond}); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 転送されたパケットは、SDPに記述したペイロードタイプのまま届く
+	for _, c := range []struct {
+		reader   *rtpbridge.Reader
+		mimeType string
+	}{{videoReader, webrtc.MimeTypeVP8}, {audioReader, webrtc.MimeTypeOpus}} {
+		packet, err := c.reader.ReadRTP(10 * time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", c.mimeType, err)
+		}
+		if len(packet.Payload) == 0 {
+			t.Errorf("%s: got an empty payload", c.mimeType)
+		}
+		sdp, err := ioutil.ReadFile(forwardConfig.sdpFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rtpmap := fmt.Sprintf("a=rtpmap:%d %s/", packet.PayloadType, strings.SplitN(c.mimeType, "/", 2)[1])
+		if !strings.Contains(string(sdp), rtpmap) {
+			t.Errorf("%s: SDP does not contain %q:\n%s", c.mimeType, rtpmap, sdp)
+		}
+	}
+
+	stopSession()
+	if err := <-done; err != nil {
+		t.Fatalf("session ended with an error: %v", err)
+	}
+	// 録画はしない
+	if manifests, _ := filepath.Glob(filepath.Join("out", "*", recording.ManifestName)); len(manifests) != 0 {
+		t.Errorf("got recordings %v", manifests)
+	}
+}
+
+// readIVFは、IVFファイルの全てのフレームをデコードし、フレーム数を返します
+func readIVF(t *testing.T, name string) int {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	reader, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header.FourCC[:]) != "VP80" {
+		t.Fatalf("got FourCC %q, want VP80", header.FourCC)
+	}
+
+	decoder := vp8.NewDecoder()
+	frames := 0
+	for {
+		frame, _, err := reader.ParseNextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("frame %d: %v", frames, err)
+		}
+		decoder.Init(bytes.NewReader(frame), len(frame))
+		fh, err := decoder.DecodeFrameHeader()
+		if err != nil {
+			t.Fatalf("frame %d: %v", frames, err)
+		}
+		if fh.Width != 64 || fh.Height != 48 {
+			t.Fatalf("frame %d: got %dx%d, want 64x48", frames, fh.Width, fh.Height)
+		}
+		if _, err := decoder.DecodeFrame(); err != nil {
+			t.Fatalf("frame %d: %v", frames, err)
+		}
+		frames++
+	}
+	if header.NumFrames != uint32(frames) {
+		t.Errorf("got %d frames in the header, want %d", header.NumFrames, frames)
+	}
+	return frames
+}
+
+// readOggは、Oggファイルの全てのページをチェックサムを検証しながら読み込み、音声パケットのページ数を返します
+func readOgg(t *testing.T, name string) int {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	reader, header, err := oggreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.SampleRate != 48000 || header.Channels != 2 {
+		t.Fatalf("got %d Hz %d channels, want 48000 Hz 2 channels", header.SampleRate, header.Channels)
+	}
+
+	pages := 0
+	for {
+		_, _, err := reader.ParseNextPage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("page %d: %v", pages, err)
+		}
+		pages++
+	}
+	// 最初のページはコメントヘッダー
+	return pages - 1
+}
+
+// chdirTempは、テスト中の作業ディレクトリを一時ディレクトリに変更します
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+//go:build gstreamer
+// +build gstreamer
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	gst "github.com/takumi2786/pion-webrtc_sample/v1/internal/gstreamer-src"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"go.uber.org/zap"
+)
+
+// restreamSupportedは、-restream-urlを利用できるかどうかです
+const restreamSupported = true
+
+// gstRestreamerは、GStreamerのパイプラインで受信した映像・音声を多重化し、RTMP・SRTで送信します
+type gstRestreamer struct {
+	session *lifecycle.Session
+	logger  *zap.Logger
+	url     string
+
+	mu sync.Mutex
+	// videoMimeType、audioMimeTypeは、多重化するトラックのコーデックです(空の場合はトラックがない)
+	videoMimeType string
+	audioMimeType string
+	// timerは、最初のトラックを受信してからパイプラインを開始するまでのタイマーです
+	timer    *time.Timer
+	pipeline *gst.Pipeline
+	closed   bool
+}
+
+// newRestreamerは、受信したトラックをurlへ送信するrestreamerを作成します
+// パイプラインは映像・音声の両方のトラックを受信するか、最初のトラックからrestreamStartTimeoutが経過すると開始します
+func newRestreamer(session *lifecycle.Session, url string) (restreamer, error) {
+	return &gstRestreamer{session: session, logger: session.Logger().With(zap.String("url", url)), url: url}, nil
+}
+
+func (r *gstRestreamer) AddTrack(kind webrtc.RTPCodecType, codec webrtc.RTPCodecParameters) {
+	mimeType := codec.MimeType
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pipeline != nil || r.closed {
+		r.logger.Warn("Track is not restreamed because the restreaming has already started", zap.Stringer("kind", kind), zap.String("mimeType", mimeType))
+		return
+	}
+	switch {
+	case kind == webrtc.RTPCodecTypeVideo && r.videoMimeType == "":
+		r.videoMimeType = mimeType
+	case kind == webrtc.RTPCodecTypeAudio && r.audioMimeType == "":
+		r.audioMimeType = mimeType
+	default:
+		// 種類ごとに最初のトラックのみ送信する
+		r.logger.Warn("Track is not restreamed because a track of the same kind is restreamed", zap.Stringer("kind", kind), zap.String("mimeType", mimeType))
+		return
+	}
+
+	if r.videoMimeType != "" && r.audioMimeType != "" {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		r.start()
+		return
+	}
+	// もう一方のトラックが来ない場合(映像のみ・音声のみ)に備えて、一定時間後に開始する
+	if r.timer == nil {
+		r.timer = time.AfterFunc(restreamStartTimeout, func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if r.pipeline == nil && !r.closed {
+				r.start()
+			}
+		})
+	}
+}
+
+// startは、パイプラインを開始します。r.muをロックして呼び出します
+func (r *gstRestreamer) start() {
+	pipeline, err := gst.CreateRestreamPipeline(r.url, r.videoMimeType, r.audioMimeType)
+	if err != nil {
+		r.session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to start restreaming: %w", err))
+		return
+	}
+	pipeline.OnEvent(func(event gst.Event) {
+		switch event.Type {
+		case gst.EventError:
+			r.session.Stop(lifecycle.ReasonError, fmt.Errorf("restreaming has failed in %s: %s", event.Source, event.Message))
+		case gst.EventWarning:
+			r.logger.Warn("GStreamer warning", zap.String("element", event.Source), zap.String("message", event.Message))
+		case gst.EventStateChanged:
+			r.logger.Debug("GStreamer pipeline state has changed", zap.Stringer("from", event.OldState), zap.Stringer("to", event.NewState))
+		}
+	})
+	pipeline.Start()
+	r.pipeline = pipeline
+	r.logger.Info("Restreaming started", zap.String("video", r.videoMimeType), zap.String("audio", r.audioMimeType))
+}
+
+func (r *gstRestreamer) WriteRTP(kind webrtc.RTPCodecType, packet *rtp.Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// パイプラインを開始するまでのパケットは捨てる
+	if r.pipeline == nil {
+		return nil
+	}
+	name := gst.RestreamVideo
+	if kind == webrtc.RTPCodecTypeAudio {
+		name = gst.RestreamAudio
+	}
+	buf, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	return r.pipeline.PushTo(name, buf)
+}
+
+func (r *gstRestreamer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.pipeline != nil {
+		r.pipeline.Destroy()
+		r.logger.Info("Restreaming stopped")
+	}
+	return nil
+}
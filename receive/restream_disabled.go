@@ -0,0 +1,14 @@
+//go:build !gstreamer
+// +build !gstreamer
+
+package main
+
+import "github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+
+// restreamSupportedは、-restream-urlを利用できるかどうかです
+const restreamSupported = false
+
+// newRestreamerは、gstreamerタグを付けずにビルドした場合はエラーを返します
+func newRestreamer(session *lifecycle.Session, url string) (restreamer, error) {
+	return nil, errRestreamUnsupported
+}
@@ -8,11 +8,61 @@ let pc = new RTCPeerConnection({
   ]
 })
 
+// 制御用データチャネル(コマンド・チャットの送信とテレメトリの受信)
+// オファーに含めるため、オファーを作成する前に作成する
+let control = pc.createDataChannel('control')
+let commandID = 0
+control.onopen = () => log('control channel opened')
+control.onmessage = function (event) {
+  const msg = JSON.parse(event.data)
+  switch (msg.type) {
+    case 'telemetry':
+      document.getElementById('telemetry').textContent = JSON.stringify(msg.telemetry, null, 2)
+      break
+    case 'result':
+      log(msg.command + ': ' + (msg.error ? msg.error : 'ok'))
+      break
+    case 'chat':
+      log('chat: ' + msg.text)
+      break
+  }
+}
+
+// コマンドボタン押下時
+function SendCommand(command, file) {
+  if (control.readyState !== 'open') {
+    return alert('control channel is not open')
+  }
+  control.send(JSON.stringify({ type: 'command', id: ++commandID, command: command, file: file }))
+}
+
+// Select Layerボタン押下時
+function SelectLayer() {
+  if (control.readyState !== 'open') {
+    return alert('control channel is not open')
+  }
+  control.send(JSON.stringify({ type: 'command', id: ++commandID, command: 'select-layer', layer: document.getElementById('layer').value }))
+}
+
+// Send Chatボタン押下時
+function SendChat() {
+  if (control.readyState !== 'open') {
+    return alert('control channel is not open')
+  }
+  control.send(JSON.stringify({ type: 'chat', text: document.getElementById('chat').value }))
+}
+
 // WebRTCでサーバーへ映像を送信する
 sendVideoStream()
 
 // 接続状態を監視し、ロギングする
-pc.oniceconnectionstatechange = e => log(pc.iceConnectionState)
+// ICEがfailedになった場合は、ICEリスタートで再接続する
+pc.oniceconnectionstatechange = function () {
+  log(pc.iceConnectionState)
+  if (pc.iceConnectionState === 'failed') {
+    RestartICE()
+  }
+}
 
 // 接続先候補が見つ買った場合にlocalSessionDescriptionを記載するイベントハンドラを設定
 // SessionDescriptionとは、P2P接続に必要な情報をまとめたもの(IPやポートなどの情報)
@@ -34,6 +84,91 @@ pc.ontrack = function (event) {
   document.getElementById('remoteVideos').appendChild(el)
 }
 
+// WebSocketシグナリング(-signal-addr)用
+// 接続後は、トラックの追加やICEの再起動のたびにSessionDescriptionを自動で交換する
+// pionのロールバックはオファーで割り当てたmidなどを元に戻さないため、オファーが衝突した場合はブラウザ側(polite)が取り下げる
+let ws = null
+let makingOffer = false
+
+pc.onnegotiationneeded = async function () {
+  if (ws === null) {
+    return
+  }
+  try {
+    makingOffer = true
+    await pc.setLocalDescription()
+    await sendLocalDescription()
+  } catch (err) {
+    log(err)
+  } finally {
+    makingOffer = false
+  }
+}
+
+// ICE候補の収集が完了してからSessionDescriptionを送信する(Trickle ICEは利用しない)
+async function sendLocalDescription() {
+  if (pc.iceGatheringState !== 'complete') {
+    await new Promise(resolve => {
+      pc.addEventListener('icegatheringstatechange', function onChange() {
+        if (pc.iceGatheringState === 'complete') {
+          pc.removeEventListener('icegatheringstatechange', onChange)
+          resolve()
+        }
+      })
+    })
+  }
+  ws.send(JSON.stringify(pc.localDescription))
+}
+
+// Connectボタン押下時
+function Connect() {
+  ws = new WebSocket(document.getElementById('signalURL').value)
+  document.getElementById('connect').disabled = true
+
+  ws.onopen = async function () {
+    log('signaling connected')
+    // 接続前に作成したオファーを送信する
+    if (pc.signalingState === 'have-local-offer') {
+      await sendLocalDescription()
+    }
+  }
+  ws.onclose = () => log('signaling closed')
+
+  ws.onmessage = async function (event) {
+    const desc = JSON.parse(event.data)
+    const collision = desc.type === 'offer' && (makingOffer || pc.signalingState !== 'stable')
+    try {
+      if (collision) {
+        log('rollback the local offer')
+        await pc.setLocalDescription({ type: 'rollback' })
+      }
+      await pc.setRemoteDescription(desc)
+      if (desc.type === 'offer') {
+        await pc.setLocalDescription()
+        await sendLocalDescription()
+      }
+    } catch (err) {
+      log(err)
+    }
+  }
+}
+
+// Restart ICEボタン押下時
+// WebSocketシグナリングの場合は、onnegotiationneededでICEリスタートのオファーを送信する
+// それ以外の場合は、新しいufrag/pwdを持つオファーをBrowser base64 Session Descriptionに表示する
+async function RestartICE() {
+  log('restart ICE')
+  pc.restartIce()
+  if (ws !== null) {
+    return
+  }
+  try {
+    await pc.setLocalDescription(await pc.createOffer({ iceRestart: true }))
+  } catch (err) {
+    log(err)
+  }
+}
+
 // ログ出力用
 function log(msg) {
   document.getElementById('logs').innerHTML += msg + '<br>'
@@ -53,11 +188,24 @@ function displayVideo(video) {
 }
 
 async function sendVideoStream() {
-  stream = await navigator.mediaDevices.getUserMedia({ video: true, audio: false })
+  stream = await navigator.mediaDevices.getUserMedia({ video: true, audio: true })
 
   try {
     stream.getTracks().forEach(function(track) {
-      pc.addTrack(track, stream);
+      if (track.kind === 'video' && document.getElementById('simulcast').checked) {
+        // 解像度の異なる3つのレイヤーをサイマルキャストで送信する
+        pc.addTransceiver(track, {
+          direction: 'sendrecv',
+          streams: [stream],
+          sendEncodings: [
+            { rid: 'q', scaleResolutionDownBy: 4.0 },
+            { rid: 'h', scaleResolutionDownBy: 2.0 },
+            { rid: 'f' }
+          ]
+        })
+      } else {
+        pc.addTrack(track, stream);
+      }
     });
   } catch(err) {
     log(err)
@@ -94,6 +242,10 @@ async function AddDisplayCapture() {
   stream.getTracks().forEach(function(track) {
     pc.addTrack(track, displayVideo(stream));
   });
+  // WebSocketシグナリングの場合は、onnegotiationneededでオファーを送信する
+  if (ws !== null) {
+    return
+  }
   offer = await pc.createOffer()
   try{
     pc.setLocalDescription(offer)
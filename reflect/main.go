@@ -2,13 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
 	"runtime"
 	"time"
 
-	"github.com/pion/rtcp"
+	"github.com/pion/interceptor"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/transport/vnet"
 	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/control"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
 	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/simulcast"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/stats"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/turnserver"
 	"go.uber.org/zap"
 )
 
@@ -16,49 +30,77 @@ var iceConnectedCtx context.Context
 var iceConnectedCtxCancel context.CancelFunc
 var logger *zap.Logger
 
-func initReflect(peerConnection *webrtc.PeerConnection) (*webrtc.TrackLocalStaticRTP, *webrtc.RTPSender) {
-	// Create Track that we send video back to browser on
-	reflectTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "pion")
-	if err != nil {
-		panic(err)
-	}
+// simulatedNetは、テストで利用する仮想ネットワークです(nilの場合は実際のネットワークを利用する)
+var simulatedNet *vnet.Net
 
-	// Add this newly created track to the PeerConnection
-	reflectRtpSender, err := peerConnection.AddTrack(reflectTrack)
-	if err != nil {
-		panic(err)
+// transcodingConfigは、受信した映像を別のコーデックに変換して送り返す場合の設定です
+// gstreamerタグを付けてビルドした場合のみ利用できます(transcode.go)
+type transcodingConfig struct {
+	// codecは、変換先のコーデック(vp8、vp9、h264)。空の場合は変換せずに送り返す
+	codec string
+	// widthとheightは、変換後の解像度。0の場合は受信した解像度のまま
+	width  int
+	height int
+	// bitrateは、変換後の目標ビットレート(bps)。0の場合は受信側のREMBに従う
+	bitrate int
+}
+
+// transcodeMimeTypesは、-transcodeで指定できるコーデックのMIMEタイプです
+var transcodeMimeTypes = map[string]string{
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+	"h264": webrtc.MimeTypeH264,
+}
+
+// errTranscodeUnsupportedは、gstreamerタグを付けずにビルドしたため-transcodeを利用できないことを表します
+var errTranscodeUnsupported = errors.New("reflect was built without GStreamer, build it with -tags gstreamer to use -transcode")
+
+// validateは、-transcode-*の値を検証します
+func (c transcodingConfig) validate() error {
+	if c.codec == "" {
+		return nil
+	}
+	if _, ok := transcodeMimeTypes[c.codec]; !ok {
+		return fmt.Errorf("unsupported codec %q", c.codec)
+	}
+	if c.width < 0 || c.height < 0 || (c.width == 0) != (c.height == 0) {
+		return fmt.Errorf("invalid resolution %dx%d", c.width, c.height)
+	}
+	if c.bitrate < 0 {
+		return fmt.Errorf("invalid bitrate %d", c.bitrate)
 	}
-	return reflectTrack, reflectRtpSender
+	return nil
 }
 
-// リモートから送られたRTPをそのまま送り返す
-func reflect(peerConnection *webrtc.PeerConnection, outputTrack *webrtc.TrackLocalStaticRTP, rtpSender *webrtc.RTPSender) {
-	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-		// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
-		go func() {
-			ticker := time.NewTicker(time.Second * 3)
-			for range ticker.C {
-				errSend := peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-				if errSend != nil {
-					fmt.Println(errSend)
-				}
-			}
-		}()
-
-		fmt.Printf("Track has started, of type %d: %s \n", track.PayloadType(), track.Codec().MimeType)
-		for {
-			// Read RTP packets being sent to Pion
-			rtp, _, readErr := track.ReadRTP()
-			if readErr != nil {
-				panic(readErr)
-			}
-
-			if writeErr := outputTrack.WriteRTP(rtp); writeErr != nil {
-				panic(writeErr)
-			}
+// newAPIは、サイマルキャストの受信に必要なRTPヘッダ拡張と、統計情報を収集するインターセプターを登録したAPIを生成します
+// netInterceptorがnilでなければ、送受信するRTP・RTCPパケットにパケットロス・遅延などを加えます
+func newAPI(statsInterceptor *stats.Interceptor, netInterceptor *netsim.Interceptor, loggerFactory *logging.LoggerFactory) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	// RIDでレイヤーを識別するために必要
+	for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
 		}
-	})
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	// ネットワークに最も近い位置でパケットを落とす・遅らせるため、最初に登録する
+	if netInterceptor != nil {
+		interceptorRegistry.Add(netInterceptor)
+	}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(statsInterceptor)
+
+	settingEngine := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	if simulatedNet != nil {
+		settingEngine.SetVNet(simulatedNet)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(settingEngine)), nil
 }
 
 func init() {
@@ -67,80 +109,256 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func main() {
-	logger, _ = zap.NewDevelopment()
-	iceConnectedCtx, iceConnectedCtxCancel = context.WithCancel(context.Background())
+// sessionConfigは、runSessionに渡すセッションの設定です
+type sessionConfig struct {
+	webrtcConfig      webrtc.Configuration
+	collector         *stats.Collector
+	logConfig         *logging.Config
+	channel           signal.Channel
+	lifecycleConfig   *lifecycle.Config
+	negotiationConfig *negotiation.Config
+	netConfig         *netsim.Config
+	transcodeConfig   *transcodingConfig
+	simulcastConfig   *simulcast.Config
+}
 
-	logger.Info("Reflect !")
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+// runSessionは、オファーを1つ受け付けてセッションが終了するまでブロックします
+func runSession(ctx context.Context, c sessionConfig) (lifecycle.Reason, error) {
+	// (オファー) Remote Session Descriptionをシグナリングチャネルから読み込む
+	offer, err := c.channel.Recv(ctx)
+	for errors.Is(err, signal.ErrInvalidSessionDescription) {
+		logger.Warn("Invalid session description", zap.Error(err))
+		offer, err = c.channel.Recv(ctx)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return lifecycle.ReasonSignal, nil
+		}
+		return lifecycle.ReasonError, fmt.Errorf("failed to receive an offer: %w", err)
 	}
 
+	session := lifecycle.NewSession(ctx, logger)
+	// 以降はセッションIDを持つロガーを利用する
+	logger := session.Logger()
+	fail := func(err error) (lifecycle.Reason, error) {
+		session.Stop(lifecycle.ReasonError, err)
+		return session.Wait()
+	}
+	iceConnectedCtx, iceConnectedCtxCancel = context.WithCancel(session.Context())
+
 	// Create a new RTCPeerConnection
-	logger.Info("NewPeerConnection")
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	logger.Info("Creating PeerConnection")
+	statsInterceptor := stats.NewInterceptor()
+	// pionのログ(ICE、DTLSなど)もセッションのロガーに出力する
+	loggerFactory, err := logging.NewLoggerFactory(logger, *c.logConfig)
+	if err != nil {
+		return fail(err)
+	}
+	// -net-*が指定されていれば、送受信するRTP・RTCPパケットにパケットロス・遅延などを加える
+	var netInterceptor *netsim.Interceptor
+	if c.netConfig.Enabled() {
+		netInterceptor = netsim.NewInterceptor(*c.netConfig)
+		logger.Info("Simulating network impairment", zap.Float64("loss", c.netConfig.Loss), zap.Duration("delay", c.netConfig.Delay), zap.Duration("jitter", c.netConfig.Jitter),
+			zap.Float64("reorder", c.netConfig.Reorder), zap.Int("bandwidth", c.netConfig.Bandwidth))
+		session.OnClose("NetworkSimulation", func() error {
+			outbound, inbound := netInterceptor.Stats()
+			logger.Info("Network impairment statistics", zap.Uint64("outboundSent", outbound.Sent), zap.Uint64("outboundDropped", outbound.Dropped),
+				zap.Uint64("inboundSent", inbound.Sent), zap.Uint64("inboundDropped", inbound.Dropped))
+			return nil
+		})
+	}
+	api, err := newAPI(statsInterceptor, netInterceptor, loggerFactory)
 	if err != nil {
-		panic(err)
+		return fail(err)
 	}
+	peerConnection, err := api.NewPeerConnection(c.webrtcConfig)
+	if err != nil {
+		return fail(err)
+	}
+	// Gracefully shutdown the peer connection
+	session.OnClose("PeerConnection", peerConnection.Close)
+
+	// セッションの統計情報を収集する
+	c.collector.Add(session.ID(), peerConnection, statsInterceptor)
+	defer c.collector.Remove(session.ID())
+
+	// シグナリングチャネルでオファー・アンサーを交換する
+	negotiator := negotiation.New(peerConnection, *c.negotiationConfig, c.channel, logger)
 
 	// 候補先情報を受信した場合にそれを表示する
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		logger.Info("OnICECandidate")
 		if candidate == nil {
-			logger.Info("No candidate")
+			logger.Debug("ICE gathering has completed")
 			return
 		}
-		logger.Info(fmt.Sprintf("Address: %s, Port: %d", candidate.Address, candidate.Port))
+		logger.Debug("ICE candidate has been gathered", zap.String("address", candidate.Address), zap.Uint16("port", candidate.Port))
 	})
 
 	// 接続状態変更を検知した際に起動するイベントハンドラを設定する
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		logger.Info("ICE connection state has changed", zap.Stringer("state", connectionState))
+		negotiator.ICEConnectionStateChange(connectionState)
 		// 接続が成功したことをcontextに伝える
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			iceConnectedCtxCancel()
 		}
 	})
 
-	// 送信するメディアを設定する
-	// videoTrack, rtpSenderは、メディアを送信する際に利用する
-	// ※ Local Session Descriptionを生成する前に実行する必要がある
-	reflectTrack, reflectRtpSender := initReflect(peerConnection)
+	// 切断・失敗・クローズを検知したらセッションを終了する
+	session.WatchPeerConnection(peerConnection, c.lifecycleConfig.DisconnectedTimeout, c.lifecycleConfig.FailedTimeout, func(state webrtc.PeerConnectionState) {
+		logger.Info("Peer connection state has changed", zap.Stringer("state", state))
+	})
 
-	// (オファー) Remote Session DescriptionをpeerConnectionに設定する
-	offer := webrtc.SessionDescription{}
-	signal.Decode(signal.MustReadStdin(), &offer)
-	err = peerConnection.SetRemoteDescription(offer)
-	if err != nil {
-		panic(err)
+	// 受信したトラックごとに送信トラックを作成して送り返す
+	// -transcodeが指定されていれば、映像は変換してから送り返す
+	reflector := newReflector(session, peerConnection, *c.transcodeConfig, *c.simulcastConfig)
+	// オファーで追加されたトラック(再ネゴシエーションを含む)に、アンサーの生成前に送信トラックを作成する
+	negotiator.OnBeforeAnswer(reflector.addOutputTracks)
+
+	// 制御用データチャネルを受け付ける
+	controller := control.New(peerConnection, logger)
+	controller.Handle(control.CommandRequestKeyFrame, func(control.Message) error {
+		return reflector.requestKeyFrames()
+	})
+	controller.Handle(control.CommandSelectLayer, func(msg control.Message) error {
+		return reflector.selectLayer(msg.Layer)
+	})
+	controller.SetStatus(reflector.status)
+	peerConnection.OnDataChannel(controller.Accept)
+	session.Go(func() { controller.Run(session.Context()) })
+
+	// (オファー)を適用し、(アンサー) Local Session Descriptionをシグナリングチャネルへ送信する
+	if err = negotiator.HandleRemoteDescription(offer); err != nil {
+		return fail(err)
 	}
+	// 2回目以降のオファー・アンサー(再ネゴシエーション、ICEリスタート)を受け付ける
+	session.Go(func() { negotiator.Run(session.Context()) })
 
-	// (アンサー) Local Session Descriptionを生成する
-	answer, err := peerConnection.CreateAnswer(nil)
-	if err != nil {
-		panic(err)
+	return session.Wait()
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// runは、セッションを実行し、終了理由に応じた終了コードを返します
+func run() int {
+	turnConfig := turnserver.Flags()
+	lifecycleConfig := lifecycle.Flags()
+	negotiationConfig := negotiation.Flags()
+	signalConfig := signal.Flags()
+	statsConfig := stats.Flags()
+	logConfig := logging.Flags()
+	netConfig := netsim.Flags()
+	simulcastConfig := simulcast.Flags()
+	transcodeConfig := &transcodingConfig{}
+	flag.StringVar(&transcodeConfig.codec, "transcode", "", "codec to transcode the reflected video to: vp8, vp9 or h264 (reflected as received when empty, requires -tags gstreamer)")
+	flag.IntVar(&transcodeConfig.width, "transcode-width", 0, "width of the transcoded video (the received size when 0)")
+	flag.IntVar(&transcodeConfig.height, "transcode-height", 0, "height of the transcoded video (the received size when 0)")
+	flag.IntVar(&transcodeConfig.bitrate, "transcode-bitrate", 0, "target bitrate of the transcoded video in bits per second (follows the REMB of the receiver when 0)")
+	flag.Parse()
+
+	var err error
+	if logger, err = logging.New(*logConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logger.Sync()
+
+	if err := netConfig.Validate(); err != nil {
+		logger.Error("Invalid network impairment", zap.Error(err))
+		return 2
+	}
+	if err := negotiationConfig.Validate(lifecycleConfig.DisconnectedTimeout); err != nil {
+		logger.Error("Invalid ICE restart", zap.Error(err))
+		return 2
+	}
+	if err := transcodeConfig.validate(); err != nil {
+		logger.Error("Invalid transcoding", zap.Error(err))
+		return 2
 	}
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
+	if transcodeConfig.codec != "" && !transcodeSupported {
+		logger.Error("Transcoding is not supported", zap.Error(errTranscodeUnsupported))
+		return 2
+	}
+
+	logger.Info("Reflect !")
+
+	// SIGINT/SIGTERMを受け取ったらキャンセルされる
+	ctx, cancel := lifecycle.SignalContext(context.Background())
+	defer cancel()
+
+	// Prepare the configuration
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+
+	// 組み込みのTurnサーバーを起動し、ICEServersに追加する
+	if turnConfig.Enabled {
+		turnServer, err := turnserver.Start(*turnConfig)
+		if err != nil {
+			logger.Error("Failed to start the TURN server", zap.Error(err))
+			return lifecycle.ReasonError.ExitCode()
+		}
+		defer turnServer.Close()
+		turnServer.Apply(&config)
+		logger.Info("TURN server started", zap.String("publicIP", turnConfig.PublicIP), zap.Int("port", turnConfig.Port))
+	}
+
+	// 統計情報を収集し、-stats-addrが指定されていれば/metrics、/statsで公開する
+	collector, err := stats.Start(ctx, *statsConfig)
 	if err != nil {
-		panic(err)
+		logger.Error("Failed to start the stats server", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+	if statsConfig.Addr != "" {
+		logger.Info("Stats server started", zap.String("url", fmt.Sprintf("http://%s/metrics", statsConfig.Addr)))
 	}
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
 
-	// Output the answer in base64 so we can paste it in browser
-	fmt.Printf("Answer Session Description: \n%s", signal.Encode(*peerConnection.LocalDescription()))
+	// オファー・アンサーを交換するシグナリングチャネル(標準入出力またはWebSocket)を準備する
+	channel, err := signal.NewChannel(*signalConfig)
+	if err != nil {
+		logger.Error("Failed to prepare the signaling channel", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+	if signalConfig.Addr != "" {
+		logger.Info("WebSocket signaling server started", zap.String("url", fmt.Sprintf("ws://%s/ws", signalConfig.Addr)))
+	}
 
-	go reflect(peerConnection, reflectTrack, reflectRtpSender)
+	var backoff lifecycle.Backoff
+	for {
+		started := time.Now()
+		reason, err := runSession(ctx, sessionConfig{
+			webrtcConfig:      config,
+			collector:         collector,
+			logConfig:         logConfig,
+			channel:           channel,
+			lifecycleConfig:   lifecycleConfig,
+			negotiationConfig: negotiationConfig,
+			netConfig:         netConfig,
+			transcodeConfig:   transcodeConfig,
+			simulcastConfig:   simulcastConfig,
+		})
+		if err != nil {
+			logger.Error("Session has ended with error", zap.Stringer("reason", reason), zap.Error(err))
+		} else {
+			logger.Info("Session has ended", zap.Stringer("reason", reason))
+		}
 
-	select {}
+		// 自動再起動が有効な場合は、新しいオファーを待つ
+		// シグナリングチャネルが閉じられた場合(標準入力のEOFなど)は、新しいオファーを受け取れないため終了する
+		if !lifecycleConfig.AutoRestart || reason == lifecycle.ReasonSignal || ctx.Err() != nil || errors.Is(err, io.EOF) {
+			return reason.ExitCode()
+		}
+		// すぐに終了するセッションを繰り返さないように、間隔を空けてから再起動する
+		delay := backoff.Next(time.Since(started))
+		logger.Info("Waiting for a new offer", zap.Duration("delay", delay))
+		if !lifecycle.Sleep(ctx, delay) {
+			return lifecycle.ReasonSignal.ExitCode()
+		}
+	}
 }
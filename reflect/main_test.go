@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/loopback"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/simulcast"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/stats"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+	"go.uber.org/zap"
+)
+
+// TestLoopbackは、仮想ネットワーク上のオファー側から送信したVP8のフレームが、
+// 送信した順序・内容のまま送り返されることを確認します
+func TestLoopback(t *testing.T) {
+	reflectFrames(t, &netsim.Config{}, netsim.Config{})
+}
+
+// TestLoopbackDelayは、-net-delayの遅延が送り返されるまでの時間に加わることを確認します
+// reflectは受信と送信の両方に遅延を加えるため、往復で2倍の遅延になる
+func TestLoopbackDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	for i, latency := range reflectFrames(t, &netsim.Config{Delay: delay}, netsim.Config{}) {
+		if latency < 2*delay {
+			t.Errorf("frame %d has been reflected in %s, want at least %s", i, latency, 2*delay)
+		}
+	}
+}
+
+// TestLoopbackImpairedNetworkは、仮想ネットワーク自体に遅延とジッターを加えても接続でき、
+// 往復の遅延が加わったフレームが送り返されることを確認します
+// インターセプターと異なり、ICE・DTLSのパケットも遅延する
+// (パケットロスはNACKの再送を起こし、このバージョンのpion/interceptorの再送バッファは-raceで競合を検出するため、internal/loopbackで確認する)
+func TestLoopbackImpairedNetwork(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	for i, latency := range reflectFrames(t, &netsim.Config{}, netsim.Config{Delay: delay, Jitter: 10 * time.Millisecond, Seed: 1}) {
+		if latency < 2*delay {
+			t.Errorf("frame %d has been reflected in %s, want at least %s", i, latency, 2*delay)
+		}
+	}
+}
+
+// reflectFramesは、VP8のフレームを送信して送り返されたフレームを確認し、
+// netConfigはreflectのインターセプター、simulatedConfigは仮想ネットワークに加える劣化です
+// 送信してから送り返されるまでの時間を返します
+func reflectFrames(t *testing.T, netConfig *netsim.Config, simulatedConfig netsim.Config) []time.Duration {
+	logger = zap.NewNop()
+	l, err := loopback.NewImpaired(logger, simulatedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	simulatedNet = l.Net
+	defer func() { simulatedNet = nil }()
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "loopback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Offerer.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	// 1フレームを1つのRTPパケットで送り返すため、パケットのペイロードをフレームとして扱える
+	reflected := make(chan []byte, 100)
+	l.Offerer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			vp8Packet := &codecs.VP8Packet{}
+			frame, err := vp8Packet.Unmarshal(packet.Payload)
+			if err != nil {
+				return
+			}
+			select {
+			case reflected <- frame:
+			default:
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	type result struct {
+		reason lifecycle.Reason
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reason, err := runSession(sessionCtx, sessionConfig{
+			collector:         stats.NewCollector(time.Second),
+			logConfig:         &logging.Config{PionLevel: "warn"},
+			channel:           l.Channel,
+			lifecycleConfig:   &lifecycle.Config{DisconnectedTimeout: 5 * time.Second},
+			negotiationConfig: &negotiation.Config{},
+			netConfig:         netConfig,
+			transcodeConfig:   &transcodingConfig{},
+			simulcastConfig:   &simulcast.Config{},
+		})
+		done <- result{reason, err}
+	}()
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 送信したフレームの番号と時刻を、フレームの内容から引けるようにする
+	type sentFrame struct {
+		n  int
+		at time.Time
+	}
+	var mu sync.Mutex
+	sent := map[string]sentFrame{}
+	video, err := testsrc.NewVideo(testsrc.Config{Width: 64, Height: 48, FrameRate: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			frame, err := video.Next(time.Now())
+			if err != nil {
+				return
+			}
+			// 小さい映像では時刻がほとんど表示されず同じフレームが続くため、末尾に番号を付けて区別する
+			// reflectはフレームをデコードしないため、末尾のデータは影響しない
+			frame = append(frame, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+			mu.Lock()
+			sent[string(frame)] = sentFrame{n: i, at: time.Now()}
+			mu.Unlock()
+			if err := track.WriteSample(media.Sample{Data: frame, Duration: 33 * time.Millisecond}); err != nil {
+				return
+			}
+		}
+	}()
+
+	var latencies []time.Duration
+	last := -1
+	for i := 0; i < 20; i++ {
+		select {
+		case frame := <-reflected:
+			now := time.Now()
+			mu.Lock()
+			s, ok := sent[string(frame)]
+			mu.Unlock()
+			if !ok {
+				t.Fatalf("reflected frame %d is not a sent frame", i)
+			}
+			if s.n <= last {
+				t.Fatalf("reflected frame %d is sent frame %d, after sent frame %d", i, s.n, last)
+			}
+			last = s.n
+			latencies = append(latencies, now.Sub(s.at))
+		case r := <-done:
+			t.Fatalf("session ended early: %s %v", r.reason, r.err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d frames have been reflected, want 20", i)
+		}
+	}
+
+	stopSession()
+	if r := <-done; r.err != nil {
+		t.Fatalf("session ended with an error: %s %v", r.reason, r.err)
+	}
+	return latencies
+}
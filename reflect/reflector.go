@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/simulcast"
+	"go.uber.org/zap"
+)
+
+// transcoderは、受信したRTPをデコードし、別のコーデックにエンコードして送信トラックに書き込みます
+type transcoder interface {
+	// WriteRTPは、受信したRTPパケットをデコーダーに渡します
+	WriteRTP(packet *rtp.Packet) error
+	// RequestKeyFrameは、エンコーダーにキーフレームを要求します
+	RequestKeyFrame()
+	// SetEstimatedBitrateは、受信側が推定した帯域(REMB)をエンコーダーに伝えます
+	SetEstimatedBitrate(bitrate uint64)
+	Close() error
+}
+
+// reflectOutputは、受信トラック1つに対応する送信トラックです
+// 変換して送り返す場合はsampleTrackとtranscoderを、そのまま送り返す場合はtrackとforwarderを利用します
+type reflectOutput struct {
+	track     *webrtc.TrackLocalStaticRTP
+	sender    *webrtc.RTPSender
+	forwarder *simulcast.Forwarder
+
+	sampleTrack *webrtc.TrackLocalStaticSample
+	// transcoderは、最初のトラックを受信した時点で、そのコーデックに合わせて作成する
+	transcoder transcoder
+	// sourceMimeTypeは、変換する前のコーデックです
+	sourceMimeType string
+}
+
+// mimeTypeは、送り返すコーデックを返します
+func (o *reflectOutput) mimeType() string {
+	if o.sampleTrack != nil {
+		return o.sampleTrack.Codec().MimeType
+	}
+	return o.track.Codec().MimeType
+}
+
+// reflectorは、受信したトラックごとに同じコーデックの送信トラックを作成し、RTPを送り返します
+type reflector struct {
+	session        *lifecycle.Session
+	peerConnection *webrtc.PeerConnection
+	// transcodeConfig.codecが空でなければ、映像を変換して送り返す
+	transcodeConfig transcodingConfig
+	// simulcastConfig.Layerが空でなければ、映像はそのレイヤーを送り返す
+	simulcastConfig simulcast.Config
+
+	mu sync.Mutex
+	// 送信トラックはトランシーバーのmidで管理する
+	outputs map[string]*reflectOutput
+}
+
+func newReflector(session *lifecycle.Session, peerConnection *webrtc.PeerConnection, transcodeConfig transcodingConfig, simulcastConfig simulcast.Config) *reflector {
+	r := &reflector{
+		session:         session,
+		peerConnection:  peerConnection,
+		transcodeConfig: transcodeConfig,
+		simulcastConfig: simulcastConfig,
+		outputs:         map[string]*reflectOutput{},
+	}
+	peerConnection.OnTrack(r.onTrack)
+	return r
+}
+
+// addOutputTracksは、送信トラックを持たない受信トランシーバーに送信トラックを追加します
+// ※ Remote Session Descriptionを設定した後、Local Session Descriptionを生成する前に実行する必要がある
+func (r *reflector) addOutputTracks() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msids := remoteMSIDs(r.peerConnection.RemoteDescription())
+	for _, transceiver := range r.peerConnection.GetTransceivers() {
+		mid := transceiver.Mid()
+		if mid == "" || transceiver.Sender() != nil || transceiver.Receiver() == nil {
+			continue
+		}
+		if _, ok := r.outputs[mid]; ok {
+			continue
+		}
+
+		// ネゴシエーションされたコーデックのうち、最も優先度の高いものを利用する
+		codecs := transceiver.Receiver().GetParameters().Codecs
+		if len(codecs) == 0 {
+			continue
+		}
+
+		streamID, trackID := "pion", fmt.Sprintf("%s-%s", transceiver.Kind(), mid)
+		if msid, ok := msids[mid]; ok {
+			streamID, trackID = "reflect-"+msid[0], msid[1]
+		}
+
+		if r.transcodeConfig.codec != "" && transceiver.Kind() == webrtc.RTPCodecTypeVideo {
+			transcoded, err := r.addTranscodedTrack(mid, codecs, trackID, streamID)
+			if err != nil {
+				return err
+			}
+			if transcoded {
+				continue
+			}
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(codecs[0].RTPCodecCapability, trackID, streamID)
+		if err != nil {
+			return err
+		}
+
+		// AddTrackは、同じ種類で送信トラックを持たない最初のトランシーバーに送信トラックを設定する
+		sender, err := r.peerConnection.AddTrack(track)
+		if err != nil {
+			return err
+		}
+		output := &reflectOutput{track: track, sender: sender}
+		output.forwarder = r.newForwarder(track, transceiver.Kind())
+		r.outputs[senderMid(r.peerConnection, sender, mid)] = output
+
+		r.session.Logger().Info("Reflect track added", zap.String("track", track.ID()), zap.String("mimeType", track.Codec().MimeType), zap.String("mid", mid))
+		r.readRTCP(output)
+		r.session.Go(func() { output.forwarder.Run(r.session.Context()) })
+	}
+	return nil
+}
+
+// addTranscodedTrackは、-transcodeのコーデックで送り返す送信トラックを追加します
+// オファーに変換先のコーデックがない場合は、追加せずにfalseを返します
+// ※ r.muを取得した状態で呼び出す
+func (r *reflector) addTranscodedTrack(mid string, codecs []webrtc.RTPCodecParameters, trackID, streamID string) (bool, error) {
+	mimeType := transcodeMimeTypes[r.transcodeConfig.codec]
+	offered := false
+	for _, codec := range codecs {
+		if strings.EqualFold(codec.MimeType, mimeType) {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		r.session.Logger().Warn("The transcoded codec is not offered, reflecting without transcoding", zap.String("mimeType", mimeType), zap.String("mid", mid))
+		return false, nil
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, trackID, streamID)
+	if err != nil {
+		return false, err
+	}
+	sender, err := r.peerConnection.AddTrack(track)
+	if err != nil {
+		return false, err
+	}
+	output := &reflectOutput{sampleTrack: track, sender: sender}
+	r.outputs[senderMid(r.peerConnection, sender, mid)] = output
+
+	r.session.Logger().Info("Transcoded reflect track added", zap.String("track", track.ID()), zap.String("mimeType", mimeType), zap.String("mid", mid))
+	r.readRTCP(output)
+	return true, nil
+}
+
+// newForwarderは、送信トラックに選択したレイヤーを書き込むforwarderを作成します
+func (r *reflector) newForwarder(track *webrtc.TrackLocalStaticRTP, kind webrtc.RTPCodecType) *simulcast.Forwarder {
+	forwarder := simulcast.NewForwarder(track, r.requestKeyFrame)
+	if r.simulcastConfig.Layer != "" && kind == webrtc.RTPCodecTypeVideo {
+		// 指定されたレイヤーがまだ届いていない場合は、届いた時点で切り替わる
+		_ = forwarder.SelectLayer(r.simulcastConfig.Layer)
+	}
+	return forwarder
+}
+
+// readRTCPは、送り返したメディアに対するRTCPを読み取り、キーフレーム要求と帯域推定をforwarderまたはtranscoderに伝えます
+func (r *reflector) readRTCP(output *reflectOutput) {
+	go func() {
+		for {
+			rtcpPackets, _, rtcpErr := output.sender.ReadRTCP()
+			if rtcpErr != nil {
+				return
+			}
+			forwarder, transcoder := r.targets(output)
+			for _, p := range rtcpPackets {
+				switch packet := p.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					if transcoder != nil {
+						transcoder.RequestKeyFrame()
+					} else if forwarder != nil {
+						forwarder.RequestKeyFrame()
+					}
+				case *rtcp.ReceiverEstimatedMaximumBitrate:
+					if transcoder != nil {
+						transcoder.SetEstimatedBitrate(packet.Bitrate)
+					} else if forwarder != nil {
+						forwarder.SetEstimatedBitrate(packet.Bitrate)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// targetsは、送信トラックに書き込んでいるforwarderとtranscoderを返します
+// どちらも差し替え・作成されるため、r.muを取得して読み込む
+func (r *reflector) targets(output *reflectOutput) (*simulcast.Forwarder, transcoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return output.forwarder, output.transcoder
+}
+
+func (r *reflector) requestKeyFrame(ssrc webrtc.SSRC) {
+	if rtcpErr := r.peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); rtcpErr != nil {
+		r.session.Logger().Warn("Failed to send PLI", zap.Uint32("ssrc", uint32(ssrc)), zap.Error(rtcpErr))
+	}
+}
+
+// requestKeyFramesは、全ての送信トラックについて、送り返しているレイヤーのキーフレームを要求します
+func (r *reflector) requestKeyFrames() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.outputs) == 0 {
+		return errors.New("no track is reflected")
+	}
+	for _, output := range r.outputs {
+		switch {
+		case output.transcoder != nil:
+			output.transcoder.RequestKeyFrame()
+		case output.forwarder != nil:
+			output.forwarder.RequestKeyFrame()
+		}
+	}
+	return nil
+}
+
+// selectLayerは、そのまま送り返している映像トラックのレイヤーをRIDのレイヤーに切り替えます
+// RIDが空の場合は、推定帯域に応じた自動選択に戻す。以降に追加される映像トラックも同じレイヤーを送り返す
+func (r *reflector) selectLayer(rid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.simulcastConfig.Layer = rid
+	found := false
+	for _, output := range r.outputs {
+		if output.forwarder == nil || output.track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		found = true
+		if err := output.forwarder.SelectLayer(rid); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return errors.New("no video track is reflected without transcoding")
+	}
+	return nil
+}
+
+// statusは、送信トラックごとに送り返しているレイヤーを返します(テレメトリ用)
+func (r *reflector) status() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tracks := map[string]interface{}{}
+	for mid, output := range r.outputs {
+		if output.sampleTrack != nil {
+			tracks[mid] = map[string]interface{}{
+				"mimeType":       output.mimeType(),
+				"transcodedFrom": output.sourceMimeType,
+			}
+			continue
+		}
+		tracks[mid] = map[string]interface{}{
+			"mimeType": output.mimeType(),
+			"layer":    output.forwarder.CurrentLayer(),
+			"layers":   output.forwarder.Layers(),
+		}
+	}
+	return map[string]interface{}{"tracks": tracks}
+}
+
+// outputForは、受信トラックに対応する送信トラックを返します
+// 送信側が実際に利用したコーデックが送信トラックと異なる場合は、同じコーデックのトラックに差し替えます
+func (r *reflector) outputFor(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) (*reflectOutput, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var output *reflectOutput
+	for _, transceiver := range r.peerConnection.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			output = r.outputs[transceiver.Mid()]
+			break
+		}
+	}
+	if output == nil {
+		return nil, fmt.Errorf("no reflect track for %s", track.Codec().MimeType)
+	}
+
+	// 変換する場合は、受信したコーデックに合わせてtranscoderを作成する
+	if output.sampleTrack != nil {
+		if output.transcoder != nil {
+			return nil, fmt.Errorf("only one simulcast layer can be transcoded, %s is already transcoded", output.sourceMimeType)
+		}
+		transcoder, err := newTranscoder(r.session, output.sampleTrack, track.Codec(), r.transcodeConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.session.OnClose("Transcoder", transcoder.Close)
+		output.transcoder = transcoder
+		output.sourceMimeType = track.Codec().MimeType
+		return output, nil
+	}
+
+	if !strings.EqualFold(output.track.Codec().MimeType, track.Codec().MimeType) {
+		replaced, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, output.track.ID(), output.track.StreamID())
+		if err != nil {
+			return nil, err
+		}
+		if err := output.sender.ReplaceTrack(replaced); err != nil {
+			return nil, err
+		}
+		r.session.Logger().Info("Reflect track replaced", zap.String("track", replaced.ID()), zap.String("from", output.track.Codec().MimeType), zap.String("to", replaced.Codec().MimeType))
+		output.track = replaced
+		output.forwarder = r.newForwarder(replaced, track.Kind())
+		r.session.Go(func() { output.forwarder.Run(r.session.Context()) })
+	}
+	return output, nil
+}
+
+// リモートから送られたRTPをそのまま送り返す
+// サイマルキャストの場合は、forwarderが選択したレイヤーのみを送り返す
+func (r *reflector) onTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	logger := r.session.Logger().With(zap.String("track", track.ID()), zap.String("mimeType", track.Codec().MimeType), zap.String("rid", track.RID()))
+	output, err := r.outputFor(track, receiver)
+	if err != nil {
+		logger.Warn("Failed to reflect track", zap.Error(err))
+		return
+	}
+	// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+	// This is a temporary fix until we implement incoming RTCP events, then we would push a PLI only when a viewer requests it
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		go func() {
+			ticker := time.NewTicker(time.Second * 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-r.session.Context().Done():
+					return
+				case <-ticker.C:
+				}
+				r.requestKeyFrame(track.SSRC())
+			}
+		}()
+	}
+
+	if output.transcoder != nil {
+		r.transcode(track, output.transcoder)
+		return
+	}
+
+	// サイマルキャストでない場合、RIDは空文字になる
+	forwarder := output.forwarder
+	rid := track.RID()
+	forwarder.AddLayer(rid, track.SSRC())
+	defer forwarder.RemoveLayer(rid)
+
+	logger.Info("Track has started", zap.Uint8("payloadType", uint8(track.PayloadType())))
+	for {
+		// Read RTP packets being sent to Pion
+		rtp, _, readErr := track.ReadRTP()
+		if readErr != nil {
+			// セッション終了に伴うエラーは無視する
+			if readErr != io.EOF && r.session.Context().Err() == nil {
+				r.session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read RTP: %w", readErr))
+			}
+			return
+		}
+
+		if writeErr := forwarder.WriteRTP(rid, rtp); writeErr != nil && writeErr != io.ErrClosedPipe {
+			r.session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to write RTP: %w", writeErr))
+			return
+		}
+	}
+}
+
+// transcodeは、受信したRTPをtranscoderに渡します
+// デコーダーが復帰できるように、onTrackで定期的にキーフレームを要求している
+func (r *reflector) transcode(track *webrtc.TrackRemote, transcoder transcoder) {
+	r.session.Logger().Info("Track has started", zap.String("track", track.ID()), zap.String("mimeType", track.Codec().MimeType), zap.Uint8("payloadType", uint8(track.PayloadType())))
+	for {
+		rtp, _, readErr := track.ReadRTP()
+		if readErr != nil {
+			// セッション終了に伴うエラーは無視する
+			if readErr != io.EOF && r.session.Context().Err() == nil {
+				r.session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read RTP: %w", readErr))
+			}
+			return
+		}
+		if writeErr := transcoder.WriteRTP(rtp); writeErr != nil {
+			// セッションの終了時はパイプラインが先に破棄される
+			if r.session.Context().Err() == nil {
+				r.session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to transcode RTP: %w", writeErr))
+			}
+			return
+		}
+	}
+}
+
+// senderMidは、送信トラックが設定されたトランシーバーのmidを返します
+func senderMid(peerConnection *webrtc.PeerConnection, sender *webrtc.RTPSender, fallback string) string {
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Sender() == sender && transceiver.Mid() != "" {
+			return transceiver.Mid()
+		}
+	}
+	return fallback
+}
+
+// remoteMSIDsは、Remote Session Descriptionのmidごとのmsid(ストリームID, トラックID)を返します
+func remoteMSIDs(desc *webrtc.SessionDescription) map[string][2]string {
+	msids := map[string][2]string{}
+	if desc == nil {
+		return msids
+	}
+	// desc.Unmarshalは解析結果をdescに書き込み、PeerConnectionの処理と競合するため、SDPを直接解析する
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		return msids
+	}
+	for _, media := range parsed.MediaDescriptions {
+		mid, ok := media.Attribute("mid")
+		if !ok {
+			continue
+		}
+		msid, ok := media.Attribute("msid")
+		if !ok {
+			continue
+		}
+		if fields := strings.Fields(msid); len(fields) == 2 {
+			msids[mid] = [2]string{fields[0], fields[1]}
+		}
+	}
+	return msids
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/simulcast"
+	"go.uber.org/zap"
+)
+
+// reflectedTrackは、オファー側が受信した送り返されたトラックです
+type reflectedTrack struct {
+	id       string
+	mimeType string
+	// tagは、最初の10パケットのペイロードの先頭のタグです。異なるタグが混ざっていれば0
+	tag byte
+}
+
+// reflectPeersは、仮想ネットワークでつながったオファー側と、reflectorを動かす応答側のPeerConnectionです
+type reflectPeers struct {
+	offerer  *webrtc.PeerConnection
+	answerer *webrtc.PeerConnection
+	// channelは、応答側のNegotiatorとつながったオファー側のシグナリングチャネルです
+	channel signal.Channel
+	// reflectedは、オファー側が受信した送り返されたトラックです
+	reflected chan reflectedTrack
+}
+
+// newReflectPeersは、応答側でreflectorとNegotiatorを動かし、オファー側で送り返されたトラックを待ち受けます
+func newReflectPeers(t *testing.T, session *lifecycle.Session) *reflectPeers {
+	t.Helper()
+	logger = zap.NewNop()
+	router, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "10.0.0.0/24", LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var settingEngines []webrtc.SettingEngine
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		vnetNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err := router.AddNet(vnetNet); err != nil {
+			t.Fatal(err)
+		}
+		settingEngine := webrtc.SettingEngine{}
+		settingEngine.SetVNet(vnetNet)
+		settingEngines = append(settingEngines, settingEngine)
+	}
+	if err := router.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = router.Stop() })
+
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	offerer, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngines[0])).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = offerer.Close() })
+	mediaEngine = &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	answerer, err := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngines[1])).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = answerer.Close() })
+
+	channel, answererChannel := signal.NewPipe()
+	p := &reflectPeers{
+		offerer:   offerer,
+		answerer:  answerer,
+		channel:   channel,
+		reflected: make(chan reflectedTrack, 10),
+	}
+	negotiator := negotiation.New(answerer, negotiation.Config{}, answererChannel, logger)
+	negotiator.OnBeforeAnswer(newReflector(session, answerer, transcodingConfig{}, simulcast.Config{}).addOutputTracks)
+	session.Go(func() { negotiator.Run(session.Context()) })
+	offerer.OnTrack(p.watchReflected)
+	return p
+}
+
+// watchReflectedは、送り返されたトラックの最初の10パケットを確認して通知します
+func (p *reflectPeers) watchReflected(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	r := reflectedTrack{id: track.ID(), mimeType: track.Codec().MimeType}
+	for i := 0; i < 10; {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		payload := packet.Payload
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			vp8Packet := &codecs.VP8Packet{}
+			if payload, err = vp8Packet.Unmarshal(packet.Payload); err != nil || vp8Packet.S != 1 {
+				continue
+			}
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		if i == 0 {
+			r.tag = payload[0]
+		} else if r.tag != payload[0] {
+			r.tag = 0
+		}
+		i++
+	}
+	p.reflected <- r
+}
+
+// negotiateは、オファー側のオファーを応答側のNegotiatorに送り、アンサーを適用します
+func (p *reflectPeers) negotiate(ctx context.Context, t *testing.T) {
+	t.Helper()
+	offer, err := p.offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(p.offerer)
+	if err := p.offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err := p.channel.Send(*p.offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := p.channel.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.offerer.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectReflectedは、wantのトラックが同じID・コーデックで、それぞれのトラックのペイロードのまま送り返されることを確認します
+func (p *reflectPeers) expectReflected(t *testing.T, want ...reflectedTrack) {
+	t.Helper()
+	got := map[string]reflectedTrack{}
+	for len(got) < len(want) {
+		select {
+		case r := <-p.reflected:
+			got[r.id] = r
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got reflected tracks %+v, want %+v", got, want)
+		}
+	}
+	for _, w := range want {
+		if r, ok := got[w.id]; !ok || r != w {
+			t.Errorf("got reflected track %+v, want %+v", r, w)
+		}
+	}
+}
+
+// sendTaggedは、ctxが終了するまで、先頭にtagを付けたサンプルをtrackに送信します
+func sendTagged(ctx context.Context, track *webrtc.TrackLocalStaticSample, tag byte) {
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := track.WriteSample(media.Sample{Data: []byte{tag, byte(i), 0, 0, 0, 0}, Duration: 20 * time.Millisecond}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func newTaggedTrack(t *testing.T, mimeType, id string) *webrtc.TrackLocalStaticSample {
+	t.Helper()
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, id, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+// TestReflectorは、OpusとVP8のトラックと、再ネゴシエーションで追加したトラックが、
+// それぞれ同じID・コーデックの送信トラックで送り返されることを確認します
+func TestReflector(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	session := lifecycle.NewSession(ctx, zap.NewNop())
+	defer func() {
+		session.Stop(lifecycle.ReasonCompleted, nil)
+		if reason, err := session.Wait(); err != nil || reason != lifecycle.ReasonCompleted {
+			t.Errorf("session ended with %s: %v", reason, err)
+		}
+	}()
+	p := newReflectPeers(t, session)
+
+	audio := newTaggedTrack(t, webrtc.MimeTypeOpus, "audio")
+	video := newTaggedTrack(t, webrtc.MimeTypeVP8, "video")
+	for _, track := range []webrtc.TrackLocal{audio, video} {
+		if _, err := p.offerer.AddTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.negotiate(ctx, t)
+	sendTagged(ctx, audio, 'a')
+	sendTagged(ctx, video, 'v')
+	p.expectReflected(t,
+		reflectedTrack{id: "audio", mimeType: webrtc.MimeTypeOpus, tag: 'a'},
+		reflectedTrack{id: "video", mimeType: webrtc.MimeTypeVP8, tag: 'v'})
+
+	// 映像トラックを追加してオファーを送り直す
+	video2 := newTaggedTrack(t, webrtc.MimeTypeVP8, "video2")
+	if _, err := p.offerer.AddTrack(video2); err != nil {
+		t.Fatal(err)
+	}
+	p.negotiate(ctx, t)
+	sendTagged(ctx, video2, 'w')
+	p.expectReflected(t, reflectedTrack{id: "video2", mimeType: webrtc.MimeTypeVP8, tag: 'w'})
+}
+
+// TestReflectorSelectLayerは、select-layerのコマンドでそのまま送り返している映像トラックのレイヤーを切り替え、
+// 以降に追加する映像トラックにも同じレイヤーを指定することを確認します
+func TestReflectorSelectLayer(t *testing.T) {
+	r := &reflector{outputs: map[string]*reflectOutput{}}
+	if err := r.selectLayer("h"); err == nil {
+		t.Error("selected a layer without video tracks")
+	}
+
+	for mid, codec := range map[string]webrtc.RTPCodecCapability{"0": {MimeType: webrtc.MimeTypeOpus}, "1": {MimeType: webrtc.MimeTypeVP8}} {
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, "track"+mid, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.outputs[mid] = &reflectOutput{track: track, forwarder: simulcast.NewForwarder(track, func(webrtc.SSRC) {})}
+	}
+	video := r.outputs["1"].forwarder
+	video.AddLayer("q", 1)
+	video.AddLayer("h", 2)
+
+	for _, tc := range []struct {
+		layer   string
+		wantErr bool
+	}{
+		{layer: "h"},
+		// 届いていないレイヤーはエラーになるが、届いた時点で切り替わる
+		{layer: "f", wantErr: true},
+		// 空の場合は自動選択に戻す
+		{layer: ""},
+	} {
+		err := r.selectLayer(tc.layer)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("layer %q: got error %v", tc.layer, err)
+		}
+		if r.simulcastConfig.Layer != tc.layer {
+			t.Errorf("layer %q: got %q for the new tracks", tc.layer, r.simulcastConfig.Layer)
+		}
+	}
+}
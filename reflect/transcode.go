@@ -0,0 +1,94 @@
+//go:build gstreamer
+// +build gstreamer
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	gst "github.com/takumi2786/pion-webrtc_sample/v1/internal/gstreamer-src"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"go.uber.org/zap"
+)
+
+// transcodeSupportedは、-transcodeを利用できるかどうかです
+const transcodeSupported = true
+
+// gstTranscoderは、GStreamerのパイプラインで受信した映像をデコードし、別のコーデックにエンコードします
+type gstTranscoder struct {
+	logger   *zap.Logger
+	pipeline *gst.Pipeline
+	config   transcodingConfig
+}
+
+// newTranscoderは、codecで受信したRTPをconfig.codecに変換してtrackに書き込むパイプラインを開始します
+// パイプラインがエラーで止まった場合は、セッションを終了します
+func newTranscoder(session *lifecycle.Session, track *webrtc.TrackLocalStaticSample, codec webrtc.RTPCodecParameters, config transcodingConfig) (transcoder, error) {
+	logger := session.Logger().With(zap.String("track", track.ID()), zap.String("from", codec.MimeType), zap.String("to", track.Codec().MimeType))
+
+	src, err := gst.RTPSource(codec.MimeType, uint8(codec.PayloadType))
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := gst.CreatePipeline(config.codec, []gst.SampleWriter{track}, src)
+	if err != nil {
+		return nil, err
+	}
+	if config.width > 0 {
+		if err := pipeline.SetResolution(config.width, config.height); err != nil {
+			pipeline.Destroy()
+			return nil, err
+		}
+	}
+	if config.bitrate > 0 {
+		if err := pipeline.SetBitrate(config.bitrate); err != nil {
+			pipeline.Destroy()
+			return nil, err
+		}
+	}
+
+	pipeline.OnEvent(func(event gst.Event) {
+		switch event.Type {
+		case gst.EventError:
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("transcoding has failed in %s: %s", event.Source, event.Message))
+		case gst.EventWarning:
+			logger.Warn("GStreamer warning", zap.String("element", event.Source), zap.String("message", event.Message))
+		case gst.EventStateChanged:
+			logger.Debug("GStreamer pipeline state has changed", zap.Stringer("from", event.OldState), zap.Stringer("to", event.NewState))
+		}
+	})
+	pipeline.Start()
+	logger.Info("Transcoding started", zap.Int("width", config.width), zap.Int("height", config.height), zap.Int("bitrate", config.bitrate))
+	return &gstTranscoder{logger: logger, pipeline: pipeline, config: config}, nil
+}
+
+func (t *gstTranscoder) WriteRTP(packet *rtp.Packet) error {
+	buf, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	return t.pipeline.Push(buf)
+}
+
+func (t *gstTranscoder) RequestKeyFrame() {
+	if err := t.pipeline.RequestKeyFrame(); err != nil {
+		t.logger.Debug("Failed to request a key frame", zap.Error(err))
+	}
+}
+
+func (t *gstTranscoder) SetEstimatedBitrate(bitrate uint64) {
+	// -transcode-bitrateが指定されている場合は固定する
+	if t.config.bitrate > 0 {
+		return
+	}
+	if err := t.pipeline.SetBitrate(int(bitrate)); err != nil {
+		t.logger.Warn("Failed to set the bitrate", zap.Error(err))
+	}
+}
+
+func (t *gstTranscoder) Close() error {
+	t.pipeline.Destroy()
+	return nil
+}
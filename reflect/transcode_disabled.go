@@ -0,0 +1,17 @@
+//go:build !gstreamer
+// +build !gstreamer
+
+package main
+
+import (
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+)
+
+// transcodeSupportedは、-transcodeを利用できるかどうかです
+const transcodeSupported = false
+
+// newTranscoderは、gstreamerタグを付けずにビルドした場合はエラーを返します
+func newTranscoder(session *lifecycle.Session, track *webrtc.TrackLocalStaticSample, codec webrtc.RTPCodecParameters, config transcodingConfig) (transcoder, error) {
+	return nil, errTranscodeUnsupported
+}
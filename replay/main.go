@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/capture"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"go.uber.org/zap"
+)
+
+// disconnectedTimeoutは、切断されたPeerConnectionの復帰を待つ時間です
+const disconnectedTimeout = 10 * time.Second
+
+// failedTimeoutは、失敗したPeerConnectionがICEリスタートで復帰するのを待つ時間です
+const failedTimeout = 5 * time.Second
+
+var logger *zap.Logger
+
+// addTracksは、キャプチャのストリームごとに送信トラックを追加し、SSRCをキーにして返します
+func addTracks(peerConnection *webrtc.PeerConnection, streams []capture.Stream) (map[uint32]*webrtc.TrackLocalStaticRTP, error) {
+	tracks := map[uint32]*webrtc.TrackLocalStaticRTP{}
+	for _, stream := range streams {
+		capability := webrtc.RTPCodecCapability{
+			MimeType:    stream.MimeType,
+			ClockRate:   stream.ClockRate,
+			Channels:    stream.Channels,
+			SDPFmtpLine: stream.SDPFmtpLine,
+		}
+		kind := strings.SplitN(stream.MimeType, "/", 2)[0]
+		track, err := webrtc.NewTrackLocalStaticRTP(capability, fmt.Sprintf("%s-%d", kind, stream.SSRC), "replay")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := peerConnection.AddTrack(track); err != nil {
+			return nil, err
+		}
+		tracks[stream.SSRC] = track
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("the capture has no RTP stream")
+	}
+	return tracks, nil
+}
+
+// replayは、キャプチャしたRTPパケットを受信した時と同じ間隔で送信します
+// SSRCとペイロードタイプは送信トラックのものに書き換えられ、シーケンス番号とタイムスタンプはそのまま送信されます
+func replay(session *lifecycle.Session, connected <-chan struct{}, reader *capture.Reader, tracks map[uint32]*webrtc.TrackLocalStaticRTP) {
+	logger := session.Logger()
+	select {
+	case <-session.Context().Done():
+		return
+	case <-connected:
+	}
+	logger.Info("Start replaying")
+
+	var start time.Time
+	var first time.Duration
+	packets := 0
+	for {
+		packet, offset, err := reader.NextRTP()
+		if err == io.EOF {
+			logger.Info("Replay has completed", zap.Int("packets", packets))
+			session.Stop(lifecycle.ReasonCompleted, nil)
+			return
+		}
+		if err != nil {
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read the capture: %w", err))
+			return
+		}
+		track, ok := tracks[packet.SSRC]
+		if !ok {
+			continue
+		}
+
+		// 最初のパケットを送信した時刻を基準に、キャプチャ中の時刻まで待つ
+		if start.IsZero() {
+			start = time.Now()
+			first = offset
+		}
+		if wait := time.Until(start.Add(offset - first)); wait > 0 {
+			select {
+			case <-session.Context().Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if err := writeRTP(track, packet); err != nil {
+			session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to write RTP: %w", err))
+			return
+		}
+		packets++
+	}
+}
+
+func writeRTP(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) error {
+	if err := track.WriteRTP(packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	return nil
+}
+
+// newAPIは、デフォルトのコーデックとインターセプターを登録したAPIを生成します
+func newAPI(loggerFactory *logging.LoggerFactory) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	settingEngine := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(settingEngine)), nil
+}
+
+// runSessionは、オファーを送信し、キャプチャを最後まで送信するとセッションを終了します
+func runSession(ctx context.Context, config webrtc.Configuration, logConfig *logging.Config, channel signal.Channel, reader *capture.Reader) (lifecycle.Reason, error) {
+	session := lifecycle.NewSession(ctx, logger)
+	// 以降はセッションIDを持つロガーを利用する
+	logger := session.Logger()
+	fail := func(err error) (lifecycle.Reason, error) {
+		session.Stop(lifecycle.ReasonError, err)
+		return session.Wait()
+	}
+
+	// pionのログ(ICE、DTLSなど)もセッションのロガーに出力する
+	loggerFactory, err := logging.NewLoggerFactory(logger, *logConfig)
+	if err != nil {
+		return fail(err)
+	}
+	api, err := newAPI(loggerFactory)
+	if err != nil {
+		return fail(err)
+	}
+	peerConnection, err := api.NewPeerConnection(config)
+	if err != nil {
+		return fail(err)
+	}
+	// Gracefully shutdown the peer connection
+	session.OnClose("PeerConnection", peerConnection.Close)
+
+	// シグナリングチャネルでオファー・アンサーを交換する
+	negotiator := negotiation.New(peerConnection, negotiation.Config{}, channel, logger)
+
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		logger.Info("ICE connection state has changed", zap.Stringer("state", connectionState))
+		negotiator.ICEConnectionStateChange(connectionState)
+	})
+
+	// DTLSの接続が完了してから送信を始める
+	connected := make(chan struct{})
+	var connectedOnce sync.Once
+	session.WatchPeerConnection(peerConnection, disconnectedTimeout, failedTimeout, func(state webrtc.PeerConnectionState) {
+		logger.Info("Peer connection state has changed", zap.Stringer("state", state))
+		if state == webrtc.PeerConnectionStateConnected {
+			connectedOnce.Do(func() { close(connected) })
+		}
+	})
+
+	tracks, err := addTracks(peerConnection, reader.Manifest.Streams)
+	if err != nil {
+		return fail(err)
+	}
+	// reflectから送り返されたトラックは読み捨てる
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		logger.Info("Track has started", zap.String("track", track.ID()), zap.String("mimeType", track.Codec().MimeType))
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+
+	// (オファー) Local Session Descriptionをシグナリングチャネルへ送信し、アンサーを待つ
+	if err = negotiator.Negotiate(); err != nil {
+		return fail(err)
+	}
+	session.Go(func() { negotiator.Run(session.Context()) })
+	session.Go(func() { replay(session, connected, reader, tracks) })
+
+	return session.Wait()
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// runは、キャプチャを1回送信し、終了理由に応じた終了コードを返します
+func run() int {
+	signalConfig := signal.ClientFlags()
+	logConfig := logging.Flags()
+	input := flag.String("input", "", "capture written by receive -dump, e.g. ../receive/out/capture.rtpdump")
+	flag.Parse()
+
+	var err error
+	if logger, err = logging.New(*logConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logger.Sync()
+
+	if *input == "" {
+		fmt.Fprintln(os.Stderr, "-input is required")
+		flag.Usage()
+		return 2
+	}
+
+	// SIGINT/SIGTERMを受け取ったらキャンセルされる
+	ctx, cancel := lifecycle.SignalContext(context.Background())
+	defer cancel()
+
+	// キャプチャとストリームの情報(<input>.json)を読み込む
+	reader, err := capture.Open(*input)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	logger.Info("Replay a capture", zap.String("file", *input), zap.Time("capturedAt", reader.Manifest.Start), zap.Int("streams", len(reader.Manifest.Streams)))
+
+	// Prepare the configuration
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+
+	// オファー・アンサーを交換するシグナリングチャネル(標準入出力またはWebSocket)を準備する
+	channel, err := signal.NewClientChannel(*signalConfig)
+	if err != nil {
+		logger.Error("Failed to prepare the signaling channel", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+
+	reason, err := runSession(ctx, config, logConfig, channel, reader)
+	if err != nil {
+		logger.Error("Session has ended with error", zap.Stringer("reason", reason), zap.Error(err))
+	} else {
+		logger.Info("Session has ended", zap.Stringer("reason", reason))
+	}
+	return reason.ExitCode()
+}
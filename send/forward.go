@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// H.264のNALユニットの種類
+const (
+	h264NALTypeIDR   = 5
+	h264NALTypeSPS   = 7
+	h264NALTypeSTAPA = 24
+	h264NALTypeFUA   = 28
+)
+
+// rtpForwarderは、カメラやffmpegから受信したRTPパケットを変換せずにブラウザへ送信します
+// 送信元に接続し直してもブラウザ側では1つのストリームに見えるように、シーケンス番号とタイムスタンプを連続させます
+type rtpForwarder struct {
+	track *webrtc.TrackLocalStaticRTP
+	// parameterSetsは、送信元のSDPに記述されたSPS・PPSです(H.264のみ)
+	parameterSets [][]byte
+
+	// seqOffset、timestampOffsetは、送信元のシーケンス番号・タイムスタンプに加える値です
+	seqOffset       uint16
+	timestampOffset uint32
+	// lastSeq、lastTimestamp、lastTimeは、最後に送信したパケットの値です
+	lastSeq       uint16
+	lastTimestamp uint32
+	lastTime      time.Time
+	started       bool
+	// resyncは、接続し直した後の最初のパケットでオフセットを計算し直すことを表します
+	resync bool
+	// parameterSetsSentは、接続してからSPSを送信したかどうかです(H.264のみ)
+	parameterSetsSent bool
+}
+
+// reconnectedは、送信元に接続し直したことを記録します
+func (s *rtpForwarder) reconnected(parameterSets [][]byte) {
+	s.parameterSets = parameterSets
+	s.resync = true
+	s.parameterSetsSent = false
+}
+
+// writeRTPは、パケットのシーケンス番号・タイムスタンプを書き換えて送信します
+// H.264でSPSがRTPで送られてこないカメラの場合は、SDPのSPS・PPSをキーフレームの前に挿入します
+func (s *rtpForwarder) writeRTP(packet *rtp.Packet, now time.Time) error {
+	if s.resync && s.started {
+		// 切断されていた間の時間だけタイムスタンプを進める
+		elapsed := uint32(now.Sub(s.lastTime).Seconds() * float64(s.track.Codec().ClockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		s.seqOffset = s.lastSeq + 1 - packet.SequenceNumber
+		s.timestampOffset = s.lastTimestamp + elapsed - packet.Timestamp
+	}
+	s.resync = false
+
+	if strings.EqualFold(s.track.Codec().MimeType, webrtc.MimeTypeH264) && len(s.parameterSets) > 0 && !s.parameterSetsSent {
+		types := h264NALTypes(packet.Payload)
+		if types[h264NALTypeSPS] {
+			s.parameterSetsSent = true
+		} else if types[h264NALTypeIDR] {
+			stapA := &rtp.Packet{Header: packet.Header, Payload: h264STAPA(s.parameterSets)}
+			stapA.Marker = false
+			if err := s.write(stapA, now); err != nil {
+				return err
+			}
+			// 挿入したパケットの分だけ、以降のシーケンス番号をずらす
+			s.seqOffset++
+			s.parameterSetsSent = true
+		}
+	}
+	return s.write(packet, now)
+}
+
+func (s *rtpForwarder) write(packet *rtp.Packet, now time.Time) error {
+	packet.SequenceNumber += s.seqOffset
+	packet.Timestamp += s.timestampOffset
+	// 順序が入れ替わったパケットでは最後の値を戻さない
+	if !s.started || int16(packet.SequenceNumber-s.lastSeq) > 0 {
+		s.lastSeq, s.lastTimestamp, s.lastTime = packet.SequenceNumber, packet.Timestamp, now
+	}
+	s.started = true
+	return s.track.WriteRTP(packet)
+}
+
+// h264NALTypesは、パケットが含むNALユニットの種類を返します(FU-Aは最初のパケットのみ)
+func h264NALTypes(payload []byte) map[byte]bool {
+	types := map[byte]bool{}
+	if len(payload) == 0 {
+		return types
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case h264NALTypeSTAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			types[payload[i+2]&0x1f] = true
+			i += 2 + size
+		}
+	case h264NALTypeFUA:
+		if len(payload) > 1 && payload[1]&0x80 != 0 {
+			types[payload[1]&0x1f] = true
+		}
+	default:
+		types[nalType] = true
+	}
+	return types
+}
+
+// h264STAPAは、NALユニットをまとめたSTAP-Aのペイロードを返します
+func h264STAPA(nals [][]byte) []byte {
+	// NRIは含まれるNALユニットの最大値にする
+	var nri byte
+	for _, nal := range nals {
+		if nal[0]&0x60 > nri {
+			nri = nal[0] & 0x60
+		}
+	}
+	payload := []byte{nri | h264NALTypeSTAPA}
+	for _, nal := range nals {
+		payload = append(payload, byte(len(nal)>>8), byte(len(nal)))
+		payload = append(payload, nal...)
+	}
+	return payload
+}
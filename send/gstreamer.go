@@ -0,0 +1,193 @@
+//go:build gstreamer
+// +build gstreamer
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/bwe"
+	gst "github.com/takumi2786/pion-webrtc_sample/v1/internal/gstreamer-src"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"go.uber.org/zap"
+)
+
+// sampleWriterは、一時停止中のサンプルを捨て、送信したフレームを数えます
+type sampleWriter struct {
+	track *webrtc.TrackLocalStaticSample
+	state *sendState
+}
+
+func (w *sampleWriter) WriteSample(sample media.Sample) error {
+	if w.state.isPaused() {
+		return nil
+	}
+	if err := w.track.WriteSample(sample); err != nil {
+		return err
+	}
+	w.state.frameSent()
+	return nil
+}
+
+// gstreamerRestartDelayは、エラー・EOSで止まったパイプラインを作り直すまでの時間です
+const gstreamerRestartDelay = time.Second
+
+// gstreamerPipelineは、作り直されるパイプラインのうち実行中のものを保持します
+type gstreamerPipeline struct {
+	mu       sync.Mutex
+	pipeline *gst.Pipeline
+	closed   bool
+}
+
+func (g *gstreamerPipeline) get() *gst.Pipeline {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pipeline
+}
+
+// setは、実行するパイプラインを入れ替えます
+// closeの後に作られたパイプラインは破棄してfalseを返します
+func (g *gstreamerPipeline) set(pipeline *gst.Pipeline) bool {
+	g.mu.Lock()
+	closed := g.closed
+	if !closed {
+		g.pipeline = pipeline
+	}
+	g.mu.Unlock()
+
+	if closed {
+		pipeline.Destroy()
+	}
+	return !closed
+}
+
+// closeは、実行中のパイプラインを破棄します
+func (g *gstreamerPipeline) close() error {
+	g.mu.Lock()
+	g.closed = true
+	pipeline := g.pipeline
+	g.mu.Unlock()
+
+	pipeline.Destroy()
+	return nil
+}
+
+// sendGStreamerMediaは、GStreamerのパイプラインでエンコードした映像を送信します
+// 受信側から届くREMBとレシーバーレポートのパケットロスから帯域を推定し、
+// エンコーダーの目標ビットレートと解像度を変更します
+// パイプラインがエラー・EOSで止まった場合は、作り直して送信を続けます
+func sendGStreamerMedia(session *lifecycle.Session, state *sendState, config gstreamerConfig, bweConfig bwe.Config, videoTrack *webrtc.TrackLocalStaticSample, rtpSender *webrtc.RTPSender) error {
+	logger := session.Logger().With(zap.String("track", videoTrack.ID()), zap.String("mimeType", videoTrack.Codec().MimeType))
+	writers := []gst.SampleWriter{&sampleWriter{track: videoTrack, state: state}}
+
+	// パイプラインを解析できない場合は、セッションを開始せずにエラーを返す
+	first, err := gst.CreatePipeline(config.codec, writers, config.src)
+	if err != nil {
+		return err
+	}
+	current := &gstreamerPipeline{pipeline: first}
+
+	estimator := bwe.NewEstimator(bweConfig, uint32(rtpSender.GetParameters().Encodings[0].SSRC))
+	setBitrate := func(bitrate int) {
+		if err := current.get().SetBitrate(bitrate); err != nil {
+			logger.Warn("Failed to set the bitrate", zap.Error(err))
+			return
+		}
+		state.setTargetBitrate(bitrate)
+		logger.Info("Target bitrate has changed", zap.Int("bitrate", bitrate))
+	}
+	estimator.OnTargetBitrate(setBitrate)
+
+	requestKeyFrame := func() error {
+		pipeline := current.get()
+		if pipeline.State() != gst.StatePlaying {
+			return errors.New("the GStreamer pipeline is not playing")
+		}
+		return pipeline.RequestKeyFrame()
+	}
+	state.setKeyFrameRequester(requestKeyFrame)
+
+	// 受け取ったRTCPパケットから帯域を推定し、PLI・FIRを受け取ったらキーフレームを生成する
+	go func() {
+		for {
+			rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
+				// PeerConnectionが閉じられると読み込みが終了する
+				return
+			}
+			estimator.HandleRTCP(rtcpPackets)
+			for _, p := range rtcpPackets {
+				switch p.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					if err := requestKeyFrame(); err != nil {
+						logger.Debug("Failed to request a key frame", zap.Error(err))
+					}
+				}
+			}
+		}
+	}()
+
+	// PeerConnectionを閉じる前にパイプラインを止める
+	session.OnClose("GStreamer pipeline", current.close)
+	session.Go(func() {
+		// 接続が確立されるまで待ちます
+		<-iceConnectedCtx.Done()
+		if session.Context().Err() != nil {
+			return
+		}
+
+		pipeline := first
+		for {
+			// エラーとEOSはパイプラインを作り直すために通知し、それ以外はログに出力する
+			stopped := make(chan gst.Event, 1)
+			pipeline.OnEvent(func(event gst.Event) {
+				switch event.Type {
+				case gst.EventError, gst.EventEOS:
+					select {
+					case stopped <- event:
+					default:
+					}
+				case gst.EventWarning:
+					logger.Warn("GStreamer warning", zap.String("element", event.Source), zap.String("message", event.Message))
+				case gst.EventStateChanged:
+					logger.Debug("GStreamer pipeline state has changed", zap.Stringer("from", event.OldState), zap.Stringer("to", event.NewState))
+				}
+			})
+			pipeline.Start()
+			setBitrate(estimator.TargetBitrate())
+			logger.Info("GStreamer pipeline started", zap.String("src", config.src), zap.String("codec", config.codec))
+
+			var event gst.Event
+			select {
+			case <-session.Context().Done():
+				return
+			case event = <-stopped:
+			}
+			pipeline.Destroy()
+			if event.Type == gst.EventEOS {
+				logger.Info("GStreamer pipeline has reached the end of the stream, restarting")
+			} else {
+				logger.Warn("GStreamer pipeline has failed, restarting", zap.String("element", event.Source), zap.String("message", event.Message))
+			}
+
+			select {
+			case <-session.Context().Done():
+				return
+			case <-time.After(gstreamerRestartDelay):
+			}
+			if pipeline, err = gst.CreatePipeline(config.codec, writers, config.src); err != nil {
+				session.Stop(lifecycle.ReasonError, err)
+				return
+			}
+			if !current.set(pipeline) {
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !gstreamer
+// +build !gstreamer
+
+package main
+
+import (
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/bwe"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+)
+
+// sendGStreamerMediaは、gstreamerタグを付けずにビルドした場合はエラーを返します
+func sendGStreamerMedia(session *lifecycle.Session, state *sendState, config gstreamerConfig, bweConfig bwe.Config, videoTrack *webrtc.TrackLocalStaticSample, rtpSender *webrtc.RTPSender) error {
+	return errors.New("send was built without GStreamer, build it with -tags gstreamer to use -gst-src")
+}
@@ -2,16 +2,33 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/transport/vnet"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/bwe"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/control"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtsp"
 	"github.com/takumi2786/pion-webrtc_sample/v1/internal/signal"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/stats"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/turnserver"
 	"go.uber.org/zap"
 )
 
@@ -25,48 +42,270 @@ var iceConnectedCtx context.Context
 var iceConnectedCtxCancel context.CancelFunc
 var logger *zap.Logger
 
-func initSendLocalMedia(peerConnection *webrtc.PeerConnection) (*webrtc.TrackLocalStaticSample, *webrtc.RTPSender) {
-	sendLocalMediaTrack, videoTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
+// simulatedNetは、テストで利用する仮想ネットワークです(nilの場合は実際のネットワークを利用する)
+var simulatedNet *vnet.Net
+
+// gstreamerConfigは、H.264ファイルの代わりにGStreamerのパイプラインで生成した映像を送信する場合の設定です
+// gstreamerタグを付けてビルドした場合のみ利用できます(gstreamer.go)
+type gstreamerConfig struct {
+	// srcは、エンコーダーより前のパイプライン(空の場合はH.264ファイルを送信する)
+	src string
+	// codecは、エンコードするコーデック(vp8、vp9、h264)
+	codec string
+}
+
+// gstreamerMimeTypesは、-gst-codecで指定できるコーデックのMIMEタイプです
+var gstreamerMimeTypes = map[string]string{
+	"vp8":  webrtc.MimeTypeVP8,
+	"vp9":  webrtc.MimeTypeVP9,
+	"h264": webrtc.MimeTypeH264,
+}
+
+// 送信する映像の生成元(sendState.source)
+const (
+	// sourceFileは、H.264ファイルを送信します
+	sourceFile = "file"
+	// sourceGStreamerは、GStreamerのパイプラインでエンコードした映像を送信します
+	sourceGStreamer = "gstreamer"
+	// sourceTestsrcは、Goで生成したカラーバーとサイン波を送信します
+	sourceTestsrc = "testsrc"
+	// sourceRTSPは、RTSPのカメラから受信した映像を送信します
+	sourceRTSP = "rtsp"
+	// sourceRTPは、ffmpegなどからUDPで受信したRTPパケットを送信します
+	sourceRTP = "rtp"
+)
+
+// sendStateは、制御用データチャネルから変更される送信の状態です
+type sendState struct {
+	mu     sync.Mutex
+	paused bool
+	// mediaDirは、送信するH.264ファイルのディレクトリ(-media-dir)です
+	mediaDir string
+	// fileは、送信するファイルのmediaDirからのパスです
+	file       string
+	switched   bool
+	framesSent uint64
+	// reconnectsは、カメラに接続し直した回数、またはRTPの送信元が再起動した回数です(RTSP、RTPのみ)
+	reconnects uint64
+	// sourceは、送信する映像の生成元です
+	source string
+	// targetBitrateは、帯域推定によるエンコーダーの目標ビットレートです(GStreamerのみ)
+	targetBitrate int
+	// requestKeyFrameは、エンコーダーにキーフレームを要求します(GStreamer、testsrcのみ)
+	requestKeyFrame func() error
+}
+
+func newSendState(source, mediaDir string) *sendState {
+	return &sendState{mediaDir: mediaDir, file: videoFileName, source: source}
+}
+
+func (s *sendState) setPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+func (s *sendState) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// switchFileは、次のフレームから送信するファイルをmediaDir内のファイルに切り替えます
+// ファイル名はリモートのピアから受け取るため、mediaDirの外のファイルは開かない
+func (s *sendState) switchFile(name string) error {
+	file, err := resolveMediaFile(s.mediaDir, name)
+	if err != nil {
+		return err
+	}
+	// エラーにはパスを含めず、mediaDirの外のパスを知らせない
+	if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("file %q does not exist", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = name
+	s.switched = true
+	return nil
+}
+
+// takeSwitchは、ファイルの切り替えが要求されていれば切り替え先のファイルのパスを返します
+func (s *sendState) takeSwitch() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switched := s.switched
+	s.switched = false
+	return filepath.Join(s.mediaDir, filepath.FromSlash(s.file)), switched
+}
+
+// resolveMediaFileは、dir内のファイルのパスを返します。nameは/区切りのパスです
+// filetransferと同様に、絶対パスや..などでdirの外を指す名前は拒否します
+func resolveMediaFile(dir, name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if name == "" || clean != name {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *sendState) frameSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.framesSent++
+}
+
+func (s *sendState) reconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnects++
+}
+
+func (s *sendState) setKeyFrameRequester(requestKeyFrame func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestKeyFrame = requestKeyFrame
+}
+
+func (s *sendState) keyFrameRequester() func() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestKeyFrame
+}
+
+func (s *sendState) setTargetBitrate(bitrate int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targetBitrate = bitrate
+}
+
+func (s *sendState) status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.source {
+	case sourceGStreamer:
+		return map[string]interface{}{
+			"paused":        s.paused,
+			"source":        s.source,
+			"targetBitrate": s.targetBitrate,
+			"framesSent":    s.framesSent,
+		}
+	case sourceTestsrc:
+		return map[string]interface{}{
+			"paused":     s.paused,
+			"source":     s.source,
+			"framesSent": s.framesSent,
+		}
+	case sourceRTSP, sourceRTP:
+		return map[string]interface{}{
+			"paused":     s.paused,
+			"source":     s.source,
+			"framesSent": s.framesSent,
+			"reconnects": s.reconnects,
+		}
+	}
+	return map[string]interface{}{
+		"paused":     s.paused,
+		"file":       s.file,
+		"framesSent": s.framesSent,
+	}
+}
+
+// handleControlは、制御用データチャネルのコマンドとテレメトリを設定します
+func handleControl(session *lifecycle.Session, peerConnection *webrtc.PeerConnection, negotiator *negotiation.Negotiator, state *sendState) {
+	controller := control.New(peerConnection, session.Logger())
+	tone := newToneTrack(session, negotiator, state)
+	controller.Handle(control.CommandPause, func(control.Message) error {
+		state.setPaused(true)
+		return nil
+	})
+	controller.Handle(control.CommandResume, func(control.Message) error {
+		state.setPaused(false)
+		return nil
+	})
+	controller.Handle(control.CommandSwitchFile, func(msg control.Message) error {
+		if state.source != sourceFile {
+			return fmt.Errorf("files cannot be switched while sending from %s", state.source)
+		}
+		return state.switchFile(msg.File)
+	})
+	controller.Handle(control.CommandRequestKeyFrame, func(control.Message) error {
+		if requestKeyFrame := state.keyFrameRequester(); requestKeyFrame != nil {
+			return requestKeyFrame()
+		}
+		// H.264ファイルをそのまま送信しているため、任意の位置でキーフレームを生成できない
+		return errors.New("key frames cannot be generated from an H.264 file")
+	})
+	controller.Handle(control.CommandAddTone, func(control.Message) error {
+		return tone.add()
+	})
+	controller.Handle(control.CommandRemoveTone, func(control.Message) error {
+		return tone.remove()
+	})
+	controller.SetStatus(state.status)
+	peerConnection.OnDataChannel(controller.Accept)
+	session.Go(func() { controller.Run(session.Context()) })
+}
+
+// openH264は、H.264ファイルを開きます
+func openH264(name string) (*os.File, *h264reader.H264Reader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	h264, err := h264reader.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, h264, nil
+}
+
+func initSendLocalMedia(peerConnection *webrtc.PeerConnection, mimeType string, id string) (*webrtc.TrackLocalStaticSample, *webrtc.RTPSender, error) {
+	sendLocalMediaTrack, videoTrackErr := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: mimeType}, id, "pion")
 	if videoTrackErr != nil {
-		panic(videoTrackErr)
+		return nil, nil, videoTrackErr
 	}
 	sendLocalMediaRtpSender, videoTrackErr := peerConnection.AddTrack(sendLocalMediaTrack)
 	if videoTrackErr != nil {
-		panic(videoTrackErr)
+		return nil, nil, videoTrackErr
 	}
-	return sendLocalMediaTrack, sendLocalMediaRtpSender
+	return sendLocalMediaTrack, sendLocalMediaRtpSender, nil
 }
 
 // ローカルファイルをリモートに送信する
-func sendLocalMedia(peerConnection *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticSample, rtpSender *webrtc.RTPSender) {
+// ファイルを最後まで送信し終えると、セッションをReasonCompletedで終了する
+// ICEが切断されている間と、制御用データチャネルでpauseされている間は送信を一時停止する
+func sendLocalMedia(session *lifecycle.Session, negotiator *negotiation.Negotiator, state *sendState, peerConnection *webrtc.PeerConnection, videoTrack *webrtc.TrackLocalStaticSample, rtpSender *webrtc.RTPSender) {
+	logger := session.Logger().With(zap.String("track", videoTrack.ID()), zap.String("mimeType", videoTrack.Codec().MimeType))
 	// 受け取ったRTCPパケットを読み取ります
 	// これらのパケットが返される前に、Nackのようなインターセプターによって処理されます。
 	// TODO: RTCPパケットに応じた再送処理を追加する
 	go func() {
-		rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
-		if rtcpErr != nil {
-			panic(rtcpErr)
-		}
-		//
-		for _, r := range rtcpPackets {
-			// RTCPパケットの中身を表示する
-			if stringer, canString := r.(fmt.Stringer); canString {
-				logger.Info(fmt.Sprintf("Received RTCP Packet: %v", stringer.String()))
+		for {
+			rtcpPackets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
+				// PeerConnectionが閉じられると読み込みが終了する
+				return
+			}
+			//
+			for _, r := range rtcpPackets {
+				// RTCPパケットの中身を表示する
+				if stringer, canString := r.(fmt.Stringer); canString {
+					logger.Debug("Received RTCP Packet", zap.Stringer("packet", stringer))
+				}
 			}
 		}
 	}()
 
-	go func() {
+	session.Go(func() {
 		// Open a H264 file and start reading using our IVFReader
-		file, h264Err := os.Open(videoFileName)
-		if h264Err != nil {
-			panic(h264Err)
-		}
-
-		h264, h264Err := h264reader.NewReader(file)
+		fileName, _ := state.takeSwitch()
+		file, h264, h264Err := openH264(fileName)
 		if h264Err != nil {
-			panic(h264Err)
+			session.Stop(lifecycle.ReasonError, h264Err)
+			return
 		}
+		defer func() { file.Close() }()
 
 		// 接続が確立されるまで待ちます
 		<-iceConnectedCtx.Done()
@@ -79,22 +318,92 @@ func sendLocalMedia(peerConnection *webrtc.PeerConnection, videoTrack *webrtc.Tr
 		// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
 		// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
 		ticker := time.NewTicker(h264FrameDuration)
-		for ; true; <-ticker.C { // 一定の間隔でメディアを送信する
+		defer ticker.Stop()
+		for { // 一定の間隔でメディアを送信する
+			// ICEリスタート中は送信を一時停止し、送信位置を維持する
+			// セッションが終了していれば送信をやめる
+			if err := negotiator.WaitConnected(session.Context()); err != nil {
+				return
+			}
+
+			if state.isPaused() {
+				select {
+				case <-session.Context().Done():
+					return
+				case <-ticker.C:
+				}
+				continue
+			}
+
+			// ファイルの切り替えが要求されていれば、切り替え先のファイルを先頭から送信する
+			if fileName, switched := state.takeSwitch(); switched {
+				switchedFile, switchedH264, err := openH264(fileName)
+				if err != nil {
+					logger.Warn("Failed to switch file", zap.String("file", fileName), zap.Error(err))
+				} else {
+					file.Close()
+					file, h264 = switchedFile, switchedH264
+					logger.Info("Switched file", zap.String("file", fileName))
+				}
+			}
+
 			nal, h264Err := h264.NextNAL()
 			if h264Err == io.EOF {
-				fmt.Printf("All video frames parsed and sent")
-				os.Exit(0)
+				logger.Info("All video frames parsed and sent")
+				session.Stop(lifecycle.ReasonCompleted, nil)
+				return
 			}
 			if h264Err != nil {
-				panic(h264Err)
+				session.Stop(lifecycle.ReasonError, h264Err)
+				return
 			}
 			// NAL: Network Abstraction Layer
 			// http://up-cat.net/H%252E264%252FAVC%2528NAL%2529.html
 			if h264Err = videoTrack.WriteSample(media.Sample{Data: nal.Data, Duration: time.Second}); h264Err != nil {
-				panic(h264Err)
+				session.Stop(lifecycle.ReasonError, h264Err)
+				return
+			}
+			state.frameSent()
+
+			select {
+			case <-session.Context().Done():
+				return
+			case <-ticker.C:
 			}
 		}
-	}()
+	})
+}
+
+// newAPIは、統計情報を収集するインターセプターを登録したAPIを生成します
+// netInterceptorがnilでなければ、送受信するRTP・RTCPパケットにパケットロス・遅延などを加えます
+func newAPI(statsInterceptor *stats.Interceptor, netInterceptor *netsim.Interceptor, loggerFactory *logging.LoggerFactory) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	// H.265のカメラの映像は、H.265を受け付けるブラウザにのみ送信できる
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: rtsp.MimeTypeH265, ClockRate: 90000},
+		PayloadType:        h265PayloadType,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	// ネットワークに最も近い位置でパケットを落とす・遅らせるため、最初に登録する
+	if netInterceptor != nil {
+		interceptorRegistry.Add(netInterceptor)
+	}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(statsInterceptor)
+
+	settingEngine := webrtc.SettingEngine{LoggerFactory: loggerFactory}
+	if simulatedNet != nil {
+		settingEngine.SetVNet(simulatedNet)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(settingEngine)), nil
 }
 
 func init() {
@@ -103,69 +412,345 @@ func init() {
 	runtime.LockOSThread()
 }
 
-func main() {
-	logger, _ = zap.NewDevelopment()
-	iceConnectedCtx, iceConnectedCtxCancel = context.WithCancel(context.Background())
+// sessionConfigは、runSessionに渡すセッションの設定です
+type sessionConfig struct {
+	webrtcConfig      webrtc.Configuration
+	collector         *stats.Collector
+	logConfig         *logging.Config
+	channel           signal.Channel
+	lifecycleConfig   *lifecycle.Config
+	negotiationConfig *negotiation.Config
+	gstConfig         *gstreamerConfig
+	bweConfig         *bwe.Config
+	testsrcConfig     *testsrc.Config
+	netConfig         *netsim.Config
+	rtspConfig        *rtsp.Config
+	rtpConfig         *rtpConfig
+	mediaDir          string
+}
 
-	logger.Info("Send Local Media to Browser!")
+// runSessionは、オファーを1つ受け付けてセッションが終了するまでブロックします
+func runSession(ctx context.Context, c sessionConfig) (lifecycle.Reason, error) {
+	// (オファー) Remote Session Descriptionをシグナリングチャネルから読み込む
+	offer, err := c.channel.Recv(ctx)
+	for errors.Is(err, signal.ErrInvalidSessionDescription) {
+		logger.Warn("Invalid session description", zap.Error(err))
+		offer, err = c.channel.Recv(ctx)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return lifecycle.ReasonSignal, nil
+		}
+		return lifecycle.ReasonError, fmt.Errorf("failed to receive an offer: %w", err)
+	}
 
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	session := lifecycle.NewSession(ctx, logger)
+	// 以降はセッションIDを持つロガーを利用する
+	logger := session.Logger()
+	fail := func(err error) (lifecycle.Reason, error) {
+		session.Stop(lifecycle.ReasonError, err)
+		return session.Wait()
 	}
+	iceConnectedCtx, iceConnectedCtxCancel = context.WithCancel(session.Context())
 
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	statsInterceptor := stats.NewInterceptor()
+	// pionのログ(ICE、DTLSなど)もセッションのロガーに出力する
+	loggerFactory, err := logging.NewLoggerFactory(logger, *c.logConfig)
+	if err != nil {
+		return fail(err)
+	}
+	// -net-*が指定されていれば、送受信するRTP・RTCPパケットにパケットロス・遅延などを加える
+	var netInterceptor *netsim.Interceptor
+	if c.netConfig.Enabled() {
+		netInterceptor = netsim.NewInterceptor(*c.netConfig)
+		logger.Info("Simulating network impairment", zap.Float64("loss", c.netConfig.Loss), zap.Duration("delay", c.netConfig.Delay), zap.Duration("jitter", c.netConfig.Jitter),
+			zap.Float64("reorder", c.netConfig.Reorder), zap.Int("bandwidth", c.netConfig.Bandwidth))
+		session.OnClose("NetworkSimulation", func() error {
+			outbound, inbound := netInterceptor.Stats()
+			logger.Info("Network impairment statistics", zap.Uint64("outboundSent", outbound.Sent), zap.Uint64("outboundDropped", outbound.Dropped),
+				zap.Uint64("inboundSent", inbound.Sent), zap.Uint64("inboundDropped", inbound.Dropped))
+			return nil
+		})
+	}
+	api, err := newAPI(statsInterceptor, netInterceptor, loggerFactory)
+	if err != nil {
+		return fail(err)
+	}
+	peerConnection, err := api.NewPeerConnection(c.webrtcConfig)
 	if err != nil {
-		panic(err)
+		return fail(err)
 	}
+	// Gracefully shutdown the peer connection
+	session.OnClose("PeerConnection", peerConnection.Close)
+
+	// セッションの統計情報を収集する
+	c.collector.Add(session.ID(), peerConnection, statsInterceptor)
+	defer c.collector.Remove(session.ID())
+
+	// シグナリングチャネルでオファー・アンサーを交換する
+	negotiator := negotiation.New(peerConnection, *c.negotiationConfig, c.channel, logger)
 
 	// 接続状態変更を検知した際に起動するイベントハンドラを設定する
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		logger.Info("ICE connection state has changed", zap.Stringer("state", connectionState))
+		negotiator.ICEConnectionStateChange(connectionState)
 		// 接続が成功したことをcontextに伝える
 		if connectionState == webrtc.ICEConnectionStateConnected {
 			iceConnectedCtxCancel()
 		}
 	})
 
+	// 切断・失敗・クローズを検知したらセッションを終了する
+	session.WatchPeerConnection(peerConnection, c.lifecycleConfig.DisconnectedTimeout, c.lifecycleConfig.FailedTimeout, func(state webrtc.PeerConnectionState) {
+		logger.Info("Peer connection state has changed", zap.Stringer("state", state))
+	})
+
 	// 送信するメディアを設定する
 	// videoTrack, rtpSenderは、メディアを送信する際に利用する
 	// ※ Local Session Descriptionを生成する前に実行する必要がある
-	sendLocalMediaTrack, sendLocalMediaRtpSender := initSendLocalMedia(peerConnection)
-
-	// (オファー) Remote Session DescriptionをpeerConnectionに設定する
-	offer := webrtc.SessionDescription{}
-	signal.Decode(signal.MustReadStdin(), &offer)
-	err = peerConnection.SetRemoteDescription(offer)
+	source, mimeType := sourceFile, webrtc.MimeTypeH264
+	var rtspConn *rtsp.Conn
+	switch {
+	case c.gstConfig.src != "":
+		source, mimeType = sourceGStreamer, gstreamerMimeTypes[c.gstConfig.codec]
+	case c.testsrcConfig.Enabled:
+		source, mimeType = sourceTestsrc, webrtc.MimeTypeVP8
+	case c.rtspConfig.URL != "":
+		// トラックのコーデックを決めるため、アンサーを作成する前にカメラに接続する
+		if rtspConn, err = rtsp.Dial(session.Context(), *c.rtspConfig); err != nil {
+			return fail(fmt.Errorf("failed to connect to the camera: %w", err))
+		}
+		source, mimeType = sourceRTSP, rtspConn.Stream().MimeType
+		logger.Info("Connected to the camera", zap.String("mimeType", mimeType), zap.String("transport", c.rtspConfig.Transport))
+	case c.rtpConfig.enabled():
+		source = sourceRTP
+	}
+	var sendLocalMediaTrack *webrtc.TrackLocalStaticSample
+	var rtspTrack *webrtc.TrackLocalStaticRTP
+	var sendLocalMediaRtpSender *webrtc.RTPSender
+	var rtpInputs []rtpInput
+	switch source {
+	case sourceRTSP:
+		// カメラのRTPパケットはトランスコードせずにそのまま送信する
+		rtspTrack, sendLocalMediaRtpSender, err = initSendRTSPTrack(peerConnection, rtspConn.Stream())
+	case sourceRTP:
+		// -rtp-video、-rtp-audioで受信するトラックを追加する
+		rtpInputs, err = initRTPInputs(session, peerConnection, *c.rtpConfig)
+	default:
+		sendLocalMediaTrack, sendLocalMediaRtpSender, err = initSendLocalMedia(peerConnection, mimeType, "video")
+	}
 	if err != nil {
-		panic(err)
+		if rtspConn != nil {
+			rtspConn.Close()
+		}
+		return fail(err)
+	}
+	// testsrcはサイン波の音声トラックも送信する
+	var audioTrack *webrtc.TrackLocalStaticSample
+	var audioRtpSender *webrtc.RTPSender
+	if source == sourceTestsrc && c.testsrcConfig.ToneFrequency > 0 {
+		if audioTrack, audioRtpSender, err = initSendLocalMedia(peerConnection, webrtc.MimeTypePCMU, "audio"); err != nil {
+			return fail(err)
+		}
 	}
 
-	// (アンサー) Local Session Descriptionを生成する
-	answer, err := peerConnection.CreateAnswer(nil)
+	// 制御用データチャネルを受け付ける
+	state := newSendState(source, c.mediaDir)
+	handleControl(session, peerConnection, negotiator, state)
+
+	// アンサーの送信に失敗した場合もカメラとの接続を閉じるため、RTSPは先に送信を開始する
+	// ICEが接続するまでに受信したパケットは捨てる
+	if source == sourceRTSP {
+		sendRTSPMedia(session, negotiator, state, *c.rtspConfig, rtspConn, rtspTrack, sendLocalMediaRtpSender)
+	}
+
+	// (オファー)を適用し、(アンサー) Local Session Descriptionをシグナリングチャネルへ送信する
+	if err = negotiator.HandleRemoteDescription(offer); err != nil {
+		return fail(err)
+	}
+	// 2回目以降のオファー・アンサー(再ネゴシエーション、ICEリスタート)を受け付ける
+	session.Go(func() { negotiator.Run(session.Context()) })
+
+	switch source {
+	case sourceGStreamer:
+		if err = sendGStreamerMedia(session, state, *c.gstConfig, *c.bweConfig, sendLocalMediaTrack, sendLocalMediaRtpSender); err != nil {
+			return fail(err)
+		}
+	case sourceTestsrc:
+		if err = sendTestsrcMedia(session, negotiator, state, *c.testsrcConfig, sendLocalMediaTrack, sendLocalMediaRtpSender, audioTrack, audioRtpSender); err != nil {
+			return fail(err)
+		}
+	case sourceRTP:
+		sendRTPMedia(session, negotiator, state, rtpInputs)
+	case sourceRTSP:
+		// 送信はアンサーの前に開始している
+	default:
+		sendLocalMedia(session, negotiator, state, peerConnection, sendLocalMediaTrack, sendLocalMediaRtpSender)
+	}
+
+	return session.Wait()
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// runは、セッションを実行し、終了理由に応じた終了コードを返します
+func run() int {
+	turnConfig := turnserver.Flags()
+	lifecycleConfig := lifecycle.Flags()
+	negotiationConfig := negotiation.Flags()
+	signalConfig := signal.Flags()
+	statsConfig := stats.Flags()
+	logConfig := logging.Flags()
+	bweConfig := bwe.Flags()
+	testsrcConfig := testsrc.Flags()
+	netConfig := netsim.Flags()
+	rtspConfig := rtsp.Flags()
+	rtpConfig := &rtpConfig{}
+	flag.StringVar(&rtpConfig.videoAddr, "rtp-video", "", "UDP address to receive the video RTP packets to send instead of the H.264 file, e.g. :5004 for ffmpeg -f rtp rtp://127.0.0.1:5004")
+	flag.StringVar(&rtpConfig.videoCodec, "rtp-video-codec", "vp8", "codec of the video RTP packets: vp8, vp9 or h264")
+	flag.StringVar(&rtpConfig.audioAddr, "rtp-audio", "", "UDP address to receive the audio RTP packets to send, e.g. :5006")
+	flag.StringVar(&rtpConfig.audioCodec, "rtp-audio-codec", "opus", "codec of the audio RTP packets: opus, pcmu or pcma")
+	mediaDir := flag.String("media-dir", ".", "directory of the H.264 files: "+videoFileName+" is sent first, and the switch-file command can switch only to the files in it")
+	gstConfig := &gstreamerConfig{}
+	flag.StringVar(&gstConfig.src, "gst-src", "", "GStreamer pipeline generating raw video, e.g. videotestsrc (the H.264 file is sent when empty, requires -tags gstreamer)")
+	flag.StringVar(&gstConfig.codec, "gst-codec", "vp8", "codec the GStreamer pipeline encodes to: vp8, vp9 or h264")
+	flag.Parse()
+
+	var err error
+	if logger, err = logging.New(*logConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logger.Sync()
+
+	if err := netConfig.Validate(); err != nil {
+		logger.Error("Invalid network impairment", zap.Error(err))
+		return 2
+	}
+	if err := negotiationConfig.Validate(lifecycleConfig.DisconnectedTimeout); err != nil {
+		logger.Error("Invalid ICE restart", zap.Error(err))
+		return 2
+	}
+
+	logger.Info("Send Local Media to Browser!")
+
+	if _, ok := gstreamerMimeTypes[gstConfig.codec]; gstConfig.src != "" && !ok {
+		logger.Error("Unsupported codec", zap.String("codec", gstConfig.codec))
+		return 2
+	}
+	if rtpConfig.enabled() {
+		if gstConfig.src != "" || testsrcConfig.Enabled || rtspConfig.URL != "" {
+			logger.Error("-rtp-video and -rtp-audio cannot be used together with -gst-src, -testsrc or -rtsp-url")
+			return 2
+		}
+		if err := rtpConfig.validate(); err != nil {
+			logger.Error("Invalid RTP configuration", zap.Error(err))
+			return 2
+		}
+	}
+	if rtspConfig.URL != "" {
+		if gstConfig.src != "" || testsrcConfig.Enabled {
+			logger.Error("-rtsp-url cannot be used together with -gst-src or -testsrc")
+			return 2
+		}
+		if err := rtspConfig.Validate(); err != nil {
+			logger.Error("Invalid RTSP configuration", zap.Error(err))
+			return 2
+		}
+	}
+	if testsrcConfig.Enabled {
+		if gstConfig.src != "" {
+			logger.Error("-testsrc and -gst-src cannot be used together")
+			return 2
+		}
+		if err := testsrcConfig.Validate(); err != nil {
+			logger.Error("Invalid test source", zap.Error(err))
+			return 2
+		}
+	}
+
+	// SIGINT/SIGTERMを受け取ったらキャンセルされる
+	ctx, cancel := lifecycle.SignalContext(context.Background())
+	defer cancel()
+
+	// Prepare the configuration
+	config := webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+
+	// 組み込みのTurnサーバーを起動し、ICEServersに追加する
+	if turnConfig.Enabled {
+		turnServer, err := turnserver.Start(*turnConfig)
+		if err != nil {
+			logger.Error("Failed to start the TURN server", zap.Error(err))
+			return lifecycle.ReasonError.ExitCode()
+		}
+		defer turnServer.Close()
+		turnServer.Apply(&config)
+		logger.Info("TURN server started", zap.String("publicIP", turnConfig.PublicIP), zap.Int("port", turnConfig.Port))
+	}
+
+	// 統計情報を収集し、-stats-addrが指定されていれば/metrics、/statsで公開する
+	collector, err := stats.Start(ctx, *statsConfig)
 	if err != nil {
-		panic(err)
+		logger.Error("Failed to start the stats server", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
 	}
-	// Create channel that is blocked until ICE Gathering is complete
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	// Sets the LocalDescription, and starts our UDP listeners
-	err = peerConnection.SetLocalDescription(answer)
+	if statsConfig.Addr != "" {
+		logger.Info("Stats server started", zap.String("url", fmt.Sprintf("http://%s/metrics", statsConfig.Addr)))
+	}
+
+	// オファー・アンサーを交換するシグナリングチャネル(標準入出力またはWebSocket)を準備する
+	channel, err := signal.NewChannel(*signalConfig)
 	if err != nil {
-		panic(err)
+		logger.Error("Failed to prepare the signaling channel", zap.Error(err))
+		return lifecycle.ReasonError.ExitCode()
+	}
+	if signalConfig.Addr != "" {
+		logger.Info("WebSocket signaling server started", zap.String("url", fmt.Sprintf("ws://%s/ws", signalConfig.Addr)))
 	}
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
 
-	// Output the answer in base64 so we can paste it in browser
-	fmt.Printf("Answer Session Description: \n%s", signal.Encode(*peerConnection.LocalDescription()))
+	var backoff lifecycle.Backoff
+	for {
+		started := time.Now()
+		reason, err := runSession(ctx, sessionConfig{
+			webrtcConfig:      config,
+			collector:         collector,
+			logConfig:         logConfig,
+			channel:           channel,
+			lifecycleConfig:   lifecycleConfig,
+			negotiationConfig: negotiationConfig,
+			gstConfig:         gstConfig,
+			bweConfig:         bweConfig,
+			testsrcConfig:     testsrcConfig,
+			netConfig:         netConfig,
+			rtspConfig:        rtspConfig,
+			rtpConfig:         rtpConfig,
+			mediaDir:          *mediaDir,
+		})
+		if err != nil {
+			logger.Error("Session has ended with error", zap.Stringer("reason", reason), zap.Error(err))
+		} else {
+			logger.Info("Session has ended", zap.Stringer("reason", reason))
+		}
 
-	go sendLocalMedia(peerConnection, sendLocalMediaTrack, sendLocalMediaRtpSender)
-	select {}
+		// 自動再起動が有効な場合は、新しいオファーを待つ
+		// シグナリングチャネルが閉じられた場合(標準入力のEOFなど)は、新しいオファーを受け取れないため終了する
+		if !lifecycleConfig.AutoRestart || reason == lifecycle.ReasonSignal || ctx.Err() != nil || errors.Is(err, io.EOF) {
+			return reason.ExitCode()
+		}
+		// すぐに終了するセッションを繰り返さないように、間隔を空けてから再起動する
+		delay := backoff.Next(time.Since(started))
+		logger.Info("Waiting for a new offer", zap.Duration("delay", delay))
+		if !lifecycle.Sleep(ctx, delay) {
+			return lifecycle.ReasonSignal.ExitCode()
+		}
+	}
 }
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/bwe"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/control"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/logging"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/loopback"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/netsim"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtpbridge"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtsp"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/stats"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+	"go.uber.org/zap"
+	"golang.org/x/image/vp8"
+)
+
+// sessionResultは、runSessionの戻り値です
+type sessionResult struct {
+	reason lifecycle.Reason
+	err    error
+}
+
+// startLoopbackは、仮想ネットワーク上のオファー側と接続したセッションを開始します
+// オファー側は映像と音声を受信するトランシーバーを持ちます
+func startLoopback(ctx context.Context, t *testing.T, testsrcConfig *testsrc.Config, rtspConfig *rtsp.Config, rtpConfig *rtpConfig) (*loopback.Loopback, <-chan sessionResult) {
+	t.Helper()
+	l, done := startSession(ctx, t, testsrcConfig, rtspConfig, rtpConfig)
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return l, done
+}
+
+// startSessionは、startLoopbackと同様にセッションを開始しますが、オファー側は接続しません
+// オファーの前にオファー側にデータチャネルなどを追加する場合に利用します
+func startSession(ctx context.Context, t *testing.T, testsrcConfig *testsrc.Config, rtspConfig *rtsp.Config, rtpConfig *rtpConfig) (*loopback.Loopback, <-chan sessionResult) {
+	t.Helper()
+	logger = zap.NewNop()
+	l, err := loopback.New(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	simulatedNet = l.Net
+	t.Cleanup(func() { simulatedNet = nil })
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := l.Offerer.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan sessionResult, 1)
+	go func() {
+		reason, err := runSession(ctx, sessionConfig{
+			collector:         stats.NewCollector(time.Second),
+			logConfig:         &logging.Config{PionLevel: "warn"},
+			channel:           l.Channel,
+			lifecycleConfig:   &lifecycle.Config{DisconnectedTimeout: 5 * time.Second},
+			negotiationConfig: &negotiation.Config{},
+			gstConfig:         &gstreamerConfig{},
+			bweConfig:         &bwe.Config{},
+			testsrcConfig:     testsrcConfig,
+			netConfig:         &netsim.Config{},
+			rtspConfig:        rtspConfig,
+			rtpConfig:         rtpConfig,
+			mediaDir:          ".",
+		})
+		done <- sessionResult{reason, err}
+	}()
+	return l, done
+}
+
+// TestLoopbackFileは、H.264ファイルの全てのNALユニットがファイルと同じ順序・内容で届くことを確認します
+func TestLoopbackFile(t *testing.T) {
+	chdirTemp(t)
+	// 開始コードを含まないように、0を含まないデータのNALユニットを作る
+	// MTUより大きいNALユニットはFU-Aで分割して送信される
+	var nals [][]byte
+	var file bytes.Buffer
+	for i := 0; i < 30; i++ {
+		nal := []byte{0x41} // non-IDR
+		size := 100
+		if i%10 == 0 {
+			nal[0] = 0x65 // IDR
+			size = 3000
+		}
+		for len(nal) < size {
+			nal = append(nal, byte(i+1), byte(len(nal)%255+1))
+		}
+		nals = append(nals, nal)
+		file.Write([]byte{0, 0, 0, 1})
+		file.Write(nal)
+	}
+	if err := ioutil.WriteFile(videoFileName, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	received := make(chan []byte, len(nals))
+	l, done := startLoopback(ctx, t, &testsrc.Config{}, &rtsp.Config{}, &rtpConfig{})
+	l.Offerer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) {
+			return
+		}
+		depacketizer := &codecs.H264Packet{}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			// 分割できないパケットは届かなかったNALユニットとして検出される
+			nal, err := depacketizer.Unmarshal(packet.Payload)
+			if err != nil {
+				return
+			}
+			// FU-Aの途中のパケットでは空になる
+			if len(nal) > 0 {
+				received <- bytes.TrimPrefix(nal, []byte{0, 0, 0, 1})
+			}
+		}
+	})
+
+	r := <-done
+	if r.err != nil || r.reason != lifecycle.ReasonCompleted {
+		t.Fatalf("session ended with %s %v, want %s", r.reason, r.err, lifecycle.ReasonCompleted)
+	}
+
+	// 接続直後(DTLSの確立前)に送信したNALユニットは届かないことがあるため、
+	// 最初に届いたNALユニットからファイルの最後までを比較する
+	first := -1
+	for i := 0; ; i++ {
+		var nal []byte
+		select {
+		case nal = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d NAL units, want %d", i, len(nals)-first)
+		}
+		if first < 0 {
+			for j := range nals {
+				if bytes.Equal(nal, nals[j]) {
+					first = j
+				}
+			}
+			if first < 0 {
+				t.Fatalf("received a NAL unit which is not in the file: % x", nal[:8])
+			}
+		}
+		if want := nals[first+i]; !bytes.Equal(nal, want) {
+			t.Fatalf("NAL unit %d: got %d bytes % x..., want %d bytes % x...", first+i, len(nal), nal[:8], len(want), want[:8])
+		}
+		if first+i == len(nals)-1 {
+			break
+		}
+	}
+	if first > len(nals)/2 {
+		t.Errorf("the first %d NAL units have been lost", first)
+	}
+}
+
+// TestLoopbackTestsrcは、testsrcの映像がカラーバーとしてデコードでき、音声(PCMU)が届くことを確認します
+func TestLoopbackTestsrc(t *testing.T) {
+	chdirTemp(t)
+	config := &testsrc.Config{Enabled: true, Width: 160, Height: 120, FrameRate: 30, ToneFrequency: 440}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	frames := make(chan []byte, 100)
+	audioPackets := make(chan int, 100)
+	l, done := startLoopback(sessionCtx, t, config, &rtsp.Config{}, &rtpConfig{})
+	l.Offerer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		// PCMU(ペイロードタイプ0)のトラックは、OnTrackの時点でCodecが空のことがあるため種類で区別する
+		switch track.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			builder := samplebuilder.New(20, &codecs.VP8Packet{}, track.Codec().ClockRate)
+			for {
+				packet, _, err := track.ReadRTP()
+				if err != nil {
+					return
+				}
+				builder.Push(packet)
+				for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+					select {
+					case frames <- sample.Data:
+					default:
+					}
+				}
+			}
+		case webrtc.RTPCodecTypeAudio:
+			for {
+				packet, _, err := track.ReadRTP()
+				if err != nil {
+					return
+				}
+				select {
+				case audioPackets <- len(packet.Payload):
+				default:
+				}
+			}
+		}
+	})
+
+	want := testsrc.NewPattern(config.Width, config.Height).Frame(time.Now(), 0)
+	for i := 0; i < 10; i++ {
+		select {
+		case frame := <-frames:
+			if err := compareBars(frame, want); err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d video frames, want 10", i)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case size := <-audioPackets:
+			if size != testsrc.ToneSampleRate/50 {
+				t.Fatalf("audio packet %d: got %d bytes, want %d", i, size, testsrc.ToneSampleRate/50)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d audio packets, want 10", i)
+		}
+	}
+
+	stopSession()
+	if r := <-done; r.err != nil {
+		t.Fatalf("session ended with an error: %s %v", r.reason, r.err)
+	}
+}
+
+// TestControlToneは、add-tone・remove-toneのコマンドで、goアプリケーションが音声トラックを追加・削除する
+// オファーを送信し、再ネゴシエーションの後に音声が届き、削除後は届かなくなることを確認します
+func TestControlTone(t *testing.T) {
+	chdirTemp(t)
+	config := &testsrc.Config{Enabled: true, Width: 160, Height: 120, FrameRate: 30}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	l, done := startSession(sessionCtx, t, config, &rtsp.Config{}, &rtpConfig{})
+	controlChannel, err := l.Offerer.CreateDataChannel("control", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	controlChannel.OnOpen(func() { close(opened) })
+	results := make(chan control.Message, 10)
+	controlChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var m control.Message
+		if err := json.Unmarshal(msg.Data, &m); err == nil && m.Type == control.TypeResult {
+			results <- m
+		}
+	})
+	audioPackets := make(chan int, 100)
+	l.Offerer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case audioPackets <- len(packet.Payload):
+			default:
+			}
+		}
+	})
+	if err := l.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-opened:
+	case <-ctx.Done():
+		t.Fatal("the control channel is not opened")
+	}
+
+	command := func(id int, name string) {
+		t.Helper()
+		data, err := json.Marshal(control.Message{Type: control.TypeCommand, ID: id, Command: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := controlChannel.SendText(string(data)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case result := <-results:
+			if result.ID != id || result.Error != "" {
+				t.Fatalf("%s: got result %+v", name, result)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%s: no result", name)
+		}
+	}
+
+	// 音声トラックを追加するまでは、音声は届かない
+	select {
+	case <-audioPackets:
+		t.Fatal("received audio before add-tone")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	command(1, control.CommandAddTone)
+	for i := 0; i < 10; i++ {
+		select {
+		case size := <-audioPackets:
+			if size != testsrc.ToneSampleRate/50 {
+				t.Fatalf("audio packet %d: got %d bytes, want %d", i, size, testsrc.ToneSampleRate/50)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d audio packets, want 10", i)
+		}
+	}
+
+	command(2, control.CommandRemoveTone)
+	// 削除の前に送信されたパケットを読み捨ててから、届かなくなったことを確認する
+	time.Sleep(500 * time.Millisecond)
+	for len(audioPackets) > 0 {
+		<-audioPackets
+	}
+	select {
+	case <-audioPackets:
+		t.Fatal("received audio after remove-tone")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	stopSession()
+	if r := <-done; r.err != nil {
+		t.Fatalf("session ended with an error: %s %v", r.reason, r.err)
+	}
+}
+
+// TestLoopbackRTSPは、カメラのRTPパケットが届き、カメラが切断されて接続し直した後もシーケンス番号が連続することを確認します
+func TestLoopbackRTSP(t *testing.T) {
+	chdirTemp(t)
+	// SPS・PPSをRTPで送らないカメラの代わり
+	parameterSets := [][]byte{{0x67, 0x42, 0x00, 0x1f}, {0x68, 0xce, 0x3c, 0x80}}
+	server, err := rtsp.NewServer("127.0.0.1:0", rtsp.Stream{MimeType: rtsp.MimeTypeH264, ClockRate: 90000, PayloadType: 96, ParameterSets: parameterSets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// 切断されたら、シーケンス番号・タイムスタンプを飛ばして送信する
+	dropped := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		seq, timestamp := uint16(100), uint32(1000)
+		for i := 0; ; i++ {
+			select {
+			case <-dropped:
+				seq, timestamp = seq+5000, timestamp+900000
+				dropped = nil
+			case <-ticker.C:
+			}
+			nal := []byte{0x41, byte(i)}
+			if i%10 == 0 {
+				nal[0] = 0x65
+			}
+			if server.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, Marker: true, PayloadType: 96, SequenceNumber: seq, Timestamp: timestamp, SSRC: 1}, Payload: nal}) != nil {
+				return
+			}
+			seq, timestamp = seq+1, timestamp+3000
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	packets := make(chan *rtp.Packet, 1000)
+	config := &rtsp.Config{URL: server.URL(), Transport: rtsp.TransportTCP, Timeout: time.Second, ReconnectInterval: 100 * time.Millisecond}
+	l, done := startLoopback(sessionCtx, t, &testsrc.Config{}, config, &rtpConfig{})
+	l.Offerer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264) {
+			return
+		}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			packets <- packet
+		}
+	})
+
+	// receiveは、パケットを受信し、シーケンス番号とタイムスタンプが連続していることを確認します
+	// STAP-A(SPS・PPS)を受信したらtrueを返します
+	var last *rtp.Packet
+	receive := func() bool {
+		t.Helper()
+		select {
+		case packet := <-packets:
+			if last != nil {
+				if packet.SequenceNumber != last.SequenceNumber+1 {
+					t.Fatalf("sequence number %d after %d", packet.SequenceNumber, last.SequenceNumber)
+				}
+				if diff := packet.Timestamp - last.Timestamp; diff > 90000 {
+					t.Fatalf("timestamp %d after %d", packet.Timestamp, last.Timestamp)
+				}
+			}
+			last = packet
+			return packet.Payload[0]&0x1f == 24
+		case <-time.After(5 * time.Second):
+			t.Fatal("no packet has been received")
+			return false
+		}
+	}
+	// 最初のキーフレームの前にSDPのSPS・PPSが挿入される
+	for !receive() {
+	}
+	for i := 0; i < 20; i++ {
+		receive()
+	}
+
+	server.DropClients()
+	close(dropped)
+	// 接続し直した後のキーフレームの前にも挿入される
+	for !receive() {
+	}
+	for i := 0; i < 20; i++ {
+		receive()
+	}
+
+	stopSession()
+	if r := <-done; r.err != nil {
+		t.Fatalf("session ended with an error: %s %v", r.reason, r.err)
+	}
+}
+
+// TestLoopbackRTPは、UDPで受信したRTPパケットが届き、送信元が再起動してSSRCが変わってもシーケンス番号が連続することを確認します
+func TestLoopbackRTP(t *testing.T) {
+	chdirTemp(t)
+	// ffmpegの代わりにパケットを送信するため、空いているポートを探す
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sessionCtx, stopSession := context.WithCancel(ctx)
+	defer stopSession()
+	packets := make(chan *rtp.Packet, 1000)
+	l, done := startLoopback(sessionCtx, t, &testsrc.Config{}, &rtsp.Config{}, &rtpConfig{videoAddr: addr, videoCodec: "vp8", audioCodec: "opus"})
+	l.Offerer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if !strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeVP8) {
+			return
+		}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			packets <- packet
+		}
+	})
+
+	writer, err := rtpbridge.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	// restartedを閉じると、SSRC・シーケンス番号・タイムスタンプを変えて送信する
+	restarted := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		ssrc, seq, timestamp := uint32(1), uint16(100), uint32(1000)
+		for {
+			select {
+			case <-sessionCtx.Done():
+				return
+			case <-restarted:
+				ssrc, seq, timestamp = 2, seq+5000, timestamp+900000
+				restarted = nil
+			case <-ticker.C:
+			}
+			// VP8のキーフレームの先頭
+			payload := []byte{0x10, 0x00, 0x00, 0x00, byte(seq)}
+			writer.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, Marker: true, PayloadType: 100, SequenceNumber: seq, Timestamp: timestamp, SSRC: ssrc}, Payload: payload})
+			seq, timestamp = seq+1, timestamp+3000
+		}
+	}()
+
+	var last *rtp.Packet
+	receive := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case packet := <-packets:
+				if last != nil && packet.SequenceNumber != last.SequenceNumber+1 {
+					t.Fatalf("sequence number %d after %d", packet.SequenceNumber, last.SequenceNumber)
+				}
+				if last != nil && packet.Timestamp-last.Timestamp > 90000 {
+					t.Fatalf("timestamp %d after %d", packet.Timestamp, last.Timestamp)
+				}
+				last = packet
+			case <-time.After(5 * time.Second):
+				t.Fatalf("received %d packets, want %d", i, n)
+			}
+		}
+	}
+	receive(20)
+	close(restarted)
+	receive(20)
+
+	stopSession()
+	if r := <-done; r.err != nil {
+		t.Fatalf("session ended with an error: %s %v", r.reason, r.err)
+	}
+}
+
+// compareBarsは、VP8のフレームをデコードし、上半分(カラーバー)がwantと一致するか比較します
+// エンコーダーは4x4画素の平均を符号化するため、量子化の誤差を許容する
+func compareBars(frame []byte, want *image.YCbCr) error {
+	const tolerance = 4
+	decoder := vp8.NewDecoder()
+	decoder.Init(bytes.NewReader(frame), len(frame))
+	if _, err := decoder.DecodeFrameHeader(); err != nil {
+		return err
+	}
+	got, err := decoder.DecodeFrame()
+	if err != nil {
+		return err
+	}
+	if got.Rect != want.Rect {
+		return fmt.Errorf("got %v, want %v", got.Rect, want.Rect)
+	}
+	for y := 0; y < want.Rect.Dy()/2; y++ {
+		for x := 0; x < want.Rect.Dx(); x++ {
+			g, w := got.YCbCrAt(x, y), want.YCbCrAt(x, y)
+			if absDiff(g.Y, w.Y) > tolerance || absDiff(g.Cb, w.Cb) > tolerance || absDiff(g.Cr, w.Cr) > tolerance {
+				return fmt.Errorf("pixel (%d, %d): got %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return nil
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// chdirTempは、テスト中の作業ディレクトリを一時ディレクトリに変更します
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestSwitchFileは、switch-fileで-media-dirの外のファイルに切り替えられないことを確認します
+func TestSwitchFile(t *testing.T) {
+	dir := t.TempDir()
+	mediaDir := filepath.Join(dir, "media")
+	if err := os.MkdirAll(filepath.Join(mediaDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(dir, "secret.h264"), filepath.Join(mediaDir, "sub", "other.h264")} {
+		if err := ioutil.WriteFile(name, []byte{0, 0, 0, 1, 0x65}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := newSendState(sourceFile, mediaDir)
+	for _, name := range []string{"../secret.h264", "sub/../../secret.h264", filepath.Join(dir, "secret.h264"), "/etc/passwd", "", ".", "sub", "missing.h264"} {
+		err := state.switchFile(name)
+		if err == nil {
+			t.Errorf("switched to %q", name)
+			continue
+		}
+		// エラーにmediaDirのパスを含めない
+		if strings.Contains(err.Error(), dir) && !strings.Contains(name, dir) {
+			t.Errorf("error for %q reveals the path: %v", name, err)
+		}
+	}
+	if _, switched := state.takeSwitch(); switched {
+		t.Error("switched to a rejected file")
+	}
+
+	if err := state.switchFile("sub/other.h264"); err != nil {
+		t.Fatal(err)
+	}
+	file, switched := state.takeSwitch()
+	if want := filepath.Join(mediaDir, "sub", "other.h264"); !switched || file != want {
+		t.Errorf("got %s (switched %v), want %s", file, switched, want)
+	}
+	if status := state.status(); status["file"] != "sub/other.h264" {
+		t.Errorf("got status %v", status)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtpbridge"
+	"go.uber.org/zap"
+)
+
+// rtpConfigは、H.264ファイルの代わりにffmpegやGStreamerからUDPで受信したRTPパケットを送信する場合の設定です
+type rtpConfig struct {
+	// videoAddr、audioAddrは、RTPパケットを受信するアドレスです(空の場合はその種類を送信しない)
+	videoAddr string
+	audioAddr string
+	// videoCodec、audioCodecは、受信するRTPパケットのコーデックです
+	videoCodec string
+	audioCodec string
+}
+
+// enabledは、RTPパケットを受信して送信するかどうかを返します
+func (c rtpConfig) enabled() bool {
+	return c.videoAddr != "" || c.audioAddr != ""
+}
+
+// rtpCodecsは、-rtp-video-codec、-rtp-audio-codecで指定できるコーデックです
+var rtpCodecs = map[webrtc.RTPCodecType]map[string]webrtc.RTPCodecCapability{
+	webrtc.RTPCodecTypeVideo: {
+		"vp8":  {MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		"vp9":  {MimeType: webrtc.MimeTypeVP9, ClockRate: 90000},
+		"h264": {MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+	},
+	webrtc.RTPCodecTypeAudio: {
+		"opus": {MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		"pcmu": {MimeType: webrtc.MimeTypePCMU, ClockRate: 8000},
+		"pcma": {MimeType: webrtc.MimeTypePCMA, ClockRate: 8000},
+	},
+}
+
+// validateは、-rtp-*の値を検証します
+func (c rtpConfig) validate() error {
+	if _, ok := rtpCodecs[webrtc.RTPCodecTypeVideo][c.videoCodec]; c.videoAddr != "" && !ok {
+		return fmt.Errorf("unsupported video codec %q (vp8, vp9 or h264)", c.videoCodec)
+	}
+	if _, ok := rtpCodecs[webrtc.RTPCodecTypeAudio][c.audioCodec]; c.audioAddr != "" && !ok {
+		return fmt.Errorf("unsupported audio codec %q (opus, pcmu or pcma)", c.audioCodec)
+	}
+	if c.videoAddr != "" && c.videoAddr == c.audioAddr {
+		return errors.New("video and audio cannot be received on the same address")
+	}
+	return nil
+}
+
+// rtpInputは、UDPで受信したRTPパケットを送信する1つのトラックです
+type rtpInput struct {
+	reader    *rtpbridge.Reader
+	track     *webrtc.TrackLocalStaticRTP
+	rtpSender *webrtc.RTPSender
+}
+
+// initRTPInputsは、-rtp-video、-rtp-audioのアドレスで受信を開始し、トラックを追加します
+// 受信はセッション終了時に止める
+func initRTPInputs(session *lifecycle.Session, peerConnection *webrtc.PeerConnection, config rtpConfig) ([]rtpInput, error) {
+	var inputs []rtpInput
+	for _, input := range []struct {
+		kind  webrtc.RTPCodecType
+		addr  string
+		codec string
+	}{
+		{webrtc.RTPCodecTypeVideo, config.videoAddr, config.videoCodec},
+		{webrtc.RTPCodecTypeAudio, config.audioAddr, config.audioCodec},
+	} {
+		if input.addr == "" {
+			continue
+		}
+		reader, err := rtpbridge.Listen(input.addr)
+		if err != nil {
+			return nil, err
+		}
+		session.OnClose("RTP "+input.kind.String(), reader.Close)
+		track, err := webrtc.NewTrackLocalStaticRTP(rtpCodecs[input.kind][input.codec], input.kind.String(), "pion")
+		if err != nil {
+			return nil, err
+		}
+		rtpSender, err := peerConnection.AddTrack(track)
+		if err != nil {
+			return nil, err
+		}
+		session.Logger().Info("Receiving RTP packets", zap.Stringer("kind", input.kind), zap.Stringer("addr", reader.Addr()), zap.String("mimeType", track.Codec().MimeType))
+		inputs = append(inputs, rtpInput{reader: reader, track: track, rtpSender: rtpSender})
+	}
+	return inputs, nil
+}
+
+// sendRTPMediaは、UDPで受信したRTPパケットをトランスコードせずに送信します
+// 送信元(ffmpegなど)が再起動してSSRCが変わっても、シーケンス番号とタイムスタンプを連続させます
+// ICEが切断されている間と、制御用データチャネルでpauseされている間に受信したパケットは捨てます
+func sendRTPMedia(session *lifecycle.Session, negotiator *negotiation.Negotiator, state *sendState, inputs []rtpInput) {
+	// 送信元にキーフレームを要求する方法はないため、ブラウザからのPLIはインターセプターで処理されたものを読み捨てる
+	state.setKeyFrameRequester(func() error { return errors.New("key frames cannot be requested from the RTP source") })
+	for _, input := range inputs {
+		input := input
+		logger := session.Logger().With(zap.String("track", input.track.ID()), zap.String("mimeType", input.track.Codec().MimeType))
+		go func() {
+			for {
+				if _, _, rtcpErr := input.rtpSender.ReadRTCP(); rtcpErr != nil {
+					return
+				}
+			}
+		}()
+
+		session.Go(func() {
+			forwarder := &rtpForwarder{track: input.track}
+			started := false
+			var ssrc uint32
+			for {
+				packet, err := input.reader.ReadRTP(0)
+				if err != nil {
+					// セッション終了時に閉じられる
+					if session.Context().Err() == nil {
+						session.Stop(lifecycle.ReasonError, fmt.Errorf("failed to read RTP: %w", err))
+					}
+					return
+				}
+				if !started {
+					logger.Info("RTP source has started", zap.Uint32("ssrc", packet.SSRC))
+				} else if packet.SSRC != ssrc {
+					logger.Info("RTP source has restarted", zap.Uint32("ssrc", packet.SSRC))
+					forwarder.reconnected(nil)
+					state.reconnected()
+				}
+				started, ssrc = true, packet.SSRC
+
+				if !negotiator.Connected() || state.isPaused() {
+					continue
+				}
+				if err := forwarder.writeRTP(packet, time.Now()); err != nil {
+					session.Stop(lifecycle.ReasonError, err)
+					return
+				}
+				if packet.Marker && input.track.Kind() == webrtc.RTPCodecTypeVideo {
+					state.frameSent()
+				}
+			}
+		})
+	}
+}
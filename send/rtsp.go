@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/rtsp"
+	"go.uber.org/zap"
+)
+
+// h265PayloadTypeは、H.265を受け付けるブラウザ(Safariなど)と交渉するためのペイロードタイプです
+// RegisterDefaultCodecsが使っていない番号を使う
+const h265PayloadType = 126
+
+// initSendRTSPTrackは、カメラのコーデックのトラックを追加します
+func initSendRTSPTrack(peerConnection *webrtc.PeerConnection, stream rtsp.Stream) (*webrtc.TrackLocalStaticRTP, *webrtc.RTPSender, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: stream.MimeType, ClockRate: stream.ClockRate}, "video", "pion")
+	if err != nil {
+		return nil, nil, err
+	}
+	rtpSender, err := peerConnection.AddTrack(track)
+	if err != nil {
+		return nil, nil, err
+	}
+	return track, rtpSender, nil
+}
+
+// sendRTSPMediaは、カメラから受信したRTPパケットをトランスコードせずに送信します
+// カメラとの接続が切れた場合は、-rtsp-reconnect-intervalごとに接続し直します
+// ICEが切断されている間と、制御用データチャネルでpauseされている間に受信したパケットは捨てます
+func sendRTSPMedia(session *lifecycle.Session, negotiator *negotiation.Negotiator, state *sendState, config rtsp.Config, conn *rtsp.Conn, track *webrtc.TrackLocalStaticRTP, rtpSender *webrtc.RTPSender) {
+	logger := session.Logger().With(zap.String("mimeType", track.Codec().MimeType))
+	// カメラにキーフレームを要求する方法はないため、ブラウザからのPLIはインターセプターで処理されたものを読み捨てる
+	state.setKeyFrameRequester(func() error { return fmt.Errorf("key frames cannot be requested from an RTSP camera") })
+	go func() {
+		for {
+			if _, _, rtcpErr := rtpSender.ReadRTCP(); rtcpErr != nil {
+				return
+			}
+		}
+	}()
+
+	// 接続し直すたびに置き換わるため、セッション終了時に閉じる接続はロックして取得する
+	var mu sync.Mutex
+	session.OnClose("RTSP", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return conn.Close()
+	})
+
+	session.Go(func() {
+		sender := &rtpForwarder{track: track, parameterSets: conn.Stream().ParameterSets}
+		for {
+			packet, err := conn.ReadRTP()
+			if err == nil {
+				if negotiator.Connected() && !state.isPaused() {
+					if err := sender.writeRTP(packet, time.Now()); err != nil {
+						session.Stop(lifecycle.ReasonError, err)
+						return
+					}
+					if packet.Marker {
+						state.frameSent()
+					}
+				}
+				continue
+			}
+			if session.Context().Err() != nil {
+				return
+			}
+
+			logger.Warn("Camera has dropped", zap.Error(err))
+			conn.Close()
+			reconnected, ok := reconnectRTSP(session, config, logger)
+			if !ok {
+				return
+			}
+			if stream := reconnected.Stream(); !strings.EqualFold(stream.MimeType, track.Codec().MimeType) {
+				reconnected.Close()
+				session.Stop(lifecycle.ReasonError, fmt.Errorf("the codec of the camera has changed from %s to %s", track.Codec().MimeType, stream.MimeType))
+				return
+			}
+			mu.Lock()
+			conn = reconnected
+			mu.Unlock()
+			// セッションが終了した後に接続した場合は、OnCloseで閉じられないためここで閉じる
+			if session.Context().Err() != nil {
+				conn.Close()
+				return
+			}
+			sender.reconnected(conn.Stream().ParameterSets)
+			state.reconnected()
+			logger.Info("Camera has reconnected")
+		}
+	})
+}
+
+// reconnectRTSPは、接続できるかセッションが終了するまでカメラに接続し直します
+func reconnectRTSP(session *lifecycle.Session, config rtsp.Config, logger *zap.Logger) (*rtsp.Conn, bool) {
+	for {
+		select {
+		case <-session.Context().Done():
+			return nil, false
+		case <-time.After(config.ReconnectInterval):
+		}
+		conn, err := rtsp.Dial(session.Context(), config)
+		if err == nil {
+			return conn, true
+		}
+		if session.Context().Err() != nil {
+			return nil, false
+		}
+		logger.Warn("Failed to reconnect to the camera", zap.Error(err))
+	}
+}
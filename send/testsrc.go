@@ -0,0 +1,104 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+	"go.uber.org/zap"
+)
+
+// sendTestsrcMediaは、Goで生成したカラーバーの映像(VP8)とサイン波の音声(PCMU)を送信します
+// GStreamerやH.264ファイルがなくても送信の処理を確認できます
+// audioTrackがnilの場合は映像のみ送信します
+func sendTestsrcMedia(session *lifecycle.Session, negotiator *negotiation.Negotiator, state *sendState, config testsrc.Config, videoTrack *webrtc.TrackLocalStaticSample, videoRtpSender *webrtc.RTPSender, audioTrack *webrtc.TrackLocalStaticSample, audioRtpSender *webrtc.RTPSender) error {
+	logger := session.Logger()
+	video, err := testsrc.NewVideo(config)
+	if err != nil {
+		return err
+	}
+	// 全てのフレームがキーフレームのため、キーフレームの要求には何もしない
+	state.setKeyFrameRequester(func() error { return nil })
+
+	// RTCPパケットはインターセプターで処理されるため、読み捨てる
+	for _, rtpSender := range []*webrtc.RTPSender{videoRtpSender, audioRtpSender} {
+		if rtpSender == nil {
+			continue
+		}
+		go func(rtpSender *webrtc.RTPSender) {
+			for {
+				if _, _, rtcpErr := rtpSender.ReadRTCP(); rtcpErr != nil {
+					// PeerConnectionが閉じられると読み込みが終了する
+					return
+				}
+			}
+		}(rtpSender)
+	}
+
+	// ICEリスタート中と、制御用データチャネルでpauseされている間は送信を一時停止する
+	// 送信できる間はtrueを返し、セッションが終了したらfalseを返す
+	waitSendable := func() bool {
+		if err := negotiator.WaitConnected(session.Context()); err != nil {
+			return false
+		}
+		return !state.isPaused()
+	}
+
+	session.Go(func() {
+		// 接続が確立されるまで待ちます
+		<-iceConnectedCtx.Done()
+		logger.Info("Test source started", zap.Int("width", config.Width), zap.Int("height", config.Height), zap.Int("fps", config.FrameRate))
+
+		frameDuration := config.FrameDuration()
+		ticker := time.NewTicker(frameDuration)
+		defer ticker.Stop()
+		for {
+			if waitSendable() {
+				frame, err := video.Next(time.Now())
+				if err != nil {
+					session.Stop(lifecycle.ReasonError, err)
+					return
+				}
+				if err := videoTrack.WriteSample(media.Sample{Data: frame, Duration: frameDuration}); err != nil {
+					session.Stop(lifecycle.ReasonError, err)
+					return
+				}
+				state.frameSent()
+			}
+
+			select {
+			case <-session.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+
+	if audioTrack == nil {
+		return nil
+	}
+	session.Go(func() {
+		<-iceConnectedCtx.Done()
+		tone := testsrc.NewTone(config.ToneFrequency)
+		ticker := time.NewTicker(testsrc.ToneFrameDuration)
+		defer ticker.Stop()
+		for {
+			if waitSendable() {
+				if err := audioTrack.WriteSample(media.Sample{Data: tone.Next(), Duration: testsrc.ToneFrameDuration}); err != nil {
+					session.Stop(lifecycle.ReasonError, err)
+					return
+				}
+			}
+
+			select {
+			case <-session.Context().Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/lifecycle"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/negotiation"
+	"github.com/takumi2786/pion-webrtc_sample/v1/internal/testsrc"
+	"go.uber.org/zap"
+)
+
+// addedToneFrequencyは、add-toneで追加する音声トラックのサイン波の周波数です
+// -testsrcの音声トラック(440Hz)と聞き分けられるように1オクターブ上にする
+const addedToneFrequency = 880
+
+// toneTrackは、制御用データチャネルのadd-tone・remove-toneで追加・削除するサイン波の音声トラック(PCMU)です
+// 追加・削除のたびに、goアプリケーションからオファーを送って再ネゴシエーションを行います
+type toneTrack struct {
+	session    *lifecycle.Session
+	negotiator *negotiation.Negotiator
+	state      *sendState
+
+	mu     sync.Mutex
+	sender *webrtc.RTPSender
+	// stopは、送信しているgoroutineを終了します
+	stop context.CancelFunc
+}
+
+func newToneTrack(session *lifecycle.Session, negotiator *negotiation.Negotiator, state *sendState) *toneTrack {
+	return &toneTrack{session: session, negotiator: negotiator, state: state}
+}
+
+// addは、音声トラックを追加してオファーを送信し、送信を開始します
+// ネゴシエーション中の場合は、完了した後にオファーを送信する
+func (t *toneTrack) add() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sender != nil {
+		return errors.New("the tone track has already been added")
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, "tone", "pion")
+	if err != nil {
+		return err
+	}
+	sender, err := t.negotiator.AddTrack(track)
+	if sender == nil {
+		return err
+	}
+	// オファーの送信に失敗しても、トラックはPeerConnectionに追加されているため送信を開始する
+	// 次のネゴシエーションでリモートに伝わる
+	ctx, stop := context.WithCancel(t.session.Context())
+	t.sender, t.stop = sender, stop
+	t.session.Go(func() { t.send(ctx, track, sender) })
+	t.session.Logger().Info("Tone track has been added", zap.Float64("frequency", addedToneFrequency))
+	return err
+}
+
+// removeは、送信を停止して音声トラックを削除し、オファーを送信します
+func (t *toneTrack) remove() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sender == nil {
+		return errors.New("no tone track has been added")
+	}
+
+	t.stop()
+	err := t.negotiator.RemoveTrack(t.sender)
+	t.sender, t.stop = nil, nil
+	t.session.Logger().Info("Tone track has been removed")
+	return err
+}
+
+// sendは、ctxが終了するまでサイン波を送信します
+// ICEリスタート中と、制御用データチャネルでpauseされている間は送信を一時停止する
+func (t *toneTrack) send(ctx context.Context, track *webrtc.TrackLocalStaticSample, sender *webrtc.RTPSender) {
+	// RTCPパケットはインターセプターで処理されるため、読み捨てる
+	// トラックを削除するとRTPSenderが停止し、読み込みが終了する
+	go func() {
+		for {
+			if _, _, rtcpErr := sender.ReadRTCP(); rtcpErr != nil {
+				return
+			}
+		}
+	}()
+
+	tone := testsrc.NewTone(addedToneFrequency)
+	ticker := time.NewTicker(testsrc.ToneFrameDuration)
+	defer ticker.Stop()
+	for {
+		if err := t.negotiator.WaitConnected(ctx); err != nil {
+			return
+		}
+		if !t.state.isPaused() {
+			if err := track.WriteSample(media.Sample{Data: tone.Next(), Duration: testsrc.ToneFrameDuration}); err != nil {
+				t.session.Stop(lifecycle.ReasonError, err)
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}